@@ -0,0 +1,81 @@
+package clients
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/lomorage/lomo-backup/common/types"
+)
+
+// Backend is one storage where isos and files are uploaded to and restored from. Checksums are base64
+// encoded sha256, and the one of multipart object is sha256 of all parts' sha256 concatenated
+type Backend interface {
+	// HeadObject returns nil if object doesn't exist. Metadata is the one given when object is uploaded
+	HeadObject(bucket, remotePath string) (*types.ISOInfo, error)
+	GetObject(ctx context.Context, bucket, remotePath string, writer io.Writer) (int64, error)
+	// GetObjectRange writes length bytes from offset, or all bytes from offset if length is negative
+	GetObjectRange(ctx context.Context, bucket, remotePath string, offset, length int64, writer io.Writer) (int64, error)
+	PutObject(ctx context.Context, bucket, remotePath, checksum, fileType, storageClass string,
+		metadata map[string]string, reader io.ReadSeeker) error
+	ListObjects(bucket, prefix string) ([]*ObjectInfo, error)
+	// DeleteObject succeeds if object doesn't exist
+	DeleteObject(bucket, remotePath string) error
+
+	// CreateMultipartUpload locks the object once it is completed if retention is not nil
+	CreateMultipartUpload(bucket, remotePath, fileType, storageClass string, metadata map[string]string,
+		retention *Retention) (*UploadRequest, error)
+	// Upload uploads one part and returns its etag
+	Upload(ctx context.Context, partNo, length int64, request *UploadRequest, reader io.ReadSeeker,
+		checksum string) (string, error)
+	CompleteMultipartUpload(request *UploadRequest, parts []*types.PartInfo, checksum string) error
+	ListMultipartUploads(bucket string) ([]*UploadRequest, error)
+	// ListParts returns parts uploaded in request in the order of part number, with size, etag, checksum
+	// and upload time
+	ListParts(request *UploadRequest) ([]*types.PartInfo, error)
+	AbortMultipartUpload(request *UploadRequest) error
+
+	// GetArchiveStatus returns nil if object doesn't exist
+	GetArchiveStatus(bucket, remotePath string) (*ArchiveStatus, error)
+	// RestoreObject makes archived object readable for given days with retrieval tier Bulk, Standard or
+	// Expedited. It succeeds if restore is in progress already
+	RestoreObject(bucket, remotePath, tier string, days int) error
+	// SetStorageClass copies object onto itself in storage class, keeping its metadata, checksum and object
+	// lock. Archived object needs to be restored firstly
+	SetStorageClass(bucket, remotePath, storageClass string) error
+}
+
+// ArchiveStatus tells whether object is able to be downloaded. Objects in GLACIER and DEEP_ARCHIVE storage
+// classes need to be restored firstly, which takes minutes to hours depending on retrieval tier
+type ArchiveStatus struct {
+	StorageClass string
+	Archived     bool
+	// restore is in progress
+	Restoring bool
+	// restored copy is readable until then, zero if it isn't restored
+	RestoreExpiry time.Time
+}
+
+// Readable returns true if object is able to be downloaded now
+func (s *ArchiveStatus) Readable() bool {
+	return !s.Archived || (!s.Restoring && !s.RestoreExpiry.IsZero())
+}
+
+// Retention locks one object version until given time, so that it can't be deleted or overwritten even
+// with the credentials which uploaded it. Mode is GOVERNANCE, in which users with special permission can
+// still remove the lock, or COMPLIANCE, in which nobody can
+type Retention struct {
+	Mode  string
+	Until time.Time
+}
+
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+var (
+	_ Backend = (*AWSClient)(nil)
+	_ Backend = (*LocalBackend)(nil)
+)
@@ -0,0 +1,209 @@
+package clients
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/lomorage/lomo-backup/common/types"
+	"github.com/sirupsen/logrus"
+)
+
+// lifecycle rules installed by InitBucket are identified by these IDs, other rules are kept as they are
+const (
+	lifecycleAbortRuleID      = "lomob-abort-incomplete-multipart-upload"
+	lifecycleTransitionRuleID = "lomob-transition"
+	lifecycleNoncurrentRuleID = "lomob-expire-noncurrent-versions"
+)
+
+// BucketOptions are settings applied to bucket by InitBucket
+type BucketOptions struct {
+	BlockPublicAccess bool
+	Versioning        bool
+	// object lock can only be enabled with versioning
+	ObjectLock bool
+	// abort incomplete multipart uploads after given days, 0 means never
+	AbortIncompleteDays int64
+	// transit objects to TransitionClass after given days, 0 means never
+	TransitionDays  int64
+	TransitionClass string
+	// delete versions after given days since they become noncurrent, 0 means never. Locked versions are
+	// deleted once their locks expire
+	NoncurrentExpireDays int64
+}
+
+// InitBucket creates bucket in client's region if it doesn't exist, and applies options to it. It is
+// safe to run again on the same bucket, e.g. to change lifecycle rules
+func (ac *AWSClient) InitBucket(bucket string, opts *BucketOptions) error {
+	created, err := ac.createBucket(bucket, opts.ObjectLock)
+	if err != nil {
+		return err
+	}
+
+	if opts.BlockPublicAccess {
+		err = ac.do("block public access of "+bucket, func() error {
+			_, err := ac.svc.PutPublicAccessBlock(&s3.PutPublicAccessBlockInput{
+				Bucket: &bucket,
+				PublicAccessBlockConfiguration: &s3.PublicAccessBlockConfiguration{
+					BlockPublicAcls:       aws.Bool(true),
+					BlockPublicPolicy:     aws.Bool(true),
+					IgnorePublicAcls:      aws.Bool(true),
+					RestrictPublicBuckets: aws.Bool(true),
+				},
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		logrus.Infof("Public access of bucket %s is blocked", bucket)
+	}
+
+	if opts.Versioning || opts.ObjectLock {
+		err = ac.do("enable versioning of "+bucket, func() error {
+			_, err := ac.svc.PutBucketVersioning(&s3.PutBucketVersioningInput{
+				Bucket: &bucket,
+				VersioningConfiguration: &s3.VersioningConfiguration{
+					Status: aws.String(s3.BucketVersioningStatusEnabled),
+				},
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		logrus.Infof("Versioning of bucket %s is enabled", bucket)
+	}
+
+	// object lock is enabled when bucket is created, while existing bucket needs it enabled separately
+	if opts.ObjectLock && !created {
+		err = ac.do("enable object lock of "+bucket, func() error {
+			_, err := ac.svc.PutObjectLockConfiguration(&s3.PutObjectLockConfigurationInput{
+				Bucket: &bucket,
+				ObjectLockConfiguration: &s3.ObjectLockConfiguration{
+					ObjectLockEnabled: aws.String(s3.ObjectLockEnabledEnabled),
+				},
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		logrus.Infof("Object lock of bucket %s is enabled", bucket)
+	}
+
+	return ac.putLifecycleRules(bucket, opts)
+}
+
+// createBucket returns true if bucket is created, or false if it exists already
+func (ac *AWSClient) createBucket(bucket string, objectLock bool) (bool, error) {
+	err := ac.do("head bucket "+bucket, func() error {
+		_, err := ac.svc.HeadBucket(&s3.HeadBucketInput{Bucket: &bucket})
+		return err
+	})
+	if err == nil {
+		logrus.Infof("Bucket %s exists", bucket)
+		return false, nil
+	}
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != "NotFound" {
+		return false, err
+	}
+
+	input := &s3.CreateBucketInput{Bucket: &bucket}
+	// us-east-1 is the default location, and is rejected if it is given as constraint
+	if ac.region != "" && ac.region != "us-east-1" {
+		input.CreateBucketConfiguration = &s3.CreateBucketConfiguration{LocationConstraint: aws.String(ac.region)}
+	}
+	if objectLock {
+		input.ObjectLockEnabledForBucket = aws.Bool(true)
+	}
+	err = ac.do("create bucket "+bucket, func() error {
+		_, err := ac.svc.CreateBucket(input)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	logrus.Infof("Bucket %s is created in %s", bucket, ac.region)
+	return true, nil
+}
+
+// putLifecycleRules replaces rules installed before with the ones in opts, and keeps other rules
+func (ac *AWSClient) putLifecycleRules(bucket string, opts *BucketOptions) error {
+	var current *s3.GetBucketLifecycleConfigurationOutput
+	err := ac.do("get lifecycle rules of "+bucket, func() (err error) {
+		current, err = ac.svc.GetBucketLifecycleConfiguration(&s3.GetBucketLifecycleConfigurationInput{
+			Bucket: &bucket,
+		})
+		return
+	})
+	var rules []*s3.LifecycleRule
+	if err == nil {
+		for _, r := range current.Rules {
+			id := aws.StringValue(r.ID)
+			if id != lifecycleAbortRuleID && id != lifecycleTransitionRuleID && id != lifecycleNoncurrentRuleID {
+				rules = append(rules, r)
+			}
+		}
+	} else if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != "NoSuchLifecycleConfiguration" {
+		return err
+	}
+
+	if opts.AbortIncompleteDays > 0 {
+		rules = append(rules, &s3.LifecycleRule{
+			ID:     aws.String(lifecycleAbortRuleID),
+			Status: aws.String(s3.ExpirationStatusEnabled),
+			Filter: &s3.LifecycleRuleFilter{Prefix: aws.String("")},
+			AbortIncompleteMultipartUpload: &s3.AbortIncompleteMultipartUpload{
+				DaysAfterInitiation: aws.Int64(opts.AbortIncompleteDays),
+			},
+		})
+	}
+	if opts.TransitionDays > 0 {
+		rules = append(rules, &s3.LifecycleRule{
+			ID:     aws.String(lifecycleTransitionRuleID),
+			Status: aws.String(s3.ExpirationStatusEnabled),
+			// isos only, while their metadata and parity files are kept readable for restore and repair
+			Filter: &s3.LifecycleRuleFilter{Tag: &s3.Tag{
+				Key:   aws.String(types.MetadataKeyObjectType),
+				Value: aws.String(types.ObjectTypeISO),
+			}},
+			Transitions: []*s3.Transition{{
+				Days:         aws.Int64(opts.TransitionDays),
+				StorageClass: aws.String(opts.TransitionClass),
+			}},
+		})
+	}
+	if opts.NoncurrentExpireDays > 0 {
+		// previous versions are left by iso set-class and upload --force, and are billed until deleted
+		rules = append(rules, &s3.LifecycleRule{
+			ID:     aws.String(lifecycleNoncurrentRuleID),
+			Status: aws.String(s3.ExpirationStatusEnabled),
+			Filter: &s3.LifecycleRuleFilter{Prefix: aws.String("")},
+			NoncurrentVersionExpiration: &s3.NoncurrentVersionExpiration{
+				NoncurrentDays: aws.Int64(opts.NoncurrentExpireDays),
+			},
+		})
+	}
+
+	if len(rules) == 0 {
+		if current == nil {
+			return nil
+		}
+		return ac.do("delete lifecycle rules of "+bucket, func() error {
+			_, err := ac.svc.DeleteBucketLifecycle(&s3.DeleteBucketLifecycleInput{Bucket: &bucket})
+			return err
+		})
+	}
+	err = ac.do("put lifecycle rules of "+bucket, func() error {
+		_, err := ac.svc.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+			Bucket:                 &bucket,
+			LifecycleConfiguration: &s3.BucketLifecycleConfiguration{Rules: rules},
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	logrus.Infof("%d lifecycle rules are set on bucket %s", len(rules), bucket)
+	return nil
+}
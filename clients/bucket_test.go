@@ -0,0 +1,167 @@
+package clients
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const existingLifecycle = `<LifecycleConfiguration>
+<Rule><ID>keep-logs</ID><Status>Enabled</Status><Filter><Prefix>logs/</Prefix></Filter>` +
+	`<Expiration><Days>90</Days></Expiration></Rule>
+<Rule><ID>lomob-abort-incomplete-multipart-upload</ID><Status>Enabled</Status><Filter><Prefix></Prefix></Filter>` +
+	`<AbortIncompleteMultipartUpload><DaysAfterInitiation>30</DaysAfterInitiation></AbortIncompleteMultipartUpload></Rule>
+</LifecycleConfiguration>`
+
+type bucketRequest struct {
+	op     string
+	header http.Header
+	body   string
+}
+
+func newBucketServer(t *testing.T, exists bool) (*httptest.Server, func() []bucketRequest) {
+	var (
+		mu       sync.Mutex
+		requests []bucketRequest
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		op := r.Method + " " + r.URL.Path + "?" + r.URL.RawQuery
+		mu.Lock()
+		requests = append(requests, bucketRequest{op: op, header: r.Header, body: string(body)})
+		mu.Unlock()
+
+		switch op {
+		case "HEAD /bucket?":
+			if !exists {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case "GET /bucket?lifecycle=":
+			if !exists {
+				awsError(http.StatusNotFound, "NoSuchLifecycleConfiguration")(w)
+				return
+			}
+			_, _ = io.WriteString(w, existingLifecycle)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s, func() []bucketRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+}
+
+func newBucketTestClient(t *testing.T, url string) *AWSClient {
+	cli, err := NewAWSClient("eu-west-1", &Config{
+		Credentials: testCredentials,
+		Endpoint:    Endpoint{URL: url, PathStyle: true},
+	})
+	require.Nil(t, err)
+	return cli
+}
+
+type lifecycleRule struct {
+	ID     string
+	Filter struct {
+		Prefix *string
+		Tag    *struct{ Key, Value string }
+	}
+	Transition *struct {
+		Days         int
+		StorageClass string
+	}
+	AbortIncompleteMultipartUpload *struct{ DaysAfterInitiation int }
+	NoncurrentVersionExpiration    *struct{ NoncurrentDays int }
+}
+
+// parseLifecycle returns rules in lifecycle configuration by their IDs, as fields are encoded in random order
+func parseLifecycle(t *testing.T, body string) map[string]*lifecycleRule {
+	var conf struct {
+		Rules []*lifecycleRule `xml:"Rule"`
+	}
+	require.Nil(t, xml.Unmarshal([]byte(body), &conf))
+	rules := map[string]*lifecycleRule{}
+	for _, r := range conf.Rules {
+		rules[r.ID] = r
+	}
+	return rules
+}
+
+func ops(requests []bucketRequest) []string {
+	result := make([]string, len(requests))
+	for i, r := range requests {
+		result[i] = r.op
+	}
+	return result
+}
+
+func TestInitBucket(t *testing.T) {
+	s, requests := newBucketServer(t, false)
+	err := newBucketTestClient(t, s.URL).InitBucket("bucket", &BucketOptions{
+		BlockPublicAccess:    true,
+		Versioning:           true,
+		ObjectLock:           true,
+		AbortIncompleteDays:  7,
+		TransitionDays:       30,
+		TransitionClass:      "DEEP_ARCHIVE",
+		NoncurrentExpireDays: 30,
+	})
+	require.Nil(t, err)
+
+	reqs := requests()
+	require.Equal(t, []string{
+		"HEAD /bucket?",
+		"PUT /bucket?",
+		"PUT /bucket?publicAccessBlock=",
+		"PUT /bucket?versioning=",
+		"GET /bucket?lifecycle=",
+		"PUT /bucket?lifecycle=",
+	}, ops(reqs))
+	require.Contains(t, reqs[1].body, "<LocationConstraint>eu-west-1</LocationConstraint>")
+	require.Equal(t, "true", reqs[1].header.Get("X-Amz-Bucket-Object-Lock-Enabled"))
+	require.Contains(t, reqs[3].body, "<Status>Enabled</Status>")
+	rules := parseLifecycle(t, reqs[5].body)
+	require.Len(t, rules, 3)
+	abort := rules[lifecycleAbortRuleID]
+	require.Equal(t, 7, abort.AbortIncompleteMultipartUpload.DaysAfterInitiation)
+	require.Equal(t, "", *abort.Filter.Prefix)
+	transition := rules[lifecycleTransitionRuleID]
+	require.Equal(t, 30, transition.Transition.Days)
+	require.Equal(t, "DEEP_ARCHIVE", transition.Transition.StorageClass)
+	// only isos are transited, and metadata and parity files are not
+	require.Nil(t, transition.Filter.Prefix)
+	require.Equal(t, &struct{ Key, Value string }{"object_type", "iso"}, transition.Filter.Tag)
+	// previous versions of all objects are deleted, e.g. the ones left by iso set-class
+	noncurrent := rules[lifecycleNoncurrentRuleID]
+	require.Equal(t, 30, noncurrent.NoncurrentVersionExpiration.NoncurrentDays)
+	require.Equal(t, "", *noncurrent.Filter.Prefix)
+}
+
+func TestInitExistingBucket(t *testing.T) {
+	s, requests := newBucketServer(t, true)
+	err := newBucketTestClient(t, s.URL).InitBucket("bucket", &BucketOptions{
+		ObjectLock:          true,
+		AbortIncompleteDays: 3,
+	})
+	require.Nil(t, err)
+
+	reqs := requests()
+	// bucket is not created again, while object lock is enabled on it
+	require.Equal(t, []string{
+		"HEAD /bucket?",
+		"PUT /bucket?versioning=",
+		"PUT /bucket?object-lock=",
+		"GET /bucket?lifecycle=",
+		"PUT /bucket?lifecycle=",
+	}, ops(reqs))
+	// rules not installed by lomob are kept, and previous lomob rule is replaced
+	require.Contains(t, reqs[4].body, "<ID>keep-logs</ID>")
+	require.Contains(t, reqs[4].body, "<DaysAfterInitiation>3</DaysAfterInitiation>")
+	require.NotContains(t, reqs[4].body, "<DaysAfterInitiation>30</DaysAfterInitiation>")
+}
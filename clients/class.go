@@ -0,0 +1,134 @@
+package clients
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/lomorage/lomo-backup/common"
+	"github.com/lomorage/lomo-backup/common/types"
+	"github.com/pkg/errors"
+)
+
+func (ac *AWSClient) headPart(bucket, remotePath string, partNo int64) (*s3.HeadObjectOutput, error) {
+	input := &s3.HeadObjectInput{
+		Bucket:       &bucket,
+		Key:          &remotePath,
+		ChecksumMode: aws.String(s3.ChecksumModeEnabled),
+	}
+	if partNo > 0 {
+		input.PartNumber = aws.Int64(partNo)
+	}
+	var object *s3.HeadObjectOutput
+	err := ac.do(fmt.Sprintf("head %s part %d", remotePath, partNo), func() (err error) {
+		object, err = ac.svc.HeadObject(input)
+		return
+	})
+	return object, err
+}
+
+// SetStorageClass copies object onto itself in storage class. Object uploaded by multipart upload is copied
+// with the same parts, so that its composite checksum is kept. Metadata, tags and object lock are kept too
+func (ac *AWSClient) SetStorageClass(bucket, remotePath, storageClass string) error {
+	object, err := ac.headPart(bucket, remotePath, 0)
+	if err != nil {
+		return err
+	}
+	var retention *Retention
+	until := aws.TimeValue(object.ObjectLockRetainUntilDate)
+	if object.ObjectLockMode != nil && until.After(time.Now()) {
+		retention = &Retention{Mode: *object.ObjectLockMode, Until: until}
+	}
+	copySource := (&url.URL{Path: bucket + "/" + remotePath}).EscapedPath()
+
+	// etag of object uploaded by multipart upload is like "hash-N"
+	if !strings.Contains(aws.StringValue(object.ETag), "-") {
+		input := &s3.CopyObjectInput{
+			Bucket:            &bucket,
+			Key:               &remotePath,
+			CopySource:        &copySource,
+			CopySourceIfMatch: object.ETag,
+			MetadataDirective: aws.String(s3.MetadataDirectiveCopy),
+			TaggingDirective:  aws.String(s3.TaggingDirectiveCopy),
+			StorageClass:      &storageClass,
+			ChecksumAlgorithm: &checksumAlgorithm,
+		}
+		if retention != nil {
+			input.ObjectLockMode = aws.String(retention.Mode)
+			input.ObjectLockRetainUntilDate = aws.Time(retention.Until)
+		}
+		return ac.do("copy "+remotePath, func() error {
+			resp, err := ac.svc.CopyObject(input)
+			common.LogDebugObject("CopyObjectReply", resp)
+			return err
+		})
+	}
+
+	request, err := ac.CreateMultipartUpload(bucket, remotePath, aws.StringValue(object.ContentType), storageClass,
+		aws.StringValueMap(object.Metadata), retention)
+	if err != nil {
+		return err
+	}
+	err = ac.copyParts(request, copySource, object)
+	if err != nil {
+		if aerr := ac.AbortMultipartUpload(request); aerr != nil {
+			return errors.Wrapf(err, "abort copy %s fail: %s", remotePath, aerr)
+		}
+	}
+	return err
+}
+
+// copyParts copies each part of source object into request with the same range and checksum
+func (ac *AWSClient) copyParts(request *UploadRequest, copySource string, object *s3.HeadObjectOutput) error {
+	var (
+		parts  []*types.PartInfo
+		offset int64
+		count  int64 = 1
+	)
+	for partNo := int64(1); partNo <= count; partNo++ {
+		part, err := ac.headPart(request.Bucket, request.Key, partNo)
+		if err != nil {
+			return err
+		}
+		if partNo == 1 {
+			count = aws.Int64Value(part.PartsCount)
+		}
+		size := aws.Int64Value(part.ContentLength)
+		input := &s3.UploadPartCopyInput{
+			Bucket:            &request.Bucket,
+			Key:               &request.Key,
+			UploadId:          &request.ID,
+			PartNumber:        aws.Int64(partNo),
+			CopySource:        &copySource,
+			CopySourceIfMatch: object.ETag,
+			CopySourceRange:   aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+size-1)),
+		}
+		var resp *s3.UploadPartCopyOutput
+		err = ac.do(fmt.Sprintf("copy %s part %d", request.Key, partNo), func() (err error) {
+			resp, err = ac.svc.UploadPartCopy(input)
+			return
+		})
+		if err != nil {
+			return err
+		}
+		if resp.CopyPartResult == nil {
+			return errors.Errorf("received empty result of copy part %d", partNo)
+		}
+		parts = append(parts, &types.PartInfo{
+			PartNo:     int(partNo),
+			Size:       int(size),
+			Etag:       aws.StringValue(resp.CopyPartResult.ETag),
+			HashRemote: aws.StringValue(resp.CopyPartResult.ChecksumSHA256),
+		})
+		offset += size
+	}
+	if offset != aws.Int64Value(object.ContentLength) {
+		return errors.Errorf("size of %d parts is %d, while object size is %d", count, offset,
+			aws.Int64Value(object.ContentLength))
+	}
+	return ac.CompleteMultipartUpload(request, parts,
+		strings.Split(aws.StringValue(object.ChecksumSHA256), "-")[0])
+}
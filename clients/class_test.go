@@ -0,0 +1,139 @@
+package clients
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type copyRequest struct {
+	method string
+	query  string
+	header http.Header
+	body   string
+}
+
+// newCopyServer serves one object of 10 bytes, uploaded by multipart upload with parts of 6 and 4 bytes if
+// multipart is true
+func newCopyServer(t *testing.T, multipart bool, failCopy bool) (*httptest.Server, func() []copyRequest) {
+	var (
+		mu       sync.Mutex
+		requests []copyRequest
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, copyRequest{r.Method, r.URL.RawQuery, r.Header.Clone(), string(body)})
+		mu.Unlock()
+
+		q := r.URL.Query()
+		switch {
+		case r.Method == http.MethodHead && q.Get("partNumber") != "":
+			w.Header().Set("X-Amz-Mp-Parts-Count", "2")
+			if q.Get("partNumber") == "1" {
+				w.Header().Set("Content-Length", "6")
+			} else {
+				w.Header().Set("Content-Length", "4")
+			}
+		case r.Method == http.MethodHead:
+			w.Header().Set("Content-Length", "10")
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("X-Amz-Meta-Hash_orig", "orig")
+			w.Header().Set("X-Amz-Object-Lock-Mode", "COMPLIANCE")
+			w.Header().Set("X-Amz-Object-Lock-Retain-Until-Date", "2999-01-01T00:00:00Z")
+			if multipart {
+				w.Header().Set("ETag", `"abc-2"`)
+				w.Header().Set("X-Amz-Checksum-Sha256", "composite-2")
+			} else {
+				w.Header().Set("ETag", `"abc"`)
+				w.Header().Set("X-Amz-Checksum-Sha256", "full")
+			}
+		case r.Method == http.MethodPost && q.Has("uploads"):
+			_, _ = io.WriteString(w, "<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>a.iso</Key>"+
+				"<UploadId>upload</UploadId></InitiateMultipartUploadResult>")
+		case r.Method == http.MethodPut && q.Get("partNumber") != "":
+			if failCopy {
+				awsError(http.StatusForbidden, "AccessDenied")(w)
+				return
+			}
+			n := q.Get("partNumber")
+			_, _ = io.WriteString(w, "<CopyPartResult><ETag>&quot;etag"+n+"&quot;</ETag>"+
+				"<ChecksumSHA256>hash"+n+"</ChecksumSHA256></CopyPartResult>")
+		case r.Method == http.MethodPut:
+			_, _ = io.WriteString(w, "<CopyObjectResult><ETag>&quot;abc&quot;</ETag>"+
+				"<ChecksumSHA256>full</ChecksumSHA256></CopyObjectResult>")
+		case r.Method == http.MethodPost:
+			_, _ = io.WriteString(w, "<CompleteMultipartUploadResult><Bucket>bucket</Bucket><Key>a.iso</Key>"+
+				"</CompleteMultipartUploadResult>")
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s, func() []copyRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+}
+
+func newCopyClient(t *testing.T, url string) *AWSClient {
+	cli, err := NewAWSClient("us-east-1", &Config{
+		Credentials: testCredentials,
+		Endpoint:    Endpoint{URL: url, PathStyle: true},
+	})
+	require.Nil(t, err)
+	return cli
+}
+
+func TestSetStorageClassCopyObject(t *testing.T) {
+	s, requests := newCopyServer(t, false, false)
+	require.Nil(t, newCopyClient(t, s.URL).SetStorageClass("bucket", "a.iso", "DEEP_ARCHIVE"))
+
+	reqs := requests()
+	require.Len(t, reqs, 2)
+	h := reqs[1].header
+	require.Equal(t, http.MethodPut, reqs[1].method)
+	require.Equal(t, "bucket/a.iso", h.Get("X-Amz-Copy-Source"))
+	require.Equal(t, `"abc"`, h.Get("X-Amz-Copy-Source-If-Match"))
+	require.Equal(t, "DEEP_ARCHIVE", h.Get("X-Amz-Storage-Class"))
+	require.Equal(t, "COPY", h.Get("X-Amz-Metadata-Directive"))
+	require.Equal(t, "SHA256", h.Get("X-Amz-Checksum-Algorithm"))
+	require.Equal(t, "COMPLIANCE", h.Get("X-Amz-Object-Lock-Mode"))
+}
+
+func TestSetStorageClassMultipart(t *testing.T) {
+	s, requests := newCopyServer(t, true, false)
+	require.Nil(t, newCopyClient(t, s.URL).SetStorageClass("bucket", "a.iso", "GLACIER_IR"))
+
+	reqs := requests()
+	// head, create, then head and copy of each part, and complete
+	require.Len(t, reqs, 7)
+	create := reqs[1].header
+	require.Equal(t, "GLACIER_IR", create.Get("X-Amz-Storage-Class"))
+	require.Equal(t, "application/octet-stream", create.Get("Content-Type"))
+	require.Equal(t, "orig", create.Get("X-Amz-Meta-Hash_orig"))
+	require.Equal(t, "COMPLIANCE", create.Get("X-Amz-Object-Lock-Mode"))
+
+	require.Equal(t, "bytes=0-5", reqs[3].header.Get("X-Amz-Copy-Source-Range"))
+	require.Equal(t, `"abc-2"`, reqs[3].header.Get("X-Amz-Copy-Source-If-Match"))
+	require.Equal(t, "bytes=6-9", reqs[5].header.Get("X-Amz-Copy-Source-Range"))
+
+	complete := reqs[6]
+	require.Equal(t, "composite", complete.header.Get("X-Amz-Checksum-Sha256"))
+	require.True(t, strings.Contains(complete.body, "<ChecksumSHA256>hash1</ChecksumSHA256>"), complete.body)
+	require.True(t, strings.Contains(complete.body, "<ChecksumSHA256>hash2</ChecksumSHA256>"), complete.body)
+}
+
+func TestSetStorageClassAbort(t *testing.T) {
+	s, requests := newCopyServer(t, true, true)
+	require.NotNil(t, newCopyClient(t, s.URL).SetStorageClass("bucket", "a.iso", "GLACIER_IR"))
+
+	reqs := requests()
+	last := reqs[len(reqs)-1]
+	require.Equal(t, http.MethodDelete, last.method)
+	require.Contains(t, last.query, "uploadId=upload")
+}
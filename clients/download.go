@@ -0,0 +1,227 @@
+package clients
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"os"
+	"slices"
+
+	lomohash "github.com/lomorage/lomo-backup/common/hash"
+	"github.com/lomorage/lomo-backup/common/retry"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// downloadRetryRounds is how many times failed chunks are downloaded again
+const downloadRetryRounds = 3
+
+var errChunkChecksum = errors.New("checksum mismatch")
+
+// DownloadChunk is one range of object downloaded at once
+type DownloadChunk struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+	// base64 encoded sha256 of the range, which is not verified if it is empty
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// SplitChunks splits object of size into chunks of chunkSize without checksum
+func SplitChunks(size, chunkSize int64) []*DownloadChunk {
+	var chunks []*DownloadChunk
+	for off := int64(0); off < size; off += chunkSize {
+		chunks = append(chunks, &DownloadChunk{Offset: off, Length: min(chunkSize, size-off)})
+	}
+	return chunks
+}
+
+// downloadState is saved in state file after each chunk is done, so that download is resumed from it
+type downloadState struct {
+	Bucket string           `json:"bucket"`
+	Key    string           `json:"key"`
+	Size   int64            `json:"size"`
+	Chunks []*DownloadChunk `json:"chunks"`
+	// indexes of chunks downloaded and verified
+	Done []int `json:"done"`
+}
+
+func (s *downloadState) sameObject(o *downloadState) bool {
+	return s.Bucket == o.Bucket && s.Key == o.Key && s.Size == o.Size &&
+		slices.EqualFunc(s.Chunks, o.Chunks, func(a, b *DownloadChunk) bool { return *a == *b })
+}
+
+func (s *downloadState) save(filename string) error {
+	content, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	err = os.WriteFile(tmp, content, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// loadDownloadState returns chunks done in state file if it is for the same object, and data file exists
+func loadDownloadState(stateFilename, filename string, state *downloadState) ([]int, error) {
+	content, err := os.ReadFile(stateFilename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	saved := &downloadState{}
+	err = json.Unmarshal(content, saved)
+	if err != nil {
+		logrus.Warnf("Ignore invalid download state %s: %s", stateFilename, err)
+		return nil, nil
+	}
+	if !saved.sameObject(state) {
+		logrus.Warnf("Download state %s is for another object, download %s from start", stateFilename,
+			state.Key)
+		return nil, nil
+	}
+	if _, err = os.Stat(filename); err != nil {
+		return nil, nil
+	}
+	return saved.Done, nil
+}
+
+type chunkResult struct {
+	idx int
+	err error
+}
+
+// Download downloads chunks of object into filename with nthreads workers in parallel. Chunks done are
+// recorded in stateFilename, and only the remaining chunks are downloaded if it is called again after
+// interruption. stateFilename is removed once all chunks are done. It returns bytes downloaded
+func Download(ctx context.Context, backend Backend, bucket, key string, size int64, chunks []*DownloadChunk,
+	filename, stateFilename string, nthreads int) (int64, error) {
+	state := &downloadState{Bucket: bucket, Key: key, Size: size, Chunks: chunks}
+	done, err := loadDownloadState(stateFilename, filename, state)
+	if err != nil {
+		return 0, err
+	}
+
+	flag := os.O_RDWR | os.O_CREATE
+	if len(done) == 0 {
+		flag |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(filename, flag, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	err = f.Truncate(size)
+	if err != nil {
+		return 0, err
+	}
+
+	var pending []int
+	for i := range chunks {
+		if slices.Contains(done, i) {
+			continue
+		}
+		pending = append(pending, i)
+	}
+	if len(done) > 0 {
+		logrus.Infof("Resume downloading %s: %d of %d chunks are done", key, len(done), len(chunks))
+	}
+	state.Done = done
+
+	var (
+		downloaded int64
+		lastErr    error
+	)
+	for round := 0; len(pending) > 0; round++ {
+		if round > 0 {
+			logrus.Infof("Retry downloading %d failed chunks of %s, round %d", len(pending), key, round)
+		}
+		var failed []int
+		failedResults := downloadChunksOnce(ctx, backend, bucket, key, f, chunks, pending, nthreads, func(idx int) {
+			downloaded += chunks[idx].Length
+			state.Done = append(state.Done, idx)
+			// chunk is downloaded again after interruption if state isn't saved, so it isn't fatal
+			if err := state.save(stateFilename); err != nil {
+				logrus.Warnf("Save download state %s: %s", stateFilename, err)
+			}
+		})
+		for _, r := range failedResults {
+			c := chunks[r.idx]
+			logrus.Infof("Download %s's range [%d, %d): %s", key, c.Offset, c.Offset+c.Length, r.err)
+			if round < downloadRetryRounds &&
+				(errors.Is(r.err, errChunkChecksum) || retry.Classify(r.err).Retryable()) {
+				failed = append(failed, r.idx)
+				continue
+			}
+			lastErr = r.err
+		}
+		pending = failed
+	}
+	if lastErr != nil {
+		return downloaded, lastErr
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return downloaded, err
+	}
+	return downloaded, os.Remove(stateFilename)
+}
+
+// downloadChunksOnce downloads each pending chunk once, and returns failed ones. done is called in caller
+// goroutine once each chunk is downloaded, so that state is updated without lock
+func downloadChunksOnce(ctx context.Context, backend Backend, bucket, key string, f *os.File,
+	chunks []*DownloadChunk, pending []int, nthreads int, done func(idx int)) []*chunkResult {
+	if nthreads < 1 {
+		nthreads = 1
+	}
+	jobs := make(chan int)
+	results := make(chan *chunkResult)
+	for i := 0; i < nthreads; i++ {
+		go func() {
+			for idx := range jobs {
+				results <- &chunkResult{idx: idx, err: downloadChunk(ctx, backend, bucket, key, f, chunks[idx])}
+			}
+		}()
+	}
+	go func() {
+		for _, idx := range pending {
+			jobs <- idx
+		}
+		close(jobs)
+	}()
+
+	var failed []*chunkResult
+	for range pending {
+		r := <-results
+		if r.err != nil {
+			failed = append(failed, r)
+			continue
+		}
+		done(r.idx)
+	}
+	return failed
+}
+
+func downloadChunk(ctx context.Context, backend Backend, bucket, key string, f *os.File, c *DownloadChunk) error {
+	h := sha256.New()
+	w := io.MultiWriter(io.NewOffsetWriter(f, c.Offset), h)
+	n, err := backend.GetObjectRange(ctx, bucket, key, c.Offset, c.Length, w)
+	if err != nil {
+		return err
+	}
+	if n != c.Length {
+		return errors.Wrapf(io.ErrUnexpectedEOF, "got %d bytes from %d, expect %d", n, c.Offset, c.Length)
+	}
+	if c.Checksum == "" {
+		return nil
+	}
+	if got := lomohash.CalculateHashBase64(h.Sum(nil)); got != c.Checksum {
+		return errors.Wrapf(errChunkChecksum, "sha256 is %s, expect %s", got, c.Checksum)
+	}
+	return nil
+}
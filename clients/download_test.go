@@ -0,0 +1,120 @@
+package clients
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	lomohash "github.com/lomorage/lomo-backup/common/hash"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// faultyRanges fails or corrupts ranges from given offsets, and records offsets downloaded
+type faultyRanges struct {
+	Backend
+	mu      sync.Mutex
+	fail    map[int64]error
+	corrupt map[int64]int
+	offsets []int64
+}
+
+func (f *faultyRanges) GetObjectRange(ctx context.Context, bucket, remotePath string, offset, length int64,
+	writer io.Writer) (int64, error) {
+	f.mu.Lock()
+	f.offsets = append(f.offsets, offset)
+	err := f.fail[offset]
+	corrupt := f.corrupt[offset] > 0
+	if corrupt {
+		f.corrupt[offset]--
+	}
+	f.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if !corrupt {
+		return f.Backend.GetObjectRange(ctx, bucket, remotePath, offset, length, writer)
+	}
+	buf := &bytes.Buffer{}
+	n, err := f.Backend.GetObjectRange(ctx, bucket, remotePath, offset, length, buf)
+	if err != nil {
+		return n, err
+	}
+	buf.Bytes()[0]++
+	return io.Copy(writer, buf)
+}
+
+func testChunks(data []byte, chunkSize int64) []*DownloadChunk {
+	chunks := SplitChunks(int64(len(data)), chunkSize)
+	for _, c := range chunks {
+		h := sha256.Sum256(data[c.Offset : c.Offset+c.Length])
+		c.Checksum = lomohash.CalculateHashBase64(h[:])
+	}
+	return chunks
+}
+
+func TestSplitChunks(t *testing.T) {
+	require.Equal(t, []*DownloadChunk{{0, 100, ""}, {100, 100, ""}, {200, 50, ""}}, SplitChunks(250, 100))
+	require.Equal(t, []*DownloadChunk{{0, 100, ""}}, SplitChunks(100, 100))
+	require.Nil(t, SplitChunks(0, 100))
+}
+
+func TestDownload(t *testing.T) {
+	lb, err := NewLocalBackend(t.TempDir())
+	require.Nil(t, err)
+	ctx := context.Background()
+	data := make([]byte, 1050)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	err = lb.PutObject(ctx, "bucket", "a.iso", "", "", "", nil, bytes.NewReader(data))
+	require.Nil(t, err)
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "a.iso")
+	stateFilename := filename + ".state"
+	chunks := testChunks(data, 100)
+
+	// corrupted chunk is downloaded again, and one permanent failure stops download
+	f := &faultyRanges{
+		Backend: lb,
+		fail:    map[int64]error{500: errors.New("access denied")},
+		corrupt: map[int64]int{200: 1},
+	}
+	n, err := Download(ctx, f, "bucket", "a.iso", int64(len(data)), chunks, filename, stateFilename, 3)
+	require.NotNil(t, err)
+	require.Equal(t, int64(950), n)
+	require.FileExists(t, stateFilename)
+
+	// resume with the failed chunk only
+	f = &faultyRanges{Backend: lb}
+	n, err = Download(ctx, f, "bucket", "a.iso", int64(len(data)), chunks, filename, stateFilename, 3)
+	require.Nil(t, err)
+	require.Equal(t, int64(100), n)
+	require.Equal(t, []int64{500}, f.offsets)
+	require.NoFileExists(t, stateFilename)
+	content, err := os.ReadFile(filename)
+	require.Nil(t, err)
+	require.Equal(t, data, content)
+
+	// chunks keep failing checksum
+	f = &faultyRanges{Backend: lb, corrupt: map[int64]int{0: downloadRetryRounds + 1}}
+	_, err = Download(ctx, f, "bucket", "a.iso", int64(len(data)), chunks, filename, stateFilename, 2)
+	require.True(t, errors.Is(err, errChunkChecksum), err)
+	require.Len(t, f.offsets, len(chunks)+downloadRetryRounds)
+
+	// state of another chunking is ignored
+	f = &faultyRanges{Backend: lb}
+	n, err = Download(ctx, f, "bucket", "a.iso", int64(len(data)), testChunks(data, 300), filename,
+		stateFilename, 2)
+	require.Nil(t, err)
+	require.Equal(t, int64(len(data)), n)
+	content, err = os.ReadFile(filename)
+	require.Nil(t, err)
+	require.Equal(t, data, content)
+}
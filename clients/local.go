@@ -0,0 +1,582 @@
+package clients
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	lomohash "github.com/lomorage/lomo-backup/common/hash"
+	"github.com/lomorage/lomo-backup/common/progress"
+	"github.com/lomorage/lomo-backup/common/types"
+	"github.com/pkg/errors"
+)
+
+// localMetaDir keeps checksums, metadata and in progress multipart uploads in each bucket directory
+const localMetaDir = ".lomob"
+
+// LocalBackend stores objects as plain files in one directory, e.g. USB disk or NFS mount. Each bucket
+// is one sub directory, and objects are written into temp files and renamed once verified, so that one
+// object is either complete or not exist
+type LocalBackend struct {
+	root string
+}
+
+func NewLocalBackend(root string) (*LocalBackend, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, errors.Errorf("%s is not a directory", root)
+	}
+	return &LocalBackend{root: root}, nil
+}
+
+func (lb *LocalBackend) Root() string {
+	return lb.root
+}
+
+func validLocalName(name string) error {
+	if !filepath.IsLocal(name) || strings.Split(filepath.ToSlash(name), "/")[0] == localMetaDir {
+		return errors.Errorf("invalid name '%s'", name)
+	}
+	return nil
+}
+
+func (lb *LocalBackend) bucketPath(bucket string) (string, error) {
+	if err := validLocalName(bucket); err != nil {
+		return "", err
+	}
+	return filepath.Join(lb.root, bucket), nil
+}
+
+func (lb *LocalBackend) objectPath(bucket, remotePath string) (string, error) {
+	if err := validLocalName(remotePath); err != nil {
+		return "", err
+	}
+	dir, err := lb.bucketPath(bucket)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, remotePath), nil
+}
+
+// checksumPath is called after bucket and remotePath are validated
+func (lb *LocalBackend) checksumPath(bucket, remotePath string) string {
+	return filepath.Join(lb.root, bucket, localMetaDir, "checksums", remotePath)
+}
+
+// metadataPath is called after bucket and remotePath are validated
+func (lb *LocalBackend) metadataPath(bucket, remotePath string) string {
+	return filepath.Join(lb.root, bucket, localMetaDir, "metadata", remotePath)
+}
+
+// writeMetadata saves metadata as json, or removes the file if there is no metadata
+func writeMetadata(filename string, metadata map[string]string) error {
+	if len(metadata) == 0 {
+		err := os.Remove(filename)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	content, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return writeFile(filename, bytes.NewReader(content), func(int64) error { return nil })
+}
+
+// readMetadata returns nil if there is no metadata
+func readMetadata(filename string) (map[string]string, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var metadata map[string]string
+	return metadata, json.Unmarshal(content, &metadata)
+}
+
+func (lb *LocalBackend) uploadsDir(bucket string) (string, error) {
+	dir, err := lb.bucketPath(bucket)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, localMetaDir, "uploads"), nil
+}
+
+func (lb *LocalBackend) uploadDir(bucket, uploadID string) (string, error) {
+	if err := validLocalName(uploadID); err != nil {
+		return "", err
+	}
+	dir, err := lb.uploadsDir(bucket)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, uploadID), nil
+}
+
+func partFilename(dir string, partNo int64) string {
+	return filepath.Join(dir, fmt.Sprintf("part-%05d", partNo))
+}
+
+// writeFile writes reader into filename through one temp file in the same directory, and calls verify
+// before renaming it to filename
+func writeFile(filename string, reader io.Reader, verify func(written int64) error) error {
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	n, err := io.Copy(tmp, reader)
+	if err != nil {
+		return err
+	}
+	err = verify(n)
+	if err != nil {
+		return err
+	}
+	err = tmp.Sync()
+	if err != nil {
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+func verifyChecksum(h []byte, checksum string) error {
+	if checksum == "" {
+		return nil
+	}
+	if got := lomohash.CalculateHashBase64(h); got != checksum {
+		return errors.Errorf("checksum mismatch, expect %s but got %s", checksum, got)
+	}
+	return nil
+}
+
+// trackedReader counts bytes into progress tracker of ctx, and returns function to take them back
+// if upload fails
+func trackedReader(ctx context.Context, r io.Reader) (io.Reader, func()) {
+	t := progress.FromContext(ctx)
+	c := &counter{r: r}
+	return progress.NewReader(c, t), func() { t.Add(-c.n) }
+}
+
+type counter struct {
+	r io.Reader
+	n int64
+}
+
+func (c *counter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (lb *LocalBackend) HeadObject(bucket, remotePath string) (*types.ISOInfo, error) {
+	filename, err := lb.objectPath(bucket, remotePath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	object := &types.ISOInfo{Size: int(info.Size())}
+	checksum, err := os.ReadFile(lb.checksumPath(bucket, remotePath))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	object.HashRemote = string(checksum)
+	object.Metadata, err = readMetadata(lb.metadataPath(bucket, remotePath))
+	return object, err
+}
+
+func (lb *LocalBackend) GetObject(ctx context.Context, bucket, remotePath string, writer io.Writer) (int64, error) {
+	return lb.GetObjectRange(ctx, bucket, remotePath, 0, -1, writer)
+}
+
+func (lb *LocalBackend) GetObjectRange(ctx context.Context, bucket, remotePath string, offset, length int64,
+	writer io.Writer) (int64, error) {
+	filename, err := lb.objectPath(bucket, remotePath)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if offset < 0 || offset > info.Size() {
+		return 0, errors.Errorf("invalid offset %d of %s whose size is %d", offset, remotePath, info.Size())
+	}
+	if length < 0 || offset+length > info.Size() {
+		length = info.Size() - offset
+	}
+	return io.Copy(writer, io.NewSectionReader(f, offset, length))
+}
+
+func (lb *LocalBackend) PutObject(ctx context.Context, bucket, remotePath, checksum, fileType, storageClass string,
+	metadata map[string]string, reader io.ReadSeeker) error {
+	filename, err := lb.objectPath(bucket, remotePath)
+	if err != nil {
+		return err
+	}
+
+	r, discard := trackedReader(ctx, reader)
+	h := sha256.New()
+	err = writeFile(filename, io.TeeReader(r, h), func(int64) error {
+		return verifyChecksum(h.Sum(nil), checksum)
+	})
+	if err != nil {
+		discard()
+		return err
+	}
+	err = writeFile(lb.checksumPath(bucket, remotePath),
+		strings.NewReader(lomohash.CalculateHashBase64(h.Sum(nil))), func(int64) error { return nil })
+	if err != nil {
+		return err
+	}
+	return writeMetadata(lb.metadataPath(bucket, remotePath), metadata)
+}
+
+func (lb *LocalBackend) ListObjects(bucket, prefix string) ([]*ObjectInfo, error) {
+	dir, err := lb.bucketPath(bucket)
+	if err != nil {
+		return nil, err
+	}
+	objects := []*ObjectInfo{}
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == dir {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if entry.IsDir() {
+			if path == filepath.Join(dir, localMetaDir) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		// skip temp files being written
+		if strings.HasPrefix(entry.Name(), ".") && strings.HasSuffix(entry.Name(), ".tmp") {
+			return nil
+		}
+		key, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		key = filepath.ToSlash(key)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, &ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return objects, err
+}
+
+func (lb *LocalBackend) DeleteObject(bucket, remotePath string) error {
+	filename, err := lb.objectPath(bucket, remotePath)
+	if err != nil {
+		return err
+	}
+	for _, f := range []string{lb.checksumPath(bucket, remotePath), lb.metadataPath(bucket, remotePath)} {
+		err = os.Remove(f)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	err = os.Remove(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (lb *LocalBackend) CreateMultipartUpload(bucket, remotePath, fileType, storageClass string,
+	metadata map[string]string, retention *Retention) (*UploadRequest, error) {
+	if retention != nil {
+		return nil, errors.New("object lock is not supported by local directory")
+	}
+	_, err := lb.objectPath(bucket, remotePath)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	request := &UploadRequest{Time: time.Now(), ID: hex.EncodeToString(id), Bucket: bucket, Key: remotePath}
+	dir, err := lb.uploadDir(bucket, request.ID)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = writeMetadata(filepath.Join(dir, "metadata"), metadata)
+	if err != nil {
+		return nil, err
+	}
+	return request, os.WriteFile(filepath.Join(dir, "key"), []byte(remotePath), 0644)
+}
+
+// openUpload returns upload directory, and checks request is in progress and its key matches
+func (lb *LocalBackend) openUpload(request *UploadRequest) (string, error) {
+	dir, err := lb.uploadDir(request.Bucket, request.ID)
+	if err != nil {
+		return "", err
+	}
+	key, err := os.ReadFile(filepath.Join(dir, "key"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", errors.Errorf("upload %s of %s doesn't exist", request.ID, request.Key)
+		}
+		return "", err
+	}
+	if string(key) != request.Key {
+		return "", errors.Errorf("upload %s is for %s instead of %s", request.ID, key, request.Key)
+	}
+	return dir, nil
+}
+
+// Upload saves one part, and returns hex sha256 of it as etag
+func (lb *LocalBackend) Upload(ctx context.Context, partNo, length int64, request *UploadRequest,
+	reader io.ReadSeeker, checksum string) (string, error) {
+	dir, err := lb.openUpload(request)
+	if err != nil {
+		return "", err
+	}
+
+	r, discard := trackedReader(ctx, io.LimitReader(reader, length))
+	h := sha256.New()
+	err = writeFile(partFilename(dir, partNo), io.TeeReader(r, h), func(n int64) error {
+		if n != length {
+			return errors.Errorf("read %d bytes of part %d while expecting %d", n, partNo, length)
+		}
+		return verifyChecksum(h.Sum(nil), checksum)
+	})
+	if err != nil {
+		discard()
+		return "", err
+	}
+	return strconv.Quote(hex.EncodeToString(h.Sum(nil))), nil
+}
+
+// CompleteMultipartUpload concatenates parts into object after verifying each part against its etag
+// and checksum, and the object against checksum
+func (lb *LocalBackend) CompleteMultipartUpload(request *UploadRequest, parts []*types.PartInfo, checksum string) error {
+	dir, err := lb.openUpload(request)
+	if err != nil {
+		return err
+	}
+	filename, err := lb.objectPath(request.Bucket, request.Key)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	partsHash := make([][]byte, len(parts))
+	go func() {
+		for i, p := range parts {
+			if i > 0 && p.PartNo <= parts[i-1].PartNo {
+				pw.CloseWithError(errors.Errorf("part %d is not in ascending order", p.PartNo))
+				return
+			}
+			h, err := copyPart(pw, partFilename(dir, int64(p.PartNo)))
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if etag := strconv.Quote(hex.EncodeToString(h)); p.Etag != etag {
+				pw.CloseWithError(errors.Errorf("part %d's etag is %s, but got %s", p.PartNo, etag, p.Etag))
+				return
+			}
+			err = verifyChecksum(h, p.HashRemote)
+			if err != nil {
+				pw.CloseWithError(errors.Wrapf(err, "part %d", p.PartNo))
+				return
+			}
+			partsHash[i] = h
+		}
+		pw.Close()
+	}()
+
+	var objectChecksum string
+	err = writeFile(filename, pr, func(int64) error {
+		var herr error
+		objectChecksum, herr = lomohash.ConcatAndCalculateBase64Hash(partsHash)
+		if herr != nil {
+			return herr
+		}
+		if checksum != "" && objectChecksum != checksum {
+			return errors.Errorf("checksum mismatch, expect %s but got %s", checksum, objectChecksum)
+		}
+		return nil
+	})
+	pr.Close()
+	if err != nil {
+		return err
+	}
+	// same format as S3 multipart object checksum
+	err = writeFile(lb.checksumPath(request.Bucket, request.Key),
+		strings.NewReader(fmt.Sprintf("%s-%d", objectChecksum, len(parts))), func(int64) error { return nil })
+	if err != nil {
+		return err
+	}
+	metadata, err := readMetadata(filepath.Join(dir, "metadata"))
+	if err != nil {
+		return err
+	}
+	err = writeMetadata(lb.metadataPath(request.Bucket, request.Key), metadata)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func copyPart(w io.Writer, filename string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(w, h), f)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func (lb *LocalBackend) ListMultipartUploads(bucket string) ([]*UploadRequest, error) {
+	dir, err := lb.uploadsDir(bucket)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	requests := []*UploadRequest{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		key, err := os.ReadFile(filepath.Join(dir, e.Name(), "key"))
+		if err != nil {
+			return nil, err
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, &UploadRequest{Time: info.ModTime(), ID: e.Name(), Bucket: bucket,
+			Key: string(key)})
+	}
+	return requests, nil
+}
+
+// ListParts returns parts saved in upload, whose etag and checksum are calculated from their content
+func (lb *LocalBackend) ListParts(request *UploadRequest) ([]*types.PartInfo, error) {
+	dir, err := lb.openUpload(request)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	parts := []*types.PartInfo{}
+	for _, e := range entries {
+		var partNo int
+		// temp files of parts being written start with dot
+		if _, err = fmt.Sscanf(e.Name(), "part-%d", &partNo); err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		h, err := copyPart(io.Discard, filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, &types.PartInfo{
+			PartNo:     partNo,
+			Size:       int(info.Size()),
+			Etag:       strconv.Quote(hex.EncodeToString(h)),
+			HashRemote: lomohash.CalculateHashBase64(h),
+			CreateTime: info.ModTime(),
+		})
+	}
+	return parts, nil
+}
+
+func (lb *LocalBackend) AbortMultipartUpload(request *UploadRequest) error {
+	dir, err := lb.openUpload(request)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// GetArchiveStatus returns objects in directory as readable, as they are never archived
+func (lb *LocalBackend) GetArchiveStatus(bucket, remotePath string) (*ArchiveStatus, error) {
+	info, err := lb.HeadObject(bucket, remotePath)
+	if err != nil || info == nil {
+		return nil, err
+	}
+	return &ArchiveStatus{}, nil
+}
+
+func (lb *LocalBackend) RestoreObject(bucket, remotePath, tier string, days int) error {
+	return errors.New("objects in local directory are not archived, and can be downloaded directly")
+}
+
+func (lb *LocalBackend) SetStorageClass(bucket, remotePath, storageClass string) error {
+	return errors.New("objects in local directory have no storage class")
+}
@@ -0,0 +1,181 @@
+package clients
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	lomohash "github.com/lomorage/lomo-backup/common/hash"
+	"github.com/lomorage/lomo-backup/common/types"
+	"github.com/stretchr/testify/require"
+)
+
+func checksum(data []byte) string {
+	h := sha256.Sum256(data)
+	return lomohash.CalculateHashBase64(h[:])
+}
+
+func TestLocalBackendMultipartUpload(t *testing.T) {
+	lb, err := NewLocalBackend(t.TempDir())
+	require.Nil(t, err)
+	ctx := context.Background()
+
+	info, err := lb.HeadObject("bucket", "a.iso")
+	require.Nil(t, err)
+	require.Nil(t, info)
+
+	// object lock is not supported
+	_, err = lb.CreateMultipartUpload("bucket", "a.iso", "", "", nil,
+		&Retention{Mode: "GOVERNANCE", Until: time.Now()})
+	require.NotNil(t, err)
+
+	metadata := map[string]string{types.MetadataKeyHashOrig: "orig", types.MetadataKeyPartSize: "8000"}
+	request, err := lb.CreateMultipartUpload("bucket", "a.iso", "", "", metadata, nil)
+	require.Nil(t, err)
+	requests, err := lb.ListMultipartUploads("bucket")
+	require.Nil(t, err)
+	require.Len(t, requests, 1)
+	require.Equal(t, request.ID, requests[0].ID)
+	require.Equal(t, "a.iso", requests[0].Key)
+
+	data := [][]byte{bytes.Repeat([]byte("lomorage"), 1000), []byte("backup")}
+	parts := make([]*types.PartInfo, len(data))
+	partsHash := make([][]byte, len(data))
+	// parts are able to be uploaded in any order
+	for i := len(data) - 1; i >= 0; i-- {
+		parts[i] = &types.PartInfo{PartNo: i + 1, HashRemote: checksum(data[i])}
+		parts[i].Etag, err = lb.Upload(ctx, int64(i+1), int64(len(data[i])), request,
+			bytes.NewReader(data[i]), parts[i].HashRemote)
+		require.Nil(t, err)
+		partsHash[i], err = lomohash.DecodeHashBase64(parts[i].HashRemote)
+		require.Nil(t, err)
+	}
+
+	// corrupted part is rejected
+	_, err = lb.Upload(ctx, 3, 6, request, strings.NewReader("lomoba"), parts[1].HashRemote)
+	require.NotNil(t, err)
+	_, err = lb.Upload(ctx, 3, 7, request, strings.NewReader("lomoba"), "")
+	require.NotNil(t, err)
+
+	remoteParts, err := lb.ListParts(request)
+	require.Nil(t, err)
+	require.Len(t, remoteParts, 2)
+	for i, p := range remoteParts {
+		require.Equal(t, i+1, p.PartNo)
+		require.Equal(t, len(data[i]), p.Size)
+		require.Equal(t, parts[i].Etag, p.Etag)
+		require.Equal(t, parts[i].HashRemote, p.HashRemote)
+	}
+
+	objectChecksum, err := lomohash.ConcatAndCalculateBase64Hash(partsHash)
+	require.Nil(t, err)
+	err = lb.CompleteMultipartUpload(request, parts, objectChecksum)
+	require.Nil(t, err)
+
+	// upload is gone once it is completed
+	_, err = lb.ListParts(request)
+	require.NotNil(t, err)
+
+	info, err = lb.HeadObject("bucket", "a.iso")
+	require.Nil(t, err)
+	require.Equal(t, len(data[0])+len(data[1]), info.Size)
+	require.Equal(t, objectChecksum+"-2", info.HashRemote)
+	require.Equal(t, metadata, info.Metadata)
+
+	requests, err = lb.ListMultipartUploads("bucket")
+	require.Nil(t, err)
+	require.Empty(t, requests)
+
+	buf := &bytes.Buffer{}
+	_, err = lb.GetObject(ctx, "bucket", "a.iso", buf)
+	require.Nil(t, err)
+	require.Equal(t, bytes.Join(data, nil), buf.Bytes())
+
+	buf.Reset()
+	_, err = lb.GetObjectRange(ctx, "bucket", "a.iso", int64(len(data[0])-4), 6, buf)
+	require.Nil(t, err)
+	require.Equal(t, "rageba", buf.String())
+
+	objects, err := lb.ListObjects("bucket", "")
+	require.Nil(t, err)
+	require.Len(t, objects, 1)
+	require.Equal(t, "a.iso", objects[0].Key)
+}
+
+func TestLocalBackendCompleteMismatch(t *testing.T) {
+	lb, err := NewLocalBackend(t.TempDir())
+	require.Nil(t, err)
+
+	request, err := lb.CreateMultipartUpload("bucket", "a.iso", "", "", nil, nil)
+	require.Nil(t, err)
+	etag, err := lb.Upload(context.Background(), 1, 8, request, strings.NewReader("lomorage"), "")
+	require.Nil(t, err)
+
+	parts := []*types.PartInfo{{PartNo: 1, Etag: etag}}
+	err = lb.CompleteMultipartUpload(request, parts, checksum([]byte("lomorage")))
+	require.NotNil(t, err)
+	parts[0].Etag = `"wrong"`
+	err = lb.CompleteMultipartUpload(request, parts, "")
+	require.NotNil(t, err)
+
+	info, err := lb.HeadObject("bucket", "a.iso")
+	require.Nil(t, err)
+	require.Nil(t, info)
+
+	err = lb.AbortMultipartUpload(request)
+	require.Nil(t, err)
+	err = lb.AbortMultipartUpload(request)
+	require.NotNil(t, err)
+}
+
+func TestLocalBackendPutObject(t *testing.T) {
+	root := t.TempDir()
+	lb, err := NewLocalBackend(root)
+	require.Nil(t, err)
+	ctx := context.Background()
+
+	data := []byte("lomorage")
+	err = lb.PutObject(ctx, "bucket", "a.txt", checksum([]byte("other")), "", "", nil, bytes.NewReader(data))
+	require.NotNil(t, err)
+	info, err := lb.HeadObject("bucket", "a.txt")
+	require.Nil(t, err)
+	require.Nil(t, info)
+
+	metadata := map[string]string{types.MetadataKeyHashOrig: "orig"}
+	err = lb.PutObject(ctx, "bucket", "a.txt", checksum(data), "", "", metadata, bytes.NewReader(data))
+	require.Nil(t, err)
+	content, err := os.ReadFile(filepath.Join(root, "bucket", "a.txt"))
+	require.Nil(t, err)
+	require.Equal(t, data, content)
+
+	info, err = lb.HeadObject("bucket", "a.txt")
+	require.Nil(t, err)
+	require.Equal(t, checksum(data), info.HashRemote)
+	require.Equal(t, metadata, info.Metadata)
+
+	// metadata is replaced together with object
+	err = lb.PutObject(ctx, "bucket", "a.txt", checksum(data), "", "", nil, bytes.NewReader(data))
+	require.Nil(t, err)
+	info, err = lb.HeadObject("bucket", "a.txt")
+	require.Nil(t, err)
+	require.Nil(t, info.Metadata)
+
+	// objects are never archived
+	status, err := lb.GetArchiveStatus("bucket", "a.txt")
+	require.Nil(t, err)
+	require.True(t, status.Readable())
+	require.NotNil(t, lb.RestoreObject("bucket", "a.txt", "Bulk", 1))
+	status, err = lb.GetArchiveStatus("bucket", "b.txt")
+	require.Nil(t, err)
+	require.Nil(t, status)
+
+	for _, name := range []string{"../a.txt", "/a.txt", ".lomob/a.txt", ""} {
+		err = lb.PutObject(ctx, "bucket", name, "", "", "", nil, bytes.NewReader(data))
+		require.NotNil(t, err, name)
+	}
+}
@@ -0,0 +1,178 @@
+package clients
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	lomohash "github.com/lomorage/lomo-backup/common/hash"
+	"github.com/lomorage/lomo-backup/common/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const probeFileType = "application/octet-stream"
+
+// ProbeResult is the result of one compatibility check
+type ProbeResult struct {
+	Check string
+	Err   error
+	// skipped as the check depends on one failed before
+	Skipped bool
+}
+
+// Probe checks whether backend supports what uploads rely on: sha256 checksum of single and multipart
+// objects, ranged download and listing of multipart uploads. Objects created under a temporary prefix
+// are removed afterwards. It returns results of all checks in order
+func Probe(ctx context.Context, backend Backend, bucket, storageClass string) []*ProbeResult {
+	var results []*ProbeResult
+	check := func(name string, ready bool, fn func() error) bool {
+		r := &ProbeResult{Check: name, Skipped: !ready}
+		if ready {
+			r.Err = fn()
+		}
+		results = append(results, r)
+		return ready && r.Err == nil
+	}
+
+	prefix := fmt.Sprintf("lomob-probe-%d/", time.Now().UnixNano())
+	singleKey := prefix + "single"
+	badKey := prefix + "bad-checksum"
+	multiKey := prefix + "multipart"
+	// objects which may have been created
+	var created []string
+	defer func() {
+		for _, key := range created {
+			if err := backend.DeleteObject(bucket, key); err != nil {
+				logrus.Warnf("Unable to delete probe object %s: %s", key, err)
+			}
+		}
+	}()
+
+	bucketOK := check("list objects in bucket", true, func() error {
+		_, err := backend.ListObjects(bucket, prefix)
+		return err
+	})
+
+	data := []byte("lomorage compatibility probe")
+	checksum := probeChecksum(data)
+	putOK := check("put object with sha256 checksum", bucketOK, func() error {
+		created = append(created, singleKey)
+		return backend.PutObject(ctx, bucket, singleKey, checksum, probeFileType, storageClass,
+			nil, bytes.NewReader(data))
+	})
+	check("head object returns sha256 checksum", putOK, func() error {
+		return probeHeadChecksum(backend, bucket, singleKey, checksum)
+	})
+	check("object with wrong sha256 checksum is rejected", bucketOK, func() error {
+		created = append(created, badKey)
+		err := backend.PutObject(ctx, bucket, badKey, probeChecksum([]byte("other")), probeFileType,
+			storageClass, nil, bytes.NewReader(data))
+		if err == nil {
+			return errors.New("object is accepted")
+		}
+		return nil
+	})
+
+	// first part needs to be no less than the min part size of S3
+	parts := [][]byte{bytes.Repeat([]byte("lomorage"), int(maxPartSize/8)), data}
+	var multiChecksum string
+	multiOK := check("multipart upload with sha256 checksum", bucketOK, func() (err error) {
+		created = append(created, multiKey)
+		multiChecksum, err = probeMultipartUpload(ctx, backend, bucket, multiKey, storageClass, parts)
+		return
+	})
+	check("head multipart object returns composite sha256 checksum", multiOK, func() error {
+		return probeHeadChecksum(backend, bucket, multiKey, fmt.Sprintf("%s-%d", multiChecksum, len(parts)))
+	})
+	check("ranged get across parts", multiOK, func() error {
+		buf := &bytes.Buffer{}
+		_, err := backend.GetObjectRange(ctx, bucket, multiKey, maxPartSize-4, 8, buf)
+		if err != nil {
+			return err
+		}
+		expected := append(append([]byte{}, parts[0][maxPartSize-4:]...), parts[1][:4]...)
+		if !bytes.Equal(buf.Bytes(), expected) {
+			return fmt.Errorf("got %q, expect %q", buf.Bytes(), expected)
+		}
+		return nil
+	})
+	check("list multipart uploads", bucketOK, func() error {
+		request, err := backend.CreateMultipartUpload(bucket, multiKey, probeFileType, storageClass, nil, nil)
+		if err != nil {
+			return err
+		}
+		defer probeAbort(backend, request)
+		requests, err := backend.ListMultipartUploads(bucket)
+		if err != nil {
+			return err
+		}
+		for _, r := range requests {
+			if r.ID == request.ID {
+				return nil
+			}
+		}
+		return fmt.Errorf("upload %s is not listed", request.ID)
+	})
+	return results
+}
+
+func probeChecksum(data []byte) string {
+	h := sha256.Sum256(data)
+	return lomohash.CalculateHashBase64(h[:])
+}
+
+func probeHeadChecksum(backend Backend, bucket, key, checksum string) error {
+	info, err := backend.HeadObject(bucket, key)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return errors.New("object not found")
+	}
+	if info.HashRemote != checksum {
+		return fmt.Errorf("checksum '%s' is returned, expect '%s'", info.HashRemote, checksum)
+	}
+	return nil
+}
+
+// probeMultipartUpload uploads given parts as one object, and returns its checksum without part count
+func probeMultipartUpload(ctx context.Context, backend Backend, bucket, key, storageClass string,
+	data [][]byte) (string, error) {
+	request, err := backend.CreateMultipartUpload(bucket, key, probeFileType, storageClass, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	parts := make([]*types.PartInfo, len(data))
+	hashes := make([][]byte, len(data))
+	for i, d := range data {
+		h := sha256.Sum256(d)
+		hashes[i] = h[:]
+		parts[i] = &types.PartInfo{PartNo: i + 1, HashRemote: lomohash.CalculateHashBase64(h[:])}
+		parts[i].Etag, err = backend.Upload(ctx, int64(i+1), int64(len(d)), request, bytes.NewReader(d),
+			parts[i].HashRemote)
+		if err != nil {
+			probeAbort(backend, request)
+			return "", errors.Wrapf(err, "upload part %d", i+1)
+		}
+	}
+	checksum, err := lomohash.ConcatAndCalculateBase64Hash(hashes)
+	if err != nil {
+		probeAbort(backend, request)
+		return "", err
+	}
+	err = backend.CompleteMultipartUpload(request, parts, checksum)
+	if err != nil {
+		probeAbort(backend, request)
+		return "", errors.Wrap(err, "complete upload")
+	}
+	return checksum, nil
+}
+
+func probeAbort(backend Backend, request *UploadRequest) {
+	if err := backend.AbortMultipartUpload(request); err != nil {
+		logrus.Warnf("Unable to abort probe upload %s: %s", request.ID, err)
+	}
+}
@@ -0,0 +1,49 @@
+package clients
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbe(t *testing.T) {
+	lb, err := NewLocalBackend(t.TempDir())
+	require.Nil(t, err)
+
+	results := Probe(context.Background(), lb, "bucket", "STANDARD")
+	require.Len(t, results, 8)
+	for _, r := range results {
+		require.False(t, r.Skipped, r.Check)
+		require.Nil(t, r.Err, r.Check)
+	}
+
+	// probe objects and uploads are cleaned up
+	objects, err := lb.ListObjects("bucket", "")
+	require.Nil(t, err)
+	require.Empty(t, objects)
+	requests, err := lb.ListMultipartUploads("bucket")
+	require.Nil(t, err)
+	require.Empty(t, requests)
+}
+
+func TestProbeBucketDenied(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		awsError(http.StatusForbidden, "AccessDenied")(w)
+	}))
+	defer s.Close()
+	cli, err := NewAWSClient("", &Config{
+		Credentials: testCredentials,
+		Endpoint:    Endpoint{URL: s.URL, PathStyle: true},
+	})
+	require.Nil(t, err)
+
+	results := Probe(context.Background(), cli, "bucket", "STANDARD")
+	require.NotNil(t, results[0].Err)
+	// all following checks depend on bucket access
+	for _, r := range results[1:] {
+		require.True(t, r.Skipped, r.Check)
+	}
+}
@@ -0,0 +1,104 @@
+package clients
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ObjectReaderAt reads one object with ranged downloads, so that only the bytes needed are downloaded.
+// Reads are aligned to blocks which are cached, as file systems like iso9660 read small records repeatedly
+type ObjectReaderAt struct {
+	ctx       context.Context
+	backend   Backend
+	bucket    string
+	key       string
+	size      int64
+	blockSize int64
+	maxBlocks int
+
+	mu sync.Mutex
+	// block index -> content. Blocks are evicted in the order they are downloaded
+	blocks     map[int64][]byte
+	order      []int64
+	downloaded int64
+}
+
+// NewObjectReaderAt returns reader of object whose size is given. At most maxBlocks blocks are cached
+func NewObjectReaderAt(ctx context.Context, backend Backend, bucket, key string, size, blockSize int64,
+	maxBlocks int) *ObjectReaderAt {
+	if maxBlocks < 1 {
+		maxBlocks = 1
+	}
+	return &ObjectReaderAt{
+		ctx:       ctx,
+		backend:   backend,
+		bucket:    bucket,
+		key:       key,
+		size:      size,
+		blockSize: blockSize,
+		maxBlocks: maxBlocks,
+		blocks:    map[int64][]byte{},
+	}
+}
+
+func (r *ObjectReaderAt) Size() int64 {
+	return r.size
+}
+
+// Downloaded returns bytes downloaded so far
+func (r *ObjectReaderAt) Downloaded() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.downloaded
+}
+
+func (r *ObjectReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.Errorf("invalid offset %d", off)
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= r.size {
+			return n, io.EOF
+		}
+		block, err := r.block(pos / r.blockSize)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], block[pos%r.blockSize:])
+	}
+	return n, nil
+}
+
+func (r *ObjectReaderAt) block(idx int64) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if b, ok := r.blocks[idx]; ok {
+		return b, nil
+	}
+
+	start := idx * r.blockSize
+	length := min(r.blockSize, r.size-start)
+	buf := bytes.NewBuffer(make([]byte, 0, length))
+	n, err := r.backend.GetObjectRange(r.ctx, r.bucket, r.key, start, length, buf)
+	r.downloaded += n
+	if err != nil {
+		return nil, err
+	}
+	if n != length {
+		return nil, errors.Errorf("got %d bytes of %s from %d, expect %d", n, r.key, start, length)
+	}
+
+	if len(r.order) >= r.maxBlocks {
+		delete(r.blocks, r.order[0])
+		r.order = r.order[1:]
+	}
+	r.blocks[idx] = buf.Bytes()
+	r.order = append(r.order, idx)
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,69 @@
+package clients
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type rangeCounter struct {
+	Backend
+	ranges [][2]int64
+}
+
+func (c *rangeCounter) GetObjectRange(ctx context.Context, bucket, remotePath string, offset, length int64,
+	writer io.Writer) (int64, error) {
+	c.ranges = append(c.ranges, [2]int64{offset, length})
+	return c.Backend.GetObjectRange(ctx, bucket, remotePath, offset, length, writer)
+}
+
+func TestObjectReaderAt(t *testing.T) {
+	lb, err := NewLocalBackend(t.TempDir())
+	require.Nil(t, err)
+	ctx := context.Background()
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err = lb.PutObject(ctx, "bucket", "a.iso", "", "", "", nil, bytes.NewReader(data))
+	require.Nil(t, err)
+
+	c := &rangeCounter{Backend: lb}
+	r := NewObjectReaderAt(ctx, c, "bucket", "a.iso", int64(len(data)), 100, 2)
+
+	// read across blocks
+	buf := make([]byte, 150)
+	n, err := r.ReadAt(buf, 50)
+	require.Nil(t, err)
+	require.Equal(t, 150, n)
+	require.Equal(t, data[50:200], buf)
+	require.Equal(t, [][2]int64{{0, 100}, {100, 100}}, c.ranges)
+
+	// cached
+	n, err = r.ReadAt(buf[:10], 120)
+	require.Nil(t, err)
+	require.Equal(t, 10, n)
+	require.Equal(t, data[120:130], buf[:10])
+	require.Len(t, c.ranges, 2)
+
+	// the first block is evicted
+	_, err = r.ReadAt(buf[:10], 250)
+	require.Nil(t, err)
+	_, err = r.ReadAt(buf[:10], 0)
+	require.Nil(t, err)
+	require.Equal(t, [][2]int64{{0, 100}, {100, 100}, {200, 100}, {0, 100}}, c.ranges)
+	require.Equal(t, int64(400), r.Downloaded())
+
+	// short read at the end
+	n, err = r.ReadAt(buf, 950)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, 50, n)
+	require.Equal(t, data[950:], buf[:50])
+
+	n, err = r.ReadAt(buf, 1000)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, 0, n)
+}
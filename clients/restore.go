@@ -0,0 +1,77 @@
+package clients
+
+import (
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// restore header of HeadObject is like: ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"
+var (
+	restoreOngoingRegex = regexp.MustCompile(`ongoing-request="(true|false)"`)
+	restoreExpiryRegex  = regexp.MustCompile(`expiry-date="([^"]+)"`)
+)
+
+func parseRestoreHeader(header string, status *ArchiveStatus) error {
+	if header == "" {
+		return nil
+	}
+	m := restoreOngoingRegex.FindStringSubmatch(header)
+	if m == nil {
+		return errors.Errorf("invalid restore header '%s'", header)
+	}
+	status.Restoring = m[1] == "true"
+	if m = restoreExpiryRegex.FindStringSubmatch(header); m != nil {
+		expiry, err := time.Parse(http.TimeFormat, m[1])
+		if err != nil {
+			return errors.Wrapf(err, "invalid expiry date in restore header '%s'", header)
+		}
+		status.RestoreExpiry = expiry
+	}
+	return nil
+}
+
+func (ac *AWSClient) GetArchiveStatus(bucket, remotePath string) (*ArchiveStatus, error) {
+	var object *s3.HeadObjectOutput
+	err := ac.do("head "+remotePath, func() (err error) {
+		object, err = ac.svc.HeadObject(&s3.HeadObjectInput{Bucket: &bucket, Key: &remotePath})
+		return
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	// storage class is not returned for STANDARD
+	status := &ArchiveStatus{StorageClass: s3.StorageClassStandard}
+	if object.StorageClass != nil {
+		status.StorageClass = *object.StorageClass
+	}
+	status.Archived = status.StorageClass == s3.StorageClassGlacier ||
+		status.StorageClass == s3.StorageClassDeepArchive
+	return status, parseRestoreHeader(aws.StringValue(object.Restore), status)
+}
+
+func (ac *AWSClient) RestoreObject(bucket, remotePath, tier string, days int) error {
+	err := ac.do("restore "+remotePath, func() error {
+		_, err := ac.svc.RestoreObject(&s3.RestoreObjectInput{
+			Bucket: &bucket,
+			Key:    &remotePath,
+			RestoreRequest: &s3.RestoreRequest{
+				Days:                 aws.Int64(int64(days)),
+				GlacierJobParameters: &s3.GlacierJobParameters{Tier: &tier},
+			},
+		})
+		return err
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "RestoreAlreadyInProgress" {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,87 @@
+package clients
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRestoreHeader(t *testing.T) {
+	expiry := time.Date(2012, 12, 21, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		header    string
+		restoring bool
+		expiry    time.Time
+		readable  bool
+	}{
+		{``, false, time.Time{}, false},
+		{`ongoing-request="true"`, true, time.Time{}, false},
+		{`ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`, false, expiry, true},
+	}
+	for _, c := range cases {
+		status := &ArchiveStatus{Archived: true}
+		require.Nil(t, parseRestoreHeader(c.header, status), c.header)
+		require.Equal(t, c.restoring, status.Restoring, c.header)
+		require.True(t, c.expiry.Equal(status.RestoreExpiry), c.header)
+		require.Equal(t, c.readable, status.Readable(), c.header)
+	}
+
+	require.NotNil(t, parseRestoreHeader(`expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`, &ArchiveStatus{}))
+	require.NotNil(t, parseRestoreHeader(`ongoing-request="false", expiry-date="tomorrow"`, &ArchiveStatus{}))
+	require.True(t, (&ArchiveStatus{StorageClass: "STANDARD"}).Readable())
+}
+
+func TestGetArchiveStatus(t *testing.T) {
+	s := newFaultServer(t,
+		func(w http.ResponseWriter) {
+			w.Header().Set("X-Amz-Storage-Class", "DEEP_ARCHIVE")
+			w.Header().Set("X-Amz-Restore", `ongoing-request="true"`)
+		},
+		func(w http.ResponseWriter) {},
+		func(w http.ResponseWriter) { w.WriteHeader(http.StatusNotFound) },
+	)
+	cli, err := NewAWSClient("us-east-1", &Config{
+		Credentials: testCredentials,
+		Endpoint:    Endpoint{URL: s.URL, PathStyle: true},
+	})
+	require.Nil(t, err)
+
+	status, err := cli.GetArchiveStatus("bucket", "a.iso")
+	require.Nil(t, err)
+	require.Equal(t, "DEEP_ARCHIVE", status.StorageClass)
+	require.True(t, status.Archived)
+	require.True(t, status.Restoring)
+	require.False(t, status.Readable())
+
+	status, err = cli.GetArchiveStatus("bucket", "a.iso")
+	require.Nil(t, err)
+	require.Equal(t, "STANDARD", status.StorageClass)
+	require.True(t, status.Readable())
+
+	status, err = cli.GetArchiveStatus("bucket", "a.iso")
+	require.Nil(t, err)
+	require.Nil(t, status)
+}
+
+func TestRestoreObject(t *testing.T) {
+	s := newFaultServer(t, nil, awsError(http.StatusConflict, "RestoreAlreadyInProgress"),
+		awsError(http.StatusForbidden, "InvalidObjectState"))
+	cli, err := NewAWSClient("us-east-1", &Config{
+		Credentials: testCredentials,
+		Retry:       testPolicy,
+		Endpoint:    Endpoint{URL: s.URL, PathStyle: true},
+	})
+	require.Nil(t, err)
+
+	require.Nil(t, cli.RestoreObject("bucket", "a.iso", "Bulk", 3))
+	body := string(s.requests()[0])
+	require.True(t, strings.Contains(body, "<Days>3</Days>"), body)
+	require.True(t, strings.Contains(body, "<Tier>Bulk</Tier>"), body)
+
+	// restore in progress already
+	require.Nil(t, cli.RestoreObject("bucket", "a.iso", "Bulk", 3))
+	require.NotNil(t, cli.RestoreObject("bucket", "a.iso", "Bulk", 3))
+}
@@ -2,24 +2,35 @@ package clients
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"io"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/lomorage/lomo-backup/common"
+	"github.com/lomorage/lomo-backup/common/bwlimit"
+	"github.com/lomorage/lomo-backup/common/progress"
+	"github.com/lomorage/lomo-backup/common/retry"
 	"github.com/lomorage/lomo-backup/common/types"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/term"
 )
 
 const (
 	maxPartSize = int64(5 * 1024 * 1024)
-	maxRetries  = 1
 )
 
 var (
@@ -38,70 +49,301 @@ type UploadRequest struct {
 	Key    string
 }
 
-/*
-type UploadClient interface {
-	GetObject(bucket, remotePath string) (*types.ISOInfo, error)
-	PutObject(bucket, remotePath, checksum, fileType string, reader io.ReadSeeker) error
-	CreateMultipartUpload(bucket, remotePath, fileType string) (*UploadRequest, error)
-	Upload(partNo, length int64, request *UploadRequest, reader io.ReadSeeker,
-		checksum string) (string, error)
-	CompleteMultipartUpload(request *UploadRequest, parts []*types.PartInfo, checksum string) error
-	ListMultipartUploads(bucket string) ([]*UploadRequest, error)
-	AbortMultipartUpload(request *UploadRequest) error
+type AWSClient struct {
+	region     string
+	svc        *s3.S3
+	retry      retry.Policy
+	objectTags bool
 }
 
-func NewAws(keyID, key, region string, svc int) (UploadClient, error) {
-	return newAWSClient(keyID, key, region)
+type Config struct {
+	Retry retry.Policy
+	// upload bandwidth limiter, nil if not limited
+	Limiter *bwlimit.Limiter
+	// S3 compatible endpoint, AWS is used if URL is empty
+	Endpoint    Endpoint
+	Credentials Credentials
+	// also save object metadata as object tags, which can be used in lifecycle rules and IAM policies
+	ObjectTags bool
 }
-*/
 
-type AWSClient struct {
-	region string
-	svc    *s3.S3
+// Credentials selects how to authenticate. Static access key is used if given, otherwise the standard chain
+// of AWS SDK: env, shared credentials and config files, web identity, SSO and instance or container role.
+// Temporary credentials are refreshed before they expire
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// profile in shared config and credentials files, which may assume role or use SSO itself
+	Profile string
+
+	// role assumed with the credentials above
+	RoleARN         string
+	RoleExternalID  string
+	RoleSessionName string
+	// serial number or ARN of MFA device, whose token is asked from stdin on each refresh if stdin is one
+	// terminal. Otherwise getting or refreshing credentials fails instead of waiting for the token
+	MFASerial    string
+	RoleDuration time.Duration
+}
+
+// stdinIsTerminal checks if MFA token can be asked from stdin
+var stdinIsTerminal = func() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// mfaTokenProvider asks MFA token from stdin. Unattended runs, e.g. by cron, have no one to answer it, so it
+// fails instead of blocking forever, which is reported as expired session if the token was given already
+type mfaTokenProvider struct {
+	asked bool
+}
+
+func (p *mfaTokenProvider) token() (string, error) {
+	if !stdinIsTerminal() {
+		if p.asked {
+			return "", errors.New("assumed role session expired, and MFA token can't be asked again as stdin " +
+				"is not a terminal. Set role duration to cover the whole run")
+		}
+		return "", errors.New("MFA token is required, while it can't be asked as stdin is not a terminal")
+	}
+	p.asked = true
+	return stscreds.StdinTokenProvider()
+}
+
+// credentialsExpiryWindow refreshes temporary credentials before they expire, so that requests signed
+// just before expiry, like one long part upload, are not rejected
+const credentialsExpiryWindow = 5 * time.Minute
+
+func (c *Credentials) sessionOptions(region string) session.Options {
+	opts := session.Options{
+		Config:                  *aws.NewConfig().WithCredentialsChainVerboseErrors(true),
+		Profile:                 c.Profile,
+		SharedConfigState:       session.SharedConfigEnable,
+		AssumeRoleTokenProvider: (&mfaTokenProvider{}).token,
+		AssumeRoleDuration:      c.RoleDuration,
+	}
+	if region != "" {
+		opts.Config.Region = aws.String(region)
+	}
+	if c.AccessKeyID != "" || c.SecretAccessKey != "" {
+		opts.Config.Credentials = credentials.NewStaticCredentials(c.AccessKeyID, c.SecretAccessKey,
+			c.SessionToken)
+	}
+	return opts
+}
+
+func (c *Credentials) assumeRole(sess *session.Session) *credentials.Credentials {
+	return stscreds.NewCredentials(sess, c.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+		if c.RoleExternalID != "" {
+			p.ExternalID = aws.String(c.RoleExternalID)
+		}
+		if c.RoleSessionName != "" {
+			p.RoleSessionName = c.RoleSessionName
+		}
+		if c.MFASerial != "" {
+			p.SerialNumber = aws.String(c.MFASerial)
+			p.TokenProvider = (&mfaTokenProvider{}).token
+		}
+		if c.RoleDuration > 0 {
+			p.Duration = c.RoleDuration
+		}
+		p.ExpiryWindow = credentialsExpiryWindow
+	})
+}
+
+// Endpoint configures S3 compatible service like MinIO, Wasabi or Ceph RGW, and how to reach it
+type Endpoint struct {
+	URL string
+	// use path style like https://host/bucket/key instead of virtual host style like https://bucket.host/key
+	PathStyle bool
+	// PEM file of CA certificates trusted besides system ones
+	CABundle string
+	// skip server certificate verification, only for lab use
+	InsecureTLS bool
+	// proxy URL. Proxy in HTTPS_PROXY, HTTP_PROXY and NO_PROXY env is used if empty
+	Proxy string
+	// not sign payload, for servers failing to verify signed payload. Only safe with https
+	UnsignedPayload bool
+	// not send Content-MD5 on uploads, for servers not supporting it
+	DisableContentMD5 bool
+}
+
+// localstackEndpointEnv is the env of endpoint used before endpoint options were added, which is deprecated
+const localstackEndpointEnv = "LOCALSTACK_ENDPOINT"
+
+// withLegacyEndpoint returns endpoint in LOCALSTACK_ENDPOINT env with path style if no endpoint URL is given
+func (e Endpoint) withLegacyEndpoint() Endpoint {
+	legacy := os.Getenv(localstackEndpointEnv)
+	if legacy == "" {
+		return e
+	}
+	if e.URL != "" {
+		logrus.Warnf("%s is deprecated and ignored as endpoint %s is given", localstackEndpointEnv, e.URL)
+		return e
+	}
+	logrus.Warnf("%s is deprecated, use LOMOB_S3_ENDPOINT and LOMOB_S3_PATH_STYLE instead", localstackEndpointEnv)
+	e.URL = legacy
+	e.PathStyle = true
+	return e
 }
 
-func NewAWSClient(keyID, key, region string) (*AWSClient, error) {
-	creds := credentials.NewStaticCredentials(keyID, key, "")
-	_, err := creds.Get()
+func (e *Endpoint) transport() (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if e.Proxy != "" {
+		proxy, err := url.Parse(e.Proxy)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid proxy %s", e.Proxy)
+		}
+		t.Proxy = http.ProxyURL(proxy)
+	}
+	if e.CABundle == "" && !e.InsecureTLS {
+		return t, nil
+	}
+
+	//nolint:gosec // insecure TLS is only enabled explicitly for lab use
+	t.TLSClientConfig = &tls.Config{InsecureSkipVerify: e.InsecureTLS}
+	if e.CABundle != "" {
+		pem, err := os.ReadFile(e.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA bundle %s", e.CABundle)
+		}
+		t.TLSClientConfig.RootCAs = pool
+	}
+	return t, nil
+}
+
+// NewAWSClient creates one S3 client whose calls are retried with conf.Retry. SDK's own retry is disabled
+// so that conf.Retry is the only limit. Region may be empty if it is given in shared config file
+func NewAWSClient(region string, conf *Config) (*AWSClient, error) {
+	endpoint := conf.Endpoint.withLegacyEndpoint()
+	sess, err := session.NewSessionWithOptions(conf.Credentials.sessionOptions(region))
 	if err != nil {
 		return nil, err
 	}
-	cfg := aws.NewConfig().WithRegion(region).WithCredentials(creds)
-	sess, err := session.NewSession()
+	creds := sess.Config.Credentials
+	if conf.Credentials.RoleARN != "" {
+		creds = conf.Credentials.assumeRole(sess)
+	}
+	// fail early, and ask MFA token before any upload starts
+	_, err = creds.Get()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get aws credentials")
+	}
+
+	// endpoint is only for S3, while STS and instance metadata are still reached directly
+	cfg := aws.NewConfig().WithCredentials(creds).WithMaxRetries(0)
+	if endpoint.URL != "" {
+		cfg = cfg.WithEndpoint(endpoint.URL)
+		// most S3 compatible services ignore region, while it is still required for signing
+		if aws.StringValue(sess.Config.Region) == "" {
+			sess.Config.Region = aws.String("us-east-1")
+		}
+	}
+	cfg = cfg.WithS3ForcePathStyle(endpoint.PathStyle).
+		WithS3DisableContentMD5Validation(endpoint.DisableContentMD5)
+
+	base, err := endpoint.transport()
 	if err != nil {
 		return nil, err
 	}
-	if os.Getenv("LOCALSTACK_ENDPOINT") != "" {
-		cfg.S3ForcePathStyle = aws.Bool(true)
-		cfg.Endpoint = aws.String(os.Getenv("LOCALSTACK_ENDPOINT"))
+	// progress is counted after limiter lets data go
+	cfg.HTTPClient = &http.Client{Transport: bwlimit.NewTransport(progress.NewTransport(base), conf.Limiter)}
+	svc := s3.New(sess, cfg)
+	if endpoint.UnsignedPayload {
+		svc.Handlers.Sign.Swap(v4.SignRequestHandler.Name,
+			v4.BuildNamedHandler(v4.SignRequestHandler.Name, v4.WithUnsignedPayload))
+	}
+	return &AWSClient{region: aws.StringValue(sess.Config.Region), svc: svc, retry: conf.Retry,
+		objectTags: conf.ObjectTags}, nil
+}
+
+// Region returns region given or resolved from shared config file
+func (ac *AWSClient) Region() string {
+	return ac.region
+}
+
+func (ac *AWSClient) do(desc string, fn func() error) error {
+	return retry.Do(context.Background(), ac.retry, desc, fn)
+}
+
+// rewind seeks reader back to pos before each attempt, as failed attempt may have read part of it
+func rewind(reader io.ReadSeeker, pos int64, fn func() error) func() error {
+	return func() error {
+		_, err := reader.Seek(pos, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		return fn()
 	}
-	return &AWSClient{region: region, svc: s3.New(sess, cfg)}, nil
 }
 
 func (ac *AWSClient) ListMultipartUploads(bucket string) ([]*UploadRequest, error) {
-	output, err := ac.svc.ListMultipartUploads(&s3.ListMultipartUploadsInput{
-		Bucket: &bucket,
+	var requests []*UploadRequest
+	err := ac.do("list multipart uploads in "+bucket, func() error {
+		requests = []*UploadRequest{}
+		return ac.svc.ListMultipartUploadsPages(&s3.ListMultipartUploadsInput{
+			Bucket: &bucket,
+		}, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+			for _, upload := range page.Uploads {
+				requests = append(requests, &UploadRequest{
+					Time:   aws.TimeValue(upload.Initiated),
+					ID:     aws.StringValue(upload.UploadId),
+					Bucket: bucket,
+					Key:    aws.StringValue(upload.Key),
+				})
+			}
+			return true
+		})
 	})
 	if err != nil {
 		return nil, err
 	}
+	return requests, nil
+}
 
-	requests := make([]*UploadRequest, len(output.Uploads))
-	for i, upload := range output.Uploads {
-		requests[i] = &UploadRequest{
-			Time: *upload.Initiated,
-			ID:   *upload.UploadId,
-			Key:  *upload.Key,
-		}
+func (ac *AWSClient) ListParts(request *UploadRequest) ([]*types.PartInfo, error) {
+	var parts []*types.PartInfo
+	err := ac.do("list parts of "+request.Key, func() error {
+		parts = []*types.PartInfo{}
+		return ac.svc.ListPartsPages(&s3.ListPartsInput{
+			Bucket:   &request.Bucket,
+			Key:      &request.Key,
+			UploadId: &request.ID,
+		}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+			for _, p := range page.Parts {
+				parts = append(parts, &types.PartInfo{
+					PartNo:     int(aws.Int64Value(p.PartNumber)),
+					Size:       int(aws.Int64Value(p.Size)),
+					Etag:       aws.StringValue(p.ETag),
+					HashRemote: aws.StringValue(p.ChecksumSHA256),
+					CreateTime: aws.TimeValue(p.LastModified),
+				})
+			}
+			return true
+		})
+	})
+	if err != nil {
+		return nil, err
 	}
-	return requests, nil
+	return parts, nil
 }
 
 func (ac *AWSClient) HeadObject(bucket, remotePath string) (*types.ISOInfo, error) {
-	object, err := ac.svc.HeadObject(&s3.HeadObjectInput{
-		Bucket:       &bucket,
-		Key:          &remotePath,
-		ChecksumMode: aws.String(s3.ChecksumModeEnabled),
+	var object *s3.HeadObjectOutput
+	err := ac.do("head "+remotePath, func() (err error) {
+		object, err = ac.svc.HeadObject(&s3.HeadObjectInput{
+			Bucket:       &bucket,
+			Key:          &remotePath,
+			ChecksumMode: aws.String(s3.ChecksumModeEnabled),
+		})
+		return
 	})
 	if err == nil {
 		info := &types.ISOInfo{}
@@ -111,6 +353,13 @@ func (ac *AWSClient) HeadObject(bucket, remotePath string) (*types.ISOInfo, erro
 		if object.ChecksumSHA256 != nil {
 			info.HashRemote = *object.ChecksumSHA256
 		}
+		// header names are canonicalized, e.g. Hash_orig
+		if len(object.Metadata) != 0 {
+			info.Metadata = make(map[string]string, len(object.Metadata))
+			for k, v := range object.Metadata {
+				info.Metadata[strings.ToLower(k)] = aws.StringValue(v)
+			}
+		}
 		common.LogDebugObject("HeadObjectReply", info)
 		return info, nil
 	} else if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
@@ -120,31 +369,26 @@ func (ac *AWSClient) HeadObject(bucket, remotePath string) (*types.ISOInfo, erro
 	}
 }
 
-func (ac *AWSClient) createBucketIfNotExist(bucket string) error {
-	// create bucket if not exist
-	_, err := ac.svc.HeadBucket(&s3.HeadBucketInput{Bucket: &bucket})
-	if err == nil {
-		logrus.Infof("Bucket %s exists in %s", bucket, ac.region)
-		return nil
-	}
-	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != "NotFound" {
-		return err
+// tagging encodes metadata as object tags if they are enabled. Object type is always tagged, which lifecycle
+// transition rule filters on
+func (ac *AWSClient) tagging(metadata map[string]string) *string {
+	tags := url.Values{}
+	if ac.objectTags {
+		for k, v := range metadata {
+			tags.Set(k, v)
+		}
+	} else if objectType := metadata[types.MetadataKeyObjectType]; objectType != "" {
+		tags.Set(types.MetadataKeyObjectType, objectType)
 	}
-	logrus.Infof("Bucket %s does't exist in %s, creating", bucket, ac.region)
-
-	_, err = ac.svc.CreateBucket(&s3.CreateBucketInput{Bucket: &bucket})
-	if err != nil {
-		return err
+	if len(tags) == 0 {
+		return nil
 	}
-	logrus.Infof("Bucket %s is created in %s", bucket, ac.region)
-	return nil
+	return aws.String(tags.Encode())
 }
 
-func (ac *AWSClient) PutObject(bucket, remotePath, checksum, fileType, storageClass string, reader io.ReadSeeker) error {
-	err := ac.createBucketIfNotExist(bucket)
-	if err != nil {
-		return err
-	}
+// PutObject uploads reader as one object. Bytes sent are counted into progress tracker of ctx if any
+func (ac *AWSClient) PutObject(ctx context.Context, bucket, remotePath, checksum, fileType, storageClass string,
+	metadata map[string]string, reader io.ReadSeeker) error {
 	input := &s3.PutObjectInput{
 		Body:              reader,
 		Bucket:            aws.String(bucket),
@@ -153,26 +397,50 @@ func (ac *AWSClient) PutObject(bucket, remotePath, checksum, fileType, storageCl
 		ChecksumAlgorithm: &checksumAlgorithm,
 		ChecksumSHA256:    aws.String(checksum),
 		StorageClass:      aws.String(storageClass),
+		Metadata:          aws.StringMap(metadata),
+		Tagging:           ac.tagging(metadata),
 	}
-	_, err = ac.svc.PutObject(input)
-	return err
-}
-
-func (ac *AWSClient) CreateMultipartUpload(bucket, remotePath, fileType, storageClass string) (*UploadRequest, error) {
-	err := ac.createBucketIfNotExist(bucket)
+	pos, err := reader.Seek(0, io.SeekCurrent)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return ac.do("put "+remotePath, rewind(reader, pos, func() error {
+		_, err := ac.svc.PutObjectWithContext(ctx, input)
+		return err
+	}))
+}
 
+func (ac *AWSClient) DeleteObject(bucket, remotePath string) error {
+	return ac.do("delete "+remotePath, func() error {
+		_, err := ac.svc.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: &bucket,
+			Key:    &remotePath,
+		})
+		return err
+	})
+}
+
+func (ac *AWSClient) CreateMultipartUpload(bucket, remotePath, fileType, storageClass string,
+	metadata map[string]string, retention *Retention) (*UploadRequest, error) {
 	input := &s3.CreateMultipartUploadInput{
 		Bucket:            &bucket,
 		Key:               &remotePath,
 		ContentType:       &fileType,
 		ChecksumAlgorithm: &checksumAlgorithm,
 		StorageClass:      &storageClass,
+		Metadata:          aws.StringMap(metadata),
+		Tagging:           ac.tagging(metadata),
+	}
+	if retention != nil {
+		input.ObjectLockMode = aws.String(retention.Mode)
+		input.ObjectLockRetainUntilDate = aws.Time(retention.Until)
 	}
 
-	resp, err := ac.svc.CreateMultipartUpload(input)
+	var resp *s3.CreateMultipartUploadOutput
+	err := ac.do("create multipart upload "+remotePath, func() (err error) {
+		resp, err = ac.svc.CreateMultipartUpload(input)
+		return
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -194,7 +462,8 @@ func (ac *AWSClient) CreateMultipartUpload(bucket, remotePath, fileType, storage
 	}, nil
 }
 
-func (ac *AWSClient) Upload(partNo, length int64, request *UploadRequest, reader io.ReadSeeker,
+// Upload uploads one part. Bytes sent are counted into progress tracker of ctx if any
+func (ac *AWSClient) Upload(ctx context.Context, partNo, length int64, request *UploadRequest, reader io.ReadSeeker,
 	checksum string) (string, error) {
 	partInput := &s3.UploadPartInput{
 		Body:              reader,
@@ -209,26 +478,25 @@ func (ac *AWSClient) Upload(partNo, length int64, request *UploadRequest, reader
 
 	common.LogDebugObject("UploadPartInput", partInput)
 
-	var retErr error
-	for retry := 1; retry <= maxRetries; retry++ {
-		logrus.Infof("#%d retry uploading part %d for %s", retry, partNo, request.Key)
-		uploadResult, err := ac.svc.UploadPart(partInput)
-		if err == nil {
-			if uploadResult.ETag == nil {
-				return "", nil
-			}
+	pos, err := reader.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	var uploadResult *s3.UploadPartOutput
+	err = ac.do(fmt.Sprintf("upload part %d for %s", partNo, request.Key), rewind(reader, pos, func() (err error) {
+		uploadResult, err = ac.svc.UploadPartWithContext(ctx, partInput)
+		return
+	}))
+	if err != nil {
+		return "", err
+	}
+	if uploadResult.ETag == nil {
+		return "", nil
+	}
 
-			common.LogDebugObject("UploadPartReply", uploadResult)
+	common.LogDebugObject("UploadPartReply", uploadResult)
 
-			return *uploadResult.ETag, nil
-		}
-		if retErr == nil {
-			retErr = err
-		} else {
-			retErr = errors.Wrapf(retErr, "%d err: %s", retry, err)
-		}
-	}
-	return "", retErr
+	return *uploadResult.ETag, nil
 }
 
 func (ac *AWSClient) CompleteMultipartUpload(request *UploadRequest, parts []*types.PartInfo, checksum string) error {
@@ -253,7 +521,11 @@ func (ac *AWSClient) CompleteMultipartUpload(request *UploadRequest, parts []*ty
 
 	common.LogDebugObject("CompleteMultipartUploadInput", completeInput)
 
-	resp, err := ac.svc.CompleteMultipartUpload(completeInput)
+	var resp *s3.CompleteMultipartUploadOutput
+	err := ac.do("complete multipart upload "+request.Key, func() (err error) {
+		resp, err = ac.svc.CompleteMultipartUpload(completeInput)
+		return
+	})
 
 	common.LogDebugObject("CompleteMultipartUploadReply", resp)
 
@@ -268,19 +540,36 @@ func (ac *AWSClient) AbortMultipartUpload(request *UploadRequest) error {
 	}
 
 	common.LogDebugObject("AbortMultipartUpload", abortInput)
-	_, err := ac.svc.AbortMultipartUpload(abortInput)
-	return err
+	return ac.do("abort multipart upload "+request.Key, func() error {
+		_, err := ac.svc.AbortMultipartUpload(abortInput)
+		return err
+	})
 }
 
 func (ac *AWSClient) GetObject(ctx context.Context, bucket, remotePath string, writer io.Writer) (int64, error) {
-	err := ac.createBucketIfNotExist(bucket)
-	if err != nil {
-		return 0, err
-	}
+	return ac.GetObjectRange(ctx, bucket, remotePath, 0, -1, writer)
+}
 
-	result, err := ac.svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+func (ac *AWSClient) GetObjectRange(ctx context.Context, bucket, remotePath string, offset, length int64,
+	writer io.Writer) (int64, error) {
+	input := &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(remotePath),
+	}
+	if length >= 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+	}
+	if length == 0 {
+		return 0, nil
+	}
+
+	// only request is retried, as part of the body may have been written into writer already
+	var result *s3.GetObjectOutput
+	err := retry.Do(ctx, ac.retry, "get "+remotePath, func() (err error) {
+		result, err = ac.svc.GetObjectWithContext(ctx, input)
+		return
 	})
 	if err != nil {
 		return 0, err
@@ -289,3 +578,24 @@ func (ac *AWSClient) GetObject(ctx context.Context, bucket, remotePath string, w
 
 	return io.Copy(writer, result.Body)
 }
+
+func (ac *AWSClient) ListObjects(bucket, prefix string) ([]*ObjectInfo, error) {
+	var objects []*ObjectInfo
+	err := ac.do("list objects in "+bucket, func() error {
+		objects = []*ObjectInfo{}
+		return ac.svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+			Bucket: &bucket,
+			Prefix: &prefix,
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, o := range page.Contents {
+				objects = append(objects, &ObjectInfo{
+					Key:     aws.StringValue(o.Key),
+					Size:    aws.Int64Value(o.Size),
+					ModTime: aws.TimeValue(o.LastModified),
+				})
+			}
+			return true
+		})
+	})
+	return objects, err
+}
@@ -0,0 +1,480 @@
+package clients
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	lomohash "github.com/lomorage/lomo-backup/common/hash"
+	"github.com/lomorage/lomo-backup/common/progress"
+	"github.com/lomorage/lomo-backup/common/retry"
+	"github.com/lomorage/lomo-backup/common/types"
+	"github.com/stretchr/testify/require"
+)
+
+type fault func(w http.ResponseWriter)
+
+func awsError(status int, code string) fault {
+	return func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(status)
+		_, _ = io.WriteString(w, "<Error><Code>"+code+"</Code><Message>injected</Message></Error>")
+	}
+}
+
+// resetConn closes connection without any response
+func resetConn(w http.ResponseWriter) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err == nil {
+		conn.Close()
+	}
+}
+
+// faultServer injects faults in order, and then replies success with etag
+type faultServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	faults []fault
+	bodies [][]byte
+}
+
+func newFaultServer(t *testing.T, faults ...fault) *faultServer {
+	s := &faultServer{faults: faults}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		s.bodies = append(s.bodies, body)
+		var f fault
+		if len(s.faults) > 0 {
+			f = s.faults[0]
+			s.faults = s.faults[1:]
+		}
+		s.mu.Unlock()
+
+		if f != nil {
+			f(w)
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *faultServer) requests() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bodies
+}
+
+var testCredentials = Credentials{AccessKeyID: "id", SecretAccessKey: "key"}
+
+var testPolicy = retry.Policy{MaxRetries: 4, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+
+func uploadTestPart(ctx context.Context, t *testing.T, url string, data []byte) (string, error) {
+	cli, err := NewAWSClient("us-east-1", &Config{
+		Credentials: testCredentials,
+		Retry:       testPolicy,
+		Endpoint:    Endpoint{URL: url, PathStyle: true},
+	})
+	require.Nil(t, err)
+	request := &UploadRequest{ID: "upload", Bucket: "bucket", Key: "key"}
+	return cli.Upload(ctx, 1, int64(len(data)), request, bytes.NewReader(data), "checksum")
+}
+
+func TestUploadRetry(t *testing.T) {
+	s := newFaultServer(t,
+		awsError(http.StatusServiceUnavailable, "SlowDown"),
+		awsError(http.StatusInternalServerError, "InternalError"),
+		resetConn,
+	)
+	data := bytes.Repeat([]byte("lomorage"), 1000)
+	etag, err := uploadTestPart(context.Background(), t, s.URL, data)
+	require.Nil(t, err)
+	require.Equal(t, `"etag"`, etag)
+
+	// body is uploaded from the beginning for each retry
+	bodies := s.requests()
+	require.Len(t, bodies, 4)
+	for _, body := range bodies {
+		require.Equal(t, data, body)
+	}
+}
+
+func TestUploadProgress(t *testing.T) {
+	s := newFaultServer(t, awsError(http.StatusInternalServerError, "InternalError"), resetConn)
+	var (
+		mu     sync.Mutex
+		events []progress.Event
+	)
+	data := bytes.Repeat([]byte("lomorage"), 100000)
+	tracker := progress.NewTracker(progress.ReporterFunc(func(e progress.Event) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	}), "upload", int64(len(data)))
+	_, err := uploadTestPart(progress.WithTracker(context.Background(), tracker), t, s.URL, data)
+	require.Nil(t, err)
+	tracker.Finish()
+
+	// bytes of failed attempts and checksum calculation are not counted
+	mu.Lock()
+	defer mu.Unlock()
+	last := events[len(events)-1]
+	require.True(t, last.Finished)
+	require.EqualValues(t, len(data), last.Done)
+}
+
+func TestUploadRetryUsedUp(t *testing.T) {
+	var faults []fault
+	for i := 0; i <= testPolicy.MaxRetries; i++ {
+		faults = append(faults, awsError(http.StatusBadGateway, "BadGateway"))
+	}
+	s := newFaultServer(t, faults...)
+	_, err := uploadTestPart(context.Background(), t, s.URL, []byte("lomorage"))
+	require.NotNil(t, err)
+	require.Equal(t, retry.ServerError, retry.Classify(err))
+	require.Len(t, s.requests(), testPolicy.MaxRetries+1)
+}
+
+func TestUploadNoRetryForAuth(t *testing.T) {
+	s := newFaultServer(t, awsError(http.StatusForbidden, "InvalidAccessKeyId"))
+	_, err := uploadTestPart(context.Background(), t, s.URL, []byte("lomorage"))
+	require.NotNil(t, err)
+	require.Equal(t, retry.Auth, retry.Classify(err))
+	require.Len(t, s.requests(), 1)
+}
+
+func TestHeadObjectNotFound(t *testing.T) {
+	s := newFaultServer(t, func(w http.ResponseWriter) { w.WriteHeader(http.StatusNotFound) })
+	cli, err := NewAWSClient("us-east-1", &Config{
+		Credentials: testCredentials,
+		Retry:       testPolicy,
+		Endpoint:    Endpoint{URL: s.URL, PathStyle: true},
+	})
+	require.Nil(t, err)
+	info, err := cli.HeadObject("bucket", "key")
+	require.Nil(t, err)
+	require.Nil(t, info)
+	require.Len(t, s.requests(), 1)
+}
+
+func TestEndpointTLS(t *testing.T) {
+	var paths []string
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer s.Close()
+
+	caBundle := filepath.Join(t.TempDir(), "ca.pem")
+	err := os.WriteFile(caBundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw}),
+		0600)
+	require.Nil(t, err)
+
+	head := func(endpoint Endpoint) error {
+		endpoint.URL = s.URL
+		endpoint.PathStyle = true
+		// region is not required by S3 compatible endpoint
+		cli, err := NewAWSClient("", &Config{Credentials: testCredentials, Endpoint: endpoint})
+		require.Nil(t, err)
+		_, err = cli.HeadObject("bucket", "key")
+		return err
+	}
+
+	// self signed certificate is rejected by default
+	require.NotNil(t, head(Endpoint{}))
+	require.Empty(t, paths)
+
+	require.Nil(t, head(Endpoint{CABundle: caBundle}))
+	require.Nil(t, head(Endpoint{InsecureTLS: true}))
+	require.Equal(t, []string{"/bucket/key", "/bucket/key"}, paths)
+
+	_, err = NewAWSClient("", &Config{Credentials: testCredentials,
+		Endpoint: Endpoint{URL: s.URL, CABundle: "/not/exist"}})
+	require.NotNil(t, err)
+}
+
+func TestEndpointProxy(t *testing.T) {
+	var urls []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		urls = append(urls, r.URL.String())
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer proxy.Close()
+
+	cli, err := NewAWSClient("", &Config{Credentials: testCredentials, Endpoint: Endpoint{
+		URL:   "http://s3.lomorage.invalid",
+		Proxy: proxy.URL,
+	}})
+	require.Nil(t, err)
+	_, err = cli.HeadObject("bucket", "key")
+	require.Nil(t, err)
+	// bucket is in host name with virtual host style
+	require.Equal(t, []string{"http://bucket.s3.lomorage.invalid/key"}, urls)
+}
+
+func TestLegacyLocalstackEndpoint(t *testing.T) {
+	var paths []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer s.Close()
+	t.Setenv(localstackEndpointEnv, s.URL)
+
+	// deprecated env is used with path style if no endpoint is given
+	cli, err := NewAWSClient("us-east-1", &Config{Credentials: testCredentials})
+	require.Nil(t, err)
+	_, err = cli.HeadObject("bucket", "key")
+	require.Nil(t, err)
+	require.Equal(t, []string{"/bucket/key"}, paths)
+
+	// endpoint given overrides it
+	endpoint := Endpoint{URL: "http://s3.lomorage.invalid"}.withLegacyEndpoint()
+	require.Equal(t, "http://s3.lomorage.invalid", endpoint.URL)
+	require.False(t, endpoint.PathStyle)
+}
+
+func TestCredentialsProfileRefresh(t *testing.T) {
+	dir := t.TempDir()
+	// each call returns new key which is expired already
+	script := filepath.Join(dir, "credentials.sh")
+	err := os.WriteFile(script, []byte(`#!/bin/sh
+n=$(cat `+dir+`/count 2>/dev/null || echo 0)
+echo $((n+1)) > `+dir+`/count
+echo '{"Version":1,"AccessKeyId":"key'$n'","SecretAccessKey":"secret","SessionToken":"token",`+
+		`"Expiration":"2000-01-01T00:00:00Z"}'
+`), 0700)
+	require.Nil(t, err)
+	config := filepath.Join(dir, "config")
+	err = os.WriteFile(config, []byte("[profile nas]\nregion = eu-west-1\ncredential_process = "+script+"\n"),
+		0600)
+	require.Nil(t, err)
+	t.Setenv("AWS_CONFIG_FILE", config)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+
+	var auths []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auths = append(auths, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer s.Close()
+
+	cli, err := NewAWSClient("", &Config{
+		Credentials: Credentials{Profile: "nas"},
+		Endpoint:    Endpoint{URL: s.URL, PathStyle: true},
+	})
+	require.Nil(t, err)
+	// region in profile is used
+	require.Equal(t, "eu-west-1", cli.region)
+
+	for i := 0; i < 2; i++ {
+		_, err = cli.HeadObject("bucket", "key")
+		require.Nil(t, err)
+	}
+	// credentials are verified when client is created, and refreshed for each request after expiry
+	require.Len(t, auths, 2)
+	require.Contains(t, auths[0], "Credential=key1/")
+	require.Contains(t, auths[1], "Credential=key2/")
+
+	_, err = NewAWSClient("", &Config{Credentials: Credentials{Profile: "not-exist"}})
+	require.NotNil(t, err)
+}
+
+func TestCreateMultipartUploadRetention(t *testing.T) {
+	var header http.Header
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		_, _ = io.WriteString(w, "<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>a.iso</Key>"+
+			"<UploadId>upload</UploadId></InitiateMultipartUploadResult>")
+	}))
+	defer s.Close()
+	cli, err := NewAWSClient("", &Config{
+		Credentials: testCredentials,
+		Endpoint:    Endpoint{URL: s.URL, PathStyle: true},
+	})
+	require.Nil(t, err)
+
+	until := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	request, err := cli.CreateMultipartUpload("bucket", "a.iso", "", "STANDARD", nil,
+		&Retention{Mode: "COMPLIANCE", Until: until})
+	require.Nil(t, err)
+	require.Equal(t, "upload", request.ID)
+	require.Equal(t, "COMPLIANCE", header.Get("X-Amz-Object-Lock-Mode"))
+	require.Equal(t, "2030-01-02T03:04:05Z", header.Get("X-Amz-Object-Lock-Retain-Until-Date"))
+
+	_, err = cli.CreateMultipartUpload("bucket", "a.iso", "", "STANDARD", nil, nil)
+	require.Nil(t, err)
+	require.Empty(t, header.Get("X-Amz-Object-Lock-Mode"))
+}
+
+func TestObjectMetadata(t *testing.T) {
+	var headers []http.Header
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.Header)
+		switch r.Method {
+		case http.MethodHead:
+			w.Header().Set("X-Amz-Meta-Hash_orig", "orig")
+			w.Header().Set("X-Amz-Meta-Part_size", "6000000")
+		case http.MethodPost:
+			_, _ = io.WriteString(w, "<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>a.iso</Key>"+
+				"<UploadId>upload</UploadId></InitiateMultipartUploadResult>")
+		}
+	}))
+	defer s.Close()
+	conf := &Config{
+		Credentials: testCredentials,
+		Endpoint:    Endpoint{URL: s.URL, PathStyle: true},
+	}
+	cli, err := NewAWSClient("", conf)
+	require.Nil(t, err)
+
+	metadata := map[string]string{types.MetadataKeyHashOrig: "orig", types.MetadataKeyPartSize: "6000000"}
+	data := []byte("lomorage")
+	h := sha256.Sum256(data)
+	err = cli.PutObject(context.Background(), "bucket", "a.txt", lomohash.CalculateHashBase64(h[:]), "",
+		"STANDARD", metadata, bytes.NewReader(data))
+	require.Nil(t, err)
+	require.Equal(t, "orig", headers[0].Get("X-Amz-Meta-Hash_orig"))
+	require.Equal(t, "6000000", headers[0].Get("X-Amz-Meta-Part_size"))
+	require.Empty(t, headers[0].Get("X-Amz-Tagging"))
+
+	info, err := cli.HeadObject("bucket", "a.txt")
+	require.Nil(t, err)
+	require.Equal(t, metadata, info.Metadata)
+
+	conf.ObjectTags = true
+	cli, err = NewAWSClient("", conf)
+	require.Nil(t, err)
+	_, err = cli.CreateMultipartUpload("bucket", "a.iso", "", "STANDARD", metadata, nil)
+	require.Nil(t, err)
+	last := headers[len(headers)-1]
+	require.Equal(t, "orig", last.Get("X-Amz-Meta-Hash_orig"))
+	require.Equal(t, "hash_orig=orig&part_size=6000000", last.Get("X-Amz-Tagging"))
+}
+
+func TestObjectTypeTag(t *testing.T) {
+	var tagging []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tagging = append(tagging, r.Header.Get("X-Amz-Tagging"))
+		_, _ = io.WriteString(w, "<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>a.iso</Key>"+
+			"<UploadId>upload</UploadId></InitiateMultipartUploadResult>")
+	}))
+	defer s.Close()
+	cli, err := NewAWSClient("", &Config{
+		Credentials: testCredentials,
+		Endpoint:    Endpoint{URL: s.URL, PathStyle: true},
+	})
+	require.Nil(t, err)
+
+	// object type is tagged without object tags enabled, so that lifecycle rule only matches isos
+	_, err = cli.CreateMultipartUpload("bucket", "a.iso", "", "STANDARD", map[string]string{
+		types.MetadataKeyHashOrig:   "orig",
+		types.MetadataKeyObjectType: types.ObjectTypeISO,
+	}, nil)
+	require.Nil(t, err)
+	_, err = cli.CreateMultipartUpload("bucket", "a.iso.meta.txt", "", "STANDARD", map[string]string{
+		types.MetadataKeyHashOrig: "orig",
+	}, nil)
+	require.Nil(t, err)
+	require.Equal(t, []string{"object_type=iso", ""}, tagging)
+}
+
+func TestListMultipartUploads(t *testing.T) {
+	var queries []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.RawQuery)
+		if r.URL.Query().Get("key-marker") == "" {
+			_, _ = io.WriteString(w, "<ListMultipartUploadsResult><IsTruncated>true</IsTruncated>"+
+				"<NextKeyMarker>a.iso</NextKeyMarker><NextUploadIdMarker>upload1</NextUploadIdMarker>"+
+				"<Upload><Key>a.iso</Key><UploadId>upload1</UploadId>"+
+				"<Initiated>2024-04-13T01:02:03.000Z</Initiated></Upload></ListMultipartUploadsResult>")
+			return
+		}
+		_, _ = io.WriteString(w, "<ListMultipartUploadsResult><IsTruncated>false</IsTruncated>"+
+			"<Upload><Key>b.iso</Key><UploadId>upload2</UploadId>"+
+			"<Initiated>2024-04-14T01:02:03.000Z</Initiated></Upload></ListMultipartUploadsResult>")
+	}))
+	defer s.Close()
+	cli, err := NewAWSClient("", &Config{
+		Credentials: testCredentials,
+		Endpoint:    Endpoint{URL: s.URL, PathStyle: true},
+	})
+	require.Nil(t, err)
+
+	// uploads in following pages are listed too
+	requests, err := cli.ListMultipartUploads("bucket")
+	require.Nil(t, err)
+	require.Len(t, queries, 2)
+	require.Contains(t, queries[1], "key-marker=a.iso")
+	require.Contains(t, queries[1], "upload-id-marker=upload1")
+	require.Equal(t, []*UploadRequest{
+		{ID: "upload1", Bucket: "bucket", Key: "a.iso", Time: time.Date(2024, 4, 13, 1, 2, 3, 0, time.UTC)},
+		{ID: "upload2", Bucket: "bucket", Key: "b.iso", Time: time.Date(2024, 4, 14, 1, 2, 3, 0, time.UTC)},
+	}, requests)
+}
+
+func TestListParts(t *testing.T) {
+	var queries []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.RawQuery)
+		if r.URL.Query().Get("part-number-marker") == "" {
+			_, _ = io.WriteString(w, "<ListPartsResult><IsTruncated>true</IsTruncated>"+
+				"<NextPartNumberMarker>1</NextPartNumberMarker><Part><PartNumber>1</PartNumber>"+
+				"<Size>6000000</Size><ETag>&quot;etag1&quot;</ETag><ChecksumSHA256>hash1</ChecksumSHA256>"+
+				"<LastModified>2024-04-13T01:02:03.000Z</LastModified></Part></ListPartsResult>")
+			return
+		}
+		_, _ = io.WriteString(w, "<ListPartsResult><IsTruncated>false</IsTruncated><Part><PartNumber>2</PartNumber>"+
+			"<Size>100</Size><ETag>&quot;etag2&quot;</ETag><ChecksumSHA256>hash2</ChecksumSHA256>"+
+			"</Part></ListPartsResult>")
+	}))
+	defer s.Close()
+	cli, err := NewAWSClient("", &Config{
+		Credentials: testCredentials,
+		Endpoint:    Endpoint{URL: s.URL, PathStyle: true},
+	})
+	require.Nil(t, err)
+
+	parts, err := cli.ListParts(&UploadRequest{ID: "upload", Bucket: "bucket", Key: "a.iso"})
+	require.Nil(t, err)
+	require.Len(t, queries, 2)
+	require.Contains(t, queries[0], "uploadId=upload")
+	require.Equal(t, []*types.PartInfo{
+		{PartNo: 1, Size: 6000000, Etag: `"etag1"`, HashRemote: "hash1",
+			CreateTime: time.Date(2024, 4, 13, 1, 2, 3, 0, time.UTC)},
+		{PartNo: 2, Size: 100, Etag: `"etag2"`, HashRemote: "hash2"},
+	}, parts)
+}
+
+func TestMFATokenNotTerminal(t *testing.T) {
+	oldIsTerminal := stdinIsTerminal
+	stdinIsTerminal = func() bool { return false }
+	defer func() { stdinIsTerminal = oldIsTerminal }()
+
+	// token is refused at start, and on refresh after the session expires, instead of waiting for stdin
+	_, err := (&mfaTokenProvider{}).token()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "not a terminal")
+	_, err = (&mfaTokenProvider{asked: true}).token()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "session expired")
+
+	_, err = NewAWSClient("us-east-1", &Config{Credentials: Credentials{AccessKeyID: "key", SecretAccessKey: "secret",
+		RoleARN: "arn:aws:iam::123456789012:role/lomob", MFASerial: "arn:aws:iam::123456789012:mfa/me"}})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "not a terminal")
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/lomorage/lomo-backup/common/compress"
+	"github.com/lomorage/lomo-backup/common/datasize"
+	"github.com/lomorage/lomo-backup/common/parity"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+type backupScanConfig struct {
+	Dirs        []string `json:"dirs"`
+	Threads     int      `json:"threads"`
+	IgnoreFiles string   `json:"ignore_files"`
+	IgnoreDirs  string   `json:"ignore_dirs"`
+}
+
+type backupGdriveConfig struct {
+	Cred     string `json:"cred"`
+	Token    string `json:"token"`
+	Folder   string `json:"folder"`
+	Compress string `json:"compress"`
+
+	codec compress.Codec
+}
+
+type backupISOConfig struct {
+	Size     string `json:"size"`
+	StoreDir string `json:"store_dir"`
+
+	size datasize.ByteSize
+}
+
+// backupUploadConfig is where isos are uploaded, with the same fields as destinations of replicate
+type backupUploadConfig struct {
+	destination
+	PartSize         string `json:"part_size"`
+	NThreads         int    `json:"nthreads"`
+	NoEncrypt        bool   `json:"no_encrypt"`
+	Compress         string `json:"compress"`
+	ParityShards     int    `json:"parity_shards"`
+	ParityDataShards int    `json:"parity_data_shards"`
+	ParityBlockSize  string `json:"parity_block_size"`
+
+	partSize   int
+	codec      compress.Codec
+	parityOpts parity.Options
+}
+
+// backupConfig is the json file given by --config of backup. Stages not in it are skipped
+type backupConfig struct {
+	Scan   *backupScanConfig   `json:"scan"`
+	Gdrive *backupGdriveConfig `json:"gdrive"`
+	ISO    *backupISOConfig    `json:"iso"`
+	Upload *backupUploadConfig `json:"upload"`
+}
+
+// loadBackupConfig fills default values of flags of each stage, and validates them before any stage runs
+func loadBackupConfig(filename string) (*backupConfig, error) {
+	if filename == "" {
+		return nil, errors.New("please provide backup config with --config")
+	}
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	conf := &backupConfig{}
+	err = json.Unmarshal(content, conf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse %s", filename)
+	}
+
+	if s := conf.Scan; s != nil {
+		if s.Threads == 0 {
+			s.Threads = defaultScanThreads
+		}
+		if s.IgnoreFiles == "" {
+			s.IgnoreFiles = defaultIgnoreFiles
+		}
+		if s.IgnoreDirs == "" {
+			s.IgnoreDirs = defaultIgnoreDirs
+		}
+		if s.Threads < 0 {
+			return nil, errors.Errorf("invalid number of scan threads: %d", s.Threads)
+		}
+	}
+
+	if g := conf.Gdrive; g != nil {
+		if g.Cred == "" {
+			g.Cred = "gdrive-credentials.json"
+		}
+		if g.Token == "" {
+			g.Token = "gdrive-token.json"
+		}
+		if g.Folder == "" {
+			g.Folder = defaultBucket
+		}
+		g.codec, err = compress.ParseCodec(g.Compress)
+		if err != nil {
+			return nil, errors.Wrap(err, "gdrive")
+		}
+	}
+
+	if i := conf.ISO; i != nil {
+		if i.Size == "" {
+			i.Size = "5G"
+		}
+		i.size, err = datasize.ParseString(i.Size)
+		if err != nil {
+			return nil, errors.Wrap(err, "iso")
+		}
+	}
+
+	if u := conf.Upload; u != nil {
+		u.Name = "upload"
+		if u.Bucket == "" {
+			u.Bucket = defaultBucket
+		}
+		if u.StorageClass == "" {
+			u.StorageClass = "STANDARD"
+		}
+		if u.PartSize == "" {
+			u.PartSize = "100M"
+		}
+		if u.NThreads == 0 {
+			u.NThreads = 3
+		}
+		if u.ParityDataShards == 0 {
+			u.ParityDataShards = 10
+		}
+		if u.ParityBlockSize == "" {
+			u.ParityBlockSize = "1M"
+		}
+		_, err = checkStorageClass(u.StorageClass)
+		if err != nil {
+			return nil, errors.Wrap(err, "upload")
+		}
+		_, err = newRetention(u.LockMode, u.LockDays)
+		if err != nil {
+			return nil, errors.Wrap(err, "upload")
+		}
+		u.partSize, err = parsePartSize(u.PartSize)
+		if err != nil {
+			return nil, errors.Wrap(err, "upload")
+		}
+		if u.NThreads < 0 {
+			return nil, errors.Errorf("invalid number of upload threads: %d", u.NThreads)
+		}
+		u.codec, err = compress.ParseCodec(u.Compress)
+		if err != nil {
+			return nil, errors.Wrap(err, "upload")
+		}
+		u.parityOpts, err = newParityOptions(u.ParityBlockSize, u.ParityDataShards, u.ParityShards)
+		if err != nil {
+			return nil, errors.Wrap(err, "upload")
+		}
+	}
+	return conf, nil
+}
+
+// backupStage is the result of one stage, which keeps running after one item fails
+type backupStage struct {
+	name   string
+	done   int
+	failed int
+	errs   []string
+}
+
+func (s *backupStage) fail(item string, err error) {
+	logrus.Warnf("Backup stage %s, %s: %s", s.name, item, err)
+	s.failed++
+	s.errs = append(s.errs, fmt.Sprintf("%s: %s", item, err))
+}
+
+func backup(ctx *cli.Context) error {
+	conf, err := loadBackupConfig(ctx.String("config"))
+	if err != nil {
+		return err
+	}
+
+	err = initLogLevel(ctx.GlobalInt("log-level"))
+	if err != nil {
+		return err
+	}
+
+	err = initDB(ctx.GlobalString("db"))
+	if err != nil {
+		return err
+	}
+
+	// ask master key before any stage, so that nightly run won't wait for it in the middle
+	var masterKey string
+	if conf.Gdrive != nil || (conf.Upload != nil && !conf.Upload.NoEncrypt) {
+		masterKey = ctx.String("encrypt-key")
+		if masterKey == "" {
+			masterKey, err = getMasterKey()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	var stages []*backupStage
+
+	if conf.Scan != nil {
+		stage := &backupStage{name: "scan"}
+		stages = append(stages, stage)
+		for _, dir := range conf.Scan.Dirs {
+			fmt.Printf("Scanning %s\n", dir)
+			err = scanDirectory(dir, conf.Scan.Threads, conf.Scan.IgnoreFiles, conf.Scan.IgnoreDirs)
+			if err != nil {
+				stage.fail(dir, err)
+				continue
+			}
+			stage.done++
+		}
+	}
+
+	if conf.Gdrive != nil {
+		stage := &backupStage{name: "upload files"}
+		stages = append(stages, stage)
+		fmt.Println("Uploading files not in iso to google drive")
+		done, failed, err := uploadFilesToDrive(conf.Gdrive.Cred, conf.Gdrive.Token, conf.Gdrive.Folder, masterKey,
+			conf.Gdrive.codec, true)
+		stage.done = done
+		if err != nil {
+			stage.fail("google drive", err)
+		}
+		if failed > 0 {
+			stage.failed += failed
+			stage.errs = append(stage.errs, fmt.Sprintf("%d files failed, see warnings above", failed))
+		}
+	}
+
+	var created []string
+	if conf.ISO != nil {
+		stage := &backupStage{name: "iso create"}
+		stages = append(stages, stage)
+		fmt.Println("Creating isos")
+		isoStoreDir = conf.ISO.StoreDir
+		if isoStoreDir != "" {
+			err = os.MkdirAll(isoStoreDir, 0755)
+		}
+		if err == nil {
+			// isos created before failure are still uploaded
+			// iso of the same days as one created before is named with suffix instead of failing the run
+			created, err = createISOs(conf.ISO.size, "", true, false)
+		}
+		stage.done = len(created)
+		if err != nil {
+			stage.fail("iso", err)
+		}
+	}
+
+	if conf.Upload != nil {
+		stage := &backupStage{name: "iso upload"}
+		stages = append(stages, stage)
+		fmt.Println("Uploading isos not uploaded")
+		uploadBackupISOs(ctx, conf.Upload, masterKey, stage)
+	}
+
+	return printBackupSummary(stages, created)
+}
+
+// uploadBackupISOs uploads all isos not uploaded yet, including the ones created or failed in previous runs.
+// Isos still not uploaded afterwards are counted as failed, so that backup exits with error until they are
+func uploadBackupISOs(ctx *cli.Context, u *backupUploadConfig, masterKey string, stage *backupStage) {
+	failed := map[string]bool{}
+	failPending := func(err error) {
+		isos, lerr := listPendingISOs()
+		if lerr != nil {
+			stage.fail("iso", lerr)
+			return
+		}
+		for _, iso := range isos {
+			if !failed[iso.Name] {
+				stage.fail(iso.Name, err)
+			}
+		}
+	}
+
+	err := u.connect(ctx.String("awsAccessKeyID"), ctx.String("awsSecretAccessKey"))
+	if err != nil {
+		failPending(err)
+		return
+	}
+	retention, err := newRetention(u.LockMode, u.LockDays)
+	if err != nil {
+		failPending(err)
+		return
+	}
+	if u.NoEncrypt {
+		masterKey = ""
+	}
+	err = uploadPendingISOs(0, func(isoFilename string) (bool, error) {
+		state := &isoUploadState{storageClass: u.StorageClass}
+		err := uploadISO(u.cli, u.location, u.Bucket, u.StorageClass, retention, isoFilename, masterKey,
+			u.partSize, u.NThreads, u.codec, u.parityOpts, false, false, state)
+		if err != nil {
+			failed[isoFilename] = true
+			stage.fail(isoFilename, err)
+			return state.inBucket, err
+		}
+		stage.done++
+		return state.inBucket, nil
+	})
+	if err != nil && len(failed) == 0 {
+		stage.fail("iso", err)
+		return
+	}
+	failPending(errors.New("not uploaded, as not found locally"))
+}
+
+// printBackupSummary prints result of each stage and isos created, and returns error if anything failed
+func printBackupSummary(stages []*backupStage, created []string) error {
+	fmt.Println("\nBackup summary:")
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 4, ' ', tabwriter.TabIndent)
+	fmt.Fprint(writer, "Stage\tDone\tFailed\n")
+	failed := 0
+	for _, s := range stages {
+		fmt.Fprintf(writer, "%s\t%d\t%d\n", s.name, s.done, s.failed)
+		failed += s.failed
+	}
+	writer.Flush()
+
+	for _, iso := range created {
+		fmt.Printf("Created iso: %s\n", iso)
+	}
+	if failed == 0 {
+		return nil
+	}
+	fmt.Println("Failures:")
+	for _, s := range stages {
+		for _, e := range s.errs {
+			fmt.Printf("  %s: %s\n", s.name, e)
+		}
+	}
+	return errors.Errorf("backup is incomplete, %d items failed", failed)
+}
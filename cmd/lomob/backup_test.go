@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lomorage/lomo-backup/common/datasize"
+	"github.com/lomorage/lomo-backup/common/types"
+	"github.com/stretchr/testify/require"
+)
+
+func writeBackupConfig(t *testing.T, scanDirs []string, storeDir, remoteDir string) string {
+	conf := map[string]interface{}{
+		"scan":   map[string]interface{}{"dirs": scanDirs},
+		"iso":    map[string]interface{}{"size": "300000", "store_dir": storeDir},
+		"upload": map[string]interface{}{"local_dir": remoteDir, "part_size": "5242880", "nthreads": 1},
+	}
+	content, err := json.Marshal(conf)
+	require.Nil(t, err)
+	filename := filepath.Join(t.TempDir(), "backup.json")
+	require.Nil(t, os.WriteFile(filename, content, 0600))
+	return filename
+}
+
+// requireUploadedISOs checks isos in DB are the given ones in order, and all of them are uploaded
+func requireUploadedISOs(t *testing.T, remoteDir string, names ...string) {
+	isos, err := db.ListISOs()
+	require.Nil(t, err)
+	require.Len(t, isos, len(names))
+	for i, iso := range isos {
+		require.Equal(t, names[i], iso.Name)
+		require.Equal(t, types.IsoUploaded, iso.Status, iso.Name)
+		require.Equal(t, "file://"+remoteDir, iso.Region, iso.Name)
+		_, err = os.Stat(filepath.Join(remoteDir, defaultBucket, iso.Name))
+		require.Nil(t, err, iso.Name)
+	}
+}
+
+func TestBackupStages(t *testing.T) {
+	dbFilename := newTestDB(t)
+	dir := shortTempDir(t)
+	storeDir := isoStoreDir
+	remoteDir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "a.jpg"), 400000, 1)
+
+	// failed scan of one dir doesn't stop the other stages, while backup still fails
+	conf := writeBackupConfig(t, []string{dir, filepath.Join(dir, "missing")}, storeDir, remoteDir)
+	err := runApp(t, dbFilename, "backup", "--config", conf, "-k", testMasterKey)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "1 items failed")
+	requireUploadedISOs(t, remoteDir, "2024-04-01--2024-04-01.iso")
+	files, err := db.ListFilesNotInISOOrCloud()
+	require.Nil(t, err)
+	require.Empty(t, files)
+
+	// new file of the same day is scanned in next run, and packed into iso with suffix
+	writeTestFile(t, filepath.Join(dir, "b.jpg"), 400000, 1)
+	conf = writeBackupConfig(t, []string{dir}, storeDir, remoteDir)
+	require.Nil(t, runApp(t, dbFilename, "backup", "--config", conf, "-k", testMasterKey))
+	requireUploadedISOs(t, remoteDir, "2024-04-01--2024-04-01.iso", "2024-04-01--2024-04-01-2.iso")
+
+	// nothing new, and no iso is created or uploaded
+	require.Nil(t, runApp(t, dbFilename, "backup", "--config", conf, "-k", testMasterKey))
+	requireUploadedISOs(t, remoteDir, "2024-04-01--2024-04-01.iso", "2024-04-01--2024-04-01-2.iso")
+}
+
+func TestBackupUploadsPendingISOs(t *testing.T) {
+	dbFilename := newTestDB(t)
+	dir := shortTempDir(t)
+	storeDir := isoStoreDir
+	remoteDir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "a.jpg"), 400000, 1)
+	writeTestFile(t, filepath.Join(dir, "b.jpg"), 400000, 2)
+	scanTestDir(t, dir)
+	require.Nil(t, runApp(t, dbFilename, "iso", "create", "-s", "300000", "-p", storeDir))
+	isos, err := db.ListISOs()
+	require.Nil(t, err)
+	require.Len(t, isos, 2)
+
+	// iso not found locally is left pending, and fails backup even if nothing new is created
+	missing := filepath.Join(storeDir, isos[1].Name)
+	require.Nil(t, os.Rename(missing, missing+".bak"))
+	conf := writeBackupConfig(t, []string{dir}, storeDir, remoteDir)
+	err = runApp(t, dbFilename, "backup", "--config", conf, "-k", testMasterKey)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "1 items failed")
+	isos, err = db.ListISOs()
+	require.Nil(t, err)
+	require.Equal(t, types.IsoUploaded, isos[0].Status)
+	require.Equal(t, types.IsoCreated, isos[1].Status)
+
+	// iso created in previous run is uploaded once it is back
+	require.Nil(t, os.Rename(missing+".bak", missing))
+	require.Nil(t, runApp(t, dbFilename, "backup", "--config", conf, "-k", testMasterKey))
+	requireUploadedISOs(t, remoteDir, isos[0].Name, isos[1].Name)
+}
+
+func TestIsoCreateKeepsName(t *testing.T) {
+	dbFilename := newTestDB(t)
+	dir := shortTempDir(t)
+	writeTestFile(t, filepath.Join(dir, "a.jpg"), 400000, 1)
+	scanTestDir(t, dir)
+	require.Nil(t, runApp(t, dbFilename, "iso", "create", "-s", "300000", "-p", isoStoreDir))
+
+	// iso create doesn't add suffix to iso of the same days, which fails as before
+	writeTestFile(t, filepath.Join(dir, "b.jpg"), 400000, 1)
+	scanTestDir(t, dir)
+	require.NotNil(t, runApp(t, dbFilename, "iso", "create", "-s", "300000", "-p", isoStoreDir))
+	isos, err := db.ListISOs()
+	require.Nil(t, err)
+	require.Len(t, isos, 1)
+	require.Equal(t, "2024-04-01--2024-04-01.iso", isos[0].Name)
+}
+
+func TestCreateISOsNoneCreated(t *testing.T) {
+	newTestDB(t)
+	dir := shortTempDir(t)
+	writeTestFile(t, filepath.Join(dir, "a.jpg"), 400000, 1)
+	writeTestFile(t, filepath.Join(dir, "b.jpg"), 400000, 2)
+	scanTestDir(t, dir)
+
+	// files in DB are more than iso size, while the ones still existing are less
+	require.Nil(t, os.Remove(filepath.Join(dir, "b.jpg")))
+	created, err := createISOs(datasize.ByteSize(600000), "", true, false)
+	require.Nil(t, err)
+	require.Empty(t, created)
+	isos, err := db.ListISOs()
+	require.Nil(t, err)
+	require.Empty(t, isos)
+}
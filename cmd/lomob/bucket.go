@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/lomorage/lomo-backup/clients"
+	"github.com/urfave/cli"
+)
+
+func initBucket(ctx *cli.Context) error {
+	opts := &clients.BucketOptions{
+		BlockPublicAccess:    ctx.BoolT("block-public-access"),
+		Versioning:           ctx.BoolT("versioning"),
+		ObjectLock:           ctx.Bool("object-lock"),
+		AbortIncompleteDays:  ctx.Int64("abort-incomplete-days"),
+		TransitionDays:       ctx.Int64("transition-days"),
+		TransitionClass:      ctx.String("transition-class"),
+		NoncurrentExpireDays: ctx.Int64("noncurrent-expire-days"),
+	}
+	if opts.AbortIncompleteDays < 0 || opts.TransitionDays < 0 || opts.NoncurrentExpireDays < 0 {
+		return fmt.Errorf("days of lifecycle rules should not be negative")
+	}
+	if opts.ObjectLock && !opts.Versioning {
+		return fmt.Errorf("object lock requires versioning")
+	}
+	switch opts.TransitionClass {
+	case "DEEP_ARCHIVE", "GLACIER", "GLACIER_IR", "INTELLIGENT_TIERING", "ONEZONE_IA", "STANDARD_IA":
+	default:
+		return fmt.Errorf("invalid transition class: %s", opts.TransitionClass)
+	}
+
+	cli, err := newAWSClient(ctx.String("awsAccessKeyID"), ctx.String("awsSecretAccessKey"),
+		ctx.String("awsBucketRegion"))
+	if err != nil {
+		return err
+	}
+	bucket := ctx.String("awsBucketName")
+	err = cli.InitBucket(bucket, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Bucket %s in %s is ready\n", bucket, cli.Region())
+	return nil
+}
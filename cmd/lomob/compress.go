@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/lomorage/lomo-backup/common/compress"
+	"github.com/lomorage/lomo-backup/common/datasize"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// skip compression for ISO if bytes not in compressed formats are less than this ratio
+const minCompressibleRatio = 0.1
+
+func getCompressCodec(ctx *cli.Context) (compress.Codec, error) {
+	return compress.ParseCodec(ctx.String("compress"))
+}
+
+type compressStats struct {
+	files      int
+	origSize   int64
+	compressed int64
+}
+
+func (cs *compressStats) add(origSize, compressed int64) {
+	cs.files++
+	cs.origSize += origSize
+	cs.compressed += compressed
+}
+
+func (cs *compressStats) print() {
+	if cs.files == 0 {
+		return
+	}
+	fmt.Printf("Compressed %d files from %s to %s, saved %s (%.1f%%)\n", cs.files,
+		datasize.ByteSize(cs.origSize).HR(), datasize.ByteSize(cs.compressed).HR(),
+		datasize.ByteSize(cs.origSize-cs.compressed).HR(), savingPercent(cs.origSize, cs.compressed))
+}
+
+func savingPercent(origSize, compressed int64) float64 {
+	if origSize == 0 {
+		return 0
+	}
+	return float64(origSize-compressed) * 100 / float64(origSize)
+}
+
+// compressToTempFile compresses src into one temp file with codec header, and return the temp file
+// which is at the beginning for read. Caller need close and remove it
+func compressToTempFile(src io.Reader, codec compress.Codec) (*os.File, int64, int64, error) {
+	tmpFile, err := os.CreateTemp("", "compress")
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	origSize, compressed, err := compress.Compress(tmpFile, src, codec)
+	if err == nil {
+		_, err = tmpFile.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return nil, 0, 0, err
+	}
+	return tmpFile, origSize, compressed, nil
+}
+
+// compressISO compresses iso file into <iso filename>.<codec ext> next to the iso file, and reuse it
+// if it exists already. Compression output is deterministic, thus one interrupted upload can be resumed
+func compressISO(isoFilename string, codec compress.Codec) (string, error) {
+	dstFilename := isoFilename + codec.Ext()
+	_, err := os.Stat(dstFilename)
+	if err == nil {
+		logrus.Infof("Reuse compressed %s", dstFilename)
+		return dstFilename, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	src, err := os.Open(isoFilename)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	// write into tmp file firstly so that one partial file won't be reused
+	tmpFilename := dstFilename + ".tmp"
+	dst, err := os.Create(tmpFilename)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpFilename)
+
+	fmt.Printf("Compressing %s with %s\n", isoFilename, codec)
+	origSize, compressed, err := compress.Compress(dst, src, codec)
+	if err != nil {
+		dst.Close()
+		return "", err
+	}
+	err = dst.Close()
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Printf("Compressed %s from %s to %s, saved %s (%.1f%%)\n", isoFilename,
+		datasize.ByteSize(origSize).HR(), datasize.ByteSize(compressed).HR(),
+		datasize.ByteSize(origSize-compressed).HR(), savingPercent(origSize, compressed))
+
+	return dstFilename, os.Rename(tmpFilename, dstFilename)
+}
+
+// chooseISOCodec skips compression if most of files in the iso are compressed media formats already
+func chooseISOCodec(isoID int, isoFilename string, codec compress.Codec) (compress.Codec, error) {
+	if codec == compress.CodecNone {
+		return codec, nil
+	}
+	extSizes, err := db.ListFileExtSizesInIso(isoID)
+	if err != nil {
+		return codec, err
+	}
+	ratio := compress.CompressibleRatio(extSizes)
+	if ratio < minCompressibleRatio {
+		fmt.Printf("Skip compressing %s as only %.1f%% of its content is compressible\n",
+			isoFilename, ratio*100)
+		return compress.CodecNone, nil
+	}
+	return codec, nil
+}
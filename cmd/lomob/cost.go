@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/lomorage/lomo-backup/common/cost"
+	"github.com/lomorage/lomo-backup/common/datasize"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// candidates of recommendation. Part sizes must be divided by salt length
+var (
+	costISOSizes = []datasize.ByteSize{1 * datasize.GB, 2 * datasize.GB, 5 * datasize.GB, 10 * datasize.GB,
+		20 * datasize.GB, 50 * datasize.GB, 100 * datasize.GB}
+	costPartSizes = []datasize.ByteSize{8 * datasize.MB, 16 * datasize.MB, 32 * datasize.MB, 64 * datasize.MB,
+		100 * datasize.MB, 128 * datasize.MB, 256 * datasize.MB, 512 * datasize.MB, 1 * datasize.GB,
+		2 * datasize.GB, 5 * datasize.GB}
+)
+
+func usd(v float64) string {
+	return fmt.Sprintf("$%.4f", v)
+}
+
+func estimateCost(ctx *cli.Context) error {
+	pricing, err := cost.Load(ctx.String("pricing"))
+	if err != nil {
+		return err
+	}
+	class := ctx.String("storage-class")
+	if _, ok := pricing.Classes[class]; !ok {
+		return errors.Errorf("no price of storage class %s", class)
+	}
+	isoSize, err := datasize.ParseString(ctx.String("iso-size"))
+	if err != nil {
+		return err
+	}
+	if isoSize == 0 {
+		return errors.New("iso size must be larger than 0")
+	}
+	partSize, err := getPartSize(ctx)
+	if err != nil {
+		return err
+	}
+	maxPartSize, err := datasize.ParseString(ctx.String("max-part-size"))
+	if err != nil {
+		return err
+	}
+	plan := cost.Plan{
+		Months:           ctx.Int("months"),
+		VerifiesPerMonth: ctx.Int("verifies"),
+		FullRestores:     ctx.Int("full-restores"),
+		FileRestores:     ctx.Int("file-restores"),
+		ChunkSize:        int64(partSize),
+	}
+	if plan.Months <= 0 || plan.VerifiesPerMonth < 0 || plan.FullRestores < 0 || plan.FileRestores < 0 {
+		return errors.New("months must be larger than 0, and number of verifications and restores can't be negative")
+	}
+
+	err = initDB(ctx.GlobalString("db"))
+	if err != nil {
+		return err
+	}
+	totalSize, totalCount, err := db.GetTotalFiles()
+	if err != nil {
+		return err
+	}
+	pending, err := db.TotalFileSizeNotInISO()
+	if err != nil {
+		return err
+	}
+	isos, err := db.ListISOs()
+	if err != nil {
+		return err
+	}
+	var avgFileSize int64
+	if totalCount > 0 {
+		avgFileSize = int64(totalSize / totalCount)
+	}
+
+	// existing isos are uploaded with their own parts, and files not packed yet will be in isos of iso size
+	archive := cost.Layout{ISOSize: int64(isoSize), PartSize: int64(partSize)}.Split(int64(pending), avgFileSize)
+	var isosSize int64
+	for _, iso := range isos {
+		parts, err := db.GetPartsByIsoID(iso.ID)
+		if err != nil {
+			return err
+		}
+		n := len(parts)
+		if n == 0 {
+			n = (iso.Size + partSize - 1) / partSize
+		}
+		archive.Objects++
+		archive.Parts += n
+		archive.Bytes += int64(iso.Size)
+		isosSize += int64(iso.Size)
+	}
+
+	fmt.Printf("Catalog: %d files (%s), %d isos (%s), %s not packed in iso yet\n", totalCount,
+		datasize.ByteSize(totalSize).HR(), len(isos), datasize.ByteSize(isosSize).HR(),
+		datasize.ByteSize(pending).HR())
+	fmt.Printf("Cost in USD of %d objects (%s, %d parts) over %d months, with %d verifications per month, "+
+		"%d full restores and %d file restores\n\n", archive.Objects, datasize.ByteSize(archive.Bytes).HR(),
+		archive.Parts, plan.Months, plan.VerifiesPerMonth, plan.FullRestores, plan.FileRestores)
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 4, ' ', tabwriter.TabIndent)
+	fmt.Fprint(writer, "Storage Class\tStorage/Month\tUpload\tVerify/Month\tFull Restore\tFile Restore\tTotal\n")
+	for _, name := range pricing.ClassNames() {
+		e, err := pricing.Estimate(name, archive, plan)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", name, usd(e.StorageMonth), usd(e.Upload),
+			usd(e.VerifyMonth), usd(e.FullRestore), usd(e.FileRestore), usd(e.Total))
+	}
+	writer.Flush()
+
+	if totalSize == 0 {
+		fmt.Println("\nNo file is scanned yet, and no iso size or part size is recommended")
+		return nil
+	}
+	var isoSizes, partSizes []int64
+	for _, s := range costISOSizes {
+		isoSizes = append(isoSizes, int64(s))
+	}
+	for _, s := range costPartSizes {
+		if s <= maxPartSize {
+			partSizes = append(partSizes, int64(s))
+		}
+	}
+	current, err := pricing.Estimate(class, cost.Layout{ISOSize: int64(isoSize), PartSize: int64(partSize)}.
+		Split(int64(totalSize), avgFileSize), plan)
+	if err != nil {
+		return err
+	}
+	best, e, err := pricing.Optimize(class, int64(totalSize), avgFileSize, plan, isoSizes, partSizes)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\nRecommended for %s: iso size %s, part size %s, total %s over %d months, "+
+		"while iso size %s and part size %s cost %s\n", class, datasize.ByteSize(best.ISOSize).HR(),
+		datasize.ByteSize(best.PartSize).HR(), usd(e.Total), plan.Months, isoSize.HR(),
+		datasize.ByteSize(partSize).HR(), usd(current.Total))
+	return nil
+}
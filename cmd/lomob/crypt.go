@@ -11,10 +11,12 @@ import (
 	"strconv"
 	"syscall"
 
+	"github.com/lomorage/lomo-backup/common/compress"
 	"github.com/lomorage/lomo-backup/common/crypto"
 	"github.com/lomorage/lomo-backup/common/datasize"
 	lomohash "github.com/lomorage/lomo-backup/common/hash"
 	lomoio "github.com/lomorage/lomo-backup/common/io"
+	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 	"golang.org/x/term"
 )
@@ -77,6 +79,14 @@ func encryptCmd(ctx *cli.Context) error {
 		}
 	}
 
+	codec, err := getCompressCodec(ctx)
+	if err != nil {
+		return err
+	}
+	if compress.IsCompressedFile(ifilename) {
+		codec = compress.CodecNone
+	}
+
 	salt, err := genSalt(ifilename)
 	if err != nil {
 		return err
@@ -98,7 +108,7 @@ func encryptCmd(ctx *cli.Context) error {
 
 	ps := ctx.String("part-size")
 	if ps == "" {
-		_, err = encryptLocalFile(src, dst, []byte(masterKey), salt, true)
+		_, err = encryptLocalFile(src, dst, []byte(masterKey), salt, codec, true)
 		if err != nil {
 			return err
 		}
@@ -108,6 +118,19 @@ func encryptCmd(ctx *cli.Context) error {
 		return nil
 	}
 
+	if codec != compress.CodecNone {
+		tmpFile, origSize, compressed, err := compressToTempFile(src, codec)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmpFile.Name())
+		defer tmpFile.Close()
+
+		fmt.Printf("Compressed '%s' with %s, saved %.1f%%\n", ifilename, codec,
+			savingPercent(origSize, compressed))
+		src = tmpFile
+	}
+
 	// Derive key from passphrase using Argon2
 	// TODO: Using IV as salt for simplicity, change to different salt?
 	encryptKey := crypto.DeriveKeyFromMasterKey([]byte(masterKey), salt)
@@ -192,7 +215,23 @@ func encryptCmd(ctx *cli.Context) error {
 	return nil
 }
 
-func encryptLocalFile(src io.ReadSeeker, dst io.Writer, masterKey, iv []byte, hasHeader bool) ([]byte, error) {
+// encryptLocalFile compresses src with given codec if it is not none, then encrypts it into dst
+func encryptLocalFile(src io.ReadSeeker, dst io.Writer, masterKey, iv []byte, codec compress.Codec,
+	hasHeader bool) ([]byte, error) {
+	if codec != compress.CodecNone {
+		tmpFile, origSize, compressed, err := compressToTempFile(src, codec)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(tmpFile.Name())
+		defer tmpFile.Close()
+
+		logrus.Infof("Compressed with %s from %s to %s, saved %.1f%%", codec,
+			datasize.ByteSize(origSize).HR(), datasize.ByteSize(compressed).HR(),
+			savingPercent(origSize, compressed))
+		src = tmpFile
+	}
+
 	// Derive key from passphrase using Argon2
 	// TODO: Using IV as salt for simplicity, change to different salt?
 	encryptKey := crypto.DeriveKeyFromMasterKey(masterKey, iv)
@@ -213,6 +252,12 @@ func decryptLocalFile(ctx *cli.Context) error {
 		return errors.New("usage: [encrypted file name]")
 	}
 
+	// local file has no metadata to record its codec, so it is given the same as encryption
+	codec, err := getCompressCodec(ctx)
+	if err != nil {
+		return err
+	}
+
 	src, err := os.Open(ctx.Args()[0])
 	if err != nil {
 		return err
@@ -246,7 +291,9 @@ func decryptLocalFile(ctx *cli.Context) error {
 
 	encryptKey := crypto.DeriveKeyFromMasterKey([]byte(masterKey), iv)
 
-	decryptor, err := crypto.NewDecryptor(dst, encryptKey, iv)
+	// decompress on the fly if the content is compressed before encryption
+	dw := compress.NewDecompressWriter(dst, codec)
+	decryptor, err := crypto.NewDecryptor(dw, encryptKey, iv)
 	if err != nil {
 		return err
 	}
@@ -255,6 +302,10 @@ func decryptLocalFile(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	err = dw.Close()
+	if err != nil {
+		return err
+	}
 
 	fmt.Println("Finish decryption!")
 	return nil
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lomorage/lomo-backup/clients"
+	"github.com/lomorage/lomo-backup/common/cost"
+	"github.com/lomorage/lomo-backup/common/types"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// classCopy is one iso uploaded into the bucket whose storage class is going to be changed
+type classCopy struct {
+	iso  *types.ISOInfo
+	copy *types.ArchiveCopy
+}
+
+// since returns when the copy is put into its current storage class
+func (c *classCopy) since() time.Time {
+	if c.iso.Region == c.copy.Region && c.iso.Bucket == c.copy.Bucket && !c.iso.ClassTime.IsZero() {
+		return c.iso.ClassTime
+	}
+	return c.copy.CreateTime
+}
+
+// listClassCopies returns isos uploaded into bucket, either given by names, or all created before olderThan
+func listClassCopies(region, bucket string, names []string, olderThan time.Time) ([]*classCopy, error) {
+	isos, err := db.ListISOs()
+	if err != nil {
+		return nil, err
+	}
+	copies, err := db.ListArchiveCopies()
+	if err != nil {
+		return nil, err
+	}
+	isoByID := map[int]*types.ISOInfo{}
+	for _, iso := range isos {
+		isoByID[iso.ID] = iso
+	}
+	copyByName := map[string]*classCopy{}
+	var all []*classCopy
+	for _, c := range copies {
+		iso, ok := isoByID[c.IsoID]
+		if !ok || c.Status != types.CopyUploaded || c.Region != region || c.Bucket != bucket {
+			continue
+		}
+		cc := &classCopy{iso: iso, copy: c}
+		copyByName[filepath.Base(iso.Name)] = cc
+		if iso.CreateTime.Before(olderThan) {
+			all = append(all, cc)
+		}
+	}
+	if len(names) == 0 {
+		return all, nil
+	}
+
+	selected := make([]*classCopy, 0, len(names))
+	for _, name := range names {
+		cc, ok := copyByName[filepath.Base(name)]
+		if !ok {
+			return nil, errors.Errorf("%s is not uploaded to region %s, bucket %s", name, region, bucket)
+		}
+		selected = append(selected, cc)
+	}
+	return selected, nil
+}
+
+// recordStorageClass saves storage class of copy, and of iso if the copy is the one uploaded by upload iso
+func recordStorageClass(c *classCopy, storageClass string) error {
+	c.copy.StorageClass = storageClass
+	err := db.UpdateArchiveCopyStorageClass(c.copy)
+	if err != nil {
+		return err
+	}
+	if c.iso.Region != c.copy.Region || c.iso.Bucket != c.copy.Bucket {
+		return nil
+	}
+	return db.UpdateIsoStorageClass(c.iso.ID, storageClass, time.Now())
+}
+
+// setStorageClass changes storage class of one copy, and returns what is done
+func setStorageClass(cli clients.Backend, c *classCopy, storageClass string, dryRun bool) (string, string, error) {
+	key := filepath.Base(c.iso.Name)
+	status, err := cli.GetArchiveStatus(c.copy.Bucket, key)
+	if err != nil {
+		return "", "", err
+	}
+	if status == nil {
+		return "", "", errors.Errorf("not found in bucket %s", c.copy.Bucket)
+	}
+	from := status.StorageClass
+	if from == storageClass {
+		if dryRun || (c.copy.StorageClass == storageClass && c.iso.StorageClass == storageClass) {
+			return from, "already in " + storageClass, nil
+		}
+		return from, "already in " + storageClass + ", recorded in DB", recordStorageClass(c, storageClass)
+	}
+	if !status.Readable() {
+		return from, "", errors.Errorf("archived in %s, restore it with 'lomob restore request' firstly", from)
+	}
+
+	action := "changed"
+	if dryRun {
+		action = "to be changed"
+	}
+	// objects moved out before min storage duration are charged for the remaining days
+	if price, ok := cost.Default().Classes[from]; ok && price.MinDays > 0 {
+		days := int(time.Since(c.since()).Hours() / 24)
+		if days < price.MinDays {
+			action += fmt.Sprintf(", charged for %d remaining days of min storage duration of %s",
+				price.MinDays-days, from)
+		}
+	}
+	if dryRun {
+		return from, action, nil
+	}
+	err = cli.SetStorageClass(c.copy.Bucket, key, storageClass)
+	if err != nil {
+		return from, "", err
+	}
+	return from, action, recordStorageClass(c, storageClass)
+}
+
+func setISOStorageClass(ctx *cli.Context) error {
+	err := initLogLevel(ctx.GlobalInt("log-level"))
+	if err != nil {
+		return err
+	}
+
+	if ctx.String("storage-class") == "" {
+		return errors.New("please provide storage class to change to with --storage-class")
+	}
+	storageClass, err := checkStorageClass(ctx.String("storage-class"))
+	if err != nil {
+		return err
+	}
+	names := ctx.Args()
+	all := ctx.Bool("all")
+	if len(names) == 0 && !all {
+		return errors.New("please provide iso names, or use --all to change all isos uploaded")
+	}
+	if len(names) != 0 && all {
+		return errors.New("iso names and --all can't be used together")
+	}
+	olderThan := time.Now()
+	if days := ctx.Int("older-than-days"); days < 0 {
+		return errors.Errorf("invalid number of days: %d", days)
+	} else if days > 0 {
+		if !all {
+			return errors.New("--older-than-days can only be used with --all")
+		}
+		olderThan = olderThan.AddDate(0, 0, -days)
+	}
+	dryRun := ctx.Bool("dry-run")
+
+	err = initDB(ctx.GlobalString("db"))
+	if err != nil {
+		return err
+	}
+
+	bucket := ctx.String("awsBucketName")
+	cli, region, err := newBackend(ctx)
+	if err != nil {
+		return err
+	}
+
+	copies, err := listClassCopies(region, bucket, names, olderThan)
+	if err != nil {
+		return err
+	}
+	if len(copies) == 0 {
+		fmt.Printf("No iso uploaded to region %s, bucket %s is selected\n", region, bucket)
+		return nil
+	}
+
+	if dryRun {
+		fmt.Println("Dry run, neither bucket nor DB is changed")
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 4, ' ', tabwriter.TabIndent)
+	fmt.Fprint(writer, "Name\tFrom\tTo\tAction\n")
+	changed, failed := 0, 0
+	for _, c := range copies {
+		from, action, err := setStorageClass(cli, c, storageClass, dryRun)
+		if err != nil {
+			action = "failed: " + err.Error()
+			failed++
+		} else if from != storageClass {
+			changed++
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", c.iso.Name, from, storageClass, action)
+	}
+	writer.Flush()
+
+	if changed != 0 && !dryRun {
+		fmt.Println("\nIf versioning is enabled in bucket, previous versions are kept and billed in their storage " +
+			"classes until they are deleted by the lifecycle rule of `lomob bucket init --noncurrent-expire-days`, " +
+			"and locked ones are only deleted after their locks expire")
+	}
+	if failed != 0 {
+		return errors.Errorf("failed to change storage class of %d isos", failed)
+	}
+	return nil
+}
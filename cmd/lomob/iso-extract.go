@@ -0,0 +1,443 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/diskfs/go-diskfs/filesystem/iso9660"
+	"github.com/lomorage/lomo-backup/common"
+	"github.com/lomorage/lomo-backup/common/compress"
+	"github.com/lomorage/lomo-backup/common/crypto"
+	"github.com/lomorage/lomo-backup/common/dbx"
+	lomohash "github.com/lomorage/lomo-backup/common/hash"
+	"github.com/lomorage/lomo-backup/common/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	isoBlockSize = 2048
+	// primary volume descriptor starts at block 16, and "CD001" follows 1 byte type
+	isoIdentifierOffset = 16*isoBlockSize + 1
+	isoIdentifier       = "CD001"
+)
+
+var errReadOnlyImage = errors.New("iso image is read only")
+
+// isoImage is one read only iso image which is plain, encrypted, or compressed
+type isoImage struct {
+	io.ReaderAt
+	size   int64
+	offset int64
+	// closes source of image, nil if there is nothing to close
+	closer io.Closer
+	// decompressed image
+	tmpFile *os.File
+}
+
+func (img *isoImage) WriteAt(p []byte, off int64) (int, error) {
+	return 0, errReadOnlyImage
+}
+
+func (img *isoImage) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += img.offset
+	case io.SeekEnd:
+		offset += img.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	img.offset = offset
+	return offset, nil
+}
+
+func (img *isoImage) Close() {
+	if img.closer != nil {
+		img.closer.Close()
+	}
+	if img.tmpFile != nil {
+		img.tmpFile.Close()
+		os.Remove(img.tmpFile.Name())
+	}
+}
+
+func isISO9660(r io.ReaderAt) bool {
+	buf := make([]byte, len(isoIdentifier))
+	_, err := r.ReadAt(buf, isoIdentifierOffset)
+	return err == nil && string(buf) == isoIdentifier
+}
+
+// compressedCodec returns codec of compressed image. Image has no metadata, while it is only checked after
+// the one not being plain iso, so that its header can't be part of one plain iso
+func compressedCodec(r io.ReaderAt) (compress.Codec, bool) {
+	buf := make([]byte, compress.HeaderLen)
+	_, err := r.ReadAt(buf, 0)
+	if err != nil {
+		return compress.CodecNone, false
+	}
+	return compress.ParseHeader(buf)
+}
+
+// decompressToTempFile decompresses image into one temp file, as compressed stream is not seekable
+func decompressToTempFile(r io.Reader, codec compress.Codec) (*os.File, int64, error) {
+	dr, err := compress.NewReader(r, codec)
+	if err != nil {
+		return nil, 0, err
+	}
+	tmpFile, err := os.CreateTemp("", "lomob-iso")
+	if err != nil {
+		return nil, 0, err
+	}
+	fmt.Printf("Decompressing %s image into %s\n", codec, tmpFile.Name())
+	size, err := io.Copy(tmpFile, dr)
+	if err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return nil, 0, err
+	}
+	return tmpFile, size, nil
+}
+
+// openISOImage opens iso image file which is plain, compressed and/or encrypted with master key
+func openISOImage(filename, masterKey string) (*isoImage, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return newISOImage(filename, f, stat.Size(), f, masterKey)
+}
+
+// newISOImage opens iso image of given size read from r. The format is detected automatically, and master
+// key is asked only if the image is encrypted. Encrypted image is decrypted at the offset read, while
+// compressed image is decompressed into one temp file as it isn't seekable
+func newISOImage(name string, r io.ReaderAt, size int64, closer io.Closer, masterKey string) (*isoImage, error) {
+	img := &isoImage{ReaderAt: r, size: size, closer: closer}
+
+	if isISO9660(img) {
+		return img, nil
+	}
+
+	codec, compressed := compressedCodec(img)
+	var err error
+	if !compressed {
+		// encrypted image: salt followed by encrypted data
+		salt := make([]byte, crypto.SaltLen())
+		_, err = r.ReadAt(salt, 0)
+		if err != nil {
+			img.Close()
+			return nil, err
+		}
+		if masterKey == "" {
+			masterKey, err = getMasterKey()
+			if err != nil {
+				img.Close()
+				return nil, err
+			}
+		}
+		img.ReaderAt, err = crypto.NewDecryptReaderAt(r, crypto.DeriveKeyFromMasterKey([]byte(masterKey), salt),
+			salt, int64(len(salt)))
+		if err != nil {
+			img.Close()
+			return nil, err
+		}
+		img.size -= int64(len(salt))
+
+		if isISO9660(img) {
+			return img, nil
+		}
+		codec, compressed = compressedCodec(img)
+		if !compressed {
+			img.Close()
+			return nil, errors.Errorf("%s is not one iso image, or master key is wrong", name)
+		}
+	}
+
+	tmpFile, size, err := decompressToTempFile(io.NewSectionReader(img, 0, img.size), codec)
+	if err != nil {
+		img.Close()
+		return nil, err
+	}
+	img.tmpFile = tmpFile
+	img.ReaderAt = tmpFile
+	img.size = size
+	if !isISO9660(img) {
+		img.Close()
+		return nil, errors.Errorf("%s is not one iso image", name)
+	}
+	return img, nil
+}
+
+// findIsoInDB looks up iso by its name, and then by its base name with extensions like .enc or .xz trimmed,
+// so that one downloaded or moved image is able to be verified
+func findIsoInDB(roDB *dbx.DB, isoFilename string) (*types.ISOInfo, error) {
+	isos, err := roDB.ListISOs()
+	if err != nil {
+		return nil, err
+	}
+	for _, iso := range isos {
+		if iso.Name == isoFilename {
+			return iso, nil
+		}
+	}
+	name := filepath.Base(isoFilename)
+	for {
+		for _, iso := range isos {
+			if filepath.Base(iso.Name) == name {
+				return iso, nil
+			}
+		}
+		ext := filepath.Ext(name)
+		if ext == "" || ext == ".iso" {
+			return nil, nil
+		}
+		name = strings.TrimSuffix(name, ext)
+	}
+}
+
+// listIsoFilesInDB returns files in iso keyed by their path in iso
+func listIsoFilesInDB(dbname, isoFilename string) (map[string]*types.FileInfo, error) {
+	roDB, err := dbx.OpenDBReadOnly(dbname)
+	if err != nil {
+		return nil, err
+	}
+	iso, err := findIsoInDB(roDB, isoFilename)
+	if err != nil {
+		return nil, err
+	}
+	if iso == nil {
+		return nil, errors.Errorf("%s is not found in DB", isoFilename)
+	}
+	scanRootDirs, err := roDB.ListScanRootDirs()
+	if err != nil {
+		return nil, err
+	}
+	files, err := roDB.ListFilesInIso(iso.ID)
+	if err != nil {
+		return nil, err
+	}
+	isoFiles := make(map[string]*types.FileInfo, len(files))
+	for _, f := range files {
+		scanRootDir, ok := scanRootDirs[f.DirID]
+		if !ok {
+			continue
+		}
+		// same path as the one in staging directory when iso is created
+		p := path.Join("/", flattenScanRootDir(scanRootDir), filepath.ToSlash(f.Name))
+		isoFiles[p] = f
+	}
+	return isoFiles, nil
+}
+
+type isoExtractor struct {
+	fs       *iso9660.FileSystem
+	dstDir   string
+	isoFiles map[string]*types.FileInfo
+	// dst dir -> mod time in iso
+	dirs map[string]time.Time
+
+	extracted  int
+	verified   int
+	unknown    int
+	mismatched []string
+}
+
+func (e *isoExtractor) dstPath(p string) string {
+	return filepath.Join(e.dstDir, filepath.FromSlash(strings.TrimPrefix(p, "/")))
+}
+
+// extract extracts file or directory p in iso, whose info is fi. fi is nil for root directory
+func (e *isoExtractor) extract(p string, fi os.FileInfo) error {
+	if fi == nil || fi.IsDir() {
+		dst := e.dstPath(p)
+		err := os.MkdirAll(dst, 0755)
+		if err != nil {
+			return err
+		}
+		if fi != nil {
+			e.dirs[dst] = fi.ModTime()
+		}
+
+		entries, err := e.fs.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			err = e.extract(path.Join(p, entry.Name()), entry)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return e.extractFile(p, fi)
+}
+
+func (e *isoExtractor) extractFile(p string, fi os.FileInfo) error {
+	dst := e.dstPath(p)
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+
+	src, err := e.fs.OpenFile(p, os.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, h), src)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+	e.extracted++
+
+	mtime := fi.ModTime()
+	f, ok := e.isoFiles[p]
+	switch {
+	case e.isoFiles == nil:
+	case !ok:
+		e.unknown++
+		logrus.Warnf("%s is not found in DB, skip verification", p)
+	default:
+		hashHex := lomohash.CalculateHashHex(h.Sum(nil))
+		if hashHex != f.HashLocal {
+			e.mismatched = append(e.mismatched, p)
+			logrus.Warnf("%s's hash in DB is %s, but got %s", p, f.HashLocal, hashHex)
+		} else {
+			e.verified++
+		}
+		// time in DB is more precise than the one in iso
+		mtime = f.ModTime
+	}
+
+	err = common.SetTime(dst, mtime, mtime, true)
+	if err != nil {
+		logrus.Warnf("Restore file original timestamp %s: %s", dst, err)
+	}
+	fmt.Printf("%s -> %s\n", p, dst)
+	return nil
+}
+
+// restoreDirsTime changes extracted directories' time from the longest path to the shortest, so that
+// directory time isn't changed by extracting its children, which is same as common.KeepDirsTime
+func (e *isoExtractor) restoreDirsTime() {
+	names := make([]string, 0, len(e.dirs))
+	for dst := range e.dirs {
+		names = append(names, dst)
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		return cmp.Compare(strings.ToLower(b), strings.ToLower(a))
+	})
+	for _, dst := range names {
+		err := common.SetTime(dst, e.dirs[dst], e.dirs[dst], true)
+		if err != nil {
+			logrus.Warnf("Restore dir original timestamp %s: %s", dst, err)
+		}
+	}
+}
+
+// statInIso returns file info of p in iso
+func statInIso(fs *iso9660.FileSystem, p string) (os.FileInfo, error) {
+	entries, err := fs.ReadDir(path.Dir(p))
+	if err != nil {
+		return nil, err
+	}
+	name := path.Base(p)
+	for _, entry := range entries {
+		if entry.Name() == name {
+			return entry, nil
+		}
+	}
+	return nil, errors.Errorf("%s is not found in iso", p)
+}
+
+func extractISO(ctx *cli.Context) error {
+	err := initLogLevel(ctx.GlobalInt("log-level"))
+	if err != nil {
+		return err
+	}
+
+	if len(ctx.Args()) < 2 {
+		return errors.New("please provide one iso filename and paths in iso to extract")
+	}
+	isoFilename := ctx.Args()[0]
+
+	img, err := openISOImage(isoFilename, ctx.String("encrypt-key"))
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	return extractFromImage(img, ctx.GlobalString("db"), isoFilename, ctx.String("to"), ctx.Args()[1:])
+}
+
+// extractFromImage extracts paths in iso image into dstDir, and verifies them with hashes in DB if the iso
+// is found in DB
+func extractFromImage(img *isoImage, dbname, isoFilename, dstDir string, paths []string) error {
+	fs, err := iso9660.Read(img, img.size, 0, isoBlockSize)
+	if err != nil {
+		return err
+	}
+
+	isoFiles, err := listIsoFilesInDB(dbname, isoFilename)
+	if err != nil {
+		logrus.Warnf("Extracted files are not verified: %s", err)
+		isoFiles = nil
+	}
+
+	e := &isoExtractor{fs: fs, dstDir: dstDir, isoFiles: isoFiles, dirs: map[string]time.Time{}}
+	for _, p := range paths {
+		p = path.Clean("/" + filepath.ToSlash(p))
+		var fi os.FileInfo
+		if p != "/" {
+			fi, err = statInIso(fs, p)
+			if err != nil {
+				return err
+			}
+		}
+		err = e.extract(p, fi)
+		if err != nil {
+			return err
+		}
+	}
+	e.restoreDirsTime()
+
+	fmt.Printf("Extracted %d files into %s", e.extracted, dstDir)
+	if isoFiles != nil {
+		fmt.Printf(", %d verified, %d not in DB, %d mismatched", e.verified, e.unknown, len(e.mismatched))
+	}
+	fmt.Println()
+	if len(e.mismatched) != 0 {
+		return errors.Errorf("%d files don't match hash in DB: %v", len(e.mismatched), e.mismatched)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/lomorage/lomo-backup/common/compress"
+	"github.com/lomorage/lomo-backup/common/datasize"
+	"github.com/stretchr/testify/require"
+)
+
+const testMasterKey = "test master key"
+
+// prepareExtractISO creates one iso of files in nested directories, and its encrypted image. It returns
+// DB filename, scan root dir, the plain iso and the encrypted one
+func prepareExtractISO(t *testing.T) (string, string, string, string) {
+	dbFilename := newTestDB(t)
+	dir := shortTempDir(t)
+	writeTestFile(t, filepath.Join(dir, "a.jpg"), 300000, 1)
+	writeTestFile(t, filepath.Join(dir, "sub", "b.jpg"), 200000, 2)
+	writeTestFile(t, filepath.Join(dir, "sub", "deep", "c.jpg"), 100000, 3)
+	scanTestDir(t, dir)
+
+	created, err := createISOs(datasize.ByteSize(600000), "", false, false)
+	require.Nil(t, err)
+	require.Len(t, created, 1)
+	isoFilename := localISOPath(created[0])
+
+	salt, err := genSalt(isoFilename)
+	require.Nil(t, err)
+	src, err := os.Open(isoFilename)
+	require.Nil(t, err)
+	defer src.Close()
+	encFilename := isoFilename + ".enc"
+	dst, err := os.Create(encFilename)
+	require.Nil(t, err)
+	defer dst.Close()
+	_, err = encryptLocalFile(src, dst, []byte(testMasterKey), salt, compress.CodecNone, true)
+	require.Nil(t, err)
+	return dbFilename, dir, isoFilename, encFilename
+}
+
+// listExtracted returns files extracted into dir relative to it
+func listExtracted(t *testing.T, dir string) []string {
+	var files []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		files = append(files, filepath.ToSlash(rel))
+		return err
+	})
+	require.Nil(t, err)
+	return files
+}
+
+func TestExtractSelectedPath(t *testing.T) {
+	dbFilename, dir, isoFilename, encFilename := prepareExtractISO(t)
+	root := flattenScanRootDir(dir)
+
+	for _, filename := range []string{isoFilename, encFilename} {
+		img, err := openISOImage(filename, testMasterKey)
+		require.Nil(t, err, filename)
+		dstDir := t.TempDir()
+		err = extractFromImage(img, dbFilename, filename, dstDir, []string{path.Join(root, "a.jpg")})
+		img.Close()
+		require.Nil(t, err, filename)
+		require.Equal(t, []string{root + "/a.jpg"}, listExtracted(t, dstDir), filename)
+
+		extracted, err := os.ReadFile(filepath.Join(dstDir, root, "a.jpg"))
+		require.Nil(t, err)
+		original, err := os.ReadFile(filepath.Join(dir, "a.jpg"))
+		require.Nil(t, err)
+		require.Equal(t, original, extracted, filename)
+	}
+}
+
+func TestExtractNestedDir(t *testing.T) {
+	dbFilename, dir, _, encFilename := prepareExtractISO(t)
+	root := flattenScanRootDir(dir)
+
+	img, err := openISOImage(encFilename, testMasterKey)
+	require.Nil(t, err)
+	defer img.Close()
+	dstDir := t.TempDir()
+	require.Nil(t, extractFromImage(img, dbFilename, encFilename, dstDir, []string{"/" + root + "/sub/"}))
+	require.Equal(t, []string{root + "/sub/b.jpg", root + "/sub/deep/c.jpg"}, listExtracted(t, dstDir))
+
+	// path not in iso
+	require.NotNil(t, extractFromImage(img, dbFilename, encFilename, t.TempDir(), []string{root + "/nope"}))
+}
+
+func TestExtractHashMismatch(t *testing.T) {
+	dbFilename, dir, isoFilename, encFilename := prepareExtractISO(t)
+	root := flattenScanRootDir(dir)
+
+	// flip one byte of b.jpg in the encrypted image, which is decrypted into one different byte
+	plain, err := os.ReadFile(isoFilename)
+	require.Nil(t, err)
+	original, err := os.ReadFile(filepath.Join(dir, "sub", "b.jpg"))
+	require.Nil(t, err)
+	off := bytes.Index(plain, original[:4096])
+	require.True(t, off > 0)
+	encrypted, err := os.ReadFile(encFilename)
+	require.Nil(t, err)
+	encrypted[len(encrypted)-len(plain)+off+100] ^= 0x01
+	require.Nil(t, os.WriteFile(encFilename, encrypted, 0644))
+
+	img, err := openISOImage(encFilename, testMasterKey)
+	require.Nil(t, err)
+	defer img.Close()
+	dstDir := t.TempDir()
+	err = extractFromImage(img, dbFilename, encFilename, dstDir, []string{root + "/sub"})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "/"+root+"/sub/b.jpg")
+	require.NotContains(t, err.Error(), "c.jpg")
+
+	// wrong master key
+	_, err = openISOImage(encFilename, "wrong key")
+	require.NotNil(t, err)
+}
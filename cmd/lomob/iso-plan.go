@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lomorage/lomo-backup/common"
+	"github.com/lomorage/lomo-backup/common/datasize"
+	"github.com/lomorage/lomo-backup/common/dbx"
+	"github.com/lomorage/lomo-backup/common/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+type isoPlan struct {
+	Name      string    `json:"name"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	FileCount int       `json:"file_count"`
+	Size      uint64    `json:"size"`
+	FillRatio float64   `json:"fill_ratio"`
+}
+
+type skippedFile struct {
+	ID     int    `json:"id"`
+	Path   string `json:"path"`
+	Size   int    `json:"size"`
+	Reason string `json:"reason"`
+}
+
+type isoCreatePlan struct {
+	ISOSize    uint64         `json:"iso_size"`
+	TotalFiles int            `json:"total_files"`
+	TotalSize  uint64         `json:"total_size"`
+	ISOs       []*isoPlan     `json:"isos"`
+	Skipped    []*skippedFile `json:"skipped"`
+	// files not enough to fill one more iso, which are left for next run
+	LeftFiles int    `json:"left_files"`
+	LeftSize  uint64 `json:"left_size"`
+}
+
+// planISOs walks through the same steps as mkISO, but only checks whether files exist instead of
+// copying them into staging directory, and never writes into DB
+func planISOs(ctx *cli.Context) error {
+	isoSize, err := datasize.ParseString(ctx.String("iso-size"))
+	if err != nil {
+		return err
+	}
+
+	roDB, err := dbx.OpenDBReadOnly(ctx.GlobalString("db"))
+	if err != nil {
+		return err
+	}
+
+	var isoFilename string
+	if len(ctx.Args()) > 0 {
+		isoFilename = ctx.Args()[0]
+	}
+	plan, err := newIsoCreatePlan(roDB, isoSize, isoFilename)
+	if err != nil {
+		return err
+	}
+
+	if ctx.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(plan)
+	}
+	printIsoCreatePlan(plan)
+	return nil
+}
+
+// newIsoCreatePlan returns isos createISOs would create from files in roDB
+func newIsoCreatePlan(roDB *dbx.DB, isoSize datasize.ByteSize, isoFilename string) (*isoCreatePlan, error) {
+	currentSizeNotInISO, err := roDB.TotalFileSizeNotInISO()
+	if err != nil {
+		return nil, err
+	}
+
+	scanRootDirs, err := roDB.ListScanRootDirs()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := roDB.ListFilesNotInISOOrCloud()
+	if err != nil {
+		return nil, err
+	}
+
+	if isoFilename != "" {
+		iso, err := roDB.GetIsoByName(isoFilename)
+		if err != nil {
+			return nil, err
+		}
+		if iso != nil {
+			return nil, errors.Errorf("%s was created at %s, and its size is %s", isoFilename,
+				iso.CreateTime.Truncate(time.Second).Local(),
+				datasize.ByteSize(iso.Size).HR())
+		}
+	}
+
+	plan := &isoCreatePlan{
+		ISOSize:    isoSize.Bytes(),
+		TotalFiles: len(files),
+		TotalSize:  currentSizeNotInISO,
+	}
+	for len(files) > 0 {
+		if currentSizeNotInISO < isoSize.Bytes() {
+			break
+		}
+		iso, leftFiles, skipped := planIso(isoSize.Bytes(), isoFilename, scanRootDirs, files)
+		plan.Skipped = append(plan.Skipped, skipped...)
+		if iso == nil {
+			files = nil
+			break
+		}
+		plan.ISOs = append(plan.ISOs, iso)
+
+		size := iso.Size
+		for _, f := range skipped {
+			size += uint64(f.Size)
+		}
+		currentSizeNotInISO -= size
+		files = leftFiles
+		// only one iso is created if filename is given
+		if isoFilename != "" {
+			break
+		}
+	}
+
+	// check the rest of files as well so that all missing files are reported
+	for _, f := range files {
+		sf := checkFileForIso(scanRootDirs, f)
+		if sf != nil {
+			plan.Skipped = append(plan.Skipped, sf)
+			continue
+		}
+		plan.LeftFiles++
+		plan.LeftSize += uint64(f.Size)
+	}
+	return plan, nil
+}
+
+// checkFileForIso returns nil if file is able to be added into iso
+func checkFileForIso(scanRootDirs map[int]string, f *types.FileInfo) *skippedFile {
+	scanRootDir, ok := scanRootDirs[f.DirID]
+	if !ok {
+		return &skippedFile{ID: f.ID, Path: f.Name, Size: f.Size,
+			Reason: fmt.Sprintf("root scan dir %d not found", f.DirID)}
+	}
+	srcFile := filepath.Join(scanRootDir, f.Name)
+	_, err := os.Stat(srcFile)
+	if err == nil {
+		return nil
+	}
+	if os.IsNotExist(err) {
+		return &skippedFile{ID: f.ID, Path: srcFile, Size: f.Size, Reason: "missing"}
+	}
+	return &skippedFile{ID: f.ID, Path: srcFile, Size: f.Size, Reason: err.Error()}
+}
+
+// planIso mirrors createIso, and returns nil plan if files are not enough to fill one iso
+func planIso(maxSize uint64, isoFilename string, scanRootDirs map[int]string,
+	files []*types.FileInfo) (*isoPlan, []*types.FileInfo, []*skippedFile) {
+	var (
+		skipped []*skippedFile
+		end     time.Time
+	)
+	iso := &isoPlan{}
+	start := futuretime
+	for idx, f := range files {
+		sf := checkFileForIso(scanRootDirs, f)
+		if sf != nil {
+			logrus.Warnf("Skip '%s': %s", sf.Path, sf.Reason)
+			skipped = append(skipped, sf)
+			continue
+		}
+
+		if f.ModTime.Before(start) {
+			start = f.ModTime
+		}
+		if f.ModTime.After(end) {
+			end = f.ModTime
+		}
+		iso.FileCount++
+		iso.Size += uint64(f.Size)
+		if iso.Size < maxSize {
+			continue
+		}
+
+		iso.Name = isoFilename
+		if iso.Name == "" {
+			iso.Name = mkIsoName(start, end) + ".iso"
+		}
+		iso.Start = start
+		iso.End = end
+		iso.FillRatio = float64(iso.Size) / float64(maxSize)
+		return iso, files[idx+1:], skipped
+	}
+	return nil, nil, skipped
+}
+
+func printIsoCreatePlan(plan *isoCreatePlan) {
+	fmt.Printf("Total %d files (%s) not in any iso, iso size is %s\n", plan.TotalFiles,
+		datasize.ByteSize(plan.TotalSize).HR(), datasize.ByteSize(plan.ISOSize).HR())
+
+	if len(plan.ISOs) == 0 {
+		fmt.Println("No iso will be created")
+	} else {
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 4, ' ', tabwriter.TabIndent)
+		fmt.Fprint(writer, "Name\tStart\tEnd\tFiles Count\tSize\tFill Ratio\n")
+		for _, iso := range plan.ISOs {
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%d\t%s\t%.1f%%\n", iso.Name,
+				common.FormatTimeDateOnly(iso.Start), common.FormatTimeDateOnly(iso.End), iso.FileCount,
+				datasize.ByteSize(iso.Size).HR(), iso.FillRatio*100)
+		}
+		writer.Flush()
+	}
+
+	if len(plan.Skipped) != 0 {
+		fmt.Printf("\n%d files are skipped:\n", len(plan.Skipped))
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 4, ' ', tabwriter.TabIndent)
+		fmt.Fprint(writer, "ID\tPath\tSize\tReason\n")
+		for _, f := range plan.Skipped {
+			fmt.Fprintf(writer, "%d\t%s\t%s\t%s\n", f.ID, f.Path, datasize.ByteSize(f.Size).HR(), f.Reason)
+		}
+		writer.Flush()
+	}
+
+	if plan.LeftFiles != 0 {
+		fmt.Printf("\n%d files (%s) are left as they are not enough to fill one iso\n", plan.LeftFiles,
+			datasize.ByteSize(plan.LeftSize).HR())
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lomorage/lomo-backup/common/datasize"
+	"github.com/lomorage/lomo-backup/common/dbx"
+	"github.com/stretchr/testify/require"
+)
+
+// prepareIsoFiles scans 5 files of 1.9 MB, one of which is removed after scan
+func prepareIsoFiles(t *testing.T) (string, string) {
+	dbFilename := newTestDB(t)
+	dir := shortTempDir(t)
+	writeTestFile(t, filepath.Join(dir, "a.jpg"), 400000, 1)
+	writeTestFile(t, filepath.Join(dir, "b.jpg"), 400000, 2)
+	writeTestFile(t, filepath.Join(dir, "sub", "c.jpg"), 400000, 3)
+	writeTestFile(t, filepath.Join(dir, "sub", "d.jpg"), 400000, 4)
+	writeTestFile(t, filepath.Join(dir, "e.jpg"), 300000, 5)
+	scanTestDir(t, dir)
+	missing := filepath.Join(dir, "b.jpg")
+	require.Nil(t, os.Remove(missing))
+	return dbFilename, missing
+}
+
+// requirePlanCreated checks isos created are the same as planned, and missing files are removed from DB
+func requirePlanCreated(t *testing.T, plan *isoCreatePlan, created []string) {
+	require.Len(t, created, len(plan.ISOs))
+	for i, p := range plan.ISOs {
+		require.Equal(t, p.Name, created[i])
+		iso, err := db.GetIsoByName(created[i])
+		require.Nil(t, err)
+		require.NotNil(t, iso, created[i])
+		size, count, err := db.GetTotalFilesInIso(iso.ID)
+		require.Nil(t, err)
+		require.EqualValues(t, p.FileCount, count, created[i])
+		require.EqualValues(t, p.Size, size, created[i])
+	}
+
+	left, err := db.ListFilesNotInISOOrCloud()
+	require.Nil(t, err)
+	require.Len(t, left, plan.LeftFiles)
+	for _, f := range left {
+		for _, s := range plan.Skipped {
+			require.NotEqual(t, s.ID, f.ID, "skipped file %s is still in DB", s.Path)
+		}
+	}
+}
+
+func TestPlanMatchesCreate(t *testing.T) {
+	dbFilename, missing := prepareIsoFiles(t)
+	roDB, err := dbx.OpenDBReadOnly(dbFilename)
+	require.Nil(t, err)
+
+	isoSize := datasize.ByteSize(700000)
+	plan, err := newIsoCreatePlan(roDB, isoSize, "")
+	require.Nil(t, err)
+	require.Len(t, plan.ISOs, 2)
+	// files in scan root dir are listed before the ones in sub dir
+	require.Equal(t, "2024-04-01--2024-04-05.iso", plan.ISOs[0].Name)
+	require.Equal(t, 2, plan.ISOs[0].FileCount)
+	require.Equal(t, "2024-04-03--2024-04-04.iso", plan.ISOs[1].Name)
+	require.Equal(t, 2, plan.ISOs[1].FileCount)
+	require.Len(t, plan.Skipped, 1)
+	require.Equal(t, missing, plan.Skipped[0].Path)
+	require.Equal(t, "missing", plan.Skipped[0].Reason)
+	require.Zero(t, plan.LeftFiles)
+
+	created, err := createISOs(isoSize, "", false, false)
+	require.Nil(t, err)
+	requirePlanCreated(t, plan, created)
+	for _, name := range created {
+		_, err = os.Stat(localISOPath(name))
+		require.Nil(t, err)
+	}
+}
+
+func TestPlanMatchesCreateWithFilename(t *testing.T) {
+	dbFilename, _ := prepareIsoFiles(t)
+	roDB, err := dbx.OpenDBReadOnly(dbFilename)
+	require.Nil(t, err)
+
+	isoSize := datasize.ByteSize(700000)
+	plan, err := newIsoCreatePlan(roDB, isoSize, "given.iso")
+	require.Nil(t, err)
+	require.Len(t, plan.ISOs, 1)
+	require.Equal(t, "given.iso", plan.ISOs[0].Name)
+	require.Equal(t, 2, plan.ISOs[0].FileCount)
+	require.Equal(t, 2, plan.LeftFiles)
+
+	created, err := createISOs(isoSize, "given.iso", false, false)
+	require.Nil(t, err)
+	requirePlanCreated(t, plan, created)
+
+	// the same name is refused by both
+	_, err = newIsoCreatePlan(roDB, isoSize, "given.iso")
+	require.NotNil(t, err)
+	_, err = createISOs(isoSize, "given.iso", false, false)
+	require.NotNil(t, err)
+}
@@ -18,6 +18,7 @@ import (
 	"github.com/lomorage/lomo-backup/common"
 	"github.com/lomorage/lomo-backup/common/datasize"
 	lomohash "github.com/lomorage/lomo-backup/common/hash"
+	"github.com/lomorage/lomo-backup/common/progress"
 	"github.com/lomorage/lomo-backup/common/types"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -25,7 +26,27 @@ import (
 	"github.com/xlab/treeprint"
 )
 
-var futuretime = time.Date(3000, time.December, 31, 0, 0, 0, 0, time.Now().UTC().Location())
+var (
+	futuretime = time.Date(3000, time.December, 31, 0, 0, 0, 0, time.Now().UTC().Location())
+	// isoStoreDir is where isos are created, and isos are named relative to it in DB. It's current
+	// directory if it is empty
+	isoStoreDir string
+)
+
+// localISOPath returns path of iso named in DB. Iso in current directory is used if it isn't in store
+// dir, e.g. it was created before store dir is used
+func localISOPath(name string) string {
+	if isoStoreDir == "" || filepath.IsAbs(name) {
+		return name
+	}
+	p := filepath.Join(isoStoreDir, name)
+	if _, err := os.Stat(p); err != nil {
+		if _, err = os.Stat(name); err == nil {
+			return name
+		}
+	}
+	return p
+}
 
 func mkISO(ctx *cli.Context) error {
 	err := initLogLevel(ctx.GlobalInt("log-level"))
@@ -33,6 +54,10 @@ func mkISO(ctx *cli.Context) error {
 		return err
 	}
 
+	if ctx.Bool("dry-run") {
+		return planISOs(ctx)
+	}
+
 	debug := ctx.Bool("debug")
 	if debug {
 		err = initLogLevel(int(logrus.DebugLevel))
@@ -45,56 +70,75 @@ func mkISO(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	isoStoreDir = ctx.String("store-dir")
+	if isoStoreDir != "" {
+		err = os.MkdirAll(isoStoreDir, 0755)
+		if err != nil {
+			return err
+		}
+	}
 
 	err = initDB(ctx.GlobalString("db"))
 	if err != nil {
 		return err
 	}
 
+	var isoFilename string
+	if len(ctx.Args()) > 0 {
+		isoFilename = ctx.Args()[0]
+	}
+	_, err = createISOs(isoSize, isoFilename, false, debug)
+	return err
+}
+
+// createISOs packs files not in any iso or cloud into isos of isoSize until files left are less than it,
+// and returns names of isos created. Only one iso is created if isoFilename is given. Iso named after
+// modify time of its files gets one suffix if uniqueName is set and the name is taken already
+func createISOs(isoSize datasize.ByteSize, isoFilename string, uniqueName, debug bool) ([]string, error) {
 	currentSizeNotInISO, err := db.TotalFileSizeNotInISO()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	scanRootDirs, err := db.ListScanRootDirs()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	files, err := db.ListFilesNotInISOOrCloud()
 	if err != nil {
-		return err
-	}
-
-	var isoFilename string
-	if len(ctx.Args()) > 0 {
-		isoFilename = ctx.Args()[0]
+		return nil, err
 	}
 
 	logrus.Infof("Total %d files (%s)", len(files), datasize.ByteSize(currentSizeNotInISO).HR())
 
+	var created []string
 	for {
 		if currentSizeNotInISO < isoSize.Bytes() {
 			currSize := datasize.ByteSize(currentSizeNotInISO)
 			fmt.Printf("Total size of un-backedup files is %s, less than %s, skip\n",
 				currSize.HR(), isoSize.HR())
 
-			return nil
+			return created, nil
 		}
 
 		iso, err := db.GetIsoByName(isoFilename)
 		if err != nil {
-			return err
+			return created, err
 		}
 		if iso != nil {
-			return errors.Errorf("%s was created at %s, and its size is %s", isoFilename,
+			return created, errors.Errorf("%s was created at %s, and its size is %s", isoFilename,
 				iso.CreateTime.Truncate(time.Second).Local(),
 				datasize.ByteSize(iso.Size).HR())
 		}
 
-		size, filename, leftFiles, notExistFiles, err := createIso(isoSize.Bytes(), isoFilename, scanRootDirs, files, debug)
+		size, filename, leftFiles, notExistFiles, err := createIso(isoSize.Bytes(), isoFilename, scanRootDirs, files,
+			uniqueName, debug)
 		if err != nil {
-			return err
+			return created, err
+		}
+		if filename != "" {
+			created = append(created, filename)
 		}
 		if len(notExistFiles) == 0 {
 			logrus.Infof("%d files (%s) are added into %s, and %d files (%s) need to be added",
@@ -116,24 +160,47 @@ func mkISO(ctx *cli.Context) error {
 			ids := fileIDs.String()
 			_, err = db.DeleteBatchFiles(strings.Trim(ids, ","))
 			if err != nil {
-				return err
+				return created, err
 			}
 			size += uint64(notExistSizes)
 		}
 
 		if len(leftFiles) == 0 {
-			return nil
+			return created, nil
 		}
-		if len(ctx.Args()) > 0 {
+		if isoFilename != "" {
 			fmt.Println("Please supply another filename")
-			return nil
+			return created, nil
 		}
 		files = leftFiles
 		currentSizeNotInISO -= size
 	}
 }
 
-func createFileInStaging(srcFile, dstFile string) error {
+// mkIsoName returns iso name from the earliest and latest modify time of files in it
+func mkIsoName(start, end time.Time) string {
+	return fmt.Sprintf("%d-%02d-%02d--%d-%02d-%02d", start.Year(), start.Month(), start.Day(),
+		end.Year(), end.Month(), end.Day())
+}
+
+// uniqueIsoFilename adds suffix to name if iso of the same name is in DB or on disk already, e.g. files of
+// the same days are packed in different runs
+func uniqueIsoFilename(name string) (string, error) {
+	filename := name + ".iso"
+	for i := 2; ; i++ {
+		iso, err := db.GetIsoByName(filename)
+		if err != nil {
+			return "", err
+		}
+		_, err = os.Stat(localISOPath(filename))
+		if iso == nil && os.IsNotExist(err) {
+			return filename, nil
+		}
+		filename = fmt.Sprintf("%s-%d.iso", name, i)
+	}
+}
+
+func createFileInStaging(srcFile, dstFile string, tracker *progress.Tracker) error {
 	src, err := os.Open(srcFile)
 	if err != nil {
 		return err
@@ -145,13 +212,13 @@ func createFileInStaging(srcFile, dstFile string) error {
 		return err
 	}
 
-	_, err = io.Copy(dst, src)
+	_, err = io.Copy(dst, progress.NewReader(src, tracker))
 
 	return err
 }
 
 func createIso(maxSize uint64, isoFilename string, scanRootDirs map[int]string, files []*types.FileInfo,
-	debug bool) (uint64, string, []*types.FileInfo, []*types.FileInfo, error) {
+	uniqueName, debug bool) (uint64, string, []*types.FileInfo, []*types.FileInfo, error) {
 	stagingDir, err := os.MkdirTemp("", "lomobackup-")
 	if err != nil {
 		return 0, "", nil, nil, err
@@ -169,6 +236,17 @@ func createIso(maxSize uint64, isoFilename string, scanRootDirs map[int]string,
 		end           time.Time
 		notExistFiles []*types.FileInfo
 	)
+	// files are added until iso reaches max size
+	var total uint64
+	for _, f := range files {
+		if total >= maxSize {
+			break
+		}
+		total += uint64(f.Size)
+	}
+	tracker := progress.NewTracker(progressReporter, "stage files", int64(total))
+	defer tracker.Finish()
+
 	start := futuretime
 	fileIDs := bytes.Buffer{}
 	dirsMap := map[string]string{} // dstDir -> srcDir
@@ -193,7 +271,7 @@ func createIso(maxSize uint64, isoFilename string, scanRootDirs map[int]string,
 			dirsMap[dstDir] = filepath.Dir(srcFile)
 		}
 
-		err = createFileInStaging(srcFile, dstFile)
+		err = createFileInStaging(srcFile, dstFile, tracker)
 		if err != nil {
 			if os.IsNotExist(err) {
 				notExistFiles = append(notExistFiles, f)
@@ -225,32 +303,45 @@ func createIso(maxSize uint64, isoFilename string, scanRootDirs map[int]string,
 			continue
 		}
 
+		tracker.Finish()
+
 		// change all destination directory's last modify time and access time
 		common.KeepDirsTime(stagingDir, dirsMap)
 
-		name := fmt.Sprintf("%d-%02d-%02d--%d-%02d-%02d", start.Year(), start.Month(), start.Day(),
-			end.Year(), end.Month(), end.Day())
-		if isoFilename == "" {
+		name := mkIsoName(start, end)
+		if isoFilename == "" && uniqueName {
+			isoFilename, err = uniqueIsoFilename(name)
+			if err != nil {
+				return 0, "", nil, nil, err
+			}
+		} else if isoFilename == "" {
 			isoFilename = name + ".iso"
 		}
 
-		out, err := exec.Command("mkisofs", "-R", "-V", "lomorage: "+name, "-o", isoFilename,
+		// new iso is always in store dir
+		isoPath := isoFilename
+		if isoStoreDir != "" && !filepath.IsAbs(isoFilename) {
+			isoPath = filepath.Join(isoStoreDir, isoFilename)
+		}
+		out, err := exec.Command("mkisofs", "-R", "-V", "lomorage: "+name, "-o", isoPath,
 			stagingDir).CombinedOutput()
 		if err != nil {
 			fmt.Println(string(out))
 			return 0, "", nil, nil, err
 		}
 
-		fileInfo, err := os.Stat(isoFilename)
+		fileInfo, err := os.Stat(isoPath)
 		if err != nil {
 			return 0, "", nil, nil, err
 		}
 		isoInfo := &types.ISOInfo{Name: isoFilename, Size: int(fileInfo.Size())}
 
-		hash, err := lomohash.CalculateHashFile(isoFilename)
+		hashTracker := progress.NewTracker(progressReporter, "hash "+isoFilename, fileInfo.Size())
+		hash, err := lomohash.CalculateHashFileWithProgress(isoPath, hashTracker)
 		if err != nil {
 			return 0, "", nil, nil, err
 		}
+		hashTracker.Finish()
 		isoInfo.SetHashLocal(hash)
 		// create db entry and update file info
 		start := time.Now()
@@ -264,7 +355,8 @@ func createIso(maxSize uint64, isoFilename string, scanRootDirs map[int]string,
 		return filesSize, isoFilename, files[idx+1:], notExistFiles, err
 	}
 
-	return filesSize, isoFilename, nil, nil, nil
+	// files existing are less than max size, and no iso is created
+	return filesSize, "", nil, nil, nil
 }
 
 func listISO(ctx *cli.Context) error {
@@ -280,15 +372,20 @@ func listISO(ctx *cli.Context) error {
 	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 4, ' ', tabwriter.TabIndent)
 	defer writer.Flush()
 
-	fmt.Fprint(writer, "ID\tName\tSize\tStatus\tRegion\tBucket\tFiles Count\tCreate Time\tLocal Hash\n")
+	fmt.Fprint(writer, "ID\tName\tSize\tStatus\tRegion\tBucket\tStorage Class\tFiles Count\tCreate Time\tLocked Until"+
+		"\tLocal Hash\n")
 	for _, iso := range isos {
 		_, count, err := db.GetTotalFilesInIso(iso.ID)
 		if err != nil {
 			return err
 		}
-		fmt.Fprintf(writer, "%d\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", iso.ID, iso.Name,
-			datasize.ByteSize(iso.Size).HR(), iso.Status, iso.Region, iso.Bucket, count,
-			common.FormatTime(iso.CreateTime.Local()), iso.HashLocal)
+		lock := ""
+		if iso.RetentionMode != "" {
+			lock = common.FormatTime(iso.RetainUntil.Local()) + " (" + iso.RetentionMode + ")"
+		}
+		fmt.Fprintf(writer, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", iso.ID, iso.Name,
+			datasize.ByteSize(iso.Size).HR(), iso.Status, iso.Region, iso.Bucket, iso.StorageClass, count,
+			common.FormatTime(iso.CreateTime.Local()), lock, iso.HashLocal)
 	}
 	return nil
 }
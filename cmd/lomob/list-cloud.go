@@ -14,6 +14,8 @@ func listFilesInGDrive(ctx *cli.Context) error {
 		CredFilename:  ctx.String("cred"),
 		TokenFilename: ctx.String("token"),
 		RefreshToken:  true,
+		Retry:         retryPolicy,
+		Limiter:       bwLimiter,
 	})
 	if err != nil {
 		return fmt.Errorf("unable to retrieve Drive client: %v", err)
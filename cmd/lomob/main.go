@@ -4,26 +4,61 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/lomorage/lomo-backup/clients"
+	"github.com/lomorage/lomo-backup/common"
+	"github.com/lomorage/lomo-backup/common/bwlimit"
 	"github.com/lomorage/lomo-backup/common/dbx"
+	"github.com/lomorage/lomo-backup/common/progress"
+	"github.com/lomorage/lomo-backup/common/retry"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
+	"golang.org/x/term"
+)
+
+const (
+	defaultIgnoreFiles = ".DS_Store,._.DS_Store,Thumbs.db,.git"
+	defaultIgnoreDirs  = ".idea,.git,.github"
+	defaultScanThreads = 20
 )
 
 var (
 	scanUsage = "[directory to scan]"
 	db        *dbx.DB
 
+	retryPolicy = retry.DefaultPolicy
+	// nil if upload bandwidth is not limited
+	bwLimiter *bwlimit.Limiter
+	// nil if progress is not reported
+	progressReporter progress.Reporter
+	// S3 compatible endpoint, empty for AWS
+	s3Endpoint clients.Endpoint
+	// access key is given by each command
+	awsCredentials clients.Credentials
+	// save object metadata as S3 object tags too
+	s3ObjectTags bool
+
 	lock *sync.Mutex
 
 	defaultBucket = "lomorage"
 )
 
 func main() {
+	if err := newApp().Run(os.Args); err != nil {
+		logrus.Errorf(err.Error())
+		os.Exit(1)
+	}
+}
+
+// newApp returns the command line application with all commands
+func newApp() *cli.App {
 	app := cli.NewApp()
 
 	app.Usage = "Backup files to remote storage with 2 stage approach"
+	app.Version = common.Version()
 	app.Email = "support@lomorage.com"
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
@@ -36,7 +71,122 @@ func main() {
 			Usage: "Log level for processing. 0: Panic, 1: Fatal, 2: Error, 3: Warn, 4: Info, 5: Debug, 6: TraceLevel",
 			Value: int(logrus.InfoLevel),
 		},
+		cli.IntFlag{
+			Name:   "max-retries",
+			Usage:  "Max number of retries for each failed cloud call caused by throttling, server or network error",
+			EnvVar: "LOMOB_MAX_RETRIES",
+			Value:  retry.DefaultPolicy.MaxRetries,
+		},
+		cli.DurationFlag{
+			Name:   "retry-base-delay",
+			Usage:  "Delay before the first retry, which is doubled for each following retry",
+			EnvVar: "LOMOB_RETRY_BASE_DELAY",
+			Value:  retry.DefaultPolicy.BaseDelay,
+		},
+		cli.DurationFlag{
+			Name:   "retry-max-delay",
+			Usage:  "Max delay between retries",
+			EnvVar: "LOMOB_RETRY_MAX_DELAY",
+			Value:  retry.DefaultPolicy.MaxDelay,
+		},
+		cli.StringFlag{
+			Name: "bwlimit",
+			Usage: "Upload bandwidth limit like 2MB/s, or schedule in local time like " +
+				"23:00-07:00=unlimited,09:00-17:00=pause,else=1MB/s. KB=1000 Byte",
+			EnvVar: "LOMOB_BWLIMIT",
+		},
+		cli.StringFlag{
+			Name: "progress",
+			Usage: "Progress of scan, iso creation and uploads. auto: redraw in terminal if stderr is one, " +
+				"otherwise log; tty: redraw in terminal; log: log progress periodically; none: no progress",
+			EnvVar: "LOMOB_PROGRESS",
+			Value:  "auto",
+		},
+		cli.DurationFlag{
+			Name:   "progress-interval",
+			Usage:  "Interval between progress log lines of one task",
+			EnvVar: "LOMOB_PROGRESS_INTERVAL",
+			Value:  10 * time.Second,
+		},
+		cli.StringFlag{
+			Name:   "s3-endpoint",
+			Usage:  "URL of S3 compatible service like MinIO, Wasabi or Ceph RGW, e.g. https://s3.wasabisys.com. AWS if empty",
+			EnvVar: "LOMOB_S3_ENDPOINT",
+		},
+		cli.BoolFlag{
+			Name:   "s3-path-style",
+			Usage:  "Address bucket in URL path instead of host name, which most self hosted services need",
+			EnvVar: "LOMOB_S3_PATH_STYLE",
+		},
+		cli.StringFlag{
+			Name:   "s3-ca-bundle",
+			Usage:  "PEM file of CA certificates to trust besides system ones, e.g. for self signed endpoint",
+			EnvVar: "LOMOB_S3_CA_BUNDLE",
+		},
+		cli.BoolFlag{
+			Name:   "s3-insecure-tls",
+			Usage:  "Skip TLS certificate verification of S3 endpoint. Only for lab use",
+			EnvVar: "LOMOB_S3_INSECURE_TLS",
+		},
+		cli.StringFlag{
+			Name:   "s3-proxy",
+			Usage:  "HTTP proxy URL to reach S3. HTTPS_PROXY, HTTP_PROXY and NO_PROXY env are used if empty",
+			EnvVar: "LOMOB_S3_PROXY",
+		},
+		cli.BoolFlag{
+			Name:   "s3-unsigned-payload",
+			Usage:  "Not sign request payload, for services failing to verify it. Use with https only",
+			EnvVar: "LOMOB_S3_UNSIGNED_PAYLOAD",
+		},
+		cli.BoolFlag{
+			Name:   "s3-disable-content-md5",
+			Usage:  "Not send Content-MD5 in uploads, for services not supporting it",
+			EnvVar: "LOMOB_S3_DISABLE_CONTENT_MD5",
+		},
+		cli.BoolFlag{
+			Name:   "s3-object-tags",
+			Usage:  "Save hashes and versions in object metadata as object tags too, e.g. to filter in lifecycle rules",
+			EnvVar: "LOMOB_S3_OBJECT_TAGS",
+		},
+		cli.StringFlag{
+			Name:   "aws-profile",
+			Usage:  "Profile in aws shared config and credentials files, used if access key is not given",
+			EnvVar: "AWS_PROFILE",
+		},
+		cli.StringFlag{
+			Name:   "aws-session-token",
+			Usage:  "Session token of temporary access key",
+			EnvVar: "AWS_SESSION_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "aws-role-arn",
+			Usage:  "ARN of role to assume with the access key or profile",
+			EnvVar: "LOMOB_AWS_ROLE_ARN",
+		},
+		cli.StringFlag{
+			Name:   "aws-role-external-id",
+			Usage:  "External ID required by the role to assume",
+			EnvVar: "LOMOB_AWS_ROLE_EXTERNAL_ID",
+		},
+		cli.StringFlag{
+			Name:   "aws-role-session-name",
+			Usage:  "Session name of the assumed role, shown in CloudTrail",
+			EnvVar: "LOMOB_AWS_ROLE_SESSION_NAME",
+			Value:  "lomob",
+		},
+		cli.StringFlag{
+			Name:   "aws-mfa-serial",
+			Usage:  "Serial number or ARN of MFA device required by the role. Token is asked from stdin, which must be one terminal",
+			EnvVar: "LOMOB_AWS_MFA_SERIAL",
+		},
+		cli.DurationFlag{
+			Name:   "aws-role-duration",
+			Usage:  "Duration of assumed role credentials before refresh, which asks MFA token again. Cover the whole run if stdin is not a terminal",
+			EnvVar: "LOMOB_AWS_ROLE_DURATION",
+			Value:  time.Hour,
+		},
 	}
+	app.Before = initGlobalOptions
 	app.Commands = []cli.Command{
 		{
 			Name:      "scan",
@@ -47,17 +197,17 @@ func main() {
 				cli.StringFlag{
 					Name:  "ignore-files, if",
 					Usage: "List of ignored files, separated by comma",
-					Value: ".DS_Store,._.DS_Store,Thumbs.db,.git",
+					Value: defaultIgnoreFiles,
 				},
 				cli.StringFlag{
 					Name:  "ignore-dirs, in",
 					Usage: "List of ignored directories, separated by comma",
-					Value: ".idea,.git,.github",
+					Value: defaultIgnoreDirs,
 				},
 				cli.IntFlag{
 					Name:  "threads, t",
 					Usage: "Number of scan threads in parallel",
-					Value: 20,
+					Value: defaultScanThreads,
 				},
 			},
 		},
@@ -84,6 +234,14 @@ func main() {
 							Name:  "debug",
 							Usage: "Keep temp directory for debugging purpose, and also dump more debug level log",
 						},
+						cli.BoolFlag{
+							Name:  "dry-run",
+							Usage: "Print planned isos and missing files only, without creating any file or updating DB",
+						},
+						cli.BoolFlag{
+							Name:  "json",
+							Usage: "Print dry run plan in JSON",
+						},
 					},
 				},
 				{
@@ -91,6 +249,24 @@ func main() {
 					Action: listISO,
 					Usage:  "List all created iso files",
 				},
+				{
+					Name:      "extract",
+					Action:    extractISO,
+					Usage:     "Extract files or directories from plain, compressed or encrypted iso, and verify them against DB",
+					ArgsUsage: "[iso filename] [path in iso]...",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "to",
+							Usage: "Directory to save extracted files",
+							Value: ".",
+						},
+						cli.StringFlag{
+							Name:   "encrypt-key, k",
+							Usage:  "Master key to decrypt encrypted iso",
+							EnvVar: "LOMOB_MASTER_KEY",
+						},
+					},
+				},
 				{
 					Name:      "dump",
 					Action:    dumpISO,
@@ -122,6 +298,10 @@ func main() {
 							Usage: "awsBucketName",
 							Value: defaultBucket,
 						},
+						cli.StringFlag{
+							Name:  "local-dir",
+							Usage: "Use this directory instead of AWS S3, e.g. USB disk or NFS mount. Bucket is one sub directory in it",
+						},
 						cli.StringFlag{
 							Name:  "part-size,p",
 							Usage: "Size of each upload partition. KB=1000 Byte",
@@ -144,6 +324,19 @@ func main() {
 							Name:  "force",
 							Usage: "force to upload from scratch and not reuse previous upload info",
 						},
+						cli.BoolFlag{
+							Name:  "all,a",
+							Usage: "Upload all isos created or partially uploaded, the oldest first",
+						},
+						cli.StringFlag{
+							Name:  "store-dir",
+							Usage: "Directory where isos are stored. It's current directory by default",
+						},
+						cli.StringFlag{
+							Name:  "max-bytes",
+							Usage: "Stop uploading more isos with -a once this many bytes are uploaded in this run. 0 is unlimited",
+							Value: "0",
+						},
 						cli.StringFlag{
 							Name:   "encrypt-key, k",
 							Usage:  "Master key to encrypt current upload file",
@@ -154,6 +347,83 @@ func main() {
 							Usage: "The  type  of storage to use for the object. Valid choices are: DEEP_ARCHIVE | GLACIER | GLACIER_IR | INTELLIGENT_TIERING | ONE-ZONE_IA | REDUCED_REDUNDANCY | STANDARD | STANDARD_IA.",
 							Value: "STANDARD",
 						},
+						cli.StringFlag{
+							Name:  "compress",
+							Usage: "Compress before encryption. Valid choices are: none | gzip | xz | lz4. Compressed media formats are skipped",
+							Value: "none",
+						},
+						cli.IntFlag{
+							Name:  "parity-shards",
+							Usage: "Number of Reed-Solomon parity blocks per group uploaded as <iso>.par sidecar. 0 means no parity",
+						},
+						cli.IntFlag{
+							Name:  "parity-data-shards",
+							Usage: "Number of data blocks per parity group",
+							Value: 10,
+						},
+						cli.StringFlag{
+							Name:  "parity-block-size",
+							Usage: "Size of each parity block. KB=1000 Byte",
+							Value: "1M",
+						},
+						cli.StringFlag{
+							Name: "lock-mode",
+							Usage: "Object lock of uploaded iso. Valid choices are: none | governance | compliance. " +
+								"Bucket needs object lock enabled",
+							Value: "none",
+						},
+						cli.IntFlag{
+							Name:  "lock-days",
+							Usage: "Days to lock uploaded iso, during which it can't be deleted or overwritten",
+						},
+					},
+				},
+				{
+					Name:      "set-class",
+					Action:    setISOStorageClass,
+					Usage:     "Change storage class of uploaded isos by copying them in place, and record it in DB",
+					ArgsUsage: "[iso filename]...",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "awsAccessKeyID",
+							Usage:  "aws Access Key ID",
+							EnvVar: "AWS_ACCESS_KEY_ID",
+						},
+						cli.StringFlag{
+							Name:   "awsSecretAccessKey",
+							Usage:  "aws Secret Access Key",
+							EnvVar: "AWS_SECRET_ACCESS_KEY",
+						},
+						cli.StringFlag{
+							Name:   "awsBucketRegion",
+							Usage:  "aws Bucket Region",
+							EnvVar: "AWS_DEFAULT_REGION",
+						},
+						cli.StringFlag{
+							Name:  "awsBucketName",
+							Usage: "awsBucketName",
+							Value: defaultBucket,
+						},
+						cli.StringFlag{
+							Name:  "local-dir",
+							Usage: "Use this directory instead of AWS S3, e.g. USB disk or NFS mount. Bucket is one sub directory in it",
+						},
+						cli.StringFlag{
+							Name:  "storage-class",
+							Usage: "The  type  of storage to change to. Valid choices are: DEEP_ARCHIVE | GLACIER | GLACIER_IR | INTELLIGENT_TIERING | ONE-ZONE_IA | REDUCED_REDUNDANCY | STANDARD | STANDARD_IA.",
+						},
+						cli.BoolFlag{
+							Name:  "all,a",
+							Usage: "Change all isos uploaded to the bucket",
+						},
+						cli.IntFlag{
+							Name:  "older-than-days",
+							Usage: "With --all, change isos created more than these days ago only, e.g. to keep newer ones in current class",
+						},
+						cli.BoolFlag{
+							Name:  "dry-run",
+							Usage: "Print what would be done without changing bucket or DB",
+						},
 					},
 				},
 			},
@@ -187,6 +457,10 @@ func main() {
 							Usage: "awsBucketName",
 							Value: defaultBucket,
 						},
+						cli.StringFlag{
+							Name:  "local-dir",
+							Usage: "Use this directory instead of AWS S3, e.g. USB disk or NFS mount. Bucket is one sub directory in it",
+						},
 						cli.StringFlag{
 							Name:  "part-size,p",
 							Usage: "Size of each upload partition. KB=1000 Byte",
@@ -209,6 +483,19 @@ func main() {
 							Name:  "force",
 							Usage: "force to upload from scratch and not reuse previous upload info",
 						},
+						cli.BoolFlag{
+							Name:  "all,a",
+							Usage: "Upload all isos created or partially uploaded, the oldest first",
+						},
+						cli.StringFlag{
+							Name:  "store-dir",
+							Usage: "Directory where isos are stored. It's current directory by default",
+						},
+						cli.StringFlag{
+							Name:  "max-bytes",
+							Usage: "Stop uploading more isos with -a once this many bytes are uploaded in this run. 0 is unlimited",
+							Value: "0",
+						},
 						cli.StringFlag{
 							Name:   "encrypt-key, k",
 							Usage:  "Master key to encrypt current upload file",
@@ -219,6 +506,75 @@ func main() {
 							Usage: "The  type  of storage to use for the object. Valid choices are: DEEP_ARCHIVE | GLACIER | GLACIER_IR | INTELLIGENT_TIERING | ONE-ZONE_IA | REDUCED_REDUNDANCY | STANDARD | STANDARD_IA.",
 							Value: "STANDARD",
 						},
+						cli.StringFlag{
+							Name:  "compress",
+							Usage: "Compress before encryption. Valid choices are: none | gzip | xz | lz4. Compressed media formats are skipped",
+							Value: "none",
+						},
+						cli.IntFlag{
+							Name:  "parity-shards",
+							Usage: "Number of Reed-Solomon parity blocks per group uploaded as <iso>.par sidecar. 0 means no parity",
+						},
+						cli.IntFlag{
+							Name:  "parity-data-shards",
+							Usage: "Number of data blocks per parity group",
+							Value: 10,
+						},
+						cli.StringFlag{
+							Name:  "parity-block-size",
+							Usage: "Size of each parity block. KB=1000 Byte",
+							Value: "1M",
+						},
+						cli.StringFlag{
+							Name: "lock-mode",
+							Usage: "Object lock of uploaded iso. Valid choices are: none | governance | compliance. " +
+								"Bucket needs object lock enabled",
+							Value: "none",
+						},
+						cli.IntFlag{
+							Name:  "lock-days",
+							Usage: "Days to lock uploaded iso, during which it can't be deleted or overwritten",
+						},
+					},
+				},
+				{
+					Name:   "reconcile",
+					Action: reconcileUploads,
+					Usage:  "Reconcile in progress multipart uploads in bucket with the ones in DB",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "awsAccessKeyID",
+							Usage:  "aws Access Key ID",
+							EnvVar: "AWS_ACCESS_KEY_ID",
+						},
+						cli.StringFlag{
+							Name:   "awsSecretAccessKey",
+							Usage:  "aws Secret Access Key",
+							EnvVar: "AWS_SECRET_ACCESS_KEY",
+						},
+						cli.StringFlag{
+							Name:   "awsBucketRegion",
+							Usage:  "aws Bucket Region",
+							EnvVar: "AWS_DEFAULT_REGION",
+						},
+						cli.StringFlag{
+							Name:  "awsBucketName",
+							Usage: "awsBucketName",
+							Value: defaultBucket,
+						},
+						cli.StringFlag{
+							Name:  "local-dir",
+							Usage: "Use this directory instead of AWS S3, e.g. USB disk or NFS mount. Bucket is one sub directory in it",
+						},
+						cli.DurationFlag{
+							Name:  "abort-after",
+							Usage: "Abort uploads not in DB once they are older than this",
+							Value: 7 * 24 * time.Hour,
+						},
+						cli.BoolFlag{
+							Name:  "dry-run",
+							Usage: "Print what would be done without changing bucket or DB",
+						},
 					},
 				},
 				{
@@ -246,6 +602,167 @@ func main() {
 							Usage:  "Master key to encrypt current upload file",
 							EnvVar: "LOMOB_MASTER_KEY",
 						},
+						cli.StringFlag{
+							Name:  "compress",
+							Usage: "Compress before encryption. Valid choices are: none | gzip | xz | lz4. Compressed media formats are skipped",
+							Value: "none",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:   "backup",
+			Action: backup,
+			Usage:  "Scan, upload files to google drive, create isos and upload them in one run from config",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "config",
+					Usage:  "JSON file of stages to run",
+					EnvVar: "LOMOB_BACKUP_CONFIG",
+				},
+				cli.StringFlag{
+					Name:   "awsAccessKeyID",
+					Usage:  "aws Access Key ID",
+					EnvVar: "AWS_ACCESS_KEY_ID",
+				},
+				cli.StringFlag{
+					Name:   "awsSecretAccessKey",
+					Usage:  "aws Secret Access Key",
+					EnvVar: "AWS_SECRET_ACCESS_KEY",
+				},
+				cli.StringFlag{
+					Name:   "encrypt-key, k",
+					Usage:  "Master key to encrypt files and isos",
+					EnvVar: "LOMOB_MASTER_KEY",
+				},
+			},
+		},
+		{
+			Name:      "replicate",
+			Action:    replicateISOs,
+			Usage:     "Verify copies of specified or all isos, and upload them until each has required copies",
+			ArgsUsage: "[iso filename]...",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "destinations",
+					Usage:  "JSON file of destinations and the number of copies each iso needs",
+					EnvVar: "LOMOB_DESTINATIONS",
+				},
+				cli.StringFlag{
+					Name:   "awsAccessKeyID",
+					Usage:  "aws Access Key ID",
+					EnvVar: "AWS_ACCESS_KEY_ID",
+				},
+				cli.StringFlag{
+					Name:   "awsSecretAccessKey",
+					Usage:  "aws Secret Access Key",
+					EnvVar: "AWS_SECRET_ACCESS_KEY",
+				},
+				cli.StringFlag{
+					Name:  "part-size,p",
+					Usage: "Size of each upload partition. KB=1000 Byte",
+					Value: "100M",
+				},
+				cli.IntFlag{
+					Name:  "nthreads,n",
+					Usage: "Number of parallel multi part upload",
+					Value: 3,
+				},
+				cli.BoolFlag{
+					Name:  "no-encrypt",
+					Usage: "not do any encryption, and upload raw files",
+				},
+				cli.StringFlag{
+					Name:   "encrypt-key, k",
+					Usage:  "Master key to encrypt current upload file",
+					EnvVar: "LOMOB_MASTER_KEY",
+				},
+				cli.BoolFlag{
+					Name:  "no-verify",
+					Usage: "Count copies uploaded before without checking them in destinations",
+				},
+				cli.StringFlag{
+					Name:  "compress",
+					Usage: "Compress before encryption if iso isn't uploaded before. Valid choices are: none | gzip | xz | lz4",
+					Value: "none",
+				},
+				cli.IntFlag{
+					Name:  "parity-shards",
+					Usage: "Number of Reed-Solomon parity blocks per group uploaded as <iso>.par sidecar. 0 means no parity",
+				},
+				cli.IntFlag{
+					Name:  "parity-data-shards",
+					Usage: "Number of data blocks per parity group",
+					Value: 10,
+				},
+				cli.StringFlag{
+					Name:  "parity-block-size",
+					Usage: "Size of each parity block. KB=1000 Byte",
+					Value: "1M",
+				},
+			},
+		},
+		{
+			Name:  "bucket",
+			Usage: "AWS S3 bucket related commands",
+			Subcommands: cli.Commands{
+				{
+					Name:   "init",
+					Action: initBucket,
+					Usage:  "Create bucket if not exist, and set access, versioning and lifecycle rules. Safe to run again",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "awsAccessKeyID",
+							Usage:  "aws Access Key ID",
+							EnvVar: "AWS_ACCESS_KEY_ID",
+						},
+						cli.StringFlag{
+							Name:   "awsSecretAccessKey",
+							Usage:  "aws Secret Access Key",
+							EnvVar: "AWS_SECRET_ACCESS_KEY",
+						},
+						cli.StringFlag{
+							Name:   "awsBucketRegion",
+							Usage:  "aws Bucket Region",
+							EnvVar: "AWS_DEFAULT_REGION",
+						},
+						cli.StringFlag{
+							Name:  "awsBucketName",
+							Usage: "awsBucketName",
+							Value: defaultBucket,
+						},
+						cli.BoolTFlag{
+							Name:  "block-public-access",
+							Usage: "Block all public access. --block-public-access=false for services not supporting it",
+						},
+						cli.BoolTFlag{
+							Name:  "versioning",
+							Usage: "Keep previous versions of overwritten or deleted objects. --versioning=false to leave it as it is",
+						},
+						cli.BoolFlag{
+							Name:  "object-lock",
+							Usage: "Enable object lock, which needs versioning",
+						},
+						cli.Int64Flag{
+							Name:  "abort-incomplete-days",
+							Usage: "Abort incomplete multipart uploads after given days. 0 means never",
+							Value: 7,
+						},
+						cli.Int64Flag{
+							Name:  "transition-days",
+							Usage: "Transit isos to transition class after given days. 0 means never",
+						},
+						cli.StringFlag{
+							Name:  "transition-class",
+							Usage: "Storage class to transit to. Valid choices are: DEEP_ARCHIVE | GLACIER | GLACIER_IR | INTELLIGENT_TIERING | ONEZONE_IA | STANDARD_IA",
+							Value: "DEEP_ARCHIVE",
+						},
+						cli.Int64Flag{
+							Name:  "noncurrent-expire-days",
+							Usage: "Delete previous versions of objects after given days since they are replaced. 0 means never",
+							Value: 30,
+						},
 					},
 				},
 			},
@@ -280,11 +797,162 @@ func main() {
 							Usage: "awsBucketName",
 							Value: defaultBucket,
 						},
+						cli.StringFlag{
+							Name:  "local-dir",
+							Usage: "Use this directory instead of AWS S3, e.g. USB disk or NFS mount. Bucket is one sub directory in it",
+						},
 						cli.StringFlag{
 							Name:   "encrypt-key, k",
 							Usage:  "Master key to encrypt current upload file",
 							EnvVar: "LOMOB_MASTER_KEY",
 						},
+						cli.BoolFlag{
+							Name:  "raw",
+							Usage: "Save the object as it is without decryption, e.g. to repair it with parity file firstly",
+						},
+						cli.IntFlag{
+							Name:  "nthreads,n",
+							Usage: "Number of parallel ranged download",
+							Value: 3,
+						},
+					},
+				},
+				{
+					Name:      "file",
+					Action:    restoreFilesInISO,
+					Usage:     "Extract files or directories from remote iso by downloading only their ranges, and verify them against DB",
+					ArgsUsage: "[iso file name] [path in iso]...",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "awsAccessKeyID",
+							Usage:  "aws Access Key ID",
+							EnvVar: "AWS_ACCESS_KEY_ID",
+						},
+						cli.StringFlag{
+							Name:   "awsSecretAccessKey",
+							Usage:  "aws Secret Access Key",
+							EnvVar: "AWS_SECRET_ACCESS_KEY",
+						},
+						cli.StringFlag{
+							Name:   "awsBucketRegion",
+							Usage:  "aws Bucket Region",
+							EnvVar: "AWS_DEFAULT_REGION",
+						},
+						cli.StringFlag{
+							Name:  "awsBucketName",
+							Usage: "awsBucketName",
+							Value: defaultBucket,
+						},
+						cli.StringFlag{
+							Name:  "local-dir",
+							Usage: "Use this directory instead of AWS S3, e.g. USB disk or NFS mount. Bucket is one sub directory in it",
+						},
+						cli.StringFlag{
+							Name:  "to",
+							Usage: "Directory to save extracted files",
+							Value: ".",
+						},
+						cli.StringFlag{
+							Name:   "encrypt-key, k",
+							Usage:  "Master key to decrypt encrypted iso",
+							EnvVar: "LOMOB_MASTER_KEY",
+						},
+					},
+				},
+				{
+					Name:      "request",
+					Action:    requestRestore,
+					Usage:     "Request restore of ISO file in GLACIER or DEEP_ARCHIVE storage class before download",
+					ArgsUsage: "[iso file name] [[output file name]]. Output file name is iso file name if not given",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "awsAccessKeyID",
+							Usage:  "aws Access Key ID",
+							EnvVar: "AWS_ACCESS_KEY_ID",
+						},
+						cli.StringFlag{
+							Name:   "awsSecretAccessKey",
+							Usage:  "aws Secret Access Key",
+							EnvVar: "AWS_SECRET_ACCESS_KEY",
+						},
+						cli.StringFlag{
+							Name:   "awsBucketRegion",
+							Usage:  "aws Bucket Region",
+							EnvVar: "AWS_DEFAULT_REGION",
+						},
+						cli.StringFlag{
+							Name:  "awsBucketName",
+							Usage: "awsBucketName",
+							Value: defaultBucket,
+						},
+						cli.StringFlag{
+							Name:  "local-dir",
+							Usage: "Use this directory instead of AWS S3, e.g. USB disk or NFS mount. Bucket is one sub directory in it",
+						},
+						cli.StringFlag{
+							Name:  "tier",
+							Usage: "Retrieval tier. Valid choices are: bulk | standard | expedited. Expedited is not supported by DEEP_ARCHIVE",
+							Value: "bulk",
+						},
+						cli.IntFlag{
+							Name:  "days",
+							Usage: "Days to keep the restored copy, which is billed in addition to the archived one",
+							Value: 7,
+						},
+						cli.BoolFlag{
+							Name:  "raw",
+							Usage: "Save the object as it is without decryption once it is restored",
+						},
+					},
+				},
+				{
+					Name:   "status",
+					Action: restoreStatus,
+					Usage:  "Check requested restores, and download ISO files restored",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "awsAccessKeyID",
+							Usage:  "aws Access Key ID",
+							EnvVar: "AWS_ACCESS_KEY_ID",
+						},
+						cli.StringFlag{
+							Name:   "awsSecretAccessKey",
+							Usage:  "aws Secret Access Key",
+							EnvVar: "AWS_SECRET_ACCESS_KEY",
+						},
+						cli.StringFlag{
+							Name:   "awsBucketRegion",
+							Usage:  "aws Bucket Region",
+							EnvVar: "AWS_DEFAULT_REGION",
+						},
+						cli.StringFlag{
+							Name:  "awsBucketName",
+							Usage: "awsBucketName",
+							Value: defaultBucket,
+						},
+						cli.StringFlag{
+							Name:  "local-dir",
+							Usage: "Use this directory instead of AWS S3, e.g. USB disk or NFS mount. Bucket is one sub directory in it",
+						},
+						cli.StringFlag{
+							Name:   "encrypt-key, k",
+							Usage:  "Master key to decrypt restored files",
+							EnvVar: "LOMOB_MASTER_KEY",
+						},
+						cli.BoolFlag{
+							Name:  "wait",
+							Usage: "Check again periodically until all requested restores are downloaded",
+						},
+						cli.DurationFlag{
+							Name:  "interval",
+							Usage: "Interval between checks with --wait",
+							Value: 15 * time.Minute,
+						},
+						cli.IntFlag{
+							Name:  "nthreads,n",
+							Usage: "Number of parallel ranged download",
+							Value: 3,
+						},
 					},
 				},
 				{
@@ -377,6 +1045,61 @@ func main() {
 					Action: listISO,
 					Usage:  "List all created iso files",
 				},
+				{
+					Name:   "copies",
+					Action: listCopies,
+					Usage:  "List copies of isos in all destinations",
+				},
+			},
+		},
+		{
+			Name:   "cost",
+			Action: estimateCost,
+			Usage:  "Estimate cost of scanned files in each storage class, and recommend iso size and part size",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "pricing",
+					Usage: "JSON file of prices overriding the built in ones of AWS us-east-1",
+				},
+				cli.StringFlag{
+					Name:  "storage-class",
+					Usage: "Storage class to recommend iso size and part size for",
+					Value: "DEEP_ARCHIVE",
+				},
+				cli.IntFlag{
+					Name:  "months",
+					Usage: "Horizon of total cost",
+					Value: 12,
+				},
+				cli.IntFlag{
+					Name:  "verifies",
+					Usage: "Number of verifications of each object per month",
+					Value: 1,
+				},
+				cli.IntFlag{
+					Name:  "full-restores",
+					Usage: "Number of restores of all objects over the horizon",
+				},
+				cli.IntFlag{
+					Name:  "file-restores",
+					Usage: "Number of restores of single file over the horizon, which retrieve the whole iso in archive classes",
+					Value: 2,
+				},
+				cli.StringFlag{
+					Name:  "iso-size,s",
+					Usage: "Size of isos created for files not packed yet. KB=1000 Byte",
+					Value: "5G",
+				},
+				cli.StringFlag{
+					Name:  "part-size,p",
+					Usage: "Size of each upload partition. KB=1000 Byte",
+					Value: "100M",
+				},
+				cli.StringFlag{
+					Name:  "max-part-size",
+					Usage: "Max part size to recommend, as one failed part is uploaded again as a whole. KB=1000 Byte",
+					Value: "1G",
+				},
 			},
 		},
 		{
@@ -398,6 +1121,11 @@ func main() {
 							Name:  "part-size,p",
 							Usage: "Size of each upload partition. KB=1000 Byte. 0 means no part. Mainly for local test purpose",
 						},
+						cli.StringFlag{
+							Name:  "compress",
+							Usage: "Compress before encryption. Valid choices are: none | gzip | xz | lz4. Compressed media formats are skipped",
+							Value: "none",
+						},
 					},
 				},
 				{
@@ -415,6 +1143,11 @@ func main() {
 							Name:  "output, o",
 							Usage: "Saved file name",
 						},
+						cli.StringFlag{
+							Name:  "compress",
+							Usage: "Decompress after decryption with the codec given to encrypt. Valid choices are: none | gzip | xz | lz4",
+							Value: "none",
+						},
 					},
 				},
 				{
@@ -434,6 +1167,41 @@ func main() {
 						},
 					},
 				},
+				{
+					Name:      "parity",
+					Action:    genParityCmd,
+					Usage:     "Generate Reed-Solomon parity file for local file",
+					ArgsUsage: "[filename] [[parity filename]]. If parity filename is not given, it will be <filename>.par",
+					Flags: []cli.Flag{
+						cli.IntFlag{
+							Name:  "parity-shards",
+							Usage: "Number of parity blocks per group",
+							Value: 2,
+						},
+						cli.IntFlag{
+							Name:  "parity-data-shards",
+							Usage: "Number of data blocks per parity group",
+							Value: 10,
+						},
+						cli.StringFlag{
+							Name:  "parity-block-size",
+							Usage: "Size of each parity block. KB=1000 Byte",
+							Value: "1M",
+						},
+					},
+				},
+				{
+					Name:      "repair",
+					Action:    repairCmd,
+					Usage:     "Verify and repair damaged blocks of downloaded file with its parity file",
+					ArgsUsage: "[filename] [[parity filename]]. If parity filename is not given, it will be <filename>.par",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "verify-only",
+							Usage: "Only report damaged blocks without modifying the file",
+						},
+					},
+				},
 				{
 					Name:   "list-inprogress-upload",
 					Action: listUploadingItems,
@@ -463,6 +1231,10 @@ func main() {
 							Usage: "awsBucketName",
 							Value: defaultBucket,
 						},
+						cli.StringFlag{
+							Name:  "local-dir",
+							Usage: "Use this directory instead of AWS S3, e.g. USB disk or NFS mount. Bucket is one sub directory in it",
+						},
 					},
 				},
 				{
@@ -491,6 +1263,10 @@ func main() {
 							Usage: "awsBucketName",
 							Value: defaultBucket,
 						},
+						cli.StringFlag{
+							Name:  "local-dir",
+							Usage: "Use this directory instead of AWS S3, e.g. USB disk or NFS mount. Bucket is one sub directory in it",
+						},
 					},
 				},
 				{
@@ -519,6 +1295,10 @@ func main() {
 							Usage: "awsBucketName",
 							Value: defaultBucket,
 						},
+						cli.StringFlag{
+							Name:  "local-dir",
+							Usage: "Use this directory instead of AWS S3, e.g. USB disk or NFS mount. Bucket is one sub directory in it",
+						},
 						cli.BoolFlag{
 							Name:  "no-encrypt",
 							Usage: "not do any encryption, and upload raw files",
@@ -533,6 +1313,47 @@ func main() {
 							Usage: "The  type  of storage to use for the object. Valid choices are: DEEP_ARCHIVE | GLACIER | GLACIER_IR | INTELLIGENT_TIERING | ONE-ZONE_IA | REDUCED_REDUNDANCY | STANDARD | STANDARD_IA.",
 							Value: "STANDARD",
 						},
+						cli.StringFlag{
+							Name:  "compress",
+							Usage: "Compress before encryption. Valid choices are: none | gzip | xz | lz4. Compressed media formats are skipped",
+							Value: "none",
+						},
+					},
+				},
+				{
+					Name:   "s3-probe",
+					Action: probeBackend,
+					Usage:  "Check if S3 compatible service supports multipart upload and sha256 checksum which uploads need",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "awsAccessKeyID",
+							Usage:  "aws Access Key ID",
+							EnvVar: "AWS_ACCESS_KEY_ID",
+						},
+						cli.StringFlag{
+							Name:   "awsSecretAccessKey",
+							Usage:  "aws Secret Access Key",
+							EnvVar: "AWS_SECRET_ACCESS_KEY",
+						},
+						cli.StringFlag{
+							Name:   "awsBucketRegion",
+							Usage:  "aws Bucket Region",
+							EnvVar: "AWS_DEFAULT_REGION",
+						},
+						cli.StringFlag{
+							Name:  "awsBucketName",
+							Usage: "awsBucketName",
+							Value: defaultBucket,
+						},
+						cli.StringFlag{
+							Name:  "local-dir",
+							Usage: "Use this directory instead of AWS S3, e.g. USB disk or NFS mount. Bucket is one sub directory in it",
+						},
+						cli.StringFlag{
+							Name:  "storage-class",
+							Usage: "The storage class used by probe objects, which should be the one of real uploads",
+							Value: "STANDARD",
+						},
 					},
 				},
 				{
@@ -586,11 +1407,7 @@ func main() {
 			},
 		},
 	}
-
-	if err := app.Run(os.Args); err != nil {
-		logrus.Errorf(err.Error())
-		return
-	}
+	return app
 }
 
 func initLogLevel(level int) error {
@@ -602,13 +1419,127 @@ func initLogLevel(level int) error {
 	return nil
 }
 
+func initGlobalOptions(ctx *cli.Context) error {
+	err := initProgress(ctx.GlobalString("progress"), ctx.GlobalDuration("progress-interval"))
+	if err != nil {
+		return err
+	}
+	err = initRetryPolicy(ctx)
+	if err != nil {
+		return err
+	}
+	schedule, err := bwlimit.ParseSchedule(ctx.GlobalString("bwlimit"))
+	if err != nil {
+		return err
+	}
+	bwLimiter = bwlimit.NewLimiter(schedule)
+	awsCredentials = clients.Credentials{
+		SessionToken:    ctx.GlobalString("aws-session-token"),
+		Profile:         ctx.GlobalString("aws-profile"),
+		RoleARN:         ctx.GlobalString("aws-role-arn"),
+		RoleExternalID:  ctx.GlobalString("aws-role-external-id"),
+		RoleSessionName: ctx.GlobalString("aws-role-session-name"),
+		MFASerial:       ctx.GlobalString("aws-mfa-serial"),
+		RoleDuration:    ctx.GlobalDuration("aws-role-duration"),
+	}
+	s3ObjectTags = ctx.GlobalBool("s3-object-tags")
+	return initS3Endpoint(ctx)
+}
+
+func initS3Endpoint(ctx *cli.Context) error {
+	s3Endpoint = clients.Endpoint{
+		URL:               ctx.GlobalString("s3-endpoint"),
+		PathStyle:         ctx.GlobalBool("s3-path-style"),
+		CABundle:          ctx.GlobalString("s3-ca-bundle"),
+		InsecureTLS:       ctx.GlobalBool("s3-insecure-tls"),
+		Proxy:             ctx.GlobalString("s3-proxy"),
+		UnsignedPayload:   ctx.GlobalBool("s3-unsigned-payload"),
+		DisableContentMD5: ctx.GlobalBool("s3-disable-content-md5"),
+	}
+	if s3Endpoint.InsecureTLS {
+		logrus.Warn("TLS certificate of S3 endpoint is not verified")
+	}
+	return nil
+}
+
+func initProgress(mode string, interval time.Duration) error {
+	switch mode {
+	case "auto":
+		if term.IsTerminal(int(os.Stderr.Fd())) {
+			progressReporter = progress.NewTerminal(os.Stderr)
+		} else {
+			progressReporter = progress.NewLogger(interval)
+		}
+	case "tty":
+		progressReporter = progress.NewTerminal(os.Stderr)
+	case "log":
+		progressReporter = progress.NewLogger(interval)
+	case "none":
+		progressReporter = nil
+	default:
+		return fmt.Errorf("invalid progress mode '%s', expect auto, tty, log or none", mode)
+	}
+	return nil
+}
+
+// newAWSClient authenticates with given access key, or with global credentials options if it is empty
+func newAWSClient(keyID, key, region string) (*clients.AWSClient, error) {
+	creds := awsCredentials
+	creds.AccessKeyID = keyID
+	creds.SecretAccessKey = key
+	return clients.NewAWSClient(region, &clients.Config{
+		Retry:       retryPolicy,
+		Limiter:     bwLimiter,
+		Endpoint:    s3Endpoint,
+		Credentials: creds,
+		ObjectTags:  s3ObjectTags,
+	})
+}
+
+// newBackend returns directory backend if --local-dir is given, otherwise AWS S3 client. The location
+// returned is recorded as iso's region in DB, which is directory URL for directory backend, and endpoint
+// URL for S3 compatible service
+func newBackend(ctx *cli.Context) (clients.Backend, string, error) {
+	if dir := ctx.String("local-dir"); dir != "" {
+		lb, err := clients.NewLocalBackend(dir)
+		if err != nil {
+			return nil, "", err
+		}
+		return lb, "file://" + lb.Root(), nil
+	}
+	cli, err := newAWSClient(ctx.String("awsAccessKeyID"), ctx.String("awsSecretAccessKey"),
+		ctx.String("awsBucketRegion"))
+	if err != nil {
+		return nil, "", err
+	}
+	if s3Endpoint.URL != "" {
+		return cli, s3Endpoint.URL, nil
+	}
+	return cli, cli.Region(), nil
+}
+
+func initRetryPolicy(ctx *cli.Context) error {
+	retryPolicy = retry.Policy{
+		MaxRetries: ctx.GlobalInt("max-retries"),
+		BaseDelay:  ctx.GlobalDuration("retry-base-delay"),
+		MaxDelay:   ctx.GlobalDuration("retry-max-delay"),
+	}
+	if retryPolicy.MaxRetries < 0 || retryPolicy.BaseDelay < 0 || retryPolicy.MaxDelay < retryPolicy.BaseDelay {
+		return errors.New("invalid retry policy, max delay should be no less than base delay")
+	}
+	return nil
+}
+
 func initDB(dbname string) (err error) {
 	db, err = dbx.OpenDB(dbname)
 	return err
 }
 
 func getAWSStorageClass(ctx *cli.Context) (string, error) {
-	c := ctx.String("storage-class")
+	return checkStorageClass(ctx.String("storage-class"))
+}
+
+func checkStorageClass(c string) (string, error) {
 	switch c {
 	case "DEEP_ARCHIVE":
 		fallthrough
@@ -629,3 +1560,27 @@ func getAWSStorageClass(ctx *cli.Context) (string, error) {
 	}
 	return "", fmt.Errorf("Invalid storage class: %s", c)
 }
+
+// getRetention returns nil if iso is not locked
+func getRetention(ctx *cli.Context) (*clients.Retention, error) {
+	return newRetention(ctx.String("lock-mode"), ctx.Int("lock-days"))
+}
+
+// newRetention returns nil if mode is none or empty
+func newRetention(mode string, days int) (*clients.Retention, error) {
+	mode = strings.ToUpper(mode)
+	switch mode {
+	case "", "NONE":
+		if days != 0 {
+			return nil, errors.New("--lock-days needs --lock-mode governance or compliance")
+		}
+		return nil, nil
+	case "GOVERNANCE", "COMPLIANCE":
+	default:
+		return nil, fmt.Errorf("Invalid lock mode: %s", mode)
+	}
+	if days <= 0 {
+		return nil, errors.New("--lock-days should be positive when iso is locked")
+	}
+	return &clients.Retention{Mode: mode, Until: time.Now().AddDate(0, 0, days)}, nil
+}
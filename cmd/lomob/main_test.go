@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/filesystem/iso9660"
+	"github.com/lomorage/lomo-backup/clients"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli"
+)
+
+// TestMain runs test binary as mkisofs if it is called so, which is linked into PATH of tests
+func TestMain(m *testing.M) {
+	if filepath.Base(os.Args[0]) == "mkisofs" {
+		err := fakeMkisofs(os.Args[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	binDir, err := os.MkdirTemp("", "lomob-test-bin-")
+	if err != nil {
+		panic(err)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		panic(err)
+	}
+	err = os.Symlink(exe, filepath.Join(binDir, "mkisofs"))
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	code := m.Run()
+	os.RemoveAll(binDir)
+	os.Exit(code)
+}
+
+// fakeMkisofs supports "-R -V label -o output dir" only
+func fakeMkisofs(args []string) error {
+	var output, label string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-o":
+			i++
+			output = args[i]
+		case "-V":
+			i++
+			label = args[i]
+		}
+	}
+	// mkisofs overwrites existing output
+	err := os.Remove(output)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return makeTestISO(args[len(args)-1], output, label)
+}
+
+// makeTestISO creates iso with rock ridge extension from files in dir
+func makeTestISO(dir, output, label string) error {
+	var size int64
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err == nil {
+			size += info.Size()
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	img, err := diskfs.Create(output, size+10*1024*1024, diskfs.Raw, diskfs.SectorSizeDefault)
+	if err != nil {
+		return err
+	}
+	img.LogicalBlocksize = 2048
+	isofs, err := img.CreateFilesystem(disk.FilesystemSpec{Partition: 0, FSType: filesystem.TypeISO9660,
+		WorkDir: dir})
+	if err != nil {
+		return err
+	}
+	return isofs.(*iso9660.FileSystem).Finalize(iso9660.FinalizeOptions{RockRidge: true,
+		DeepDirectories: true, VolumeIdentifier: label})
+}
+
+// newTestDB creates DB with all schemas in temp dir as the global DB, and returns its filename
+func newTestDB(t *testing.T) string {
+	filename := filepath.Join(t.TempDir(), "lomob.db")
+	require.Nil(t, initDB(filename))
+	oldStoreDir := isoStoreDir
+	isoStoreDir = t.TempDir()
+	t.Cleanup(func() { isoStoreDir = oldStoreDir })
+	return filename
+}
+
+// execTestDB runs statement on DB directly, e.g. to lose records of uploads
+func execTestDB(t *testing.T, dbFilename, stmt string, args ...interface{}) {
+	raw, err := sql.Open("sqlite3", dbFilename)
+	require.Nil(t, err)
+	defer raw.Close()
+	_, err = raw.Exec(stmt, args...)
+	require.Nil(t, err, stmt)
+}
+
+// writeTestFile writes size bytes of content derived from path, modified at the given day
+func writeTestFile(t *testing.T, filename string, size int, day int) {
+	require.Nil(t, os.MkdirAll(filepath.Dir(filename), 0755))
+	content := make([]byte, size)
+	seed := []byte(filename)
+	for i := range content {
+		content[i] = seed[i%len(seed)] + byte(i/len(seed))
+	}
+	require.Nil(t, os.WriteFile(filename, content, 0644))
+	modTime := time.Date(2024, time.April, day, 12, 0, 0, 0, time.UTC)
+	require.Nil(t, os.Chtimes(filename, modTime, modTime))
+}
+
+// shortTempDir returns temp dir whose path is short enough to be one iso9660 directory name once it is
+// flattened in staging directory
+func shortTempDir(t *testing.T) string {
+	dir, err := os.MkdirTemp("", "lb")
+	require.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func scanTestDir(t *testing.T, dir string) {
+	require.Nil(t, scanDirectory(dir, 2, defaultIgnoreFiles, defaultIgnoreDirs))
+}
+
+// runApp runs lomob command line with DB of test and no progress output. Errors with exit code, e.g. the
+// ones of commands executed, are returned instead of exiting test
+func runApp(t *testing.T, dbFilename string, args ...string) error {
+	oldExiter := cli.OsExiter
+	cli.OsExiter = func(int) {}
+	defer func() { cli.OsExiter = oldExiter }()
+	return newApp().Run(append([]string{"lomob", "--db", dbFilename, "--progress", "none"}, args...))
+}
+
+// countingBackend records parts uploaded into backend, and fails parts from failFrom if it is not 0
+type countingBackend struct {
+	clients.Backend
+	failFrom int64
+
+	mu    sync.Mutex
+	parts []int64
+}
+
+func (b *countingBackend) Upload(ctx context.Context, partNo, length int64, request *clients.UploadRequest,
+	reader io.ReadSeeker, checksum string) (string, error) {
+	if b.failFrom != 0 && partNo >= b.failFrom {
+		return "", errors.New("upload interrupted")
+	}
+	b.mu.Lock()
+	b.parts = append(b.parts, partNo)
+	b.mu.Unlock()
+	return b.Backend.Upload(ctx, partNo, length, request, reader, checksum)
+}
+
+// uploaded returns part numbers uploaded in order
+func (b *countingBackend) uploaded() []int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	parts := append([]int64{}, b.parts...)
+	sort.Slice(parts, func(i, j int) bool { return parts[i] < parts[j] })
+	return parts
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/lomorage/lomo-backup/clients"
+	"github.com/lomorage/lomo-backup/common/crypto"
+	"github.com/lomorage/lomo-backup/common/datasize"
+	"github.com/lomorage/lomo-backup/common/parity"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+func mkParityFilename(filename string) string {
+	return filename + ".par"
+}
+
+// getParityOptions returns parity options from flags. ParityShards is 0 if parity is disabled
+func getParityOptions(ctx *cli.Context) (parity.Options, error) {
+	return newParityOptions(ctx.String("parity-block-size"), ctx.Int("parity-data-shards"),
+		ctx.Int("parity-shards"))
+}
+
+func newParityOptions(blockSize string, dataShards, parityShards int) (parity.Options, error) {
+	bs, err := datasize.ParseString(blockSize)
+	if err != nil {
+		return parity.Options{}, err
+	}
+	opts := parity.Options{
+		BlockSize:    int(bs),
+		DataShards:   dataShards,
+		ParityShards: parityShards,
+	}
+	if opts.ParityShards < 0 {
+		return opts, errors.Errorf("invalid parity shards: %d", opts.ParityShards)
+	}
+	if opts.ParityShards != 0 && (opts.DataShards <= 0 || opts.DataShards+opts.ParityShards > parity.MaxShards) {
+		return opts, errors.Errorf("data shards plus parity shards must be between 2 and %d", parity.MaxShards)
+	}
+	return opts, nil
+}
+
+// genParityFile generates parity file for size bytes read from r. It writes into one tmp file
+// firstly so that one partial parity file won't be reused
+func genParityFile(r io.Reader, size int64, parFilename string, opts parity.Options) error {
+	tmpFilename := parFilename + ".tmp"
+	f, err := os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFilename)
+
+	err = parity.Generate(f, r, size, opts)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, parFilename)
+}
+
+// uploadISOParity generates parity file for the object uploaded from srcFilename, and uploads it as
+// sidecar object <iso filename>.par. Parity is computed over the uploaded bytes, i.e. after compression
+// and encryption, so that the downloaded object can be repaired before decryption without master key
+func uploadISOParity(cli clients.Backend, bucket, storageClass, isoFilename, srcFilename, masterKey string,
+	opts parity.Options) error {
+	if opts.ParityShards == 0 {
+		return nil
+	}
+	parFilename := mkParityFilename(localISOPath(isoFilename))
+	remoteInfo, err := cli.HeadObject(bucket, filepath.Base(parFilename))
+	if err != nil {
+		return err
+	}
+	if remoteInfo != nil {
+		fmt.Printf("%s is already in bucket %s, no need upload again !\n", filepath.Base(parFilename), bucket)
+		return nil
+	}
+
+	src, err := os.Open(srcFilename)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	stat, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	var (
+		r    io.Reader = src
+		size           = stat.Size()
+	)
+	if masterKey != "" {
+		isoInfo, err := db.GetIsoByName(isoFilename)
+		if err != nil {
+			return err
+		}
+		if isoInfo == nil {
+			return errors.Errorf("%s is not found in DB", isoFilename)
+		}
+		decoded, err := hex.DecodeString(isoInfo.HashLocal)
+		if err != nil {
+			return err
+		}
+		if len(decoded) < crypto.SaltLen() {
+			return errors.Errorf("invalid hash length '%d', less than '%d'", len(decoded), crypto.SaltLen())
+		}
+		salt := decoded[:crypto.SaltLen()]
+		encryptKey := crypto.DeriveKeyFromMasterKey([]byte(masterKey), salt)
+		// same stream as uploadEncryptParts: salt followed by encrypted data
+		r, err = crypto.NewEncryptor(src, encryptKey, salt, true)
+		if err != nil {
+			return err
+		}
+		size += int64(crypto.SaltLen())
+	}
+
+	fmt.Printf("Generating parity file %s with %d data shards and %d parity shards\n", parFilename,
+		opts.DataShards, opts.ParityShards)
+	err = genParityFile(r, size, parFilename, opts)
+	if err != nil {
+		return err
+	}
+	err = uploadRawFileToS3(cli, bucket, storageClass, parFilename, binContentType)
+	if err != nil {
+		return err
+	}
+	return os.Remove(parFilename)
+}
+
+func genParityCmd(ctx *cli.Context) error {
+	if len(ctx.Args()) == 0 {
+		return errors.New("please provide filename to generate parity")
+	}
+	filename := ctx.Args()[0]
+	parFilename := mkParityFilename(filename)
+	if len(ctx.Args()) > 1 {
+		parFilename = ctx.Args()[1]
+	}
+
+	opts, err := getParityOptions(ctx)
+	if err != nil {
+		return err
+	}
+	if opts.ParityShards == 0 {
+		return errors.New("parity shards must be larger than 0")
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = genParityFile(f, stat.Size(), parFilename, opts)
+	if err != nil {
+		return err
+	}
+	h := &parity.Header{Options: opts, Size: stat.Size()}
+	fmt.Printf("Parity file %s is generated, size %s (%.1f%% of %s)\n", parFilename,
+		datasize.ByteSize(h.SidecarSize()).HR(), float64(h.SidecarSize())*100/float64(max(stat.Size(), 1)),
+		datasize.ByteSize(stat.Size()).HR())
+	return nil
+}
+
+func repairCmd(ctx *cli.Context) error {
+	if len(ctx.Args()) == 0 {
+		return errors.New("please provide filename to repair")
+	}
+	filename := ctx.Args()[0]
+	parFilename := mkParityFilename(filename)
+	if len(ctx.Args()) > 1 {
+		parFilename = ctx.Args()[1]
+	}
+	verifyOnly := ctx.Bool("verify-only")
+
+	sidecar, err := os.Open(parFilename)
+	if err != nil {
+		return err
+	}
+	defer sidecar.Close()
+	h, err := parity.ReadHeader(sidecar)
+	if err != nil {
+		return err
+	}
+
+	flag := os.O_RDWR
+	if verifyOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(filename, flag, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() != h.Size {
+		fmt.Printf("%s size is %d, but original size is %d\n", filename, stat.Size(), h.Size)
+	}
+
+	var report *parity.Report
+	if verifyOnly {
+		report, err = parity.Verify(f, sidecar)
+	} else {
+		report, err = parity.Repair(f, sidecar)
+	}
+	if err != nil {
+		return err
+	}
+	if !verifyOnly && stat.Size() > h.Size {
+		err = f.Truncate(h.Size)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Total blocks: %d, block size: %s\n", report.Blocks, datasize.ByteSize(h.BlockSize).HR())
+	fmt.Printf("Damaged blocks: %d %v\n", len(report.Damaged), report.Damaged)
+	if report.ParityDamaged > 0 {
+		fmt.Printf("Damaged parity blocks: %d\n", report.ParityDamaged)
+	}
+	if verifyOnly {
+		fmt.Printf("Repairable blocks: %d\n", report.Repaired)
+	} else {
+		fmt.Printf("Repaired blocks: %d\n", report.Repaired)
+	}
+	if !report.OK() {
+		return errors.Errorf("%d blocks are unable to be repaired: %v", len(report.Unrepairable),
+			report.Unrepairable)
+	}
+	if len(report.HashesDamaged) != 0 {
+		return errors.Errorf("block hashes of %d groups %v are damaged in %s, and their blocks are not verified."+
+			" Generate parity file again from one intact copy", len(report.HashesDamaged), report.HashesDamaged,
+			parFilename)
+	}
+	if len(report.Damaged) == 0 {
+		fmt.Printf("%s is intact\n", filename)
+	} else if !verifyOnly {
+		fmt.Printf("%s is repaired\n", filename)
+	}
+	return nil
+}
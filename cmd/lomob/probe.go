@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/lomorage/lomo-backup/clients"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+func probeBackend(ctx *cli.Context) error {
+	storageClass, err := getAWSStorageClass(ctx)
+	if err != nil {
+		return err
+	}
+	backend, region, err := newBackend(ctx)
+	if err != nil {
+		return err
+	}
+	bucket := ctx.String("awsBucketName")
+	fmt.Printf("Probing bucket %s in %s\n", bucket, region)
+
+	results := clients.Probe(context.Background(), backend, bucket, storageClass)
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 4, ' ', tabwriter.TabIndent)
+	fmt.Fprint(writer, "Check\tResult\tDetail\n")
+	failed := 0
+	for _, r := range results {
+		switch {
+		case r.Skipped:
+			fmt.Fprintf(writer, "%s\tSKIP\t\n", r.Check)
+		case r.Err != nil:
+			failed++
+			// keep SDK's multiple line error in one row
+			fmt.Fprintf(writer, "%s\tFAIL\t%s\n", r.Check, strings.ReplaceAll(r.Err.Error(), "\n", " "))
+		default:
+			fmt.Fprintf(writer, "%s\tPASS\t\n", r.Check)
+		}
+	}
+	writer.Flush()
+
+	if failed > 0 {
+		return errors.Errorf("%d of %d checks failed, uploads to this bucket may not work", failed, len(results))
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lomorage/lomo-backup/clients"
+	"github.com/lomorage/lomo-backup/common"
+	"github.com/lomorage/lomo-backup/common/types"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// knownUpload is one multipart upload in DB, either of iso uploaded by upload iso or of its copy uploaded
+// by replicate. Upload info of iso and status of parts are the ones of this upload
+type knownUpload struct {
+	iso   *types.ISOInfo
+	parts []*types.PartInfo
+	state uploadState
+}
+
+// listKnownUploads returns uploads in progress in given bucket recorded in DB, keyed by upload ID
+func listKnownUploads(region, bucket string) (map[string]*knownUpload, error) {
+	isos, err := db.ListISOs()
+	if err != nil {
+		return nil, err
+	}
+	copies, err := db.ListArchiveCopies()
+	if err != nil {
+		return nil, err
+	}
+
+	uploads := map[string]*knownUpload{}
+	add := func(iso *types.ISOInfo, state uploadState) error {
+		parts, err := db.GetPartsByIsoID(iso.ID)
+		if err != nil {
+			return err
+		}
+		err = state.load(iso, parts)
+		if err != nil {
+			return err
+		}
+		uploads[iso.UploadID] = &knownUpload{iso: iso, parts: parts, state: state}
+		return nil
+	}
+
+	isoByID := map[int]*types.ISOInfo{}
+	for _, iso := range isos {
+		isoByID[iso.ID] = iso
+		if iso.Status == types.IsoUploaded || iso.UploadID == "" || iso.Region != region || iso.Bucket != bucket {
+			continue
+		}
+		err = add(iso, &isoUploadState{})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range copies {
+		if c.Status != types.CopyUploading || c.UploadID == "" || c.Region != region || c.Bucket != bucket {
+			continue
+		}
+		iso, ok := isoByID[c.IsoID]
+		if !ok {
+			continue
+		}
+		isoCopy := *iso
+		err = add(&isoCopy, &copyUploadState{copy: c})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return uploads, nil
+}
+
+// adoptParts marks parts in bucket whose checksums are the same as DB as uploaded, and parts uploaded in DB
+// but missing or different in bucket as failed, so that they are uploaded again on resume
+func adoptParts(cli clients.Backend, request *clients.UploadRequest, u *knownUpload, dryRun bool) (string, error) {
+	remoteParts, err := cli.ListParts(request)
+	if err != nil {
+		return "", err
+	}
+	remote := map[int]*types.PartInfo{}
+	for _, p := range remoteParts {
+		remote[p.PartNo] = p
+	}
+
+	var adopted, reset int
+	for _, p := range u.parts {
+		rp := remote[p.PartNo]
+		switch {
+		case rp != nil && p.HashRemote != "" && rp.HashRemote == p.HashRemote:
+			if p.Status == types.PartUploaded && p.Etag == rp.Etag {
+				continue
+			}
+			p.Status = types.PartUploaded
+			p.Etag = rp.Etag
+			adopted++
+		case p.Status == types.PartUploaded:
+			p.Status = types.PartUploadFailed
+			reset++
+		default:
+			continue
+		}
+		if dryRun {
+			continue
+		}
+		err = u.state.savePart(p)
+		if err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%s: %d of %d parts in bucket, %d adopted, %d to upload again", u.iso.Name,
+		len(remoteParts), len(u.parts), adopted, reset), nil
+}
+
+// resetUpload clears upload which is not in bucket any more, e.g. aborted or expired by lifecycle rule, so
+// that next upload starts a new one instead of failing with no such upload
+func resetUpload(u *knownUpload, dryRun bool) error {
+	u.iso.UploadKey = ""
+	u.iso.UploadID = ""
+	if dryRun {
+		return nil
+	}
+	err := u.state.saveRequest(u.iso)
+	if err != nil {
+		return err
+	}
+	for _, p := range u.parts {
+		if p.Status == types.PartUploading {
+			continue
+		}
+		p.Status = types.PartUploading
+		err = u.state.savePart(p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func reconcileUploads(ctx *cli.Context) error {
+	err := initLogLevel(ctx.GlobalInt("log-level"))
+	if err != nil {
+		return err
+	}
+
+	err = initDB(ctx.GlobalString("db"))
+	if err != nil {
+		return err
+	}
+
+	abortAfter := ctx.Duration("abort-after")
+	if abortAfter < 0 {
+		return errors.Errorf("invalid age to abort unknown uploads: %s", abortAfter)
+	}
+	dryRun := ctx.Bool("dry-run")
+	bucket := ctx.String("awsBucketName")
+
+	cli, region, err := newBackend(ctx)
+	if err != nil {
+		return err
+	}
+
+	requests, err := cli.ListMultipartUploads(bucket)
+	if err != nil {
+		return errors.Wrap(err, "while listing all multi part uploads")
+	}
+	known, err := listKnownUploads(region, bucket)
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		fmt.Println("Dry run, neither bucket nor DB is changed")
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 4, ' ', tabwriter.TabIndent)
+	fmt.Fprint(writer, "UploadKey\tUploadID\tUploadTime\tAction\n")
+
+	failed := 0
+	inBucket := map[string]bool{}
+	for _, r := range requests {
+		r.Bucket = bucket
+		inBucket[r.ID] = true
+
+		var (
+			action string
+			err    error
+		)
+		u, ok := known[r.ID]
+		switch {
+		case ok && u.iso.UploadKey == r.Key:
+			action, err = adoptParts(cli, r, u, dryRun)
+		case time.Since(r.Time) < abortAfter:
+			action = "not in DB, keep as it is newer than " + abortAfter.String()
+		default:
+			action = "not in DB, abort"
+			if !dryRun {
+				err = cli.AbortMultipartUpload(r)
+			}
+		}
+		if err != nil {
+			action = "failed: " + err.Error()
+			failed++
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", r.Key, r.ID, common.FormatTime(r.Time.Local()), action)
+	}
+
+	var gone []*knownUpload
+	for id, u := range known {
+		if !inBucket[id] {
+			gone = append(gone, u)
+		}
+	}
+	sort.Slice(gone, func(i, j int) bool {
+		return gone[i].iso.UploadID < gone[j].iso.UploadID
+	})
+	for _, u := range gone {
+		key, id := u.iso.UploadKey, u.iso.UploadID
+		action := u.iso.Name + ": not in bucket, reset in DB"
+		err = resetUpload(u, dryRun)
+		if err != nil {
+			action = "failed: " + err.Error()
+			failed++
+		}
+		fmt.Fprintf(writer, "%s\t%s\t\t%s\n", key, id, action)
+	}
+	writer.Flush()
+
+	if failed != 0 {
+		return errors.Errorf("failed to reconcile %d uploads", failed)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/lomorage/lomo-backup/clients"
+	"github.com/lomorage/lomo-backup/common/compress"
+	"github.com/lomorage/lomo-backup/common/datasize"
+	"github.com/lomorage/lomo-backup/common/parity"
+	"github.com/lomorage/lomo-backup/common/types"
+	"github.com/stretchr/testify/require"
+)
+
+// prepareLargeISO creates one iso of 4 parts of the smallest part size
+func prepareLargeISO(t *testing.T) (string, string) {
+	dbFilename := newTestDB(t)
+	dir := shortTempDir(t)
+	writeTestFile(t, filepath.Join(dir, "a.jpg"), 4000000, 1)
+	writeTestFile(t, filepath.Join(dir, "sub", "b.jpg"), 3000000, 2)
+	scanTestDir(t, dir)
+	created, err := createISOs(datasize.ByteSize(6000000), "", false, false)
+	require.Nil(t, err)
+	require.Len(t, created, 1)
+	return dbFilename, created[0]
+}
+
+// uploadTestISO uploads iso encrypted into directory backend, and returns parts uploaded in this run
+func uploadTestISO(t *testing.T, lb *clients.LocalBackend, isoFilename string, failFrom int64) ([]int64, error) {
+	cb := &countingBackend{Backend: lb, failFrom: failFrom}
+	err := uploadISO(cb, "file://"+lb.Root(), defaultBucket, "STANDARD", nil, isoFilename, testMasterKey, 5242880, 1,
+		compress.CodecNone, parity.Options{}, false, false, &isoUploadState{storageClass: "STANDARD"})
+	return cb.uploaded(), err
+}
+
+// interruptTestUpload uploads the first 2 parts of iso only, and returns its parts in DB
+func interruptTestUpload(t *testing.T, remoteDir, isoFilename string) (*clients.LocalBackend, []*types.PartInfo) {
+	lb, err := clients.NewLocalBackend(remoteDir)
+	require.Nil(t, err)
+	uploaded, err := uploadTestISO(t, lb, isoFilename, 3)
+	require.NotNil(t, err)
+	require.Equal(t, []int64{1, 2}, uploaded)
+	return lb, testISOParts(t, isoFilename)
+}
+
+func testISOParts(t *testing.T, isoFilename string) []*types.PartInfo {
+	iso, err := db.GetIsoByName(isoFilename)
+	require.Nil(t, err)
+	parts, err := db.GetPartsByIsoID(iso.ID)
+	require.Nil(t, err)
+	return parts
+}
+
+func partStatuses(parts []*types.PartInfo) []types.PartStatus {
+	statuses := make([]types.PartStatus, len(parts))
+	for i, p := range parts {
+		statuses[i] = p.Status
+	}
+	return statuses
+}
+
+func TestReconcileAdoptParts(t *testing.T) {
+	dbFilename, isoFilename := prepareLargeISO(t)
+	remoteDir := t.TempDir()
+	lb, parts := interruptTestUpload(t, remoteDir, isoFilename)
+	require.Len(t, parts, 4)
+	require.Equal(t, []types.PartStatus{types.PartUploaded, types.PartUploaded, types.PartUploadFailed,
+		types.PartUploadFailed}, partStatuses(parts))
+
+	// status of parts in bucket is lost, and part 3 is marked as uploaded while it isn't in bucket
+	execTestDB(t, dbFilename, "update parts set status=?, etag='' where part_no in (1, 2)", types.PartUploading)
+	execTestDB(t, dbFilename, "update parts set status=? where part_no=3", types.PartUploaded)
+
+	// dry run changes nothing
+	require.Nil(t, runApp(t, dbFilename, "upload", "reconcile", "--local-dir", remoteDir, "--dry-run"))
+	require.Equal(t, []types.PartStatus{types.PartUploading, types.PartUploading, types.PartUploaded,
+		types.PartUploadFailed}, partStatuses(testISOParts(t, isoFilename)))
+
+	require.Nil(t, runApp(t, dbFilename, "upload", "reconcile", "--local-dir", remoteDir))
+	parts = testISOParts(t, isoFilename)
+	require.Equal(t, []types.PartStatus{types.PartUploaded, types.PartUploaded, types.PartUploadFailed,
+		types.PartUploadFailed}, partStatuses(parts))
+	require.NotEmpty(t, parts[0].Etag)
+	require.NotEmpty(t, parts[1].Etag)
+
+	// resume uploads the parts not in bucket only
+	uploaded, err := uploadTestISO(t, lb, isoFilename, 0)
+	require.Nil(t, err)
+	require.Equal(t, []int64{3, 4}, uploaded)
+}
+
+func TestReconcileAbortUnknown(t *testing.T) {
+	dbFilename, isoFilename := prepareLargeISO(t)
+	remoteDir := t.TempDir()
+	lb, _ := interruptTestUpload(t, remoteDir, isoFilename)
+	unknown, err := lb.CreateMultipartUpload(defaultBucket, "other.iso", binContentType, "STANDARD", nil, nil)
+	require.Nil(t, err)
+
+	listIDs := func() []string {
+		requests, err := lb.ListMultipartUploads(defaultBucket)
+		require.Nil(t, err)
+		var ids []string
+		for _, r := range requests {
+			ids = append(ids, r.ID)
+		}
+		return ids
+	}
+	iso, err := db.GetIsoByName(isoFilename)
+	require.Nil(t, err)
+	require.ElementsMatch(t, []string{iso.UploadID, unknown.ID}, listIDs())
+
+	// upload not in DB is kept if it is newer than abort-after, or aborted otherwise
+	require.Nil(t, runApp(t, dbFilename, "upload", "reconcile", "--local-dir", remoteDir, "--abort-after", "1h"))
+	require.ElementsMatch(t, []string{iso.UploadID, unknown.ID}, listIDs())
+	require.Nil(t, runApp(t, dbFilename, "upload", "reconcile", "--local-dir", remoteDir, "--abort-after", "0s",
+		"--dry-run"))
+	require.ElementsMatch(t, []string{iso.UploadID, unknown.ID}, listIDs())
+	require.Nil(t, runApp(t, dbFilename, "upload", "reconcile", "--local-dir", remoteDir, "--abort-after", "0s"))
+	require.Equal(t, []string{iso.UploadID}, listIDs())
+
+	// upload known is still resumed
+	uploaded, err := uploadTestISO(t, lb, isoFilename, 0)
+	require.Nil(t, err)
+	require.Equal(t, []int64{3, 4}, uploaded)
+}
+
+func TestReconcileResetGone(t *testing.T) {
+	dbFilename, isoFilename := prepareLargeISO(t)
+	remoteDir := t.TempDir()
+	lb, _ := interruptTestUpload(t, remoteDir, isoFilename)
+
+	// upload is aborted in bucket, e.g. by lifecycle rule
+	iso, err := db.GetIsoByName(isoFilename)
+	require.Nil(t, err)
+	require.Nil(t, lb.AbortMultipartUpload(&clients.UploadRequest{ID: iso.UploadID, Bucket: defaultBucket,
+		Key: iso.UploadKey}))
+
+	require.Nil(t, runApp(t, dbFilename, "upload", "reconcile", "--local-dir", remoteDir))
+	iso, err = db.GetIsoByName(isoFilename)
+	require.Nil(t, err)
+	require.Empty(t, iso.UploadID)
+	require.Empty(t, iso.UploadKey)
+	require.Equal(t, []types.PartStatus{types.PartUploading, types.PartUploading, types.PartUploading,
+		types.PartUploading}, partStatuses(testISOParts(t, isoFilename)))
+
+	// new upload is started with all parts
+	uploaded, err := uploadTestISO(t, lb, isoFilename, 0)
+	require.Nil(t, err)
+	require.Equal(t, []int64{1, 2, 3, 4}, uploaded)
+}
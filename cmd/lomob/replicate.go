@@ -0,0 +1,449 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lomorage/lomo-backup/clients"
+	"github.com/lomorage/lomo-backup/common"
+	"github.com/lomorage/lomo-backup/common/compress"
+	"github.com/lomorage/lomo-backup/common/parity"
+	"github.com/lomorage/lomo-backup/common/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// destination is one bucket where copies of isos are kept
+type destination struct {
+	Name string `json:"name"`
+	// directory backend like USB disk or NFS mount if it is set, otherwise S3
+	LocalDir string `json:"local_dir"`
+	Region   string `json:"region"`
+	Bucket   string `json:"bucket"`
+	// S3 compatible service, AWS if it is empty
+	Endpoint  string `json:"endpoint"`
+	PathStyle bool   `json:"path_style"`
+	// profile in aws shared config and credentials files. Global credentials options are used if it is empty
+	Profile      string `json:"profile"`
+	StorageClass string `json:"storage_class"`
+	LockMode     string `json:"lock_mode"`
+	LockDays     int    `json:"lock_days"`
+
+	cli clients.Backend
+	// location recorded as region of copies, same as the one of upload iso
+	location string
+}
+
+// destinationsConfig is the json file given by --destinations
+type destinationsConfig struct {
+	// copies each iso needs, which is the number of destinations if it is 0
+	Copies       int            `json:"copies"`
+	Destinations []*destination `json:"destinations"`
+}
+
+func loadDestinations(filename string) (*destinationsConfig, error) {
+	if filename == "" {
+		return nil, errors.New("please provide destinations config with --destinations")
+	}
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	conf := &destinationsConfig{}
+	err = json.Unmarshal(content, conf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse %s", filename)
+	}
+	if len(conf.Destinations) == 0 {
+		return nil, errors.Errorf("no destination in %s", filename)
+	}
+	if conf.Copies == 0 {
+		conf.Copies = len(conf.Destinations)
+	}
+	if conf.Copies < 0 || conf.Copies > len(conf.Destinations) {
+		return nil, errors.Errorf("copies %d should be between 1 and the number of destinations %d", conf.Copies,
+			len(conf.Destinations))
+	}
+
+	names := map[string]bool{}
+	for _, d := range conf.Destinations {
+		if d.Name == "" || names[d.Name] {
+			return nil, errors.Errorf("destination name '%s' is empty or duplicated", d.Name)
+		}
+		names[d.Name] = true
+		if d.Bucket == "" {
+			d.Bucket = defaultBucket
+		}
+		if d.StorageClass == "" {
+			d.StorageClass = "STANDARD"
+		}
+		_, err = checkStorageClass(d.StorageClass)
+		if err != nil {
+			return nil, errors.Wrapf(err, "destination %s", d.Name)
+		}
+		_, err = newRetention(d.LockMode, d.LockDays)
+		if err != nil {
+			return nil, errors.Wrapf(err, "destination %s", d.Name)
+		}
+	}
+	return conf, nil
+}
+
+// connect creates backend of destination, and its location is the same as the one of newBackend
+func (d *destination) connect(keyID, key string) error {
+	if d.LocalDir != "" {
+		lb, err := clients.NewLocalBackend(d.LocalDir)
+		if err != nil {
+			return err
+		}
+		d.cli = lb
+		d.location = "file://" + lb.Root()
+		return nil
+	}
+
+	creds := awsCredentials
+	creds.AccessKeyID = keyID
+	creds.SecretAccessKey = key
+	if d.Profile != "" {
+		// profile may assume role itself, so global role isn't assumed again
+		creds = clients.Credentials{Profile: d.Profile, RoleDuration: awsCredentials.RoleDuration}
+	}
+	endpoint := s3Endpoint
+	endpoint.URL = d.Endpoint
+	endpoint.PathStyle = d.PathStyle
+	cli, err := clients.NewAWSClient(d.Region, &clients.Config{
+		Retry:       retryPolicy,
+		Limiter:     bwLimiter,
+		Endpoint:    endpoint,
+		Credentials: creds,
+		ObjectTags:  s3ObjectTags,
+	})
+	if err != nil {
+		return err
+	}
+	d.cli = cli
+	d.location = cli.Region()
+	if d.Endpoint != "" {
+		d.location = d.Endpoint
+	}
+	return nil
+}
+
+// copyUploadState is state of one copy uploaded by replicate. Parts are the same as the ones in parts table
+// except their status, so that all copies are the same object
+type copyUploadState struct {
+	copy *types.ArchiveCopy
+}
+
+func (s *copyUploadState) load(isoInfo *types.ISOInfo, parts []*types.PartInfo) error {
+	isoInfo.Region = s.copy.Region
+	isoInfo.Bucket = s.copy.Bucket
+	isoInfo.UploadKey = s.copy.UploadKey
+	isoInfo.UploadID = s.copy.UploadID
+	isoInfo.RetentionMode = s.copy.RetentionMode
+	isoInfo.RetainUntil = s.copy.RetainUntil
+
+	copyParts := map[int]*types.PartInfo{}
+	if s.copy.UploadID != "" {
+		ps, err := db.GetCopyParts(s.copy.ID)
+		if err != nil {
+			return err
+		}
+		for _, p := range ps {
+			copyParts[p.PartNo] = p
+		}
+	}
+	for _, p := range parts {
+		p.Status = types.PartUploading
+		p.Etag = ""
+		cp, ok := copyParts[p.PartNo]
+		if !ok {
+			continue
+		}
+		p.Status = cp.Status
+		p.Etag = cp.Etag
+		if cp.HashRemote != "" {
+			p.HashRemote = cp.HashRemote
+		}
+	}
+	return nil
+}
+
+func (s *copyUploadState) saveRequest(isoInfo *types.ISOInfo) error {
+	s.copy.Status = types.CopyUploading
+	s.copy.UploadKey = isoInfo.UploadKey
+	s.copy.UploadID = isoInfo.UploadID
+	s.copy.RetentionMode = isoInfo.RetentionMode
+	s.copy.RetainUntil = isoInfo.RetainUntil
+	err := db.UpdateArchiveCopyUploadInfo(s.copy)
+	if err != nil {
+		return err
+	}
+	return db.DeleteCopyParts(s.copy.ID)
+}
+
+func (s *copyUploadState) savePart(p *types.PartInfo) error {
+	return db.UpsertCopyPart(s.copy.ID, p)
+}
+
+func (s *copyUploadState) done(isoInfo *types.ISOInfo) error {
+	s.copy.UploadKey = ""
+	s.copy.UploadID = ""
+	err := s.uploaded(isoInfo.HashRemote)
+	if err != nil {
+		return err
+	}
+	return db.DeleteCopyParts(s.copy.ID)
+}
+
+func (s *copyUploadState) skipped(isoInfo *types.ISOInfo, remoteHash string) error {
+	logrus.Infof("%s is in %s %s already, record it as one copy", isoInfo.Name, s.copy.Region, s.copy.Bucket)
+	return s.uploaded(remoteHash)
+}
+
+func (s *copyUploadState) uploaded(remoteHash string) error {
+	s.copy.Status = types.CopyUploaded
+	s.copy.HashRemote = remoteHash
+	s.copy.VerifyTime = time.Now()
+	err := db.UpdateArchiveCopyUploadInfo(s.copy)
+	if err != nil {
+		return err
+	}
+	return db.UpdateArchiveCopyStatus(s.copy)
+}
+
+// verifyCopy checks copy against the checksum kept by storage and original hash in object metadata, without
+// downloading it. Copy is marked as broken if it is missing or different
+func verifyCopy(d *destination, iso *types.ISOInfo, c *types.ArchiveCopy) error {
+	remoteInfo, err := d.cli.HeadObject(c.Bucket, filepath.Base(iso.Name))
+	if err != nil {
+		return err
+	}
+	c.Destination = d.Name
+	c.Status = types.CopyBroken
+	switch {
+	case remoteInfo == nil:
+		logrus.Warnf("Copy of %s in destination %s is missing", iso.Name, d.Name)
+	case remoteInfo.Metadata[types.MetadataKeyHashOrig] != "" &&
+		remoteInfo.Metadata[types.MetadataKeyHashOrig] != iso.HashLocal:
+		logrus.Warnf("Copy of %s in destination %s has original hash %s, expect %s", iso.Name, d.Name,
+			remoteInfo.Metadata[types.MetadataKeyHashOrig], iso.HashLocal)
+	case c.HashRemote != "" && remoteInfo.HashRemote != "" &&
+		strings.Split(remoteInfo.HashRemote, "-")[0] != c.HashRemote:
+		logrus.Warnf("Copy of %s in destination %s has checksum %s, expect %s", iso.Name, d.Name,
+			remoteInfo.HashRemote, c.HashRemote)
+	default:
+		c.Status = types.CopyUploaded
+		c.VerifyTime = time.Now()
+	}
+	return db.UpdateArchiveCopyStatus(c)
+}
+
+func replicateISOs(ctx *cli.Context) error {
+	conf, err := loadDestinations(ctx.String("destinations"))
+	if err != nil {
+		return err
+	}
+	partSize, err := getPartSize(ctx)
+	if err != nil {
+		return err
+	}
+	nthreads := ctx.Int("nthreads")
+	if nthreads <= 0 {
+		return errors.Errorf("invalid number of threads: %d", nthreads)
+	}
+	codec, err := getCompressCodec(ctx)
+	if err != nil {
+		return err
+	}
+	parityOpts, err := getParityOptions(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = initDB(ctx.GlobalString("db"))
+	if err != nil {
+		return err
+	}
+
+	var isos []*types.ISOInfo
+	if len(ctx.Args()) == 0 {
+		all, err := db.ListISOs()
+		if err != nil {
+			return err
+		}
+		for _, iso := range all {
+			if iso.Status != types.IsoCreating {
+				isos = append(isos, iso)
+			}
+		}
+	}
+	for _, name := range ctx.Args() {
+		iso, err := db.GetIsoByName(filepath.Clean(name))
+		if err != nil {
+			return err
+		}
+		if iso == nil {
+			return errors.Errorf("%s is not found in DB", name)
+		}
+		isos = append(isos, iso)
+	}
+
+	for _, d := range conf.Destinations {
+		err = d.connect(ctx.String("awsAccessKeyID"), ctx.String("awsSecretAccessKey"))
+		if err != nil {
+			return errors.Wrapf(err, "destination %s", d.Name)
+		}
+	}
+
+	masterKey := ctx.String("encrypt-key")
+	if ctx.Bool("no-encrypt") {
+		masterKey = ""
+	} else if masterKey == "" {
+		masterKey, err = getMasterKey()
+		if err != nil {
+			return err
+		}
+	}
+
+	copies, err := db.ListArchiveCopies()
+	if err != nil {
+		return err
+	}
+	isoCopies := map[int][]*types.ArchiveCopy{}
+	for _, c := range copies {
+		isoCopies[c.IsoID] = append(isoCopies[c.IsoID], c)
+	}
+
+	var lacking []string
+	for _, iso := range isos {
+		n, err := replicateISO(conf, iso, isoCopies[iso.ID], masterKey, partSize, nthreads, codec, parityOpts,
+			ctx.Bool("no-verify"))
+		if err != nil {
+			return err
+		}
+		if n < conf.Copies {
+			logrus.Warnf("%s has %d copies, less than %d", iso.Name, n, conf.Copies)
+			lacking = append(lacking, iso.Name)
+		}
+	}
+	if len(lacking) != 0 {
+		return errors.Errorf("%d isos have less than %d copies: %s", len(lacking), conf.Copies,
+			strings.Join(lacking, ", "))
+	}
+	fmt.Printf("%d isos have %d copies at least\n", len(isos), conf.Copies)
+	return nil
+}
+
+// replicateISO verifies copies of iso in destinations, and uploads it into destinations in order until it has
+// enough copies. Copies in buckets not in destinations are counted without verification. It returns the
+// number of copies, and failed upload into one destination is logged and the next one is tried
+func replicateISO(conf *destinationsConfig, iso *types.ISOInfo, copies []*types.ArchiveCopy, masterKey string,
+	partSize, nthreads int, codec compress.Codec, parityOpts parity.Options, noVerify bool) (int, error) {
+	findCopy := func(d *destination) *types.ArchiveCopy {
+		for _, c := range copies {
+			if c.Region == d.location && c.Bucket == d.Bucket {
+				return c
+			}
+		}
+		return nil
+	}
+
+	for _, d := range conf.Destinations {
+		c := findCopy(d)
+		if noVerify || c == nil || c.Status != types.CopyUploaded {
+			continue
+		}
+		err := verifyCopy(d, iso, c)
+		if err != nil {
+			return 0, errors.Wrapf(err, "verify copy of %s in destination %s", iso.Name, d.Name)
+		}
+	}
+	n := 0
+	for _, c := range copies {
+		if c.Status == types.CopyUploaded {
+			n++
+		}
+	}
+
+	// parts are shared by all copies, so that copies must be compressed in the same way
+	parts, err := db.GetPartsByIsoID(iso.ID)
+	if err != nil {
+		return n, err
+	}
+	if len(parts) != 0 {
+		codec = iso.Codec
+	}
+
+	for _, d := range conf.Destinations {
+		if n >= conf.Copies {
+			break
+		}
+		c := findCopy(d)
+		if c != nil && c.Status == types.CopyUploaded {
+			continue
+		}
+		if _, err = os.Stat(localISOPath(iso.Name)); err != nil {
+			logrus.Warnf("Unable to replicate %s: %s", iso.Name, err)
+			return n, nil
+		}
+		if c == nil {
+			c = &types.ArchiveCopy{IsoID: iso.ID, IsoName: iso.Name, Region: d.location, Bucket: d.Bucket}
+			c.ID, err = db.InsertArchiveCopy(c)
+			if err != nil {
+				return n, err
+			}
+		}
+		c.Destination = d.Name
+		c.StorageClass = d.StorageClass
+
+		retention, err := newRetention(d.LockMode, d.LockDays)
+		if err != nil {
+			return n, err
+		}
+		fmt.Printf("Replicating %s into destination %s\n", iso.Name, d.Name)
+		err = uploadISO(d.cli, d.location, d.Bucket, d.StorageClass, retention, iso.Name, masterKey, partSize,
+			nthreads, codec, parityOpts, false, false, &copyUploadState{copy: c})
+		if err != nil {
+			logrus.Warnf("Replicate %s into destination %s: %s", iso.Name, d.Name, err)
+			continue
+		}
+		n++
+	}
+	return n, nil
+}
+
+func listCopies(ctx *cli.Context) error {
+	err := initDB(ctx.GlobalString("db"))
+	if err != nil {
+		return err
+	}
+	copies, err := db.ListArchiveCopies()
+	if err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 4, ' ', tabwriter.TabIndent)
+	defer writer.Flush()
+
+	fmt.Fprint(writer, "ISO\tDestination\tRegion\tBucket\tStorage Class\tStatus\tVerify Time\tLocked Until\tChecksum\n")
+	for _, c := range copies {
+		verifyTime := ""
+		if !c.VerifyTime.IsZero() {
+			verifyTime = common.FormatTime(c.VerifyTime.Local())
+		}
+		lock := ""
+		if c.RetentionMode != "" {
+			lock = common.FormatTime(c.RetainUntil.Local()) + " (" + c.RetentionMode + ")"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", c.IsoName, c.Destination, c.Region, c.Bucket,
+			c.StorageClass, c.Status, verifyTime, lock, c.HashRemote)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lomorage/lomo-backup/common/compress"
+	"github.com/lomorage/lomo-backup/common/datasize"
+	"github.com/lomorage/lomo-backup/common/parity"
+	"github.com/lomorage/lomo-backup/common/types"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestDestination connects destination in local dir, whose backend counts parts uploaded
+func newTestDestination(t *testing.T, name, dir string) (*destination, *countingBackend) {
+	d := &destination{Name: name, LocalDir: dir, Bucket: defaultBucket, StorageClass: "STANDARD"}
+	require.Nil(t, d.connect("", ""))
+	cb := &countingBackend{Backend: d.cli}
+	d.cli = cb
+	return d, cb
+}
+
+func replicateTestISO(t *testing.T, conf *destinationsConfig, isoFilename string) int {
+	iso, err := db.GetIsoByName(isoFilename)
+	require.Nil(t, err)
+	copies, err := db.ListArchiveCopies()
+	require.Nil(t, err)
+	var isoCopies []*types.ArchiveCopy
+	for _, c := range copies {
+		if c.IsoID == iso.ID {
+			isoCopies = append(isoCopies, c)
+		}
+	}
+	n, err := replicateISO(conf, iso, isoCopies, testMasterKey, 5242880, 1, compress.CodecNone,
+		parity.Options{}, false)
+	require.Nil(t, err)
+	return n
+}
+
+func TestReplicateResume(t *testing.T) {
+	dbFilename := newTestDB(t)
+	dir := shortTempDir(t)
+	writeTestFile(t, filepath.Join(dir, "a.jpg"), 4000000, 1)
+	writeTestFile(t, filepath.Join(dir, "sub", "b.jpg"), 3000000, 2)
+	scanTestDir(t, dir)
+	created, err := createISOs(datasize.ByteSize(6000000), "", false, false)
+	require.Nil(t, err)
+	require.Len(t, created, 1)
+	isoFilename := created[0]
+
+	// first copy is uploaded by upload iso
+	dirA, dirB := t.TempDir(), t.TempDir()
+	uploadTestISOs(t, dbFilename, dirA, isoFilename)
+	iso, err := db.GetIsoByName(isoFilename)
+	require.Nil(t, err)
+	parts, err := db.GetPartsByIsoID(iso.ID)
+	require.Nil(t, err)
+	require.True(t, len(parts) > 2)
+
+	// copy into second destination is interrupted after its first part
+	destA, cbA := newTestDestination(t, "a", dirA)
+	destB, cbB := newTestDestination(t, "b", dirB)
+	cbB.failFrom = 2
+	conf := &destinationsConfig{Copies: 2, Destinations: []*destination{destA, destB}}
+	require.Equal(t, 1, replicateTestISO(t, conf, isoFilename))
+	require.Equal(t, []int64{1}, cbB.uploaded())
+	copies, err := db.ListArchiveCopies()
+	require.Nil(t, err)
+	require.Len(t, copies, 2)
+	require.Equal(t, types.CopyUploading, copies[1].Status)
+	require.NotEmpty(t, copies[1].UploadID)
+
+	// complete copy is verified and skipped, and interrupted one is resumed from its second part
+	destA, cbA = newTestDestination(t, "a", dirA)
+	destB, cbB = newTestDestination(t, "b", dirB)
+	conf = &destinationsConfig{Copies: 2, Destinations: []*destination{destA, destB}}
+	require.Equal(t, 2, replicateTestISO(t, conf, isoFilename))
+	require.Empty(t, cbA.uploaded())
+	var rest []int64
+	for _, p := range parts[1:] {
+		rest = append(rest, int64(p.PartNo))
+	}
+	require.Equal(t, rest, cbB.uploaded())
+
+	copies, err = db.ListArchiveCopies()
+	require.Nil(t, err)
+	require.Len(t, copies, 2)
+	for _, c := range copies {
+		require.Equal(t, types.CopyUploaded, c.Status, c.Region)
+		require.Empty(t, c.UploadID)
+		require.False(t, c.VerifyTime.IsZero())
+	}
+	require.Equal(t, copies[0].HashRemote, copies[1].HashRemote)
+	copyA, err := os.ReadFile(filepath.Join(dirA, defaultBucket, isoFilename))
+	require.Nil(t, err)
+	copyB, err := os.ReadFile(filepath.Join(dirB, defaultBucket, isoFilename))
+	require.Nil(t, err)
+	require.Equal(t, copyA, copyB)
+
+	// both copies are complete, and nothing is uploaded again
+	destA, cbA = newTestDestination(t, "a", dirA)
+	destB, cbB = newTestDestination(t, "b", dirB)
+	conf = &destinationsConfig{Copies: 2, Destinations: []*destination{destA, destB}}
+	require.Equal(t, 2, replicateTestISO(t, conf, isoFilename))
+	require.Empty(t, cbA.uploaded())
+	require.Empty(t, cbB.uploaded())
+}
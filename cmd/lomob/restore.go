@@ -3,15 +3,30 @@ package main
 import (
 	"context"
 	"crypto/aes"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
 
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/lomorage/lomo-backup/clients"
+	"github.com/lomorage/lomo-backup/common"
+	"github.com/lomorage/lomo-backup/common/compress"
 	"github.com/lomorage/lomo-backup/common/crypto"
+	"github.com/lomorage/lomo-backup/common/datasize"
+	"github.com/lomorage/lomo-backup/common/dbx"
 	"github.com/lomorage/lomo-backup/common/gcloud"
+	lomohash "github.com/lomorage/lomo-backup/common/hash"
+	"github.com/lomorage/lomo-backup/common/progress"
+	"github.com/lomorage/lomo-backup/common/types"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
 
@@ -24,6 +39,8 @@ func restoreGdriveFile(ctx *cli.Context) error {
 		CredFilename:  ctx.String("cred"),
 		TokenFilename: ctx.String("token"),
 		RefreshToken:  true,
+		Retry:         retryPolicy,
+		Limiter:       bwLimiter,
 	})
 	if err != nil {
 		return fmt.Errorf("unable to retrieve Drive client: %v", err)
@@ -48,6 +65,16 @@ func restoreGdriveFile(ctx *cli.Context) error {
 			return err
 		}
 	}
+	// codec is recorded in metadata if the file is compressed before encryption
+	metadata, err := client.GetFileMetadata(fid)
+	if err != nil {
+		return err
+	}
+	codec, err := compress.ParseCodec(metadata[types.MetadataKeyCodec])
+	if err != nil {
+		return err
+	}
+
 	// final file, decrypt
 	readCloser, err := client.GetFile(fid)
 	if err != nil {
@@ -70,13 +97,18 @@ func restoreGdriveFile(ctx *cli.Context) error {
 	}
 	encryptKey := crypto.DeriveKeyFromMasterKey([]byte(masterKey), iv)
 
-	decryptor, err := crypto.NewDecryptor(dst, encryptKey, iv)
+	// decompress on the fly if the file is compressed before encryption
+	dw := compress.NewDecompressWriter(dst, codec)
+	decryptor, err := crypto.NewDecryptor(dw, encryptKey, iv)
 	if err != nil {
 		return err
 	}
 
 	_, err = io.Copy(decryptor, readCloser)
-	return err
+	if err != nil {
+		return err
+	}
+	return dw.Close()
 }
 
 func restoreAwsFile(ctx *cli.Context) error {
@@ -84,32 +116,456 @@ func restoreAwsFile(ctx *cli.Context) error {
 		return errors.New("please provide one iso filename and output filename")
 	}
 
-	accessKeyID := ctx.String("awsAccessKeyID")
-	accessKey := ctx.String("awsSecretAccessKey")
-	region := ctx.String("awsBucketRegion")
 	bucket := ctx.String("awsBucketName")
-
 	src := ctx.Args()[0]
-	dst, err := os.Create(ctx.Args()[1])
+
+	// parts in DB are used to verify downloaded chunks, while one object is restored without DB too, e.g. on
+	// one new machine, so DB is only read if it exists
+	var partsDB *dbx.DB
+	dbname := ctx.GlobalString("db")
+	_, err := os.Stat(dbname)
+	if err == nil {
+		partsDB, err = dbx.OpenDBReadOnly(dbname)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	cli, _, err := newBackend(ctx)
+	if err != nil {
+		return err
+	}
+	err = checkReadable(cli, bucket, src)
+	if err != nil {
+		return err
+	}
+
+	raw := ctx.Bool("raw")
+	masterKey := ctx.String("encrypt-key")
+	if !raw && masterKey == "" {
+		masterKey, err = getMasterKey()
+		if err != nil {
+			return err
+		}
+	}
+	return downloadObject(cli, partsDB, bucket, src, ctx.Args()[1], masterKey, raw, ctx.Int("nthreads"))
+}
+
+// checkReadable returns error if object doesn't exist, or is archived and not restored
+func checkReadable(cli clients.Backend, bucket, src string) error {
+	status, err := cli.GetArchiveStatus(bucket, src)
+	if err != nil {
+		return err
+	}
+	if status == nil {
+		return errors.Errorf("%s is not found in bucket %s", src, bucket)
+	}
+	if status.Readable() {
+		return nil
+	}
+	if status.Restoring {
+		return errors.Errorf("%s is being restored from %s, check it with 'lomob restore status'", src,
+			status.StorageClass)
+	}
+	return errors.Errorf("%s is in %s and needs restore before download, request it with 'lomob restore request'",
+		src, status.StorageClass)
+}
+
+// defaultDownloadChunkSize is used if ISO isn't in DB and part size isn't in object metadata
+const defaultDownloadChunkSize = 100 * 1024 * 1024
+
+// downloadObject downloads object into dstFilename, decrypted with masterKey unless raw is set, and verifies
+// it against hash saved in object metadata if any. Chunks are verified with parts in partsDB if it isn't nil. Object is downloaded in chunks in parallel into a temp
+// file, which is resumed if download is interrupted, and it is decrypted in order once all chunks are done
+func downloadObject(cli clients.Backend, partsDB *dbx.DB, bucket, src, dstFilename, masterKey string, raw bool,
+	nthreads int) error {
+	remoteInfo, err := cli.HeadObject(bucket, src)
+	if err != nil {
+		return err
+	}
+	if remoteInfo == nil {
+		return errors.Errorf("%s is not found in bucket %s", src, bucket)
+	}
+
+	// save object as it is, e.g. to repair it with parity file before decryption
+	downloadFilename := dstFilename
+	if !raw {
+		downloadFilename = dstFilename + ".download"
+	}
+	size := int64(remoteInfo.Size)
+	tracker := progress.NewTracker(progressReporter, "download "+src, size)
+	_, err = clients.Download(progress.WithTracker(context.Background(), tracker), cli, bucket, src, size,
+		downloadChunks(partsDB, src, remoteInfo), downloadFilename, downloadFilename+".state", nthreads)
+	tracker.Finish()
+	if err != nil {
+		return errors.Wrapf(err, "download %s, run it again to resume", src)
+	}
+
+	downloaded, err := os.Open(downloadFilename)
+	if err != nil {
+		return err
+	}
+	defer downloaded.Close()
+	h := sha256.New()
+
+	if raw {
+		_, err = io.Copy(h, downloaded)
+		if err != nil {
+			return err
+		}
+		return verifyRestoredHash(src, remoteInfo.Metadata[types.MetadataKeyHashEncrypt], h.Sum(nil))
+	}
+
+	codec, err := compress.ParseCodec(remoteInfo.Metadata[types.MetadataKeyCodec])
+	if err != nil {
+		return err
+	}
+	dst, err := os.Create(dstFilename)
 	if err != nil {
 		return err
 	}
 	defer dst.Close()
 
-	cli, err := clients.NewAWSClient(accessKeyID, accessKey, region)
+	dw := compress.NewDecompressWriter(io.MultiWriter(dst, h), codec)
+	decryptor := crypto.NewMasterDecryptor(dw, []byte(masterKey))
+	_, err = io.Copy(decryptor, downloaded)
+	if err != nil {
+		return err
+	}
+	err = dw.Close()
+	if err != nil {
+		return err
+	}
+	err = verifyRestoredHash(src, remoteInfo.Metadata[types.MetadataKeyHashOrig], h.Sum(nil))
+	if err != nil {
+		return err
+	}
+	return os.Remove(downloadFilename)
+}
+
+// downloadChunks splits object into its upload parts in DB, so that each chunk is verified with the part's
+// sha256. Otherwise object is split with part size in object metadata, and chunks are not verified
+func downloadChunks(partsDB *dbx.DB, src string, remoteInfo *types.ISOInfo) []*clients.DownloadChunk {
+	size := int64(remoteInfo.Size)
+	chunks, err := partChunks(partsDB, src, size)
+	if err != nil {
+		logrus.Warnf("Unable to verify downloaded chunks of %s with its parts in DB: %s", src, err)
+	}
+	if chunks != nil {
+		return chunks
+	}
+	chunkSize, err := strconv.Atoi(remoteInfo.Metadata[types.MetadataKeyPartSize])
+	if err != nil || chunkSize <= 0 {
+		chunkSize = defaultDownloadChunkSize
+	}
+	return clients.SplitChunks(size, int64(chunkSize))
+}
+
+// partChunks returns nil if ISO or its parts are not in DB
+func partChunks(partsDB *dbx.DB, src string, size int64) ([]*clients.DownloadChunk, error) {
+	if partsDB == nil {
+		return nil, nil
+	}
+	iso, err := partsDB.GetIsoByName(src)
+	if err != nil || iso == nil {
+		return nil, err
+	}
+	parts, err := partsDB.GetPartsByIsoID(iso.ID)
+	if err != nil || len(parts) == 0 {
+		return nil, err
+	}
+	slices.SortFunc(parts, func(a, b *types.PartInfo) int { return a.PartNo - b.PartNo })
+
+	var (
+		total  int64
+		chunks []*clients.DownloadChunk
+	)
+	for _, p := range parts {
+		if p.HashRemote == "" {
+			return nil, errors.Errorf("part %d has no hash", p.PartNo)
+		}
+		chunks = append(chunks, &clients.DownloadChunk{Offset: total, Length: int64(p.Size),
+			Checksum: p.HashRemote})
+		total += int64(p.Size)
+	}
+	// salt ahead of encrypted object is counted in the last part when uploaded, but not saved in DB
+	if total+int64(crypto.SaltLen()) == size {
+		chunks[len(chunks)-1].Length += int64(crypto.SaltLen())
+		total = size
+	}
+	if total != size {
+		return nil, errors.Errorf("parts in DB are %d bytes, but object is %d bytes", total, size)
+	}
+	return chunks, nil
+}
+
+// verifyRestoredHash compares hash of restored file with expected hex hash, which is skipped if it is empty
+func verifyRestoredHash(src, expected string, h []byte) error {
+	if expected == "" {
+		return nil
+	}
+	if got := lomohash.CalculateHashHex(h); got != expected {
+		return errors.Errorf("hash of restored %s is %s, but %s is saved when uploaded", src, got, expected)
+	}
+	fmt.Printf("%s is restored and its hash %s is verified\n", src, expected)
+	return nil
+}
+
+// restoreTiers maps tier given in command line to the one of S3 API
+var restoreTiers = map[string]string{
+	"bulk":      s3.TierBulk,
+	"standard":  s3.TierStandard,
+	"expedited": s3.TierExpedited,
+}
+
+func requestRestore(ctx *cli.Context) error {
+	if len(ctx.Args()) == 0 || len(ctx.Args()) > 2 {
+		return errors.New("please provide one iso filename, and optional output filename")
+	}
+	src := ctx.Args()[0]
+	output := filepath.Base(src)
+	if len(ctx.Args()) == 2 {
+		output = ctx.Args()[1]
+	}
+	tier, ok := restoreTiers[strings.ToLower(ctx.String("tier"))]
+	if !ok {
+		return errors.Errorf("invalid tier %s, valid choices are: bulk | standard | expedited", ctx.String("tier"))
+	}
+	days := ctx.Int("days")
+	if days <= 0 {
+		return errors.Errorf("invalid days %d, it must be positive", days)
+	}
+
+	err := initDB(ctx.GlobalString("db"))
+	if err != nil {
+		return err
+	}
+
+	bucket := ctx.String("awsBucketName")
+	cli, region, err := newBackend(ctx)
+	if err != nil {
+		return err
+	}
+	status, err := cli.GetArchiveStatus(bucket, src)
+	if err != nil {
+		return err
+	}
+	if status == nil {
+		return errors.Errorf("%s is not found in bucket %s", src, bucket)
+	}
+	if !status.Archived {
+		fmt.Printf("%s is not archived and can be downloaded directly with 'lomob restore aws'\n", src)
+		return nil
+	}
+
+	// restoring one restored object again changes its expiry
+	err = cli.RestoreObject(bucket, src, tier, days)
+	if err != nil {
+		return err
+	}
+	err = db.UpsertRestore(&types.RestoreInfo{
+		Name:   src,
+		Region: region,
+		Bucket: bucket,
+		Tier:   tier,
+		Days:   days,
+		Output: output,
+		Raw:    ctx.Bool("raw"),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restore of %s from %s is requested with %s tier for %d days. Run 'lomob restore status' to "+
+		"download it into %s once it is restored\n", src, status.StorageClass, tier, days, output)
+	return nil
+}
+
+func restoreStatus(ctx *cli.Context) error {
+	err := initDB(ctx.GlobalString("db"))
+	if err != nil {
+		return err
+	}
+
+	bucket := ctx.String("awsBucketName")
+	wait := ctx.Bool("wait")
+	interval := ctx.Duration("interval")
+	nthreads := ctx.Int("nthreads")
+	if wait && interval <= 0 {
+		return errors.Errorf("invalid interval %s", interval)
+	}
+	cli, region, err := newBackend(ctx)
 	if err != nil {
 		return err
 	}
 
 	masterKey := ctx.String("encrypt-key")
-	if masterKey == "" {
-		masterKey, err = getMasterKey()
+	for {
+		restores, err := db.ListRestores()
 		if err != nil {
 			return err
 		}
+		var (
+			current []*types.RestoreInfo
+			pending []*types.RestoreInfo
+		)
+		for _, r := range restores {
+			if r.Region != region || r.Bucket != bucket {
+				continue
+			}
+			current = append(current, r)
+			if r.Status == types.RestoreRequested {
+				pending = append(pending, r)
+			}
+		}
+		if len(current) == 0 {
+			fmt.Printf("No restore is requested in bucket %s\n", bucket)
+			return nil
+		}
+		// ask master key before waiting, so that download isn't blocked hours later
+		if wait && masterKey == "" && slices.ContainsFunc(pending, func(r *types.RestoreInfo) bool { return !r.Raw }) {
+			masterKey, err = getMasterKey()
+			if err != nil {
+				return err
+			}
+		}
+
+		// one failed restore doesn't stop checking the others, and it is checked again in next round
+		states := map[int]string{}
+		restoring := 0
+		var failed []string
+		for _, r := range pending {
+			states[r.ID], err = checkRestore(cli, r, &masterKey, nthreads)
+			if err != nil {
+				logrus.Warnf("Check restore of %s: %s", r.Name, err)
+				states[r.ID] = restoreStateFailed
+				failed = append(failed, fmt.Sprintf("%s: %s", r.Name, err))
+				continue
+			}
+			if states[r.ID] == restoreStateRestoring {
+				restoring++
+			}
+		}
+		printRestores(current, states)
+
+		if !wait || restoring == 0 {
+			if len(failed) != 0 {
+				return errors.Errorf("failed to check restore of %s", strings.Join(failed, "; "))
+			}
+			return nil
+		}
+		fmt.Printf("%d objects are being restored, check again in %s\n", restoring, interval)
+		time.Sleep(interval)
+	}
+}
+
+const (
+	restoreStateRestoring = "Restoring"
+	restoreStateFailed    = "Failed"
+)
+
+// checkRestore downloads object once it is restored, and returns its state
+func checkRestore(cli clients.Backend, r *types.RestoreInfo, masterKey *string, nthreads int) (string, error) {
+	status, err := cli.GetArchiveStatus(r.Bucket, r.Name)
+	if err != nil {
+		return "", err
+	}
+	if status == nil {
+		logrus.Warnf("%s is not found in bucket %s", r.Name, r.Bucket)
+		return "Not found", nil
+	}
+	if !status.Readable() {
+		if status.Restoring {
+			return restoreStateRestoring, nil
+		}
+		// restored copy is expired or restore request is lost
+		return "Not restored, request again", nil
+	}
+
+	r.ExpiryTime = status.RestoreExpiry
+	err = db.UpdateRestoreStatus(r.ID, types.RestoreRequested, r.ExpiryTime)
+	if err != nil {
+		return "", err
+	}
+	if !r.Raw && *masterKey == "" {
+		*masterKey, err = getMasterKey()
+		if err != nil {
+			return "", err
+		}
+	}
+	fmt.Printf("%s is restored, downloading it into %s\n", r.Name, r.Output)
+	err = downloadObject(cli, db, r.Bucket, r.Name, r.Output, *masterKey, r.Raw, nthreads)
+	if err != nil {
+		return "", errors.Wrapf(err, "download %s", r.Name)
+	}
+	r.Status = types.RestoreDownloaded
+	return r.Status.String(), db.UpdateRestoreStatus(r.ID, r.Status, r.ExpiryTime)
+}
+
+func printRestores(restores []*types.RestoreInfo, states map[int]string) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 4, ' ', tabwriter.TabIndent)
+	defer writer.Flush()
+
+	fmt.Fprint(writer, "Name\tTier\tDays\tRequest Time\tStatus\tExpiry Time\tOutput\n")
+	for _, r := range restores {
+		state, ok := states[r.ID]
+		if !ok {
+			state = r.Status.String()
+		}
+		expiry := ""
+		if !r.ExpiryTime.IsZero() {
+			expiry = common.FormatTime(r.ExpiryTime.Local())
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", r.Name, r.Tier, r.Days,
+			common.FormatTime(r.CreateTime.Local()), state, expiry, r.Output)
+	}
+}
+
+const (
+	// ranged download size of remote iso, which is cached as iso9660 reads directory records repeatedly
+	remoteISOBlockSize = 1024 * 1024
+	remoteISOMaxBlocks = 16
+)
+
+// restoreFilesInISO extracts files from remote iso with ranged downloads, so that only directory records
+// and the files' extents are downloaded instead of the whole iso
+func restoreFilesInISO(ctx *cli.Context) error {
+	err := initLogLevel(ctx.GlobalInt("log-level"))
+	if err != nil {
+		return err
+	}
+	if len(ctx.Args()) < 2 {
+		return errors.New("please provide one iso filename and paths in iso to extract")
+	}
+
+	bucket := ctx.String("awsBucketName")
+	src := ctx.Args()[0]
+	cli, _, err := newBackend(ctx)
+	if err != nil {
+		return err
+	}
+	err = checkReadable(cli, bucket, src)
+	if err != nil {
+		return err
+	}
+	remoteInfo, err := cli.HeadObject(bucket, src)
+	if err != nil {
+		return err
+	}
+	if remoteInfo == nil {
+		return errors.Errorf("%s is not found in bucket %s", src, bucket)
+	}
+
+	r := clients.NewObjectReaderAt(context.Background(), cli, bucket, src, int64(remoteInfo.Size),
+		remoteISOBlockSize, remoteISOMaxBlocks)
+	img, err := newISOImage(src, r, r.Size(), nil, ctx.String("encrypt-key"))
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	if img.tmpFile != nil {
+		logrus.Warnf("%s is compressed, so the whole object is downloaded", src)
 	}
 
-	decryptor := crypto.NewMasterDecryptor(dst, []byte(masterKey))
-	_, err = cli.GetObject(context.Background(), bucket, src, decryptor)
+	err = extractFromImage(img, ctx.GlobalString("db"), src, ctx.String("to"), ctx.Args()[1:])
+	fmt.Printf("Downloaded %s of %s\n", datasize.ByteSize(r.Downloaded()).HR(), datasize.ByteSize(r.Size()).HR())
 	return err
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lomorage/lomo-backup/clients"
+	"github.com/lomorage/lomo-backup/common/datasize"
+	"github.com/lomorage/lomo-backup/common/types"
+	"github.com/stretchr/testify/require"
+)
+
+// uploadTestISOs uploads isos encrypted into directory backend with the smallest part size
+func uploadTestISOs(t *testing.T, dbFilename, remoteDir string, isoFilenames ...string) {
+	args := []string{"iso", "upload", "--local-dir", remoteDir, "--store-dir", isoStoreDir, "--part-size", "5242880",
+		"-k", testMasterKey}
+	require.Nil(t, runApp(t, dbFilename, append(args, isoFilenames...)...))
+}
+
+func TestUploadRestoreLocalBackend(t *testing.T) {
+	dbFilename := newTestDB(t)
+	dir := shortTempDir(t)
+	writeTestFile(t, filepath.Join(dir, "a.jpg"), 4000000, 1)
+	writeTestFile(t, filepath.Join(dir, "sub", "b.jpg"), 3000000, 2)
+	scanTestDir(t, dir)
+	created, err := createISOs(datasize.ByteSize(6000000), "", false, false)
+	require.Nil(t, err)
+	require.Len(t, created, 1)
+	isoFilename := created[0]
+	original, err := os.ReadFile(localISOPath(isoFilename))
+	require.Nil(t, err)
+	// iso is uploaded in 2 parts at least
+	require.Greater(t, len(original), 5*1024*1024)
+
+	remoteDir := t.TempDir()
+	uploadTestISOs(t, dbFilename, remoteDir, isoFilename)
+	isos, err := db.ListISOs()
+	require.Nil(t, err)
+	require.Len(t, isos, 1)
+	require.Equal(t, types.IsoUploaded, isos[0].Status)
+	require.Equal(t, "file://"+remoteDir, isos[0].Region)
+
+	// object in bucket is encrypted
+	stored, err := os.ReadFile(filepath.Join(remoteDir, defaultBucket, isoFilename))
+	require.Nil(t, err)
+	require.NotEqual(t, original, stored)
+
+	restored := filepath.Join(t.TempDir(), "restored.iso")
+	require.Nil(t, runApp(t, dbFilename, "restore", "aws", "--local-dir", remoteDir, "-k", testMasterKey,
+		isoFilename, restored))
+	content, err := os.ReadFile(restored)
+	require.Nil(t, err)
+	require.Equal(t, original, content)
+
+	// wrong master key fails hash check
+	require.NotNil(t, runApp(t, dbFilename, "restore", "aws", "--local-dir", remoteDir, "-k", "wrong key",
+		isoFilename, filepath.Join(t.TempDir(), "wrong.iso")))
+}
+
+func TestRestoreStatusContinuesPastFailure(t *testing.T) {
+	dbFilename := newTestDB(t)
+	dir := shortTempDir(t)
+	writeTestFile(t, filepath.Join(dir, "a.jpg"), 400000, 1)
+	writeTestFile(t, filepath.Join(dir, "b.jpg"), 400000, 2)
+	scanTestDir(t, dir)
+	created, err := createISOs(datasize.ByteSize(300000), "", false, false)
+	require.Nil(t, err)
+	require.Len(t, created, 2)
+	remoteDir := t.TempDir()
+	uploadTestISOs(t, dbFilename, remoteDir, created...)
+
+	// first iso in bucket is corrupted, which fails its download
+	remote := filepath.Join(remoteDir, defaultBucket, created[0])
+	content, err := os.ReadFile(remote)
+	require.Nil(t, err)
+	content[len(content)/2] ^= 0x01
+	require.Nil(t, os.WriteFile(remote, content, 0644))
+
+	outDir := t.TempDir()
+	for _, name := range created {
+		require.Nil(t, db.UpsertRestore(&types.RestoreInfo{Name: name, Region: "file://" + remoteDir,
+			Bucket: defaultBucket, Tier: "Bulk", Days: 1, Output: filepath.Join(outDir, name)}))
+	}
+	err = runApp(t, dbFilename, "restore", "status", "--local-dir", remoteDir, "-k", testMasterKey)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), created[0])
+	require.NotContains(t, err.Error(), created[1])
+
+	// the other restore is downloaded, and failed one is left to check again
+	restores, err := db.ListRestores()
+	require.Nil(t, err)
+	require.Len(t, restores, 2)
+	require.Equal(t, types.RestoreRequested, restores[0].Status)
+	require.Equal(t, types.RestoreDownloaded, restores[1].Status)
+	original, err := os.ReadFile(localISOPath(created[1]))
+	require.Nil(t, err)
+	restored, err := os.ReadFile(filepath.Join(outDir, created[1]))
+	require.Nil(t, err)
+	require.Equal(t, original, restored)
+}
+
+func TestRestoreFileCodec(t *testing.T) {
+	dbFilename := newTestDB(t)
+	dir := t.TempDir()
+	// uncompressed file which starts with the same bytes as compression header
+	plain := filepath.Join(dir, "header.bin")
+	require.Nil(t, os.WriteFile(plain, append([]byte("LOMZ\x01"), bytes.Repeat([]byte("plain"), 1000)...), 0644))
+	text := filepath.Join(dir, "doc.txt")
+	require.Nil(t, os.WriteFile(text, bytes.Repeat([]byte("compressible text\n"), 10000), 0644))
+
+	remoteDir := t.TempDir()
+	require.Nil(t, runApp(t, dbFilename, "util", "upload-s3", "--local-dir", remoteDir, "-k", testMasterKey, plain))
+	require.Nil(t, runApp(t, dbFilename, "util", "upload-s3", "--local-dir", remoteDir, "-k", testMasterKey,
+		"--compress", "gzip", text))
+
+	lb, err := clients.NewLocalBackend(remoteDir)
+	require.Nil(t, err)
+	info, err := lb.HeadObject(defaultBucket, "header.bin")
+	require.Nil(t, err)
+	require.NotContains(t, info.Metadata, types.MetadataKeyCodec)
+	info, err = lb.HeadObject(defaultBucket, "doc.txt")
+	require.Nil(t, err)
+	require.Equal(t, "gzip", info.Metadata[types.MetadataKeyCodec])
+
+	for _, filename := range []string{plain, text} {
+		restored := filepath.Join(t.TempDir(), "restored")
+		require.Nil(t, runApp(t, dbFilename, "restore", "aws", "--local-dir", remoteDir, "-k", testMasterKey,
+			filepath.Base(filename), restored))
+		requireSameFile(t, filename, restored)
+	}
+
+	// local file is decompressed with the codec given
+	for filename, codec := range map[string]string{plain: "none", text: "gzip"} {
+		encrypted := filepath.Join(t.TempDir(), "encrypted")
+		decrypted := filepath.Join(t.TempDir(), "decrypted")
+		require.Nil(t, runApp(t, dbFilename, "util", "encrypt", "-k", testMasterKey, "--compress", codec, filename,
+			encrypted))
+		require.Nil(t, runApp(t, dbFilename, "util", "decrypt", "-k", testMasterKey, "--compress", codec, "-o",
+			decrypted, encrypted))
+		requireSameFile(t, filename, decrypted)
+	}
+}
+
+func requireSameFile(t *testing.T, expected, actual string) {
+	expectedContent, err := os.ReadFile(expected)
+	require.Nil(t, err)
+	actualContent, err := os.ReadFile(actual)
+	require.Nil(t, err)
+	require.Equal(t, expectedContent, actualContent)
+}
+
+func TestUploadRestoreCompressedISO(t *testing.T) {
+	dbFilename := newTestDB(t)
+	dir := shortTempDir(t)
+	writeTestFile(t, filepath.Join(dir, "a.txt"), 400000, 1)
+	scanTestDir(t, dir)
+	created, err := createISOs(datasize.ByteSize(300000), "", false, false)
+	require.Nil(t, err)
+	require.Len(t, created, 1)
+
+	remoteDir := t.TempDir()
+	require.Nil(t, runApp(t, dbFilename, "iso", "upload", "--local-dir", remoteDir, "--store-dir", isoStoreDir,
+		"--part-size", "5242880", "-k", testMasterKey, "--compress", "gzip", created[0]))
+	lb, err := clients.NewLocalBackend(remoteDir)
+	require.Nil(t, err)
+	info, err := lb.HeadObject(defaultBucket, created[0])
+	require.Nil(t, err)
+	require.Equal(t, "gzip", info.Metadata[types.MetadataKeyCodec])
+
+	restored := filepath.Join(t.TempDir(), "restored.iso")
+	require.Nil(t, runApp(t, dbFilename, "restore", "aws", "--local-dir", remoteDir, "-k", testMasterKey,
+		created[0], restored))
+	requireSameFile(t, localISOPath(created[0]), restored)
+}
+
+func TestRestoreWithoutDB(t *testing.T) {
+	dbFilename, created := prepareTestISOs(t, 1)
+	remoteDir := t.TempDir()
+	uploadTestISOs(t, dbFilename, remoteDir, created[0])
+
+	// one new machine has no DB, and restore doesn't create one
+	missingDB := filepath.Join(t.TempDir(), "lomob.db")
+	restored := filepath.Join(t.TempDir(), "restored.iso")
+	require.Nil(t, runApp(t, missingDB, "restore", "aws", "--local-dir", remoteDir, "-k", testMasterKey,
+		created[0], restored))
+	requireSameFile(t, localISOPath(created[0]), restored)
+	_, err := os.Stat(missingDB)
+	require.True(t, os.IsNotExist(err))
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/lomorage/lomo-backup/common/dbx"
 	lomohash "github.com/lomorage/lomo-backup/common/hash"
+	"github.com/lomorage/lomo-backup/common/progress"
 	"github.com/lomorage/lomo-backup/common/scan"
 	"github.com/lomorage/lomo-backup/common/types"
 	"github.com/sirupsen/logrus"
@@ -25,25 +26,31 @@ var (
 	scanRootDir   string
 	scanRootDirID int
 	dirs          map[string]scanDirInfo
+	// total grows while walking, and files in DB already are skipped
+	scanTracker *progress.Tracker
 )
 
-func scanDir(ctx *cli.Context) (err error) {
+func scanDir(ctx *cli.Context) error {
 	if len(ctx.Args()) != 1 {
 		return errors.New("usage: lomob " + scanUsage)
 	}
-	scanRootDir, err = filepath.Abs(ctx.Args()[0])
+
+	err := initLogLevel(ctx.GlobalInt("log-level"))
 	if err != nil {
 		return err
 	}
 
-	nthreads := ctx.Int("threads")
-
-	err = initLogLevel(ctx.GlobalInt("log-level"))
+	err = initDB(ctx.GlobalString("db"))
 	if err != nil {
 		return err
 	}
 
-	err = initDB(ctx.GlobalString("db"))
+	return scanDirectory(ctx.Args()[0], ctx.Int("threads"), ctx.String("ignore-files"), ctx.String("ignore-dirs"))
+}
+
+// scanDirectory adds files under dir into DB. ignoreFiles and ignoreDirs are separated by comma
+func scanDirectory(dir string, nthreads int, ignoreFiles, ignoreDirs string) (err error) {
+	scanRootDir, err = filepath.Abs(dir)
 	if err != nil {
 		return err
 	}
@@ -53,27 +60,28 @@ func scanDir(ctx *cli.Context) (err error) {
 		return err
 	}
 
-	ignoreFiles := make(map[string]struct{})
+	ignoreFilesMap := make(map[string]struct{})
 
-	for _, ignore := range strings.Split(ctx.String("ignore-files"), ",") {
-		ignoreFiles[ignore] = struct{}{}
+	for _, ignore := range strings.Split(ignoreFiles, ",") {
+		ignoreFilesMap[ignore] = struct{}{}
 	}
 
-	ignoreDirs := make(map[string]struct{})
+	ignoreDirsMap := make(map[string]struct{})
 
-	for _, ignore := range strings.Split(ctx.String("ignore-dirs"), ",") {
-		ignoreDirs[ignore] = struct{}{}
+	for _, ignore := range strings.Split(ignoreDirs, ",") {
+		ignoreDirsMap[ignore] = struct{}{}
 	}
 
 	dirs = make(map[string]scanDirInfo)
 	lock = &sync.Mutex{}
+	scanTracker = progress.NewTracker(progressReporter, "scan "+scanRootDir, 0)
 
 	var wg sync.WaitGroup
 	ch := make(chan scan.FileCallback, nthreads)
 	go func() {
 		for {
 			cb := <-ch
-			err = handleScan(cb.Path, cb.Info)
+			err := handleScan(cb.Path, cb.Info)
 			if err != nil {
 				logrus.Warnf("Error handling file %s: %s", cb.Path, err)
 			}
@@ -81,12 +89,13 @@ func scanDir(ctx *cli.Context) (err error) {
 		}
 	}()
 
-	err = scan.Directory(scanRootDir, ignoreFiles, ignoreDirs, &wg, ch)
+	err = scan.Directory(scanRootDir, ignoreFilesMap, ignoreDirsMap, &wg, ch)
 	if err != nil {
 		return err
 	}
 
 	wg.Wait()
+	scanTracker.Finish()
 	return nil
 }
 
@@ -152,10 +161,11 @@ func selectOrInsertFile(dirID int, path string, info os.FileInfo) error {
 	}
 	if fi != nil {
 		// skip as already in db
+		scanTracker.Skip(info.Size())
 		return nil
 	}
 
-	hash, err := lomohash.CalculateHashFile(path)
+	hash, err := lomohash.CalculateHashFileWithProgress(path, scanTracker)
 	if err != nil {
 		return err
 	}
@@ -195,5 +205,6 @@ func handleScan(path string, info os.FileInfo) error {
 		return err
 	}
 
+	scanTracker.AddTotal(info.Size())
 	return selectOrInsertFile(dirID, path, info)
 }
@@ -1,2 +1,2 @@
 rm ../lomob.db
-sqlite3 ../lomob.db < ../../../common/dbx/schema/1.sql
+cat $(ls ../../../common/dbx/schema/*.sql | sort -V) | sqlite3 ../lomob.db
@@ -1,18 +1,24 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/lomorage/lomo-backup/clients"
+	"github.com/lomorage/lomo-backup/common"
+	"github.com/lomorage/lomo-backup/common/compress"
 	"github.com/lomorage/lomo-backup/common/crypto"
 	"github.com/lomorage/lomo-backup/common/gcloud"
 	"github.com/lomorage/lomo-backup/common/hash"
 	lomohash "github.com/lomorage/lomo-backup/common/hash"
+	"github.com/lomorage/lomo-backup/common/progress"
 	"github.com/lomorage/lomo-backup/common/types"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -37,19 +43,35 @@ func uploadFilesToGdrive(ctx *cli.Context) error {
 		}
 	}
 
+	codec, err := getCompressCodec(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = uploadFilesToDrive(ctx.String("cred"), ctx.String("token"), ctx.String("folder"),
+		masterKey, codec, false)
+	return err
+}
+
+// uploadFilesToDrive uploads files not in any iso or cloud into folder of google drive, and returns the
+// number of files uploaded and failed. It stops at the first failed file unless continueOnError is set, in
+// which case failed files are logged and skipped
+func uploadFilesToDrive(cred, token, uploadRootFolder, masterKey string, codec compress.Codec,
+	continueOnError bool) (int, int, error) {
 	client, err := gcloud.CreateDriveClient(&gcloud.Config{
-		CredFilename:  ctx.String("cred"),
-		TokenFilename: ctx.String("token"),
+		CredFilename:  cred,
+		TokenFilename: token,
 		RefreshToken:  true,
+		Retry:         retryPolicy,
+		Limiter:       bwLimiter,
 	})
 	if err != nil {
-		return fmt.Errorf("unable to retrieve Drive client: %v", err)
+		return 0, 0, fmt.Errorf("unable to retrieve Drive client: %v", err)
 	}
 
-	uploadRootFolder := ctx.String("folder")
 	exist, uploadRootFolderID, err := client.GetAndCreateFileIDIfNotExist(uploadRootFolder, "", nil, time.Now())
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 	if !exist {
 		logrus.Infof("Root folder '%s' does not exist, created", uploadRootFolder)
@@ -57,12 +79,12 @@ func uploadFilesToGdrive(ctx *cli.Context) error {
 
 	scanRootDirs, err := db.ListScanRootDirs()
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 
 	fileInfos, err := db.ListFilesNotInISOAndCloud()
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 
 	if len(fileInfos) == 0 {
@@ -77,7 +99,17 @@ func uploadFilesToGdrive(ctx *cli.Context) error {
 	existingDirsInCloud := map[string]dirInfoInCloud{
 		"": {folderID: uploadRootFolderID},
 	}
+	// total is adjusted with compressed size and salt of each file
+	var total int64
 	for _, f := range fileInfos {
+		total += int64(f.Size)
+	}
+	tracker := progress.NewTracker(progressReporter, "upload files to google drive", total)
+	defer tracker.Finish()
+	uploadCtx := progress.WithTracker(context.Background(), tracker)
+
+	stats := &compressStats{}
+	uploadFile := func(f *types.FileInfo) error {
 		scanRoot, ok := scanRootDirs[f.DirID]
 		if !ok {
 			return fmt.Errorf("unable to find scan root directory whose ID is %d", f.DirID)
@@ -147,6 +179,7 @@ func uploadFilesToGdrive(ctx *cli.Context) error {
 		if err != nil {
 			return err
 		}
+		defer file.Close()
 
 		stat, err := file.Stat()
 		if err != nil {
@@ -155,42 +188,86 @@ func uploadFilesToGdrive(ctx *cli.Context) error {
 
 		encryptKey := crypto.DeriveKeyFromMasterKey([]byte(masterKey), salt)
 
-		encryptor, err := crypto.NewEncryptor(file, encryptKey, salt, true)
+		// compress before encryption unless it is compressed media format already
+		src := file
+		var tmpFile *os.File
+		fileCodec := compress.CodecNone
+		if codec != compress.CodecNone && !compress.IsCompressedFile(filename) {
+			fileCodec = codec
+			var origSize, compressed int64
+			tmpFile, origSize, compressed, err = compressToTempFile(file, codec)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				tmpFile.Close()
+				os.Remove(tmpFile.Name())
+			}()
+			stats.add(origSize, compressed)
+			tracker.AddTotal(compressed - origSize)
+			logrus.Infof("Compressed %s with %s, saved %.1f%%", fullLocalPath, codec,
+				savingPercent(origSize, compressed))
+			src = tmpFile
+		}
+
+		srcStat, err := src.Stat()
 		if err != nil {
 			return err
 		}
+		encryptor, err := crypto.NewEncryptReaderAt(src, encryptKey, salt, true)
+		if err != nil {
+			return err
+		}
+		// encrypted content is seekable so that it is able to be uploaded again if upload fails
+		encrypted := io.NewSectionReader(encryptor, 0, srcStat.Size()+int64(crypto.SaltLen()))
+		hashEncrypt := sha256.New()
+		_, err = io.Copy(hashEncrypt, encrypted)
+		if err != nil {
+			return err
+		}
+		tracker.AddTotal(int64(crypto.SaltLen()))
 
 		logrus.Infof("Uploading: %s into %s (%s):%s\n", fullLocalPath, folderKey, parentID, filename)
 
-		fileID, err := client.CreateFile(filename, parentID, encryptor, stat.ModTime())
+		fileID, err := client.CreateFile(uploadCtx, filename, parentID, encrypted, stat.ModTime())
 		if err != nil {
 			return err
 		}
 		logrus.Infof("Uploading success")
-		err = file.Close()
-		if err != nil {
-			logrus.Warnf("Close %s: %s", fullLocalPath, err)
-		}
 
-		hashEnc := hash.CalculateHashHex(encryptor.GetHashEncrypt())
+		hashEnc := hash.CalculateHashHex(hashEncrypt.Sum(nil))
 		err = db.UpdateFileIsoIDAndRemoteHash(types.IsoIDCloud, f.ID, hashEnc)
 		if err != nil {
 			return err
 		}
 
 		// add encrypt hash as part of the file's metadata
-		err = client.UpdateFileMetadata(fileID, map[string]string{
+		metadata := map[string]string{
 			types.MetadataKeyHashOrig:    f.HashLocal,
 			types.MetadataKeyHashEncrypt: hashEnc,
-		})
+		}
+		if fileCodec != compress.CodecNone {
+			metadata[types.MetadataKeyCodec] = fileCodec.String()
+		}
+		return client.UpdateFileMetadata(fileID, metadata)
+	}
+
+	failed := 0
+	for i, f := range fileInfos {
+		err = uploadFile(f)
+		if err != nil && !continueOnError {
+			return i - failed, failed + 1, err
+		}
 		if err != nil {
-			return err
+			logrus.Warnf("Upload %s to google drive: %s", f.Name, err)
+			failed++
 		}
 	}
 
-	fmt.Printf("%d files are uploaded to google drive\n", len(fileInfos))
+	fmt.Printf("%d files are uploaded to google drive\n", len(fileInfos)-failed)
+	stats.print()
 
-	return nil
+	return len(fileInfos) - failed, failed, nil
 }
 
 func flattenScanRootDir(dir string) string {
@@ -198,9 +275,6 @@ func flattenScanRootDir(dir string) string {
 }
 
 func uploadFilesToS3(ctx *cli.Context) error {
-	accessKeyID := ctx.String("awsAccessKeyID")
-	accessKey := ctx.String("awsSecretAccessKey")
-	region := ctx.String("awsBucketRegion")
 	bucket := ctx.String("awsBucketName")
 
 	storageClass, err := getAWSStorageClass(ctx)
@@ -218,7 +292,12 @@ func uploadFilesToS3(ctx *cli.Context) error {
 		}
 	}
 
-	cli, err := clients.NewAWSClient(accessKeyID, accessKey, region)
+	codec, err := getCompressCodec(ctx)
+	if err != nil {
+		return err
+	}
+
+	cli, _, err := newBackend(ctx)
 	if err != nil {
 		return err
 	}
@@ -234,7 +313,11 @@ func uploadFilesToS3(ctx *cli.Context) error {
 			}
 			continue
 		}
-		tmpFilename, err := uploadEncryptFileToS3(cli, bucket, storageClass, name, masterKey)
+		c := codec
+		if compress.IsCompressedFile(name) {
+			c = compress.CodecNone
+		}
+		tmpFilename, err := uploadEncryptFileToS3(cli, bucket, storageClass, name, masterKey, c)
 		if err != nil {
 			return err
 		}
@@ -246,8 +329,29 @@ func uploadFilesToS3(ctx *cli.Context) error {
 	return nil
 }
 
-func uploadFileToS3(cli *clients.AWSClient, bucket, storageClass, remoteFilename, expectHash, contentType string, expectSize int,
-	reader io.ReadSeeker) error {
+// objectMetadata returns metadata saved with one uploaded object, so that it can be verified with the bucket
+// only. hashEnc is empty if object isn't encrypted or its hash is unknown before upload, and partSize is 0
+// if object isn't uploaded in parts
+func objectMetadata(hashOrig, hashEnc string, partSize int, codec compress.Codec) map[string]string {
+	metadata := map[string]string{
+		types.MetadataKeyHashOrig:      hashOrig,
+		types.MetadataKeyFormatVersion: types.FormatVersion,
+		types.MetadataKeyLomobVersion:  common.Version(),
+	}
+	if hashEnc != "" {
+		metadata[types.MetadataKeyHashEncrypt] = hashEnc
+	}
+	if partSize > 0 {
+		metadata[types.MetadataKeyPartSize] = strconv.Itoa(partSize)
+	}
+	if codec != compress.CodecNone {
+		metadata[types.MetadataKeyCodec] = codec.String()
+	}
+	return metadata
+}
+
+func uploadFileToS3(cli clients.Backend, bucket, storageClass, remoteFilename, expectHash, contentType string, expectSize int,
+	metadata map[string]string, reader io.ReadSeeker) error {
 	remoteInfo, err := cli.HeadObject(bucket, remoteFilename)
 	if err != nil {
 		return err
@@ -277,7 +381,10 @@ func uploadFileToS3(cli *clients.AWSClient, bucket, storageClass, remoteFilename
 		}
 	}
 
-	err = cli.PutObject(bucket, remoteFilename, expectHash, contentType, storageClass, reader)
+	tracker := progress.NewTracker(progressReporter, "upload "+remoteFilename, int64(expectSize))
+	err = cli.PutObject(progress.WithTracker(context.Background(), tracker), bucket, remoteFilename, expectHash,
+		contentType, storageClass, metadata, reader)
+	tracker.Finish()
 	if err != nil {
 		fmt.Printf("Uploading metadata file %s fail: %s\n", remoteFilename, err)
 	} else {
@@ -286,7 +393,7 @@ func uploadFileToS3(cli *clients.AWSClient, bucket, storageClass, remoteFilename
 	return err
 }
 
-func uploadRawFileToS3(cli *clients.AWSClient, bucket, storageClass, filename, contentType string) error {
+func uploadRawFileToS3(cli clients.Backend, bucket, storageClass, filename, contentType string) error {
 	h, err := hash.CalculateHashFile(filename)
 	if err != nil {
 		return err
@@ -305,16 +412,20 @@ func uploadRawFileToS3(cli *clients.AWSClient, bucket, storageClass, filename, c
 		return err
 	}
 
-	return uploadFileToS3(cli, bucket, storageClass, filepath.Base(filename), hashBase64, contentType, int(stat.Size()), f)
+	return uploadFileToS3(cli, bucket, storageClass, filepath.Base(filename), hashBase64, contentType, int(stat.Size()),
+		objectMetadata(hash.CalculateHashHex(h), "", 0, compress.CodecNone), f)
 }
 
 // as PutObject requires encryption before input, thus, it has to write into one temp file or memory to get all data
 // return tmp filename, and let caller delete
-func uploadEncryptFileToS3(cli *clients.AWSClient, bucket, storageClass, filename, masterKey string) (string, error) {
-	salt, err := genSalt(filename)
+func uploadEncryptFileToS3(cli clients.Backend, bucket, storageClass, filename, masterKey string,
+	codec compress.Codec) (string, error) {
+	hashOrig, err := hash.CalculateHashFile(filename)
 	if err != nil {
 		return "", err
 	}
+	// same salt as genSalt
+	salt := hashOrig[:crypto.SaltLen()]
 	src, err := os.Open(filename)
 	if err != nil {
 		return "", err
@@ -328,7 +439,7 @@ func uploadEncryptFileToS3(cli *clients.AWSClient, bucket, storageClass, filenam
 	tmpFileName := tmpFile.Name()
 	defer tmpFile.Close()
 
-	hash, err := encryptLocalFile(src, tmpFile, []byte(masterKey), salt, true)
+	hash, err := encryptLocalFile(src, tmpFile, []byte(masterKey), salt, codec, true)
 	if err != nil {
 		return "", err
 	}
@@ -344,5 +455,6 @@ func uploadEncryptFileToS3(cli *clients.AWSClient, bucket, storageClass, filenam
 	}
 
 	return tmpFileName, uploadFileToS3(cli, bucket, storageClass, filepath.Base(filename), lomohash.CalculateHashBase64(hash),
-		binContentType, int(size), tmpFile)
+		binContentType, int(size), objectMetadata(lomohash.CalculateHashHex(hashOrig), lomohash.CalculateHashHex(hash), 0,
+			codec), tmpFile)
 }
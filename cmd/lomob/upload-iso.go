@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
@@ -9,16 +10,23 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/lomorage/lomo-backup/clients"
 	"github.com/lomorage/lomo-backup/common"
+	"github.com/lomorage/lomo-backup/common/compress"
 	"github.com/lomorage/lomo-backup/common/crypto"
 	"github.com/lomorage/lomo-backup/common/datasize"
 	lomohash "github.com/lomorage/lomo-backup/common/hash"
 	lomoio "github.com/lomorage/lomo-backup/common/io"
+	"github.com/lomorage/lomo-backup/common/parity"
+	"github.com/lomorage/lomo-backup/common/progress"
+	"github.com/lomorage/lomo-backup/common/retry"
 	"github.com/lomorage/lomo-backup/common/types"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -35,7 +43,8 @@ func mkIsoMetadataFilename(isoFilename string) string {
 }
 
 func validateISO(isoFilename string) (*os.File, *types.ISOInfo, error) {
-	f, err := os.Open(isoFilename)
+	isoPath := localISOPath(isoFilename)
+	f, err := os.Open(isoPath)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -48,15 +57,20 @@ func validateISO(isoFilename string) (*os.File, *types.ISOInfo, error) {
 	if err != nil {
 		return nil, nil, err
 	}
+	if iso == nil {
+		return nil, nil, errors.Errorf("%s is not found in DB", isoFilename)
+	}
 
 	if info.Size() != int64(iso.Size) {
 		return nil, nil, errors.Errorf("Size in DB is %d, but got %d", iso.Size, info.Size())
 	}
 
-	hash, err := lomohash.CalculateHashFile(isoFilename)
+	tracker := progress.NewTracker(progressReporter, "verify "+isoFilename, info.Size())
+	hash, err := lomohash.CalculateHashFileWithProgress(isoPath, tracker)
 	if err != nil {
 		return nil, nil, err
 	}
+	tracker.Finish()
 	hashHex := lomohash.CalculateHashHex(hash)
 	if hashHex != iso.HashLocal {
 		return nil, nil, errors.Errorf("Hash in DB is %s, but got %s", iso.HashLocal, hashHex)
@@ -64,12 +78,30 @@ func validateISO(isoFilename string) (*os.File, *types.ISOInfo, error) {
 	return f, iso, nil
 }
 
-func prepareUploadParts(isoFilename string, partSize int, calHash bool) (*os.File, *types.ISOInfo, []*types.PartInfo, error) {
+// prepareUploadParts validates iso file and split srcFilename into parts. srcFilename is the file
+// actually uploaded, which is the iso file itself or its compressed copy
+func prepareUploadParts(isoFilename, srcFilename string, partSize int, calHash bool) (*os.File, *types.ISOInfo,
+	[]*types.PartInfo, error) {
 	isoFile, isoInfo, err := validateISO(isoFilename)
 	if err != nil {
 		return nil, nil, nil, err
 	}
 
+	if srcFilename != localISOPath(isoFilename) {
+		isoFile.Close()
+		isoFile, err = os.Open(srcFilename)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		stat, err := isoFile.Stat()
+		if err != nil {
+			isoFile.Close()
+			return nil, nil, nil, err
+		}
+		// upload size is the compressed size
+		isoInfo.Size = int(stat.Size())
+	}
+
 	parts, err := db.GetPartsByIsoID(isoInfo.ID)
 	if err != nil {
 		return nil, nil, nil, err
@@ -83,10 +115,12 @@ func prepareUploadParts(isoFilename string, partSize int, calHash bool) (*os.Fil
 		partsChecksum [][]byte
 	)
 	if calHash {
-		partsChecksum, err = lomohash.CalculateMultiPartsHash(isoFilename, partSize)
+		tracker := progress.NewTracker(progressReporter, "hash parts "+srcFilename, int64(isoInfo.Size))
+		partsChecksum, err = lomohash.CalculateMultiPartsHashWithProgress(srcFilename, partSize, tracker)
 		if err != nil {
 			return nil, nil, nil, err
 		}
+		tracker.Finish()
 		numParts = len(partsChecksum)
 	} else {
 		numParts = isoInfo.Size/partSize + 1
@@ -102,6 +136,7 @@ func prepareUploadParts(isoFilename string, partSize int, calHash bool) (*os.Fil
 			partLength = partSize
 		}
 		parts[i] = &types.PartInfo{
+			IsoID:  isoInfo.ID,
 			PartNo: i + 1,
 			Size:   partLength,
 		}
@@ -127,8 +162,9 @@ func prepareUploadParts(isoFilename string, partSize int, calHash bool) (*os.Fil
 	return isoFile, isoInfo, parts, db.UpdateIsoRemoteHash(isoInfo.ID, isoInfo.HashRemote)
 }
 
-func prepareUploadRequest(cli *clients.AWSClient, region, bucket, storageClass string,
-	isoInfo *types.ISOInfo, force bool) (*clients.UploadRequest, error) {
+func prepareUploadRequest(cli clients.Backend, region, bucket, storageClass string, retention *clients.Retention,
+	isoInfo *types.ISOInfo, partSize int, force bool, state uploadState, local *localParts) (*clients.UploadRequest,
+	error) {
 	isoFilename := filepath.Base(isoInfo.Name)
 	remoteInfo, err := cli.HeadObject(bucket, isoFilename)
 	if err != nil {
@@ -139,6 +175,11 @@ func prepareUploadRequest(cli *clients.AWSClient, region, bucket, storageClass s
 			return nil, errors.Errorf("%s exists in cloud and its size is %d, but provided file size is %d",
 				isoFilename, remoteInfo.Size, isoInfo.Size)
 		}
+		// remote checksum of encrypted iso is unknown before upload, while original hash is still able to compare
+		if hashOrig := remoteInfo.Metadata[types.MetadataKeyHashOrig]; hashOrig != "" && hashOrig != isoInfo.HashLocal {
+			return nil, errors.Errorf("%s exists in cloud and its original hash is %s, but provided hash is %s",
+				isoFilename, hashOrig, isoInfo.HashLocal)
+		}
 		if isoInfo.HashRemote != "" && remoteInfo.HashRemote != "" {
 			remoteHash := strings.Split(remoteInfo.HashRemote, "-")[0]
 			if remoteHash != isoInfo.HashRemote {
@@ -147,12 +188,23 @@ func prepareUploadRequest(cli *clients.AWSClient, region, bucket, storageClass s
 			}
 		}
 		// no need upload, return nil upload request
-		return nil, nil
+		isoInfo.Region = region
+		isoInfo.Bucket = bucket
+		return nil, state.skipped(isoInfo, strings.Split(remoteInfo.HashRemote, "-")[0])
 	}
 
 	// not exist but previous upload not finish, so reuse previous upload
 	if isoInfo.Region == region && isoInfo.Bucket == bucket && isoInfo.UploadID != "" &&
 		isoInfo.UploadKey != "" {
+		// lock is given when upload is created, and can't be changed afterwards
+		mode := ""
+		if retention != nil {
+			mode = retention.Mode
+		}
+		if mode != isoInfo.RetentionMode {
+			logrus.Warnf("Resume upload of %s which keeps its lock %s, rerun with --force to change it",
+				isoFilename, formatRetention(isoInfo))
+		}
 		return &clients.UploadRequest{
 			ID:     isoInfo.UploadID,
 			Bucket: bucket,
@@ -160,18 +212,188 @@ func prepareUploadRequest(cli *clients.AWSClient, region, bucket, storageClass s
 		}, nil
 	}
 
-	// create new upload
-	request, err := cli.CreateMultipartUpload(bucket, isoFilename, binContentType, storageClass)
-	if err != nil {
-		return nil, err
+	var request *clients.UploadRequest
+	if !force {
+		request, err = discoverUpload(cli, bucket, isoFilename, local)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if request != nil {
+		// lock of upload found is unknown, and the one given is recorded
+		logrus.Infof("Resume upload %s of %s found in bucket %s", request.ID, isoFilename, bucket)
+	} else {
+		// create new upload. Checksum of encrypted iso is the composite one kept by S3, so only original hash
+		// is saved
+		metadata := objectMetadata(isoInfo.HashLocal, "", partSize, isoInfo.Codec)
+		metadata[types.MetadataKeyObjectType] = types.ObjectTypeISO
+		request, err = cli.CreateMultipartUpload(bucket, isoFilename, binContentType, storageClass, metadata,
+			retention)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	isoInfo.Region = region
 	isoInfo.Bucket = request.Bucket
 	isoInfo.UploadKey = request.Key
 	isoInfo.UploadID = request.ID
+	isoInfo.RetentionMode = ""
+	isoInfo.RetainUntil = time.Time{}
+	if retention != nil {
+		isoInfo.RetentionMode = retention.Mode
+		isoInfo.RetainUntil = retention.Until
+	}
+
+	return request, state.saveRequest(isoInfo)
+}
+
+// localParts is parts of iso to upload, which are compared with the ones in bucket to resume upload whose
+// parts are not recorded in DB, e.g. DB is restored from an older copy
+type localParts struct {
+	uploads []*partUpload
+	// hash returns base64 sha256 of part to upload, which is only called for parts found in bucket
+	hash   func(pu *partUpload) (string, error)
+	hashes map[int]string
+}
+
+func (l *localParts) checksum(pu *partUpload) (string, error) {
+	if h, ok := l.hashes[pu.part.PartNo]; ok {
+		return h, nil
+	}
+	h, err := l.hash(pu)
+	if err != nil {
+		return "", err
+	}
+	if l.hashes == nil {
+		l.hashes = map[int]string{}
+	}
+	l.hashes[pu.part.PartNo] = h
+	return h, nil
+}
+
+// match returns parts not uploaded in DB which are in request with the same size and checksum, and whether
+// all parts in request are either uploaded in DB or the same as local ones
+func (l *localParts) match(cli clients.Backend, request *clients.UploadRequest) (map[int]*types.PartInfo, bool,
+	error) {
+	remoteParts, err := cli.ListParts(request)
+	if err != nil {
+		return nil, false, err
+	}
+	uploads := map[int]*partUpload{}
+	for _, pu := range l.uploads {
+		uploads[pu.part.PartNo] = pu
+	}
+	matched := map[int]*types.PartInfo{}
+	all := true
+	for _, rp := range remoteParts {
+		pu, ok := uploads[rp.PartNo]
+		if !ok || int64(rp.Size) != pu.end-pu.start {
+			all = false
+			continue
+		}
+		if pu.part.Status == types.PartUploaded {
+			continue
+		}
+		h, err := l.checksum(pu)
+		if err != nil {
+			return nil, false, err
+		}
+		if h == "" || h != rp.HashRemote {
+			all = false
+			continue
+		}
+		matched[rp.PartNo] = rp
+	}
+	return matched, all, nil
+}
+
+// resume marks parts in request which are the same as local ones as uploaded, and returns parts to upload
+func (l *localParts) resume(cli clients.Backend, request *clients.UploadRequest, isoFilename string,
+	state uploadState) ([]*partUpload, error) {
+	matched, _, err := l.match(cli, request)
+	if err != nil {
+		return nil, err
+	}
+	var uploads []*partUpload
+	for _, pu := range l.uploads {
+		p := pu.part
+		if rp, ok := matched[p.PartNo]; ok {
+			logrus.Infof("%s's part %d is in bucket already, skip new upload", isoFilename, p.PartNo)
+			p.Status = types.PartUploaded
+			p.Etag = rp.Etag
+			p.HashRemote = rp.HashRemote
+			err = state.savePart(p)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if p.Status != types.PartUploaded {
+			uploads = append(uploads, pu)
+		}
+	}
+	return uploads, nil
+}
 
-	return request, db.UpdateIsoUploadInfo(isoInfo)
+// discoverUpload returns upload of key in bucket which is not recorded in DB, e.g. DB is restored from an
+// older copy. Upload is only used if it has parts and all of them are the same as local ones, so that its
+// object metadata given on creation is of the same iso. The latest one is used if there are more than one
+func discoverUpload(cli clients.Backend, bucket, key string, local *localParts) (*clients.UploadRequest, error) {
+	requests, err := cli.ListMultipartUploads(bucket)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].Time.After(requests[j].Time)
+	})
+	for _, r := range requests {
+		if r.Key != key {
+			continue
+		}
+		r.Bucket = bucket
+		matched, all, err := local.match(cli, r)
+		if err != nil {
+			return nil, err
+		}
+		if all && len(matched) > 0 {
+			return r, nil
+		}
+		logrus.Infof("Upload %s of %s in bucket has parts different from local ones, skip it", r.ID, key)
+	}
+	return nil, nil
+}
+
+// resumeUploadedParts returns parts not uploaded yet, and parts in bucket already are marked as uploaded
+func resumeUploadedParts(cli clients.Backend, request *clients.UploadRequest, isoFilename string, local *localParts,
+	state uploadState) ([]*partUpload, error) {
+	uploads, err := local.resume(cli, request, isoFilename, state)
+	if err != nil {
+		return nil, err
+	}
+	if n := len(local.uploads) - len(uploads); n > 0 {
+		logrus.Infof("%d of %d parts of %s were uploaded, %s to upload", n, len(local.uploads), isoFilename,
+			datasize.ByteSize(remainingBytes(uploads)).HR())
+	}
+	return uploads, nil
+}
+
+func remainingBytes(uploads []*partUpload) int64 {
+	var size int64
+	for _, pu := range uploads {
+		size += pu.end - pu.start
+	}
+	return size
+}
+
+// newPartUploads returns parts with their range in uploaded object
+func newPartUploads(parts []*types.PartInfo) []*partUpload {
+	var end int64
+	uploads := make([]*partUpload, len(parts))
+	for i, p := range parts {
+		uploads[i] = &partUpload{part: p, start: end, end: end + int64(p.Size)}
+		end += int64(p.Size)
+	}
+	return uploads
 }
 
 func validateISOMetafile(metaFilename string, tree []byte) error {
@@ -209,16 +431,18 @@ func validateISOMetafile(metaFilename string, tree []byte) error {
 	return os.WriteFile(metaFilename, tree, 0644)
 }
 
-func uploadISOMetafile(cli *clients.AWSClient, bucket, storageClass, isoFilename, masterKey string) error {
+func uploadISOMetafile(cli clients.Backend, bucket, storageClass, isoFilename, masterKey string,
+	codec compress.Codec) error {
 	// TODO: create meta file if it is zero or not exist
-	tree, err := genTreeInIso(isoFilename)
+	isoPath := localISOPath(isoFilename)
+	tree, err := genTreeInIso(isoPath)
 	if err != nil {
 		return err
 	}
 
 	treeBuf := []byte(tree + "\n")
 
-	metaFilename := mkIsoMetadataFilename(isoFilename)
+	metaFilename := mkIsoMetadataFilename(isoPath)
 	err = validateISOMetafile(metaFilename, treeBuf)
 	if err != nil {
 		return nil
@@ -232,84 +456,243 @@ func uploadISOMetafile(cli *clients.AWSClient, bucket, storageClass, isoFilename
 
 	fmt.Printf("Uploading encrypted metadata file %s\n", metaFilename)
 
-	tmpFileName, err := uploadEncryptFileToS3(cli, bucket, storageClass, metaFilename, masterKey)
+	tmpFileName, err := uploadEncryptFileToS3(cli, bucket, storageClass, metaFilename, masterKey, codec)
 	if err != nil {
 		return err
 	}
 	return os.Remove(tmpFileName)
 }
 
-func uploadRawParts(cli *clients.AWSClient, region, bucket, storageClass, isoFilename string,
-	partSize int, saveParts, force bool) error {
-	isoFile, isoInfo, parts, err := prepareUploadParts(isoFilename, partSize, true)
+// uploadState loads and saves progress of uploading iso into one bucket. Iso uploaded by upload iso keeps it
+// in isos and parts tables, and copies uploaded by replicate keep it in archive_copies and copy_parts tables
+type uploadState interface {
+	// load replaces upload info of isoInfo and status of parts with the ones of this upload
+	load(isoInfo *types.ISOInfo, parts []*types.PartInfo) error
+	saveRequest(isoInfo *types.ISOInfo) error
+	savePart(p *types.PartInfo) error
+	// done is called once iso is uploaded, and skipped is called if the same iso is in bucket already
+	done(isoInfo *types.ISOInfo) error
+	skipped(isoInfo *types.ISOInfo, remoteHash string) error
+}
+
+// isoUploadState is state of upload iso, which is recorded as one archive copy too once it is uploaded
+type isoUploadState struct {
+	storageClass string
+	// iso is found in bucket already and not uploaded
+	inBucket bool
+}
+
+func (s *isoUploadState) load(isoInfo *types.ISOInfo, parts []*types.PartInfo) error {
+	return nil
+}
+
+func (s *isoUploadState) saveRequest(isoInfo *types.ISOInfo) error {
+	return db.UpdateIsoUploadInfo(isoInfo)
+}
+
+func (s *isoUploadState) savePart(p *types.PartInfo) error {
+	if p.Status != types.PartUploaded {
+		return db.UpdatePartStatus(p.IsoID, p.PartNo, p.Status)
+	}
+	return db.UpdatePartEtagAndStatusHash(p.IsoID, p.PartNo, p.Etag, p.HashLocal, p.HashRemote, p.Status)
+}
+
+func (s *isoUploadState) done(isoInfo *types.ISOInfo) error {
+	err := db.UpdateIsoStatusRemoteHash(isoInfo.ID, isoInfo.HashRemote, types.IsoUploaded)
 	if err != nil {
 		return err
 	}
-	defer isoFile.Close()
+	err = db.UpdateIsoStorageClass(isoInfo.ID, s.storageClass, time.Now())
+	if err != nil {
+		return err
+	}
+	return db.UpsertArchiveCopy(&types.ArchiveCopy{
+		IsoID:         isoInfo.ID,
+		Region:        isoInfo.Region,
+		Bucket:        isoInfo.Bucket,
+		StorageClass:  s.storageClass,
+		Status:        types.CopyUploaded,
+		HashRemote:    isoInfo.HashRemote,
+		RetentionMode: isoInfo.RetentionMode,
+		RetainUntil:   isoInfo.RetainUntil,
+		VerifyTime:    time.Now(),
+	})
+}
 
-	request, err := prepareUploadRequest(cli, region, bucket, storageClass, isoInfo, force)
+// skipped records iso as uploaded into the bucket where it is found. Storage class of the object found is
+// unknown, and is left empty
+func (s *isoUploadState) skipped(isoInfo *types.ISOInfo, remoteHash string) error {
+	s.inBucket = true
+	if remoteHash == "" {
+		remoteHash = isoInfo.HashRemote
+	}
+	// previous upload of it isn't resumed anymore
+	isoInfo.UploadKey = ""
+	isoInfo.UploadID = ""
+	err := db.UpdateIsoUploadInfo(isoInfo)
 	if err != nil {
 		return err
 	}
-	if request == nil {
-		fmt.Printf("%s is already in region %s, bucket %s, no need upload again !\n",
-			isoFilename, region, bucket)
-		return nil
+	err = db.UpdateIsoStatusRemoteHash(isoInfo.ID, remoteHash, types.IsoUploaded)
+	if err != nil {
+		return err
 	}
+	return db.UpsertArchiveCopy(&types.ArchiveCopy{
+		IsoID:         isoInfo.ID,
+		Region:        isoInfo.Region,
+		Bucket:        isoInfo.Bucket,
+		Status:        types.CopyUploaded,
+		HashRemote:    remoteHash,
+		RetentionMode: isoInfo.RetentionMode,
+		RetainUntil:   isoInfo.RetainUntil,
+		VerifyTime:    time.Now(),
+	})
+}
 
-	var start, end int64
-	var failParts []int
-	for i, p := range parts {
-		if i == 0 {
-			end = int64(p.Size)
-		} else {
-			start = end
-			end += int64(p.Size)
-		}
+type partUpload struct {
+	part *types.PartInfo
+	// range in uploaded object, which is same as source file if not encrypted
+	start, end int64
+}
 
-		if p.Status == types.PartUploaded {
-			logrus.Infof("%s's part %d was uploaded successfully, skip new upload", isoFilename, p.PartNo)
-			continue
-		}
+type partUploadResult struct {
+	pu  *partUpload
+	err error
+}
 
-		logrus.Infof("Uploading %s's part %d [%d, %d]", isoFilename, p.PartNo, start, end)
+// failedPartsRetryRounds is the number of rounds to upload failed parts again after all other parts are
+// done, in addition to the retries of each upload call, so that a longer outage won't fail the whole run
+const failedPartsRetryRounds = 2
 
-		var readSeeker io.ReadSeeker
-		prs := lomoio.NewFilePartReadSeeker(isoFile, start, end)
-		if saveParts {
-			partFile, err := os.Create(isoFilename + ".part" + strconv.Itoa(p.PartNo))
-			if err != nil {
-				e := cli.AbortMultipartUpload(request)
-				if e != nil {
-					fmt.Printf("abort request %v: %s\n", *request, e)
-				}
-				return err
+// uploadParts uploads parts with nthreads workers. upload runs in worker goroutines and only changes
+// its own part, while part status is saved in caller goroutine so that DB updates are serialized.
+// At most nthreads parts are in progress, which bounds memory and temp files. Parts failed with retryable
+// error are uploaded again in following rounds. It returns part numbers failed to upload
+func uploadParts(isoFilename string, uploads []*partUpload, nthreads int, state uploadState,
+	upload func(pu *partUpload) error) []int {
+	var failParts []int
+	for round := 0; len(uploads) > 0; round++ {
+		if round > 0 {
+			logrus.Infof("Retry uploading %d failed parts of %s, round %d", len(uploads), isoFilename, round)
+		}
+		var retryUploads []*partUpload
+		for _, r := range uploadPartsOnce(isoFilename, uploads, nthreads, state, upload) {
+			if round < failedPartsRetryRounds && retry.Classify(r.err).Retryable() {
+				retryUploads = append(retryUploads, r.pu)
+				continue
 			}
-			defer partFile.Close()
-			readSeeker = lomoio.NewReadSeekSaver(partFile, prs)
-		} else {
-			readSeeker = prs
+			failParts = append(failParts, r.pu.part.PartNo)
 		}
+		uploads = retryUploads
+	}
+	slices.Sort(failParts)
+	return failParts
+}
 
-		p.Etag, err = cli.Upload(int64(p.PartNo), int64(p.Size), request, readSeeker, p.HashRemote)
-		if err != nil {
-			failParts = append(failParts, p.PartNo)
-			logrus.Infof("Upload %s's part number %d:%s", isoFilename, p.PartNo, err)
-			err = db.UpdatePartStatus(p.IsoID, p.PartNo, types.PartUploadFailed)
+// uploadPartsOnce uploads each part once, and returns failed ones
+func uploadPartsOnce(isoFilename string, uploads []*partUpload, nthreads int, state uploadState,
+	upload func(pu *partUpload) error) []*partUploadResult {
+	jobs := make(chan *partUpload)
+	results := make(chan *partUploadResult)
+	for i := 0; i < nthreads; i++ {
+		go func() {
+			for pu := range jobs {
+				logrus.Infof("Uploading %s's part %d [%d, %d]", isoFilename, pu.part.PartNo, pu.start, pu.end)
+				results <- &partUploadResult{pu: pu, err: upload(pu)}
+			}
+		}()
+	}
+	go func() {
+		for _, pu := range uploads {
+			jobs <- pu
+		}
+		close(jobs)
+	}()
+
+	var failed []*partUploadResult
+	for range uploads {
+		r := <-results
+		p := r.pu.part
+		if r.err != nil {
+			failed = append(failed, r)
+			logrus.Infof("Upload %s's part number %d:%s", isoFilename, p.PartNo, r.err)
+			p.Status = types.PartUploadFailed
+			err := state.savePart(p)
 			if err != nil {
 				logrus.Infof("Update %s's part number %d status %s:%s", isoFilename, p.PartNo,
 					types.PartUploadFailed, err)
 			}
 			continue
 		}
-		err = db.UpdatePartEtagAndStatus(p.IsoID, p.PartNo, p.Etag, types.PartUploaded)
+		p.Status = types.PartUploaded
+		err := state.savePart(p)
 		if err != nil {
 			logrus.Infof("Update %s's part number %d status %s:%s", isoFilename, p.PartNo,
 				types.PartUploaded, err)
 		}
 		logrus.Infof("Uploading %s's part %d is done!", isoFilename, p.PartNo)
 	}
+	return failed
+}
+
+func uploadRawParts(cli clients.Backend, region, bucket, storageClass string, retention *clients.Retention,
+	isoFilename, srcFilename string, partSize, nthreads int, saveParts, force bool, state uploadState) error {
+	isoFile, isoInfo, parts, err := prepareUploadParts(isoFilename, srcFilename, partSize, true)
+	if err != nil {
+		return err
+	}
+	defer isoFile.Close()
+	err = state.load(isoInfo, parts)
+	if err != nil {
+		return err
+	}
+
+	// checksums of raw parts are calculated already
+	local := &localParts{
+		uploads: newPartUploads(parts),
+		hash: func(pu *partUpload) (string, error) {
+			return pu.part.HashRemote, nil
+		},
+	}
+	request, err := prepareUploadRequest(cli, region, bucket, storageClass, retention, isoInfo, partSize, force, state,
+		local)
+	if err != nil {
+		return err
+	}
+	if request == nil {
+		fmt.Printf("%s is already in region %s, bucket %s, no need upload again !\n",
+			isoFilename, region, bucket)
+		return nil
+	}
 
+	uploads, err := resumeUploadedParts(cli, request, isoFilename, local, state)
+	if err != nil {
+		return err
+	}
+	tracker := progress.NewTracker(progressReporter, "upload "+isoFilename, int64(isoInfo.Size))
+	defer tracker.Finish()
+	uploadCtx := progress.WithTracker(context.Background(), tracker)
+	tracker.Skip(int64(isoInfo.Size) - remainingBytes(uploads))
+
+	failParts := uploadParts(isoFilename, uploads, nthreads, state, func(pu *partUpload) error {
+		p := pu.part
+		var readSeeker io.ReadSeeker
+		prs := lomoio.NewFilePartReadSeeker(isoFile, pu.start, pu.end)
+		if saveParts {
+			partFile, err := os.Create(isoFilename + ".part" + strconv.Itoa(p.PartNo))
+			if err != nil {
+				return err
+			}
+			defer partFile.Close()
+			readSeeker = lomoio.NewReadSeekSaver(partFile, prs)
+		} else {
+			readSeeker = prs
+		}
+
+		var err error
+		p.Etag, err = cli.Upload(uploadCtx, int64(p.PartNo), int64(p.Size), request, readSeeker, p.HashRemote)
+		return err
+	})
 	if len(failParts) != 0 {
 		return errors.Errorf("Parts %v failed to upload", failParts)
 	}
@@ -321,16 +704,21 @@ func uploadRawParts(cli *clients.AWSClient, region, bucket, storageClass, isoFil
 	fmt.Printf("%s is uploaded to region %s, bucket %s successfully!\n",
 		isoFilename, region, bucket)
 
-	return db.UpdateIsoStatus(isoInfo.ID, types.IsoUploaded)
+	return state.done(isoInfo)
 }
 
-func uploadEncryptParts(cli *clients.AWSClient, region, bucket, storageClass, isoFilename, masterKey string,
-	partSize int, saveParts, force bool) error {
-	isoFile, isoInfo, parts, err := prepareUploadParts(isoFilename, partSize, false)
+func uploadEncryptParts(cli clients.Backend, region, bucket, storageClass string, retention *clients.Retention,
+	isoFilename, srcFilename, masterKey string, partSize, nthreads int, saveParts, force bool,
+	state uploadState) error {
+	isoFile, isoInfo, parts, err := prepareUploadParts(isoFilename, srcFilename, partSize, false)
 	if err != nil {
 		return err
 	}
 	defer isoFile.Close()
+	err = state.load(isoInfo, parts)
+	if err != nil {
+		return err
+	}
 
 	decoded, err := hex.DecodeString(isoInfo.HashLocal)
 	if err != nil {
@@ -349,7 +737,33 @@ func uploadEncryptParts(cli *clients.AWSClient, region, bucket, storageClass, is
 	// iso size need add salt block size so as to compare with remote size
 	isoInfo.Size += crypto.SaltLen()
 	isoInfo.HashRemote = ""
-	request, err := prepareUploadRequest(cli, region, bucket, storageClass, isoInfo, force)
+
+	// encrypted object is salt followed by encrypted data, which is encrypted on demand for each part
+	encryptReaderAt, err := crypto.NewEncryptReaderAt(isoFile, encryptKey, salt, true)
+	if err != nil {
+		return err
+	}
+	// add salt len for the last part
+	if len(parts) > 0 {
+		parts[len(parts)-1].Size += crypto.SaltLen()
+	}
+	// checksum of encrypted part is calculated by encrypting it, as it is never saved on disk
+	hashPart := func(pu *partUpload) (string, error) {
+		h := sha256.New()
+		n, err := io.Copy(h, io.NewSectionReader(encryptReaderAt, pu.start, pu.end-pu.start))
+		if err != nil {
+			return "", err
+		}
+		if n != pu.end-pu.start {
+			return "", fmt.Errorf("read %d bytes while expecting %d btw [%d, %d]", n, pu.end-pu.start, pu.start,
+				pu.end)
+		}
+		return lomohash.CalculateHashBase64(h.Sum(nil)), nil
+	}
+	local := &localParts{uploads: newPartUploads(parts), hash: hashPart}
+
+	request, err := prepareUploadRequest(cli, region, bucket, storageClass, retention, isoInfo, partSize, force, state,
+		local)
 	if err != nil {
 		return err
 	}
@@ -359,123 +773,56 @@ func uploadEncryptParts(cli *clients.AWSClient, region, bucket, storageClass, is
 		return nil
 	}
 
-	partsHash := [][]byte{}
-
-	var (
-		start, end int64
-		failParts  []int
-		encryptor  *crypto.Encryptor
-		prs        *lomoio.FilePartReadSeeker
-	)
-	for i, p := range parts {
-		// add salt len for the last part
-		if i == len(parts)-1 {
-			p.Size += crypto.SaltLen()
-		}
-
-		if i == 0 {
-			end = int64(p.Size - crypto.SaltLen())
-		} else {
-			start = end
-			end += int64(p.Size)
-		}
-
-		if p.Status == types.PartUploaded {
-			logrus.Infof("%s's part %d was uploaded successfully, skip new upload", isoFilename, p.PartNo)
-			h, err := lomohash.DecodeHashBase64(p.HashRemote)
-			if err != nil {
-				return errors.Wrapf(err, "while decode part %d's base64 hash %s", i+1, p.HashRemote)
-			}
-			partsHash = append(partsHash, h)
-			continue
-		}
+	uploads, err := resumeUploadedParts(cli, request, isoFilename, local, state)
+	if err != nil {
+		return err
+	}
+	tracker := progress.NewTracker(progressReporter, "upload "+isoFilename, int64(isoInfo.Size))
+	defer tracker.Finish()
+	uploadCtx := progress.WithTracker(context.Background(), tracker)
+	tracker.Skip(int64(isoInfo.Size) - remainingBytes(uploads))
 
-		logrus.Infof("Uploading %s's part %d [%d, %d]", isoFilename, p.PartNo, start, end)
+	failParts := uploadParts(isoFilename, uploads, nthreads, state, func(pu *partUpload) error {
+		p := pu.part
+		part := io.NewSectionReader(encryptReaderAt, pu.start, pu.end-pu.start)
 
-		// create a local tmpfile and save intermittent part
-		tmpFile, err := os.CreateTemp("", "part")
+		// first pass calculates hash of encrypted part, and second pass encrypts it again while uploading,
+		// so that encrypted part is never saved on disk
+		hashRemote, err := hashPart(pu)
 		if err != nil {
 			return err
 		}
-		tmpFilename := tmpFile.Name()
-		defer os.Remove(tmpFilename)
-		defer tmpFile.Close()
-
-		if prs == nil {
-			prs = lomoio.NewFilePartReadSeeker(isoFile, start, end)
-		} else {
-			prs.SetStartEnd(start, end)
+		// hash is known if the part is uploaded to another bucket already, and copies must be the same
+		if p.HashRemote != "" && p.HashRemote != hashRemote {
+			return errors.Errorf("encrypted part %d is different from the one uploaded before, is master key same?",
+				p.PartNo)
 		}
+		p.HashRemote = hashRemote
 
-		hr := sha256.New()
-		mw := io.MultiWriter(hr, tmpFile)
-
-		if encryptor == nil {
-			encryptor, err = crypto.NewEncryptor(prs, encryptKey, salt, false)
-			if err != nil {
-				return err
-			}
-			n, err := mw.Write(salt)
-			if err != nil {
-				return err
-			}
-			if n != len(salt) {
-				return fmt.Errorf("write %d byte salt while expecting %d", n, len(salt))
-			}
-		}
-
-		n, err := io.Copy(mw, encryptor)
-		if err != nil {
-			return err
-		}
-
-		if n != end-start {
-			return fmt.Errorf("write %d byte salt while expecting %d btw [%d, %d]", n, end-start, start, end)
-		}
-
-		hrData := hr.Sum(nil)
-		p.SetHashRemote(hrData)
-
-		// seek to beginning for upload
-		_, err = tmpFile.Seek(0, io.SeekStart)
-		if err != nil {
-			return err
-		}
-
-		p.Etag, err = cli.Upload(int64(p.PartNo), int64(p.Size), request, tmpFile, p.HashRemote)
-		if err != nil {
-			failParts = append(failParts, p.PartNo)
-			logrus.Infof("Upload %s's part number %d:%s", isoFilename, p.PartNo, err)
-			err = db.UpdatePartStatus(p.IsoID, p.PartNo, types.PartUploadFailed)
-			if err != nil {
-				logrus.Infof("Update %s's part number %d status %s:%s", isoFilename, p.PartNo,
-					types.PartUploadFailed, err)
-			}
-			continue
-		}
-		partsHash = append(partsHash, hrData)
-		err = db.UpdatePartEtagAndStatusHash(p.IsoID, p.PartNo, p.Etag, p.HashLocal, p.HashRemote, types.PartUploaded)
-		if err != nil {
-			logrus.Infof("Update %s's part number %d status %s:%s", isoFilename, p.PartNo,
-				types.PartUploaded, err)
-		}
-		logrus.Infof("Uploading %s's part %d is done!", isoFilename, p.PartNo)
+		var readSeeker io.ReadSeeker = part
 		if saveParts {
-			err = tmpFile.Close()
-			if err != nil {
-				return err
-			}
-			err = os.Rename(tmpFilename, isoFilename+".part"+strconv.Itoa(i+1))
+			partFile, err := os.Create(isoFilename + ".part" + strconv.Itoa(p.PartNo))
 			if err != nil {
 				return err
 			}
+			defer partFile.Close()
+			readSeeker = lomoio.NewReadSeekSaver(partFile, part)
 		}
-	}
 
+		p.Etag, err = cli.Upload(uploadCtx, int64(p.PartNo), int64(p.Size), request, readSeeker, p.HashRemote)
+		return err
+	})
 	if len(failParts) != 0 {
 		return errors.Errorf("Parts %v failed to upload", failParts)
 	}
 
+	partsHash := make([][]byte, len(parts))
+	for i, p := range parts {
+		partsHash[i], err = lomohash.DecodeHashBase64(p.HashRemote)
+		if err != nil {
+			return errors.Wrapf(err, "while decode part %d's base64 hash %s", p.PartNo, p.HashRemote)
+		}
+	}
 	isoInfo.HashRemote, err = lomohash.ConcatAndCalculateBase64Hash(partsHash)
 	if err != nil {
 		return errors.Wrapf(err, "while encode iso base64 hash %v", partsHash)
@@ -488,18 +835,43 @@ func uploadEncryptParts(cli *clients.AWSClient, region, bucket, storageClass, is
 	fmt.Printf("%s is uploaded to region %s, bucket %s successfully!\n",
 		isoFilename, region, bucket)
 
-	return db.UpdateIsoStatusRemoteHash(isoInfo.ID, isoInfo.HashRemote, types.IsoUploaded)
+	return state.done(isoInfo)
 }
 
-func uploadISO(accessKeyID, accessKey, region, bucket, storageClass, isoFilename, masterKey string,
-	partSize int, saveParts, force bool) error {
-	cli, err := clients.NewAWSClient(accessKeyID, accessKey, region)
-	if err != nil {
+func formatRetention(isoInfo *types.ISOInfo) string {
+	if isoInfo.RetentionMode == "" {
+		return "none"
+	}
+	return isoInfo.RetentionMode + " until " + common.FormatTime(isoInfo.RetainUntil.Local())
+}
+
+// checkISOLock returns error if iso uploaded to given bucket is still locked. Locked iso can't be removed,
+// so uploading it again from scratch only adds one more copy which is billed until the lock expires
+func checkISOLock(region, bucket, isoFilename string) error {
+	isoInfo, err := db.GetIsoByName(isoFilename)
+	if err != nil || isoInfo == nil {
 		return err
 	}
+	if isoInfo.Region != region || isoInfo.Bucket != bucket || isoInfo.RetentionMode == "" ||
+		!time.Now().Before(isoInfo.RetainUntil) {
+		return nil
+	}
+	return errors.Errorf("%s in bucket %s is locked in %s, and can't be replaced before that",
+		isoFilename, bucket, formatRetention(isoInfo))
+}
+
+func uploadISO(cli clients.Backend, region, bucket, storageClass string, retention *clients.Retention,
+	isoFilename, masterKey string, partSize, nthreads int, codec compress.Codec, parityOpts parity.Options,
+	saveParts, force bool, state uploadState) error {
+	if force {
+		err := checkISOLock(region, bucket, isoFilename)
+		if err != nil {
+			return err
+		}
+	}
 
 	// check metadata file firstly
-	err = uploadISOMetafile(cli, bucket, storageClass, isoFilename, masterKey)
+	err := uploadISOMetafile(cli, bucket, storageClass, isoFilename, masterKey, codec)
 	if err != nil {
 		return err
 	}
@@ -510,23 +882,79 @@ func uploadISO(accessKeyID, accessKey, region, bucket, storageClass, isoFilename
 			return err
 		}
 	}
+
+	isoInfo, err := db.GetIsoByName(isoFilename)
+	if err != nil {
+		return err
+	}
+	if isoInfo == nil {
+		return errors.Errorf("%s is not found in DB", isoFilename)
+	}
+	codec, err = chooseISOCodec(isoInfo.ID, isoFilename, codec)
+	if err != nil {
+		return err
+	}
+	if isoInfo.UploadID != "" && isoInfo.Codec != codec {
+		return errors.Errorf("previous upload of %s was compressed with %s, rerun with same compression or --force",
+			isoFilename, isoInfo.Codec)
+	}
+
+	isoPath := localISOPath(isoFilename)
+	srcFilename := isoPath
+	if codec != compress.CodecNone {
+		srcFilename, err = compressISO(isoPath, codec)
+		if err != nil {
+			return err
+		}
+	}
+	if isoInfo.Codec != codec {
+		err = db.UpdateIsoCodec(isoInfo.ID, codec)
+		if err != nil {
+			return err
+		}
+	}
+
 	if masterKey == "" {
-		return uploadRawParts(cli, region, bucket, storageClass, isoFilename, partSize, saveParts, force)
+		err = uploadRawParts(cli, region, bucket, storageClass, retention, isoFilename, srcFilename, partSize, nthreads,
+			saveParts, force, state)
+	} else {
+		err = uploadEncryptParts(cli, region, bucket, storageClass, retention, isoFilename, srcFilename, masterKey,
+			partSize, nthreads, saveParts, force, state)
+	}
+	if err != nil {
+		return err
+	}
+	err = uploadISOParity(cli, bucket, storageClass, isoFilename, srcFilename, masterKey, parityOpts)
+	if err != nil || srcFilename == isoPath {
+		return err
 	}
-	return uploadEncryptParts(cli, region, bucket, storageClass, isoFilename, masterKey, partSize, saveParts, force)
+	// compressed copy is not needed anymore once upload is done
+	return os.Remove(srcFilename)
 }
 
-func uploadISOs(ctx *cli.Context) error {
-	ps, err := datasize.ParseString(ctx.String("part-size"))
+func getPartSize(ctx *cli.Context) (int, error) {
+	return parsePartSize(ctx.String("part-size"))
+}
+
+func parsePartSize(s string) (int, error) {
+	ps, err := datasize.ParseString(s)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	partSize := int(ps)
 	if partSize < 5*1024*1024 {
-		return errors.New("part size must be larger than 5*1024*1024=5242880")
+		return 0, errors.New("part size must be larger than 5*1024*1024=5242880")
 	}
 	if partSize%crypto.SaltLen() != 0 || (partSize-crypto.SaltLen())%crypto.SaltLen() != 0 {
-		return errors.Errorf("part size must be able to divided by salt length '%d'", crypto.SaltLen())
+		return 0, errors.Errorf("part size must be able to divided by salt length '%d'", crypto.SaltLen())
+	}
+	return partSize, nil
+}
+
+func uploadISOs(ctx *cli.Context) error {
+	partSize, err := getPartSize(ctx)
+	if err != nil {
+		return err
 	}
 
 	err = initDB(ctx.GlobalString("db"))
@@ -539,22 +967,37 @@ func uploadISOs(ctx *cli.Context) error {
 		return err
 	}
 
-	accessKeyID := ctx.String("awsAccessKeyID")
-	secretAccessKey := ctx.String("awsSecretAccessKey")
-	region := ctx.String("awsBucketRegion")
 	bucket := ctx.String("awsBucketName")
 	saveParts := ctx.Bool("save-parts")
 	force := ctx.Bool("force")
+	nthreads := ctx.Int("nthreads")
+	if nthreads <= 0 {
+		return errors.Errorf("invalid number of threads: %d", nthreads)
+	}
 
-	if len(ctx.Args()) == 0 {
+	all := ctx.Bool("all")
+	if len(ctx.Args()) == 0 && !all {
 		return errors.New("Please supply one iso file name at least, or -a to upload all files not uploaded")
 	}
+	if len(ctx.Args()) != 0 && all {
+		return errors.New("iso file names can't be given with -a")
+	}
+	budget, err := datasize.ParseString(ctx.String("max-bytes"))
+	if err != nil {
+		return err
+	}
+	isoStoreDir = ctx.String("store-dir")
 
 	storageClass, err := getAWSStorageClass(ctx)
 	if err != nil {
 		return err
 	}
 
+	retention, err := getRetention(ctx)
+	if err != nil {
+		return err
+	}
+
 	masterKey := ctx.String("encrypt-key")
 	if ctx.Bool("no-encrypt") {
 		masterKey = ""
@@ -565,9 +1008,32 @@ func uploadISOs(ctx *cli.Context) error {
 		}
 	}
 
+	codec, err := getCompressCodec(ctx)
+	if err != nil {
+		return err
+	}
+
+	parityOpts, err := getParityOptions(ctx)
+	if err != nil {
+		return err
+	}
+
+	cli, region, err := newBackend(ctx)
+	if err != nil {
+		return err
+	}
+
+	upload := func(isoFilename string) (bool, error) {
+		state := &isoUploadState{storageClass: storageClass}
+		err := uploadISO(cli, region, bucket, storageClass, retention, isoFilename, masterKey, partSize,
+			nthreads, codec, parityOpts, saveParts, force, state)
+		return state.inBucket, err
+	}
+	if all {
+		return uploadPendingISOs(uint64(budget), upload)
+	}
 	for _, isoFilename := range ctx.Args() {
-		err = uploadISO(accessKeyID, secretAccessKey, region, bucket, storageClass,
-			filepath.Clean(isoFilename), masterKey, partSize, saveParts, force)
+		_, err = upload(filepath.Clean(isoFilename))
 		if err != nil {
 			return err
 		}
@@ -575,13 +1041,130 @@ func uploadISOs(ctx *cli.Context) error {
 	return nil
 }
 
+// listPendingISOs returns isos created or uploading, the oldest first
+func listPendingISOs() ([]*types.ISOInfo, error) {
+	isos, err := db.ListISOs()
+	if err != nil {
+		return nil, err
+	}
+	var pending []*types.ISOInfo
+	for _, iso := range isos {
+		if iso.Status == types.IsoCreated || iso.Status == types.IsoUploading {
+			pending = append(pending, iso)
+		}
+	}
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].CreateTime.Before(pending[j].CreateTime)
+	})
+	return pending, nil
+}
+
+// pendingUploadBytes returns bytes of iso not uploaded yet, which is the size of parts not uploaded if upload
+// was started before, otherwise iso size as its parts are only known once its upload starts
+func pendingUploadBytes(iso *types.ISOInfo, parts []*types.PartInfo) uint64 {
+	if len(parts) == 0 {
+		return uint64(iso.Size)
+	}
+	var size uint64
+	for _, p := range parts {
+		if p.Status != types.PartUploaded {
+			size += uint64(p.Size)
+		}
+	}
+	return size
+}
+
+// sentUploadBytes returns the size of parts of iso uploaded since parts before were listed, which are the
+// bytes sent after compression, and not the ones uploaded in previous runs
+func sentUploadBytes(iso *types.ISOInfo, before []*types.PartInfo) (uint64, error) {
+	uploaded := map[int]bool{}
+	for _, p := range before {
+		if p.Status == types.PartUploaded {
+			uploaded[p.PartNo] = true
+		}
+	}
+	parts, err := db.GetPartsByIsoID(iso.ID)
+	if err != nil {
+		return 0, err
+	}
+	var size uint64
+	for _, p := range parts {
+		if p.Status == types.PartUploaded && !uploaded[p.PartNo] {
+			size += uint64(p.Size)
+		}
+	}
+	return size, nil
+}
+
+// uploadPendingISOs uploads isos created or uploading the oldest first, and resumes the ones partially
+// uploaded. Isos not found locally are skipped, and one failed iso doesn't stop the others. It stops before
+// the iso whose bytes not uploaded yet make bytes sent in this run beyond budget, and budget is unlimited if
+// it is 0. Budget is charged with parts sent, including the ones of failed isos. upload returns true if iso is
+// found in bucket already, which isn't counted into budget
+func uploadPendingISOs(budget uint64, upload func(isoFilename string) (bool, error)) error {
+	isos, err := listPendingISOs()
+	if err != nil {
+		return err
+	}
+	if len(isos) == 0 {
+		fmt.Println("No iso needs to be uploaded")
+		return nil
+	}
+
+	var (
+		used                        uint64
+		uploaded, skipped, inBucket int
+		failed                      []string
+	)
+	for i, iso := range isos {
+		if _, err = os.Stat(localISOPath(iso.Name)); err != nil {
+			logrus.Warnf("Skip uploading %s: %s", iso.Name, err)
+			skipped++
+			continue
+		}
+		before, err := db.GetPartsByIsoID(iso.ID)
+		if err != nil {
+			return err
+		}
+		need := pendingUploadBytes(iso, before)
+		if budget != 0 && used+need > budget {
+			fmt.Printf("Upload budget %s is reached with %s uploaded, %s needs %s, %d isos are left for next run\n",
+				datasize.ByteSize(budget).HR(), datasize.ByteSize(used).HR(), iso.Name,
+				datasize.ByteSize(need).HR(), len(isos)-i)
+			break
+		}
+		found, err := upload(iso.Name)
+		if !found {
+			sent, serr := sentUploadBytes(iso, before)
+			if serr != nil {
+				return serr
+			}
+			used += sent
+		}
+		if err != nil {
+			logrus.Warnf("Upload %s: %s", iso.Name, err)
+			failed = append(failed, iso.Name)
+			continue
+		}
+		if found {
+			inBucket++
+			continue
+		}
+		uploaded++
+	}
+
+	fmt.Printf("%d isos are uploaded (%s), %d are in bucket already, %d are skipped as not found locally, "+
+		"%d failed\n", uploaded, datasize.ByteSize(used).HR(), inBucket, skipped, len(failed))
+	if len(failed) != 0 {
+		return errors.Errorf("failed to upload %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
 func listUploadingItems(ctx *cli.Context) error {
-	accessKeyID := ctx.String("awsAccessKeyID")
-	secretAccessKey := ctx.String("awsSecretAccessKey")
-	region := ctx.String("awsBucketRegion")
 	bucket := ctx.String("awsBucketName")
 
-	cli, err := clients.NewAWSClient(accessKeyID, secretAccessKey, region)
+	cli, _, err := newBackend(ctx)
 	if err != nil {
 		return err
 	}
@@ -606,12 +1189,9 @@ func abortUpload(ctx *cli.Context) error {
 	if len(ctx.Args()) == 0 {
 		return errors.New("please provide upload key at least")
 	}
-	accessKeyID := ctx.String("awsAccessKeyID")
-	secretAccessKey := ctx.String("awsSecretAccessKey")
-	region := ctx.String("awsBucketRegion")
 	bucket := ctx.String("awsBucketName")
 
-	cli, err := clients.NewAWSClient(accessKeyID, secretAccessKey, region)
+	cli, _, err := newBackend(ctx)
 	if err != nil {
 		return err
 	}
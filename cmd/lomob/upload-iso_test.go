@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lomorage/lomo-backup/clients"
+	"github.com/lomorage/lomo-backup/common/compress"
+	"github.com/lomorage/lomo-backup/common/datasize"
+	"github.com/lomorage/lomo-backup/common/parity"
+	"github.com/lomorage/lomo-backup/common/types"
+	"github.com/stretchr/testify/require"
+)
+
+// prepareTestISOs creates one iso for each day, and returns their names in the order of days
+func prepareTestISOs(t *testing.T, days int) (string, []string) {
+	dbFilename := newTestDB(t)
+	dir := shortTempDir(t)
+	for day := 1; day <= days; day++ {
+		writeTestFile(t, filepath.Join(dir, fmt.Sprintf("%d.jpg", day)), 400000, day)
+	}
+	scanTestDir(t, dir)
+	created, err := createISOs(datasize.ByteSize(300000), "", false, false)
+	require.Nil(t, err)
+	require.Len(t, created, days)
+	return dbFilename, created
+}
+
+func isoSizes(t *testing.T) map[string]uint64 {
+	isos, err := db.ListISOs()
+	require.Nil(t, err)
+	sizes := map[string]uint64{}
+	for _, iso := range isos {
+		sizes[iso.Name] = uint64(iso.Size)
+	}
+	return sizes
+}
+
+func TestUploadPendingISOsOldestFirst(t *testing.T) {
+	dbFilename, created := prepareTestISOs(t, 4)
+	// isos are created in reverse order, and the uploaded one is not pending
+	now := time.Now().UTC()
+	for i, name := range created {
+		execTestDB(t, dbFilename, "update isos set create_time=? where name=?",
+			now.Add(-time.Duration(i)*time.Hour), name)
+	}
+	execTestDB(t, dbFilename, "update isos set status=? where name=?", types.IsoUploaded, created[1])
+	execTestDB(t, dbFilename, "update isos set status=? where name=?", types.IsoUploading, created[2])
+
+	var uploaded []string
+	err := uploadPendingISOs(0, func(isoFilename string) (bool, error) {
+		uploaded = append(uploaded, isoFilename)
+		return false, nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, []string{created[3], created[2], created[0]}, uploaded)
+}
+
+// uploadTestParts records parts of iso as uploaded up to part n, and creates parts of sizes if there is none
+func uploadTestParts(t *testing.T, isoFilename string, sizes []int, n int) {
+	iso, err := db.GetIsoByName(isoFilename)
+	require.Nil(t, err)
+	parts, err := db.GetPartsByIsoID(iso.ID)
+	require.Nil(t, err)
+	if len(parts) == 0 {
+		for i, size := range sizes {
+			parts = append(parts, &types.PartInfo{IsoID: iso.ID, PartNo: i + 1, Size: size})
+		}
+		require.Nil(t, db.InsertIsoParts(iso.ID, parts))
+	}
+	for partNo := 1; partNo <= n; partNo++ {
+		require.Nil(t, db.UpdatePartStatus(iso.ID, partNo, types.PartUploaded))
+	}
+}
+
+func TestUploadPendingISOsBudget(t *testing.T) {
+	_, created := prepareTestISOs(t, 4)
+	sizes := isoSizes(t)
+
+	// iso found in bucket isn't counted, and the last one is beyond budget
+	var uploaded []string
+	err := uploadPendingISOs(sizes[created[0]]+sizes[created[2]], func(isoFilename string) (bool, error) {
+		uploaded = append(uploaded, isoFilename)
+		if isoFilename == created[1] {
+			return true, nil
+		}
+		uploadTestParts(t, isoFilename, []int{int(sizes[isoFilename])}, 1)
+		return false, nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, created[:3], uploaded)
+}
+
+func TestUploadPendingISOsBudgetSent(t *testing.T) {
+	_, created := prepareTestISOs(t, 4)
+	sizes := isoSizes(t)
+	size := func(i int) int { return int(sizes[created[i]]) }
+
+	// the first iso is partially uploaded, and needs the size of its parts not uploaded
+	uploadTestParts(t, created[0], []int{size(0) - 100, 100}, 1)
+	iso, err := db.GetIsoByName(created[0])
+	require.Nil(t, err)
+	parts, err := db.GetPartsByIsoID(iso.ID)
+	require.Nil(t, err)
+	require.EqualValues(t, 100, pendingUploadBytes(iso, parts))
+
+	// the second one is compressed into half, and the third one fails after sending half of it. Budget is
+	// charged with parts sent, so the last one is beyond budget by one byte
+	budget := uint64(100 + size(1)/2 + size(2)/2 + size(3) - 1)
+	var uploaded []string
+	err = uploadPendingISOs(budget, func(isoFilename string) (bool, error) {
+		uploaded = append(uploaded, isoFilename)
+		switch isoFilename {
+		case created[0]:
+			uploadTestParts(t, isoFilename, nil, 2)
+		case created[1]:
+			uploadTestParts(t, isoFilename, []int{size(1) / 2}, 1)
+		case created[2]:
+			uploadTestParts(t, isoFilename, []int{size(2) / 2, size(2) - size(2)/2}, 1)
+			return false, errors.New("upload interrupted")
+		}
+		return false, nil
+	})
+	require.NotNil(t, err)
+	require.Equal(t, created[:3], uploaded)
+
+	// the failed one only needs the part not sent
+	for _, name := range created[:2] {
+		iso, err := db.GetIsoByName(name)
+		require.Nil(t, err)
+		require.Nil(t, db.UpdateIsoStatus(iso.ID, types.IsoUploaded))
+	}
+	uploaded = nil
+	err = uploadPendingISOs(uint64(size(2)-size(2)/2), func(isoFilename string) (bool, error) {
+		uploaded = append(uploaded, isoFilename)
+		uploadTestParts(t, isoFilename, nil, 2)
+		return false, nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, created[2:3], uploaded)
+}
+
+func TestUploadISOInBucketAlready(t *testing.T) {
+	dbFilename, created := prepareTestISOs(t, 1)
+	remoteDir := t.TempDir()
+	uploadTestISOs(t, dbFilename, remoteDir, created[0])
+
+	// records of upload are lost, and iso found in bucket is recorded as uploaded without upload
+	execTestDB(t, dbFilename, "update isos set status=?, region='', bucket='', hash_remote='', upload_key='',"+
+		" upload_id='', storage_class=''", types.IsoCreated)
+	execTestDB(t, dbFilename, "delete from parts")
+	execTestDB(t, dbFilename, "delete from archive_copies")
+
+	lb, err := clients.NewLocalBackend(remoteDir)
+	require.Nil(t, err)
+	cb := &countingBackend{Backend: lb}
+	region := "file://" + lb.Root()
+	err = uploadPendingISOs(0, func(isoFilename string) (bool, error) {
+		state := &isoUploadState{storageClass: "STANDARD"}
+		err := uploadISO(cb, region, defaultBucket, "STANDARD", nil, isoFilename, testMasterKey, 5242880, 1,
+			compress.CodecNone, parity.Options{}, false, false, state)
+		return state.inBucket, err
+	})
+	require.Nil(t, err)
+	require.Empty(t, cb.uploaded())
+
+	isos, err := db.ListISOs()
+	require.Nil(t, err)
+	require.Len(t, isos, 1)
+	require.Equal(t, types.IsoUploaded, isos[0].Status)
+	require.Equal(t, region, isos[0].Region)
+	require.Equal(t, defaultBucket, isos[0].Bucket)
+	require.NotEmpty(t, isos[0].HashRemote)
+	copies, err := db.ListArchiveCopies()
+	require.Nil(t, err)
+	require.Len(t, copies, 1)
+	require.Equal(t, types.CopyUploaded, copies[0].Status)
+	require.Equal(t, region, copies[0].Region)
+	require.Equal(t, isos[0].HashRemote, copies[0].HashRemote)
+
+	// nothing is pending anymore
+	require.Nil(t, uploadPendingISOs(0, func(isoFilename string) (bool, error) {
+		t.Fatalf("%s is uploaded again", isoFilename)
+		return false, nil
+	}))
+}
+
+// partialBackend stores the first half of part partNo only, and fails its upload
+type partialBackend struct {
+	clients.Backend
+	partNo int64
+}
+
+func (b *partialBackend) Upload(ctx context.Context, partNo, length int64, request *clients.UploadRequest,
+	reader io.ReadSeeker, checksum string) (string, error) {
+	if partNo != b.partNo {
+		return b.Backend.Upload(ctx, partNo, length, request, reader, checksum)
+	}
+	_, err := b.Backend.Upload(ctx, partNo, length/2, request, reader, "")
+	if err != nil {
+		return "", err
+	}
+	return "", errors.New("upload interrupted")
+}
+
+// requireRestored checks iso restored from directory backend is the same as local one
+func requireRestored(t *testing.T, dbFilename, remoteDir, isoFilename string) {
+	original, err := os.ReadFile(localISOPath(isoFilename))
+	require.Nil(t, err)
+	restored := filepath.Join(t.TempDir(), "restored.iso")
+	require.Nil(t, runApp(t, dbFilename, "restore", "aws", "--local-dir", remoteDir, "-k", testMasterKey,
+		isoFilename, restored))
+	content, err := os.ReadFile(restored)
+	require.Nil(t, err)
+	require.Equal(t, original, content)
+}
+
+func testPartFilename(remoteDir, uploadID string, partNo int) string {
+	return filepath.Join(remoteDir, defaultBucket, ".lomob", "uploads", uploadID, fmt.Sprintf("part-%05d", partNo))
+}
+
+func TestResumeUploadPartsLost(t *testing.T) {
+	dbFilename, isoFilename := prepareLargeISO(t)
+	remoteDir := t.TempDir()
+	lb, _ := interruptTestUpload(t, remoteDir, isoFilename)
+	iso, err := db.GetIsoByName(isoFilename)
+	require.Nil(t, err)
+
+	// parts are recreated, and the ones in bucket are adopted by their size and checksum
+	execTestDB(t, dbFilename, "delete from parts")
+	uploaded, err := uploadTestISO(t, lb, isoFilename, 0)
+	require.Nil(t, err)
+	require.Equal(t, []int64{3, 4}, uploaded)
+
+	isos, err := db.ListISOs()
+	require.Nil(t, err)
+	require.Equal(t, types.IsoUploaded, isos[0].Status)
+	require.Equal(t, iso.UploadID, isos[0].UploadID)
+	requireRestored(t, dbFilename, remoteDir, isoFilename)
+}
+
+func TestResumeUploadDiscovered(t *testing.T) {
+	dbFilename, isoFilename := prepareLargeISO(t)
+	remoteDir := t.TempDir()
+	lb, _ := interruptTestUpload(t, remoteDir, isoFilename)
+	iso, err := db.GetIsoByName(isoFilename)
+	require.Nil(t, err)
+
+	// newer upload of the same key with a different part is skipped
+	stale, err := lb.CreateMultipartUpload(defaultBucket, iso.UploadKey, binContentType, "STANDARD", nil, nil)
+	require.Nil(t, err)
+	_, err = lb.Upload(context.Background(), 1, 5242880, stale, bytes.NewReader(make([]byte, 5242880)), "")
+	require.Nil(t, err)
+	future := time.Now().Add(time.Hour)
+	require.Nil(t, os.Chtimes(filepath.Dir(testPartFilename(remoteDir, stale.ID, 1)), future, future))
+
+	execTestDB(t, dbFilename, "update isos set upload_id='', upload_key=''")
+	execTestDB(t, dbFilename, "delete from parts")
+	uploaded, err := uploadTestISO(t, lb, isoFilename, 0)
+	require.Nil(t, err)
+	require.Equal(t, []int64{3, 4}, uploaded)
+
+	isos, err := db.ListISOs()
+	require.Nil(t, err)
+	require.Equal(t, types.IsoUploaded, isos[0].Status)
+	require.Equal(t, iso.UploadID, isos[0].UploadID)
+	requireRestored(t, dbFilename, remoteDir, isoFilename)
+
+	// upload not of this iso is left as is
+	requests, err := lb.ListMultipartUploads(defaultBucket)
+	require.Nil(t, err)
+	require.Len(t, requests, 1)
+	require.Equal(t, stale.ID, requests[0].ID)
+}
+
+func TestResumeUploadPartsMismatch(t *testing.T) {
+	dbFilename, isoFilename := prepareLargeISO(t)
+	remoteDir := t.TempDir()
+	lb, _ := interruptTestUpload(t, remoteDir, isoFilename)
+	iso, err := db.GetIsoByName(isoFilename)
+	require.Nil(t, err)
+
+	// part 1 in bucket is shorter, and part 2 has the same size but different content
+	require.Nil(t, os.Truncate(testPartFilename(remoteDir, iso.UploadID, 1), 5242880-1))
+	part2 := testPartFilename(remoteDir, iso.UploadID, 2)
+	content, err := os.ReadFile(part2)
+	require.Nil(t, err)
+	content[0] ^= 0xff
+	require.Nil(t, os.WriteFile(part2, content, 0644))
+
+	// upload found in bucket isn't used as its parts are different
+	execTestDB(t, dbFilename, "update isos set upload_id='', upload_key=''")
+	execTestDB(t, dbFilename, "delete from parts")
+	uploaded, err := uploadTestISO(t, lb, isoFilename, 2)
+	require.NotNil(t, err)
+	require.Equal(t, []int64{1}, uploaded)
+	newIso, err := db.GetIsoByName(isoFilename)
+	require.Nil(t, err)
+	require.NotEqual(t, iso.UploadID, newIso.UploadID)
+
+	// the recorded upload is resumed, and its parts different from local ones are uploaded again
+	execTestDB(t, dbFilename, "update isos set upload_id=?, upload_key=?", iso.UploadID, iso.UploadKey)
+	execTestDB(t, dbFilename, "delete from parts")
+	uploaded, err = uploadTestISO(t, lb, isoFilename, 0)
+	require.Nil(t, err)
+	require.Equal(t, []int64{1, 2, 3, 4}, uploaded)
+	requireRestored(t, dbFilename, remoteDir, isoFilename)
+}
+
+func TestResumeUploadPartialLastPart(t *testing.T) {
+	dbFilename, isoFilename := prepareLargeISO(t)
+	remoteDir := t.TempDir()
+	lb, err := clients.NewLocalBackend(remoteDir)
+	require.Nil(t, err)
+	state := &isoUploadState{storageClass: "STANDARD"}
+	err = uploadISO(&partialBackend{Backend: lb, partNo: 4}, "file://"+lb.Root(), defaultBucket, "STANDARD", nil,
+		isoFilename, testMasterKey, 5242880, 1, compress.CodecNone, parity.Options{}, false, false, state)
+	require.NotNil(t, err)
+	iso, err := db.GetIsoByName(isoFilename)
+	require.Nil(t, err)
+	parts, err := lb.ListParts(&clients.UploadRequest{ID: iso.UploadID, Bucket: defaultBucket, Key: iso.UploadKey})
+	require.Nil(t, err)
+	require.Len(t, parts, 4)
+
+	// last part is longer by the salt in front of encrypted iso, and its first half in bucket is uploaded again
+	execTestDB(t, dbFilename, "delete from parts")
+	uploaded, err := uploadTestISO(t, lb, isoFilename, 0)
+	require.Nil(t, err)
+	require.Equal(t, []int64{4}, uploaded)
+	requireRestored(t, dbFilename, remoteDir, isoFilename)
+}
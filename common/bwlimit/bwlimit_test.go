@@ -0,0 +1,160 @@
+package bwlimit
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRate(t *testing.T) {
+	for s, expect := range map[string]Rate{
+		"2MB/s":     2000000,
+		"500KB":     500000,
+		"1mb/s":     1000000,
+		"unlimited": Unlimited,
+		"":          Unlimited,
+		"pause":     Paused,
+		"0":         Paused,
+	} {
+		r, err := ParseRate(s)
+		require.Nil(t, err, s)
+		require.Equal(t, expect, r, s)
+	}
+	for _, s := range []string{"fast", "2Mb/s", "-1MB"} {
+		_, err := ParseRate(s)
+		require.NotNil(t, err, s)
+	}
+}
+
+func at(hour, minute int) time.Time {
+	return time.Date(2024, time.May, 1, hour, minute, 30, 0, time.Local)
+}
+
+func TestSchedule(t *testing.T) {
+	s, err := ParseSchedule("23:00-07:00=unlimited, 09:00-17:00=pause,else=1MB/s")
+	require.Nil(t, err)
+	require.False(t, s.IsUnlimited())
+
+	for _, c := range []struct {
+		t    time.Time
+		rate Rate
+		next time.Time
+	}{
+		{at(23, 0), Unlimited, at(7, 0).Add(24*time.Hour - 30*time.Second)},
+		{at(2, 0), Unlimited, at(7, 0).Add(-30 * time.Second)},
+		{at(6, 59), Unlimited, at(7, 0).Add(-30 * time.Second)},
+		{at(7, 0), 1000000, at(9, 0).Add(-30 * time.Second)},
+		{at(12, 0), Paused, at(17, 0).Add(-30 * time.Second)},
+		{at(17, 0), 1000000, at(23, 0).Add(-30 * time.Second)},
+	} {
+		require.Equal(t, c.rate, s.RateAt(c.t), c.t.String())
+		require.Equal(t, c.next, s.NextChange(c.t), c.t.String())
+	}
+
+	s, err = ParseSchedule("2MB/s")
+	require.Nil(t, err)
+	require.Equal(t, Rate(2000000), s.RateAt(at(12, 0)))
+	require.True(t, s.NextChange(at(12, 0)).IsZero())
+
+	s, err = ParseSchedule("01:00-02:00=unlimited")
+	require.Nil(t, err)
+	require.True(t, s.IsUnlimited())
+	require.Nil(t, NewLimiter(s))
+
+	for _, str := range []string{"23:00=1MB", "23:00-25:00=1MB", "else", "always=1MB", "01:00-02:00=fast"} {
+		_, err = ParseSchedule(str)
+		require.NotNil(t, err, str)
+	}
+}
+
+// fakeClock advances when sleeping
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.slept += d
+	return nil
+}
+
+func newTestLimiter(t *testing.T, schedule string, now time.Time) (*Limiter, *fakeClock) {
+	s, err := ParseSchedule(schedule)
+	require.Nil(t, err)
+	l := NewLimiter(s)
+	require.NotNil(t, l)
+	c := &fakeClock{now: now}
+	l.now = c.Now
+	l.sleep = c.Sleep
+	return l, c
+}
+
+func TestReaderRate(t *testing.T) {
+	l, c := newTestLimiter(t, "1MB/s", at(12, 0))
+	data := bytes.Repeat([]byte{1}, 3000000)
+	got, err := io.ReadAll(NewReader(context.Background(), bytes.NewReader(data), l))
+	require.Nil(t, err)
+	require.Equal(t, data, got)
+	require.InDelta(t, 3*time.Second, c.slept, float64(10*time.Millisecond))
+}
+
+func TestWaitOpen(t *testing.T) {
+	l, c := newTestLimiter(t, "09:00-17:00=pause,else=1MB/s", at(12, 0))
+	require.Nil(t, l.WaitOpen(context.Background()))
+	require.Equal(t, at(17, 0).Add(-30*time.Second), c.Now())
+
+	// request started before pause window keeps going with the last rate
+	l, c = newTestLimiter(t, "09:00-17:00=pause,else=1MB/s", at(8, 59))
+	require.Nil(t, l.WaitN(context.Background(), 1000))
+	require.Equal(t, time.Millisecond, c.slept)
+	c.now = at(9, 0)
+	// bucket is full after one minute, and the other 1MB waits for one second
+	require.Nil(t, l.WaitN(context.Background(), 2000000))
+	require.InDelta(t, time.Second+time.Millisecond, c.slept, float64(time.Millisecond))
+}
+
+func TestTransport(t *testing.T) {
+	var received []byte
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = io.ReadAll(r.Body)
+	}))
+	defer s.Close()
+
+	l, c := newTestLimiter(t, "09:00-17:00=pause,else=1MB/s", at(12, 0))
+	cli := &http.Client{Transport: NewTransport(nil, l)}
+	data := bytes.Repeat([]byte{1}, 2000000)
+	resp, err := cli.Post(s.URL, "application/octet-stream", bytes.NewReader(data))
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, data, received)
+	// wait until 17:00, and then send 2MB at 1MB/s
+	require.Equal(t, at(17, 0).Add(-30*time.Second+2*time.Second), c.Now().Round(10*time.Millisecond))
+
+	// requests without body or with small body are not limited even if paused
+	c.now = at(12, 0)
+	slept := c.slept
+	resp, err = cli.Get(s.URL)
+	require.Nil(t, err)
+	resp.Body.Close()
+	resp, err = cli.Post(s.URL, "application/json", bytes.NewReader([]byte("{}")))
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, slept, c.slept)
+}
@@ -0,0 +1,174 @@
+package bwlimit
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxChunk is the max bytes sent between two waits, so that bandwidth is smooth
+const maxChunk = 32 * 1024
+
+// Limiter is one token bucket shared by all uploads, whose rate follows the schedule. Burst is one
+// second of the current rate
+type Limiter struct {
+	schedule *Schedule
+	now      func() time.Time
+	sleep    func(ctx context.Context, d time.Duration) error
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	rate   Rate
+	// the last rate not paused, which is used by requests in flight when pause window starts
+	active Rate
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// NewLimiter returns nil if schedule never limits bandwidth
+func NewLimiter(schedule *Schedule) *Limiter {
+	if schedule == nil || schedule.IsUnlimited() {
+		return nil
+	}
+	return &Limiter{schedule: schedule, now: time.Now, sleep: sleep, rate: Unlimited, active: Unlimited}
+}
+
+// WaitOpen blocks until uploads are not paused by schedule
+func (l *Limiter) WaitOpen(ctx context.Context) error {
+	for {
+		now := l.now()
+		if l.schedule.RateAt(now) != Paused {
+			return nil
+		}
+		next := l.schedule.NextChange(now)
+		logrus.Infof("Uploads are paused until %s", next.Format("15:04"))
+		err := l.sleep(ctx, next.Sub(now))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// reserve takes n tokens and returns how long to wait before sending them. Tokens may go negative so
+// that concurrent uploads wait in turn
+func (l *Limiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	rate := l.schedule.RateAt(now)
+	if rate == Paused {
+		// request already started keeps going instead of timing out on server
+		rate = l.active
+	} else {
+		l.active = rate
+	}
+	if rate != l.rate {
+		logrus.Infof("Upload bandwidth limit is %s", rate)
+		l.rate = rate
+		l.tokens = 0
+		l.last = now
+	}
+	if rate == Unlimited {
+		return 0
+	}
+
+	l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+	l.tokens = min(l.tokens, float64(rate))
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+}
+
+// WaitN blocks until n bytes are allowed to be sent
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	d := l.reserve(n)
+	if d <= 0 {
+		return nil
+	}
+	return l.sleep(ctx, d)
+}
+
+type reader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) > maxChunk {
+		p = p[:maxChunk]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		werr := r.l.WaitN(r.ctx, n)
+		if werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// NewReader returns reader whose data is read no faster than limiter allows. r is returned if limiter
+// is nil
+func NewReader(ctx context.Context, r io.Reader, l *Limiter) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &reader{ctx: ctx, r: r, l: l}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Transport limits bandwidth of request bodies. Bodies are limited here instead of the readers given to
+// cloud clients, because SDK reads them to calculate checksums before sending, which shouldn't be limited.
+// Requests with body wait while uploads are paused, except small ones like metadata or token refresh
+type Transport struct {
+	Base    http.RoundTripper
+	Limiter *Limiter
+}
+
+// NewTransport returns base if limiter is nil
+func NewTransport(base http.RoundTripper, l *Limiter) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if l == nil {
+		return base
+	}
+	return &Transport{Base: base, Limiter: l}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.Body == http.NoBody || (req.ContentLength >= 0 && req.ContentLength < maxChunk) {
+		return t.Base.RoundTrip(req)
+	}
+	err := t.Limiter.WaitOpen(req.Context())
+	if err != nil {
+		req.Body.Close()
+		return nil, err
+	}
+	r := req.Clone(req.Context())
+	r.Body = readCloser{Reader: NewReader(req.Context(), req.Body, t.Limiter), Closer: req.Body}
+	return t.Base.RoundTrip(r)
+}
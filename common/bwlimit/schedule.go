@@ -0,0 +1,179 @@
+package bwlimit
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lomorage/lomo-backup/common/datasize"
+)
+
+// Rate is upload bandwidth in bytes per second. Unlimited means no limit, and 0 pauses uploads
+type Rate int64
+
+const (
+	Unlimited Rate = -1
+	Paused    Rate = 0
+)
+
+func (r Rate) String() string {
+	switch r {
+	case Unlimited:
+		return "unlimited"
+	case Paused:
+		return "paused"
+	}
+	return datasize.ByteSize(r).HR() + "/s"
+}
+
+// ParseRate parses rate like "2MB/s", "500KB", "unlimited" or "pause"
+func ParseRate(s string) (Rate, error) {
+	s = strings.TrimSpace(s)
+	switch strings.ToLower(s) {
+	case "", "unlimited", "off":
+		return Unlimited, nil
+	case "pause", "paused":
+		return Paused, nil
+	}
+	size, err := datasize.ParseString(strings.TrimSuffix(s, "/s"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate '%s': %w", s, err)
+	}
+	if size.Bytes() > uint64(1<<62) {
+		return 0, fmt.Errorf("invalid rate '%s': too large", s)
+	}
+	return Rate(size), nil
+}
+
+const minutesPerDay = 24 * 60
+
+// window is [start, end) in minutes of day, which crosses midnight if end is not larger than start
+type window struct {
+	start, end int
+	rate       Rate
+}
+
+func (w window) contains(minute int) bool {
+	if w.start < w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+// Schedule is rates in time of day windows, and the rate out of any window. The first matched window wins
+type Schedule struct {
+	windows []window
+	rate    Rate
+}
+
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		if strings.TrimSpace(s) == "24:00" {
+			return minutesPerDay, nil
+		}
+		return 0, fmt.Errorf("invalid time of day '%s', expect HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// ParseSchedule parses one rate like "2MB/s", or comma separated time of day windows and their rates in
+// local time, like "23:00-07:00=unlimited,09:00-17:00=pause,else=1MB/s". Rate out of windows is unlimited
+// if else is not given
+func ParseSchedule(s string) (*Schedule, error) {
+	if !strings.Contains(s, "=") {
+		rate, err := ParseRate(s)
+		if err != nil {
+			return nil, err
+		}
+		return &Schedule{rate: rate}, nil
+	}
+
+	schedule := &Schedule{rate: Unlimited}
+	for _, item := range strings.Split(s, ",") {
+		period, rateStr, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule '%s', expect <HH:MM-HH:MM>=<rate> or else=<rate>", item)
+		}
+		rate, err := ParseRate(rateStr)
+		if err != nil {
+			return nil, err
+		}
+		period = strings.TrimSpace(period)
+		if period == "else" {
+			schedule.rate = rate
+			continue
+		}
+		startStr, endStr, ok := strings.Cut(period, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid window '%s', expect HH:MM-HH:MM", period)
+		}
+		w := window{rate: rate}
+		w.start, err = parseTimeOfDay(startStr)
+		if err != nil {
+			return nil, err
+		}
+		w.end, err = parseTimeOfDay(endStr)
+		if err != nil {
+			return nil, err
+		}
+		w.start %= minutesPerDay
+		w.end %= minutesPerDay
+		schedule.windows = append(schedule.windows, w)
+	}
+	return schedule, nil
+}
+
+// IsUnlimited returns true if no limit is applied at any time
+func (s *Schedule) IsUnlimited() bool {
+	if s.rate != Unlimited {
+		return false
+	}
+	for _, w := range s.windows {
+		if w.rate != Unlimited {
+			return false
+		}
+	}
+	return true
+}
+
+// RateAt returns rate at local time of t
+func (s *Schedule) RateAt(t time.Time) Rate {
+	minute := t.Hour()*60 + t.Minute()
+	for _, w := range s.windows {
+		if w.contains(minute) {
+			return w.rate
+		}
+	}
+	return s.rate
+}
+
+// NextChange returns the first window edge after t, or zero time if there is no window
+func (s *Schedule) NextChange(t time.Time) time.Time {
+	var next time.Time
+	for _, w := range s.windows {
+		for _, edge := range []int{w.start, w.end} {
+			e := time.Date(t.Year(), t.Month(), t.Day(), edge/60, edge%60, 0, 0, t.Location())
+			if !e.After(t) {
+				e = e.AddDate(0, 0, 1)
+			}
+			if next.IsZero() || e.Before(next) {
+				next = e
+			}
+		}
+	}
+	return next
+}
+
+func (s *Schedule) String() string {
+	if len(s.windows) == 0 {
+		return s.rate.String()
+	}
+	items := make([]string, 0, len(s.windows)+1)
+	for _, w := range s.windows {
+		items = append(items, fmt.Sprintf("%02d:%02d-%02d:%02d=%s", w.start/60, w.start%60, w.end/60, w.end%60,
+			w.rate))
+	}
+	items = append(items, "else="+s.rate.String())
+	return strings.Join(items, ",")
+}
@@ -0,0 +1,247 @@
+package compress
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// Codec is the compression algorithm applied before encryption
+type Codec byte
+
+const (
+	CodecNone Codec = iota
+	CodecGzip
+	CodecXz
+	CodecLz4
+)
+
+// header is written in front of the compressed stream so that decompression can check it is the codec
+// recorded along with the data. It is 4 bytes magic plus 1 byte codec
+const magic = "LOMZ"
+
+// HeaderLen is the length of the compression header
+const HeaderLen = len(magic) + 1
+
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecGzip:
+		return "gzip"
+	case CodecXz:
+		return "xz"
+	case CodecLz4:
+		return "lz4"
+	}
+	return "unknown"
+}
+
+// Ext returns the file extension for the codec, and empty for none
+func (c Codec) Ext() string {
+	switch c {
+	case CodecGzip:
+		return ".gz"
+	case CodecXz:
+		return ".xz"
+	case CodecLz4:
+		return ".lz4"
+	}
+	return ""
+}
+
+func ParseCodec(s string) (Codec, error) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return CodecNone, nil
+	case "gzip", "gz":
+		return CodecGzip, nil
+	case "xz":
+		return CodecXz, nil
+	case "lz4":
+		return CodecLz4, nil
+	}
+	return CodecNone, fmt.Errorf("invalid compression codec: %s", s)
+}
+
+// compressedExts are formats which are compressed already, and compress them again gain nearly nothing
+var compressedExts = map[string]struct{}{
+	"jpg": {}, "jpeg": {}, "heic": {}, "heif": {}, "png": {}, "gif": {}, "webp": {},
+	"mp4": {}, "mov": {}, "m4v": {}, "avi": {}, "mkv": {}, "3gp": {}, "webm": {},
+	"mp3": {}, "m4a": {}, "aac": {}, "ogg": {}, "opus": {},
+	"zip": {}, "gz": {}, "tgz": {}, "xz": {}, "lz4": {}, "bz2": {}, "7z": {}, "rar": {}, "zst": {},
+	"docx": {}, "xlsx": {}, "pptx": {}, "odt": {}, "epub": {},
+}
+
+// IsCompressedExt checks if given file extension, with or without leading dot, is a compressed media
+// or archive format
+func IsCompressedExt(ext string) bool {
+	_, ok := compressedExts[strings.TrimPrefix(strings.ToLower(ext), ".")]
+	return ok
+}
+
+// IsCompressedFile checks if given file is a compressed media or archive format by its extension
+func IsCompressedFile(filename string) bool {
+	return IsCompressedExt(filepath.Ext(filename))
+}
+
+// CompressibleRatio returns the ratio of bytes not in compressed formats, given total size per extension
+func CompressibleRatio(extSizes map[string]int) float64 {
+	var total, compressible int
+	for ext, size := range extSizes {
+		total += size
+		if !IsCompressedExt(ext) {
+			compressible += size
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(compressible) / float64(total)
+}
+
+func genHeader(c Codec) []byte {
+	return append([]byte(magic), byte(c))
+}
+
+// NewWriter writes header and returns one writer compressing into w. Caller must close returned writer
+// to flush all data. No header is written for CodecNone so that output keeps compatible with the old format
+func NewWriter(w io.Writer, c Codec) (io.WriteCloser, error) {
+	if c == CodecNone {
+		return nopWriteCloser{w}, nil
+	}
+	_, err := w.Write(genHeader(c))
+	if err != nil {
+		return nil, err
+	}
+	switch c {
+	case CodecGzip:
+		return gzip.NewWriter(w), nil
+	case CodecXz:
+		return xz.NewWriter(w)
+	case CodecLz4:
+		return lz4.NewWriter(w), nil
+	}
+	return nil, fmt.Errorf("invalid compression codec: %d", c)
+}
+
+func newDecompressReader(r io.Reader, c Codec) (io.Reader, error) {
+	switch c {
+	case CodecNone:
+		return r, nil
+	case CodecGzip:
+		return gzip.NewReader(r)
+	case CodecXz:
+		return xz.NewReader(r)
+	case CodecLz4:
+		return lz4.NewReader(r), nil
+	}
+	return nil, fmt.Errorf("invalid compression codec: %d", c)
+}
+
+// ParseHeader detects codec from the first bytes of one stream, and returns false if there is no header
+func ParseHeader(h []byte) (Codec, bool) {
+	if len(h) < HeaderLen || string(h[:len(magic)]) != magic {
+		return CodecNone, false
+	}
+	c := Codec(h[len(magic)])
+	if c == CodecNone || c > CodecLz4 {
+		return CodecNone, false
+	}
+	return c, true
+}
+
+// NewReader returns one reader decompressing data compressed with given codec, which is recorded along with
+// the data, e.g. in object metadata. The header must match the codec. Data of CodecNone is returned as it is,
+// even if it starts with bytes same as one header
+func NewReader(r io.Reader, c Codec) (io.Reader, error) {
+	if c == CodecNone {
+		return r, nil
+	}
+	h := make([]byte, HeaderLen)
+	_, err := io.ReadFull(r, h)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	if hc, ok := ParseHeader(h); !ok || hc != c {
+		return nil, fmt.Errorf("data is not compressed with %s", c)
+	}
+	return newDecompressReader(r, c)
+}
+
+// Compress compresses all data from src into dst with header, and return bytes read and written
+func Compress(dst io.Writer, src io.Reader, c Codec) (int64, int64, error) {
+	cw := &countWriter{w: dst}
+	w, err := NewWriter(cw, c)
+	if err != nil {
+		return 0, 0, err
+	}
+	n, err := io.Copy(w, src)
+	if err != nil {
+		return n, cw.n, err
+	}
+	err = w.Close()
+	return n, cw.n, err
+}
+
+// decompressWriter decompresses data written into it with the codec given, Close must be called to flush
+// all data
+type decompressWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+// NewDecompressWriter returns one writer decompressing data compressed with given codec into w, see NewReader
+func NewDecompressWriter(w io.Writer, c Codec) io.WriteCloser {
+	if c == CodecNone {
+		return nopWriteCloser{w}
+	}
+	pr, pw := io.Pipe()
+	dw := &decompressWriter{pw: pw, done: make(chan error, 1)}
+	go func() {
+		dr, err := NewReader(pr, c)
+		if err == nil {
+			_, err = io.Copy(w, dr)
+		}
+		// unblock writer if decompress fails
+		pr.CloseWithError(err)
+		dw.done <- err
+	}()
+	return dw
+}
+
+func (dw *decompressWriter) Write(p []byte) (int, error) {
+	return dw.pw.Write(p)
+}
+
+func (dw *decompressWriter) Close() error {
+	err := dw.pw.Close()
+	if err != nil {
+		return err
+	}
+	return <-dw.done
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,111 @@
+package compress
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testFilename = "../testdata/indepedant_declaration.txt"
+
+func TestCompressDecompress(t *testing.T) {
+	plaintext, err := os.ReadFile(testFilename)
+	require.Nil(t, err)
+
+	for _, c := range []Codec{CodecNone, CodecGzip, CodecXz, CodecLz4} {
+		buf := &bytes.Buffer{}
+		n, written, err := Compress(buf, bytes.NewReader(plaintext), c)
+		require.Nil(t, err, c.String())
+		require.EqualValues(t, len(plaintext), n, c.String())
+		require.EqualValues(t, buf.Len(), written, c.String())
+		if c == CodecNone {
+			require.Equal(t, plaintext, buf.Bytes())
+		} else {
+			require.Less(t, buf.Len(), len(plaintext), c.String())
+		}
+
+		// reader side
+		r, err := NewReader(bytes.NewReader(buf.Bytes()), c)
+		require.Nil(t, err, c.String())
+		output, err := io.ReadAll(r)
+		require.Nil(t, err, c.String())
+		require.Equal(t, plaintext, output, c.String())
+
+		// writer side, write in small chunks so that header is split across writes
+		output2 := &bytes.Buffer{}
+		dw := NewDecompressWriter(output2, c)
+		data := buf.Bytes()
+		for len(data) > 0 {
+			l := 3
+			if l > len(data) {
+				l = len(data)
+			}
+			n, err := dw.Write(data[:l])
+			require.Nil(t, err, c.String())
+			require.Equal(t, l, n, c.String())
+			data = data[l:]
+		}
+		require.Nil(t, dw.Close(), c.String())
+		require.Equal(t, plaintext, output2.Bytes(), c.String())
+	}
+}
+
+func TestUncompressedWithHeader(t *testing.T) {
+	// uncompressed data is kept as it is, even if it looks like one compressed stream
+	for _, text := range []string{"", "a", "LOMZ", "LOMZ\x01abc", "LOMZ\x02abc"} {
+		r, err := NewReader(bytes.NewReader([]byte(text)), CodecNone)
+		require.Nil(t, err)
+		output, err := io.ReadAll(r)
+		require.Nil(t, err)
+		require.Equal(t, text, string(output))
+
+		buf := &bytes.Buffer{}
+		dw := NewDecompressWriter(buf, CodecNone)
+		_, err = dw.Write([]byte(text))
+		require.Nil(t, err)
+		require.Nil(t, dw.Close())
+		require.Equal(t, text, buf.String())
+	}
+}
+
+func TestDecompressCodecMismatch(t *testing.T) {
+	buf := &bytes.Buffer{}
+	_, _, err := Compress(buf, bytes.NewReader([]byte("hello")), CodecGzip)
+	require.Nil(t, err)
+
+	for _, data := range [][]byte{buf.Bytes(), []byte("hello"), nil} {
+		_, err = NewReader(bytes.NewReader(data), CodecXz)
+		require.NotNil(t, err)
+
+		dw := NewDecompressWriter(io.Discard, CodecXz)
+		_, err = dw.Write(data)
+		if err == nil {
+			err = dw.Close()
+		}
+		require.NotNil(t, err)
+	}
+}
+
+func TestParseCodec(t *testing.T) {
+	for s, expect := range map[string]Codec{"": CodecNone, "none": CodecNone, "gzip": CodecGzip,
+		"XZ": CodecXz, "lz4": CodecLz4} {
+		c, err := ParseCodec(s)
+		require.Nil(t, err)
+		require.Equal(t, expect, c)
+	}
+	_, err := ParseCodec("zstd")
+	require.NotNil(t, err)
+}
+
+func TestIsCompressedFile(t *testing.T) {
+	require.True(t, IsCompressedFile("a/b/IMG_0001.JPG"))
+	require.True(t, IsCompressedFile("video.mp4"))
+	require.False(t, IsCompressedFile("IMG_0001.DNG"))
+	require.False(t, IsCompressedFile("notes.txt"))
+
+	require.Equal(t, 0.0, CompressibleRatio(nil))
+	require.Equal(t, 0.25, CompressibleRatio(map[string]int{"jpg": 300, ".txt": 100}))
+}
@@ -0,0 +1,258 @@
+package cost
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"slices"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// gb is the unit of AWS price, which is 2^30 bytes
+const gb = 1 << 30
+
+// MaxParts is the max number of parts in one multipart upload
+const MaxParts = 10000
+
+// Price is the price of one storage class in USD
+type Price struct {
+	StorageGBMonth float64 `json:"storage_gb_month"`
+	// PUT, COPY, POST and LIST requests
+	PutPer1000 float64 `json:"put_per_1000"`
+	// GET, HEAD and all other requests
+	GetPer1000 float64 `json:"get_per_1000"`
+	// data retrieval, or restore of archive classes
+	RetrievalGB    float64 `json:"retrieval_gb"`
+	RestorePer1000 float64 `json:"restore_per_1000"`
+	// objects deleted or transitioned before it are charged for the remaining days
+	MinDays int `json:"min_days"`
+	// billed storage for each object besides its data, e.g. index kept for archive classes
+	OverheadKB int `json:"overhead_kb"`
+	// objects need to be restored before GET, and restore retrieves the whole object
+	Archive bool `json:"archive"`
+}
+
+// Pricing is prices of all storage classes in one region
+type Pricing struct {
+	TransferOutGB float64           `json:"transfer_out_gb"`
+	Classes       map[string]*Price `json:"classes"`
+}
+
+// Default returns the built in prices of AWS S3 us-east-1 as of 2024/4, with standard restore tier
+func Default() *Pricing {
+	return &Pricing{
+		TransferOutGB: 0.09,
+		Classes: map[string]*Price{
+			"STANDARD":           {StorageGBMonth: 0.023, PutPer1000: 0.005, GetPer1000: 0.0004},
+			"REDUCED_REDUNDANCY": {StorageGBMonth: 0.024, PutPer1000: 0.005, GetPer1000: 0.0004},
+			"INTELLIGENT_TIERING": {StorageGBMonth: 0.0125, PutPer1000: 0.005, GetPer1000: 0.0004,
+				MinDays: 30},
+			"STANDARD_IA": {StorageGBMonth: 0.0125, PutPer1000: 0.01, GetPer1000: 0.001, RetrievalGB: 0.01,
+				MinDays: 30},
+			"ONEZONE_IA": {StorageGBMonth: 0.01, PutPer1000: 0.01, GetPer1000: 0.001, RetrievalGB: 0.01,
+				MinDays: 30},
+			"GLACIER_IR": {StorageGBMonth: 0.004, PutPer1000: 0.02, GetPer1000: 0.01, RetrievalGB: 0.03,
+				MinDays: 90},
+			"GLACIER": {StorageGBMonth: 0.0036, PutPer1000: 0.03, GetPer1000: 0.0004, RetrievalGB: 0.01,
+				RestorePer1000: 0.05, MinDays: 90, OverheadKB: 40, Archive: true},
+			"DEEP_ARCHIVE": {StorageGBMonth: 0.00099, PutPer1000: 0.05, GetPer1000: 0.0004, RetrievalGB: 0.02,
+				RestorePer1000: 0.1, MinDays: 180, OverheadKB: 40, Archive: true},
+		},
+	}
+}
+
+// Load returns the built in prices overridden by the ones in filename. Fields not in file keep built in
+// values, and new storage classes can be added
+func Load(filename string) (*Pricing, error) {
+	p := Default()
+	if filename == "" {
+		return p, nil
+	}
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	override := struct {
+		TransferOutGB *float64                   `json:"transfer_out_gb"`
+		Classes       map[string]json.RawMessage `json:"classes"`
+	}{}
+	err = json.Unmarshal(content, &override)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse %s", filename)
+	}
+	if override.TransferOutGB != nil {
+		p.TransferOutGB = *override.TransferOutGB
+	}
+	for class, raw := range override.Classes {
+		price, ok := p.Classes[class]
+		if !ok {
+			price = &Price{}
+			p.Classes[class] = price
+		}
+		err = json.Unmarshal(raw, price)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse price of %s in %s", class, filename)
+		}
+	}
+	return p, nil
+}
+
+// ClassNames returns storage classes in the order of storage price, the most expensive first
+func (p *Pricing) ClassNames() []string {
+	names := make([]string, 0, len(p.Classes))
+	for name := range p.Classes {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		pi, pj := p.Classes[names[i]], p.Classes[names[j]]
+		if pi.StorageGBMonth != pj.StorageGBMonth {
+			return pi.StorageGBMonth > pj.StorageGBMonth
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// Archive is the objects uploaded into one storage class
+type Archive struct {
+	Objects int
+	Bytes   int64
+	// parts of multipart uploads. Each object is uploaded by one PUT if it is 0
+	Parts int
+	// average size of files packed in objects, which is restored alone
+	AvgFileSize int64
+}
+
+// Plan is how archive is used over the horizon
+type Plan struct {
+	Months int
+	// HEAD of each object per month to verify its checksum
+	VerifiesPerMonth int
+	// restore all objects
+	FullRestores int
+	// restore one file, which retrieves the whole object containing it in archive classes
+	FileRestores int
+	// size of each ranged GET while downloading
+	ChunkSize int64
+}
+
+// Estimate is cost of one archive in one storage class in USD
+type Estimate struct {
+	Class        string
+	StorageMonth float64
+	Upload       float64
+	VerifyMonth  float64
+	// restore all objects once
+	FullRestore float64
+	// restore one file once
+	FileRestore float64
+	// total over the horizon of plan, including min storage duration charge and restores planned
+	Total float64
+}
+
+func chunks(size, chunkSize int64) float64 {
+	if chunkSize <= 0 {
+		return 1
+	}
+	return math.Ceil(float64(size) / float64(chunkSize))
+}
+
+// Estimate calculates cost of archive in storage class with plan
+func (p *Pricing) Estimate(class string, a Archive, plan Plan) (*Estimate, error) {
+	price, ok := p.Classes[class]
+	if !ok {
+		return nil, errors.Errorf("no price of storage class %s", class)
+	}
+	e := &Estimate{Class: class}
+	if a.Objects == 0 {
+		return e, nil
+	}
+
+	billedBytes := float64(a.Bytes) + float64(a.Objects)*float64(price.OverheadKB)*1024
+	e.StorageMonth = billedBytes / gb * price.StorageGBMonth
+
+	// multipart upload needs one request to create and one to complete besides parts
+	puts := float64(a.Objects)
+	if a.Parts > 0 {
+		puts = float64(a.Parts + 2*a.Objects)
+	}
+	e.Upload = puts / 1000 * price.PutPer1000
+
+	e.VerifyMonth = float64(a.Objects*plan.VerifiesPerMonth) / 1000 * price.GetPer1000
+
+	objectSize := a.Bytes / int64(a.Objects)
+	gets := float64(a.Objects) * chunks(objectSize, plan.ChunkSize)
+	e.FullRestore = gets/1000*price.GetPer1000 + float64(a.Bytes)/gb*(price.RetrievalGB+p.TransferOutGB)
+	if price.Archive {
+		e.FullRestore += float64(a.Objects) / 1000 * price.RestorePer1000
+	}
+
+	// ranged GET retrieves the file only, unless the whole object needs to be restored
+	retrieved := a.AvgFileSize
+	e.FileRestore = chunks(a.AvgFileSize, plan.ChunkSize) / 1000 * price.GetPer1000
+	if price.Archive {
+		retrieved = objectSize
+		e.FileRestore += 1.0 / 1000 * price.RestorePer1000
+	}
+	e.FileRestore += float64(retrieved)/gb*price.RetrievalGB + float64(a.AvgFileSize)/gb*p.TransferOutGB
+
+	storageMonths := math.Max(float64(plan.Months), float64(price.MinDays)/30)
+	e.Total = e.Upload + e.StorageMonth*storageMonths + e.VerifyMonth*float64(plan.Months) +
+		e.FullRestore*float64(plan.FullRestores) + e.FileRestore*float64(plan.FileRestores)
+	return e, nil
+}
+
+// Layout is how data is split into ISOs and upload parts
+type Layout struct {
+	ISOSize  int64
+	PartSize int64
+}
+
+// Split returns archive of data split by layout
+func (l Layout) Split(dataSize, avgFileSize int64) Archive {
+	a := Archive{AvgFileSize: avgFileSize, Bytes: dataSize}
+	full := int(dataSize / l.ISOSize)
+	a.Objects = full
+	a.Parts = full * int(chunks(l.ISOSize, l.PartSize))
+	if rest := dataSize % l.ISOSize; rest > 0 {
+		a.Objects++
+		a.Parts += int(chunks(rest, l.PartSize))
+	}
+	return a
+}
+
+// Optimize returns the layout with the lowest total cost of data in storage class over the horizon of plan.
+// Part sizes which need more than MaxParts parts are skipped, and smaller sizes are preferred if costs are
+// the same
+func (p *Pricing) Optimize(class string, dataSize, avgFileSize int64, plan Plan, isoSizes,
+	partSizes []int64) (Layout, *Estimate, error) {
+	var (
+		best     Layout
+		bestCost *Estimate
+	)
+	isoSizes = slices.Clone(isoSizes)
+	slices.Sort(isoSizes)
+	partSizes = slices.Clone(partSizes)
+	slices.Sort(partSizes)
+	for _, isoSize := range isoSizes {
+		for _, partSize := range partSizes {
+			if partSize > isoSize || chunks(isoSize, partSize) > MaxParts {
+				continue
+			}
+			l := Layout{ISOSize: isoSize, PartSize: partSize}
+			e, err := p.Estimate(class, l.Split(dataSize, avgFileSize), plan)
+			if err != nil {
+				return best, nil, err
+			}
+			if bestCost == nil || e.Total < bestCost.Total {
+				best, bestCost = l, e
+			}
+		}
+	}
+	if bestCost == nil {
+		return best, nil, errors.New("no valid iso size and part size")
+	}
+	return best, bestCost, nil
+}
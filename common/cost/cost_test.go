@@ -0,0 +1,102 @@
+package cost
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	p, err := Load("")
+	require.Nil(t, err)
+	require.Equal(t, Default(), p)
+
+	filename := filepath.Join(t.TempDir(), "pricing.json")
+	err = os.WriteFile(filename, []byte(`{"transfer_out_gb": 0,
+		"classes": {"DEEP_ARCHIVE": {"storage_gb_month": 0.002}, "COLD": {"storage_gb_month": 0.001, "archive": true}}}`),
+		0600)
+	require.Nil(t, err)
+	p, err = Load(filename)
+	require.Nil(t, err)
+	require.Equal(t, float64(0), p.TransferOutGB)
+	require.Equal(t, 0.002, p.Classes["DEEP_ARCHIVE"].StorageGBMonth)
+	// fields not overridden keep built in values
+	require.Equal(t, 0.05, p.Classes["DEEP_ARCHIVE"].PutPer1000)
+	require.Equal(t, 180, p.Classes["DEEP_ARCHIVE"].MinDays)
+	require.True(t, p.Classes["COLD"].Archive)
+	require.Equal(t, "STANDARD", p.ClassNames()[1])
+	require.Equal(t, "COLD", p.ClassNames()[len(p.Classes)-1])
+
+	err = os.WriteFile(filename, []byte(`{"classes": {"STANDARD": 1}}`), 0600)
+	require.Nil(t, err)
+	_, err = Load(filename)
+	require.NotNil(t, err)
+}
+
+func TestEstimate(t *testing.T) {
+	p := &Pricing{
+		TransferOutGB: 0.1,
+		Classes: map[string]*Price{
+			"HOT":  {StorageGBMonth: 0.02, PutPer1000: 1, GetPer1000: 0.5, RetrievalGB: 0.01},
+			"COLD": {StorageGBMonth: 0.001, PutPer1000: 2, GetPer1000: 0.5, RetrievalGB: 0.02, RestorePer1000: 10, MinDays: 180, Archive: true},
+		},
+	}
+	a := Archive{Objects: 10, Bytes: 100 * gb, Parts: 100, AvgFileSize: gb / 2}
+	plan := Plan{Months: 3, VerifiesPerMonth: 2, FullRestores: 1, FileRestores: 2, ChunkSize: gb}
+
+	e, err := p.Estimate("HOT", a, plan)
+	require.Nil(t, err)
+	require.InDelta(t, 2, e.StorageMonth, 1e-9)
+	require.InDelta(t, 0.12, e.Upload, 1e-9)
+	require.InDelta(t, 0.01, e.VerifyMonth, 1e-9)
+	require.InDelta(t, 0.05+100*0.11, e.FullRestore, 1e-9)
+	require.InDelta(t, 0.0005+0.5*0.11, e.FileRestore, 1e-9)
+	require.InDelta(t, 0.12+2*3+0.01*3+e.FullRestore+2*e.FileRestore, e.Total, 1e-9)
+
+	// whole object is restored for one file, and storage is charged for min days
+	e, err = p.Estimate("COLD", a, plan)
+	require.Nil(t, err)
+	require.InDelta(t, 0.05+100*0.12+0.1, e.FullRestore, 1e-9)
+	require.InDelta(t, 0.0005+0.01+10*0.02+0.5*0.1, e.FileRestore, 1e-9)
+	require.InDelta(t, 0.24+0.1*6+0.01*3+e.FullRestore+2*e.FileRestore, e.Total, 1e-9)
+
+	_, err = p.Estimate("WARM", a, plan)
+	require.NotNil(t, err)
+}
+
+func TestSplit(t *testing.T) {
+	a := Layout{ISOSize: 100, PartSize: 30}.Split(250, 5)
+	require.Equal(t, Archive{Objects: 3, Bytes: 250, Parts: 4 + 4 + 2, AvgFileSize: 5}, a)
+	a = Layout{ISOSize: 100, PartSize: 50}.Split(200, 5)
+	require.Equal(t, Archive{Objects: 2, Bytes: 200, Parts: 4, AvgFileSize: 5}, a)
+}
+
+func TestOptimize(t *testing.T) {
+	p := Default()
+	plan := Plan{Months: 12, VerifiesPerMonth: 1, ChunkSize: 100 << 20}
+	isoSizes := []int64{50 * gb, 1 * gb, 10 * gb}
+	partSizes := []int64{1 << 30, 8 << 20, 100 << 20}
+
+	// requests are the only difference without restore, so the largest iso and part win
+	l, e, err := p.Optimize("DEEP_ARCHIVE", 500*gb, 2<<20, plan, isoSizes, partSizes)
+	require.Nil(t, err)
+	require.Equal(t, Layout{ISOSize: 50 * gb, PartSize: 1 << 30}, l)
+	require.Equal(t, "DEEP_ARCHIVE", e.Class)
+
+	// the whole iso is restored for one file, so smaller iso is cheaper
+	plan.FileRestores = 10
+	l, _, err = p.Optimize("DEEP_ARCHIVE", 500*gb, 2<<20, plan, isoSizes, partSizes)
+	require.Nil(t, err)
+	require.Equal(t, Layout{ISOSize: 1 * gb, PartSize: 1 << 30}, l)
+
+	// ranged GET of one file costs the same for all isos, and the smallest layout is preferred for the same cost
+	l, _, err = p.Optimize("STANDARD", 100<<20, 2<<20, plan, isoSizes, partSizes)
+	require.Nil(t, err)
+	require.Equal(t, Layout{ISOSize: 1 * gb, PartSize: 100 << 20}, l)
+
+	// parts are limited
+	_, _, err = p.Optimize("STANDARD", 500*gb, 2<<20, plan, []int64{100 * gb}, []int64{8 << 20})
+	require.NotNil(t, err)
+}
@@ -27,6 +27,96 @@ func newCipherStream(key, iv []byte) (cipher.Stream, error) {
 	return cipher.NewCTR(block, iv), nil
 }
 
+// NewCipherStreamAt returns cipher stream starting at given offset of the plaintext, so that data
+// encrypted with key and iv is able to be decrypted from any position
+func NewCipherStreamAt(key, iv []byte, offset int64) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return newCipherStreamAt(block, iv, offset), nil
+}
+
+func newCipherStreamAt(block cipher.Block, iv []byte, offset int64) cipher.Stream {
+	// CTR counter is the iv as one 128 bits big endian integer, increased by one for each block
+	counter := make([]byte, aes.BlockSize)
+	copy(counter, iv)
+	carry := uint64(offset / aes.BlockSize)
+	for i := aes.BlockSize - 1; i >= 0 && carry != 0; i-- {
+		sum := uint64(counter[i]) + carry&0xff
+		counter[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+
+	stream := cipher.NewCTR(block, counter)
+	if skip := offset % aes.BlockSize; skip != 0 {
+		buf := make([]byte, skip)
+		stream.XORKeyStream(buf, buf)
+	}
+	return stream
+}
+
+// DecryptReaderAt decrypts data at any offset of one encrypted file. Offset is the one of plaintext,
+// and base is the position of the first encrypted byte in underlying reader, e.g. salt length if
+// salt is prepended
+type DecryptReaderAt struct {
+	r     io.ReaderAt
+	block cipher.Block
+	iv    []byte
+	base  int64
+}
+
+func NewDecryptReaderAt(r io.ReaderAt, key, iv []byte, base int64) (*DecryptReaderAt, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &DecryptReaderAt{r: r, block: block, iv: iv, base: base}, nil
+}
+
+func (d *DecryptReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := d.r.ReadAt(p, d.base+off)
+	if n > 0 {
+		newCipherStreamAt(d.block, d.iv, off).XORKeyStream(p[:n], p[:n])
+	}
+	return n, err
+}
+
+// EncryptReaderAt reads the encrypted object of plaintext r at any offset, i.e. salt followed by encrypted
+// data if it has header, so that any part of the object can be encrypted again on demand instead of
+// being saved. CTR encryption is the same XOR operation as decryption
+type EncryptReaderAt struct {
+	d      *DecryptReaderAt
+	header []byte
+}
+
+func NewEncryptReaderAt(r io.ReaderAt, key, iv []byte, hasHeader bool) (*EncryptReaderAt, error) {
+	d, err := NewDecryptReaderAt(r, key, iv, 0)
+	if err != nil {
+		return nil, err
+	}
+	e := &EncryptReaderAt{d: d}
+	if hasHeader {
+		e.header = iv
+	}
+	return e, nil
+}
+
+func (e *EncryptReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	var n int
+	if off < int64(len(e.header)) {
+		n = copy(p, e.header[off:])
+		if n == len(p) {
+			return n, nil
+		}
+	}
+	m, err := e.d.ReadAt(p[n:], off+int64(n)-int64(len(e.header)))
+	return n + m, err
+}
+
 // Encrytor wrap io.CryptStreamReader and create ciper.Stream automatically
 func NewEncryptor(r io.ReadSeeker, key, iv []byte, hasHeader bool) (*Encryptor, error) {
 	stream, err := newCipherStream(key, iv)
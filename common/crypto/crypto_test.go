@@ -7,6 +7,8 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"io"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -88,3 +90,194 @@ func testEncryptDecrypt(t *testing.T, plaintext []byte, hasHeader bool) {
 	require.EqualValues(t, len(plaintext), n)
 	require.EqualValues(t, plaintext, decyptBuf.Bytes())
 }
+
+func TestDecryptReaderAt(t *testing.T) {
+	plaintext := make([]byte, 1000)
+	_, err := rand.Read(plaintext)
+	require.Nil(t, err)
+	key := make([]byte, 32)
+	_, err = rand.Read(key)
+	require.Nil(t, err)
+
+	// counter overflow in the lowest bytes should carry into higher bytes
+	iv := make([]byte, aes.BlockSize)
+	for i := aes.BlockSize - 4; i < aes.BlockSize; i++ {
+		iv[i] = 0xff
+	}
+	iv[aes.BlockSize-1] = 0xfa
+
+	en, err := NewEncryptor(bytes.NewReader(plaintext), key, iv, true)
+	require.Nil(t, err)
+	encrypted, err := io.ReadAll(en)
+	require.Nil(t, err)
+
+	de, err := NewDecryptReaderAt(bytes.NewReader(encrypted), key, iv, int64(len(iv)))
+	require.Nil(t, err)
+	for _, off := range []int{0, 1, 15, 16, 17, 95, 96, 500, 999} {
+		for _, l := range []int{1, 16, 33, 200} {
+			buf := make([]byte, l)
+			n, err := de.ReadAt(buf, int64(off))
+			if off+l > len(plaintext) {
+				require.Equal(t, io.EOF, err)
+				require.Equal(t, len(plaintext)-off, n)
+			} else {
+				require.Nil(t, err)
+				require.Equal(t, l, n)
+			}
+			require.Equal(t, plaintext[off:off+n], buf[:n], "offset %d length %d", off, l)
+		}
+	}
+}
+
+func TestEncryptReaderAt(t *testing.T) {
+	plaintext := make([]byte, 1000)
+	_, err := rand.Read(plaintext)
+	require.Nil(t, err)
+	key := make([]byte, 32)
+	_, err = rand.Read(key)
+	require.Nil(t, err)
+	iv := make([]byte, aes.BlockSize)
+	_, err = rand.Read(iv)
+	require.Nil(t, err)
+
+	for _, hasHeader := range []bool{true, false} {
+		en, err := NewEncryptor(bytes.NewReader(plaintext), key, iv, hasHeader)
+		require.Nil(t, err)
+		encrypted, err := io.ReadAll(en)
+		require.Nil(t, err)
+
+		ea, err := NewEncryptReaderAt(bytes.NewReader(plaintext), key, iv, hasHeader)
+		require.Nil(t, err)
+		for _, off := range []int{0, 1, 15, 16, 17, 95, 96, 500, 999, 1015} {
+			for _, l := range []int{1, 16, 33, 200} {
+				if off >= len(encrypted) {
+					continue
+				}
+				buf := make([]byte, l)
+				n, err := ea.ReadAt(buf, int64(off))
+				if off+l > len(encrypted) {
+					require.Equal(t, io.EOF, err)
+					require.Equal(t, len(encrypted)-off, n)
+				} else {
+					require.Nil(t, err)
+					require.Equal(t, l, n)
+				}
+				require.Equal(t, encrypted[off:off+n], buf[:n], "header %v offset %d length %d", hasHeader, off, l)
+			}
+		}
+
+		// the whole object is able to be read again after seek, which upload retry relies on
+		sr := io.NewSectionReader(ea, 0, int64(len(encrypted)))
+		for i := 0; i < 2; i++ {
+			got, err := io.ReadAll(sr)
+			require.Nil(t, err)
+			require.Equal(t, encrypted, got)
+			_, err = sr.Seek(0, io.SeekStart)
+			require.Nil(t, err)
+		}
+	}
+}
+
+// ioCounter counts bytes read from and written into disk
+type ioCounter struct {
+	f       *os.File
+	read    *int64
+	written *int64
+}
+
+func (c ioCounter) Read(p []byte) (int, error) {
+	n, err := c.f.Read(p)
+	*c.read += int64(n)
+	return n, err
+}
+
+func (c ioCounter) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.f.ReadAt(p, off)
+	*c.read += int64(n)
+	return n, err
+}
+
+func (c ioCounter) Seek(offset int64, whence int) (int64, error) {
+	return c.f.Seek(offset, whence)
+}
+
+func (c ioCounter) Write(p []byte) (int, error) {
+	n, err := c.f.Write(p)
+	*c.written += int64(n)
+	return n, err
+}
+
+func createBenchFile(b *testing.B, size int) (*os.File, []byte, []byte) {
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	require.Nil(b, err)
+	filename := filepath.Join(b.TempDir(), "plain")
+	require.Nil(b, os.WriteFile(filename, data, 0644))
+	f, err := os.Open(filename)
+	require.Nil(b, err)
+	b.Cleanup(func() { f.Close() })
+
+	key := make([]byte, 32)
+	_, err = rand.Read(key)
+	require.Nil(b, err)
+	return f, key, data[:SaltLen()]
+}
+
+func reportIO(b *testing.B, read, written int64) {
+	b.ReportMetric(float64(read)/float64(b.N), "disk-read-B/op")
+	b.ReportMetric(float64(written)/float64(b.N), "disk-write-B/op")
+}
+
+const benchPartSize = 8 << 20
+
+// BenchmarkEncryptPartTempFile encrypts one part into temp file to get its hash, and reads it back for upload
+func BenchmarkEncryptPartTempFile(b *testing.B) {
+	f, key, iv := createBenchFile(b, benchPartSize)
+	var read, written int64
+	b.SetBytes(benchPartSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := f.Seek(0, io.SeekStart)
+		require.Nil(b, err)
+		en, err := NewEncryptor(ioCounter{f: f, read: &read}, key, iv, true)
+		require.Nil(b, err)
+
+		tmp, err := os.CreateTemp(b.TempDir(), "part")
+		require.Nil(b, err)
+		_, err = io.Copy(ioCounter{f: tmp, written: &written}, en)
+		require.Nil(b, err)
+		_ = en.GetHashEncrypt()
+
+		_, err = tmp.Seek(0, io.SeekStart)
+		require.Nil(b, err)
+		_, err = io.Copy(io.Discard, ioCounter{f: tmp, read: &read})
+		require.Nil(b, err)
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	reportIO(b, read, written)
+}
+
+// BenchmarkEncryptPartReaderAt hashes encrypted part in the first pass, and encrypts it again for upload
+func BenchmarkEncryptPartReaderAt(b *testing.B) {
+	f, key, iv := createBenchFile(b, benchPartSize)
+	var read, written int64
+	b.SetBytes(benchPartSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ea, err := NewEncryptReaderAt(ioCounter{f: f, read: &read}, key, iv, true)
+		require.Nil(b, err)
+		sr := io.NewSectionReader(ea, 0, benchPartSize+int64(SaltLen()))
+
+		h := sha256.New()
+		_, err = io.Copy(h, sr)
+		require.Nil(b, err)
+		_ = h.Sum(nil)
+
+		_, err = sr.Seek(0, io.SeekStart)
+		require.Nil(b, err)
+		_, err = io.Copy(io.Discard, sr)
+		require.Nil(b, err)
+	}
+	reportIO(b, read, written)
+}
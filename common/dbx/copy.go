@@ -0,0 +1,193 @@
+package dbx
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lomorage/lomo-backup/common/types"
+)
+
+const (
+	copyColumns = "c.id, c.iso_id, i.name, c.destination, c.region, c.bucket, c.storage_class, c.status," +
+		" c.hash_remote, c.upload_key, c.upload_id, c.retention_mode, c.retain_until, c.verify_time, c.create_time"
+	getArchiveCopyStmt = "select " + copyColumns + " from archive_copies as c inner join isos as i" +
+		" on c.iso_id=i.id where c.iso_id=? and c.region=? and c.bucket=?"
+	listArchiveCopiesStmt = "select " + copyColumns + " from archive_copies as c inner join isos as i" +
+		" on c.iso_id=i.id order by c.iso_id, c.id"
+	insertArchiveCopyStmt = "insert into archive_copies (iso_id, destination, region, bucket, storage_class," +
+		" status, create_time) values (?, ?, ?, ?, ?, ?, ?)"
+	upsertArchiveCopyStmt = "insert into archive_copies (iso_id, destination, region, bucket, storage_class," +
+		" status, hash_remote, retention_mode, retain_until, verify_time, create_time)" +
+		" values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) on conflict(iso_id, region, bucket) do update set" +
+		" storage_class=excluded.storage_class, status=excluded.status, hash_remote=excluded.hash_remote," +
+		" upload_key='', upload_id='', retention_mode=excluded.retention_mode," +
+		" retain_until=excluded.retain_until, verify_time=excluded.verify_time"
+	updateArchiveCopyUploadInfoStmt = "update archive_copies set destination=?, storage_class=?, status=?," +
+		" upload_key=?, upload_id=?, retention_mode=?, retain_until=? where id=?"
+	updateArchiveCopyStatusStmt = "update archive_copies set destination=?, status=?, hash_remote=?," +
+		" verify_time=? where id=?"
+	updateArchiveCopyStorageClassStmt = "update archive_copies set storage_class=? where id=?"
+
+	getCopyPartsStmt   = "select part_no, etag, hash_remote, status from copy_parts where copy_id=?"
+	upsertCopyPartStmt = "insert into copy_parts (copy_id, part_no, etag, hash_remote, status) values (?, ?, ?, ?, ?)" +
+		" on conflict(copy_id, part_no) do update set etag=excluded.etag, hash_remote=excluded.hash_remote," +
+		" status=excluded.status"
+	deleteCopyPartsStmt = "delete from copy_parts where copy_id=?"
+)
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t.UTC(), Valid: !t.IsZero()}
+}
+
+func scanArchiveCopy(row interface{ Scan(...any) error }) (*types.ArchiveCopy, error) {
+	c := &types.ArchiveCopy{}
+	var retainUntil, verifyTime sql.NullTime
+	err := row.Scan(&c.ID, &c.IsoID, &c.IsoName, &c.Destination, &c.Region, &c.Bucket, &c.StorageClass,
+		&c.Status, &c.HashRemote, &c.UploadKey, &c.UploadID, &c.RetentionMode, &retainUntil, &verifyTime,
+		&c.CreateTime)
+	c.RetainUntil = retainUntil.Time
+	c.VerifyTime = verifyTime.Time
+	return c, err
+}
+
+// GetArchiveCopy returns nil if iso has no copy in given bucket
+func (db *DB) GetArchiveCopy(isoID int, region, bucket string) (*types.ArchiveCopy, error) {
+	var c *types.ArchiveCopy
+	err := db.retryIfLocked(fmt.Sprintf("get copy of iso %d in %s %s", isoID, region, bucket),
+		func(tx *sql.Tx) (err error) {
+			c, err = scanArchiveCopy(tx.QueryRow(getArchiveCopyStmt, isoID, region, bucket))
+			return err
+		},
+	)
+	if err != nil {
+		if IsErrNoRow(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+func (db *DB) ListArchiveCopies() ([]*types.ArchiveCopy, error) {
+	copies := []*types.ArchiveCopy{}
+	err := db.retryIfLocked("list archive copies",
+		func(tx *sql.Tx) error {
+			rows, err := tx.Query(listArchiveCopiesStmt)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				c, err := scanArchiveCopy(rows)
+				if err != nil {
+					return err
+				}
+				copies = append(copies, c)
+			}
+			return rows.Err()
+		},
+	)
+	return copies, err
+}
+
+// InsertArchiveCopy records copy which is going to be uploaded
+func (db *DB) InsertArchiveCopy(c *types.ArchiveCopy) (int, error) {
+	var id int64
+	err := db.retryIfLocked(fmt.Sprintf("insert copy of iso %d in %s %s", c.IsoID, c.Region, c.Bucket),
+		func(tx *sql.Tx) error {
+			res, err := tx.Exec(insertArchiveCopyStmt, c.IsoID, c.Destination, c.Region, c.Bucket, c.StorageClass,
+				types.CopyUploading, time.Now().UTC())
+			if err != nil {
+				return err
+			}
+			id, err = res.LastInsertId()
+			return err
+		},
+	)
+	return int(id), err
+}
+
+// UpsertArchiveCopy records copy uploaded, which replaces previous one in the same bucket
+func (db *DB) UpsertArchiveCopy(c *types.ArchiveCopy) error {
+	return db.retryIfLocked(fmt.Sprintf("upsert copy of iso %d in %s %s", c.IsoID, c.Region, c.Bucket),
+		func(tx *sql.Tx) error {
+			_, err := tx.Exec(upsertArchiveCopyStmt, c.IsoID, c.Destination, c.Region, c.Bucket, c.StorageClass,
+				c.Status, c.HashRemote, c.RetentionMode, nullTime(c.RetainUntil), nullTime(c.VerifyTime),
+				time.Now().UTC())
+			return err
+		},
+	)
+}
+
+func (db *DB) UpdateArchiveCopyUploadInfo(c *types.ArchiveCopy) error {
+	return db.retryIfLocked(fmt.Sprintf("update copy %d upload info", c.ID),
+		func(tx *sql.Tx) error {
+			_, err := tx.Exec(updateArchiveCopyUploadInfoStmt, c.Destination, c.StorageClass, c.Status,
+				c.UploadKey, c.UploadID, c.RetentionMode, nullTime(c.RetainUntil), c.ID)
+			return err
+		},
+	)
+}
+
+func (db *DB) UpdateArchiveCopyStatus(c *types.ArchiveCopy) error {
+	return db.retryIfLocked(fmt.Sprintf("update copy %d status %s", c.ID, c.Status),
+		func(tx *sql.Tx) error {
+			_, err := tx.Exec(updateArchiveCopyStatusStmt, c.Destination, c.Status, c.HashRemote,
+				nullTime(c.VerifyTime), c.ID)
+			return err
+		},
+	)
+}
+
+func (db *DB) UpdateArchiveCopyStorageClass(c *types.ArchiveCopy) error {
+	return db.retryIfLocked(fmt.Sprintf("update copy %d storage class %s", c.ID, c.StorageClass),
+		func(tx *sql.Tx) error {
+			_, err := tx.Exec(updateArchiveCopyStorageClassStmt, c.StorageClass, c.ID)
+			return err
+		},
+	)
+}
+
+// GetCopyParts returns parts of copy in progress, with part number, etag, remote hash and status only
+func (db *DB) GetCopyParts(copyID int) ([]*types.PartInfo, error) {
+	parts := []*types.PartInfo{}
+	err := db.retryIfLocked(fmt.Sprintf("get parts of copy %d", copyID),
+		func(tx *sql.Tx) error {
+			rows, err := tx.Query(getCopyPartsStmt, copyID)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				p := &types.PartInfo{}
+				err = rows.Scan(&p.PartNo, &p.Etag, &p.HashRemote, &p.Status)
+				if err != nil {
+					return err
+				}
+				parts = append(parts, p)
+			}
+			return rows.Err()
+		},
+	)
+	return parts, err
+}
+
+func (db *DB) UpsertCopyPart(copyID int, p *types.PartInfo) error {
+	return db.retryIfLocked(fmt.Sprintf("update copy %d part %d etag %s status %s", copyID, p.PartNo, p.Etag,
+		p.Status),
+		func(tx *sql.Tx) error {
+			_, err := tx.Exec(upsertCopyPartStmt, copyID, p.PartNo, p.Etag, p.HashRemote, p.Status)
+			return err
+		},
+	)
+}
+
+func (db *DB) DeleteCopyParts(copyID int) error {
+	return db.retryIfLocked(fmt.Sprintf("delete parts of copy %d", copyID),
+		func(tx *sql.Tx) error {
+			_, err := tx.Exec(deleteCopyPartsStmt, copyID)
+			return err
+		},
+	)
+}
@@ -0,0 +1,154 @@
+package dbx
+
+import (
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/lomorage/lomo-backup/common/types"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestDB creates DB in temp dir with all schemas applied
+func newTestDB(t *testing.T) *DB {
+	db, err := OpenDB(filepath.Join(t.TempDir(), "lomob.db"))
+	require.Nil(t, err)
+	t.Cleanup(func() { db.db.Close() })
+	return db
+}
+
+func insertTestISO(t *testing.T, db *DB, name string) int {
+	id, err := db.InsertISO(&types.ISOInfo{Name: name, Size: 100, HashLocal: "local"})
+	require.Nil(t, err)
+	return id
+}
+
+func TestArchiveCopy(t *testing.T) {
+	db := newTestDB(t)
+	isoID := insertTestISO(t, db, "a.iso")
+
+	c, err := db.GetArchiveCopy(isoID, "us-east-1", "backup")
+	require.Nil(t, err)
+	require.Nil(t, c)
+
+	// copy is uploading once it is inserted
+	id, err := db.InsertArchiveCopy(&types.ArchiveCopy{IsoID: isoID, Destination: "offsite", Region: "us-east-1",
+		Bucket: "backup", StorageClass: "GLACIER"})
+	require.Nil(t, err)
+	c, err = db.GetArchiveCopy(isoID, "us-east-1", "backup")
+	require.Nil(t, err)
+	require.Equal(t, id, c.ID)
+	require.Equal(t, "a.iso", c.IsoName)
+	require.Equal(t, "offsite", c.Destination)
+	require.Equal(t, "GLACIER", c.StorageClass)
+	require.Equal(t, types.CopyUploading, c.Status)
+	require.True(t, c.VerifyTime.IsZero())
+	require.True(t, c.RetainUntil.IsZero())
+
+	// the same bucket can't have 2 copies of one iso
+	_, err = db.InsertArchiveCopy(&types.ArchiveCopy{IsoID: isoID, Region: "us-east-1", Bucket: "backup"})
+	require.NotNil(t, err)
+
+	retainUntil := time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)
+	c.UploadKey = "a.iso"
+	c.UploadID = "upload"
+	c.RetentionMode = "COMPLIANCE"
+	c.RetainUntil = retainUntil
+	require.Nil(t, db.UpdateArchiveCopyUploadInfo(c))
+	c, err = db.GetArchiveCopy(isoID, "us-east-1", "backup")
+	require.Nil(t, err)
+	require.Equal(t, "upload", c.UploadID)
+	require.Equal(t, "a.iso", c.UploadKey)
+	require.Equal(t, "COMPLIANCE", c.RetentionMode)
+	require.True(t, retainUntil.Equal(c.RetainUntil))
+
+	verifyTime := time.Date(2024, time.April, 1, 12, 0, 0, 0, time.UTC)
+	c.Status = types.CopyUploaded
+	c.HashRemote = "remote"
+	c.VerifyTime = verifyTime
+	require.Nil(t, db.UpdateArchiveCopyStatus(c))
+	c.StorageClass = "DEEP_ARCHIVE"
+	require.Nil(t, db.UpdateArchiveCopyStorageClass(c))
+	c, err = db.GetArchiveCopy(isoID, "us-east-1", "backup")
+	require.Nil(t, err)
+	require.Equal(t, types.CopyUploaded, c.Status)
+	require.Equal(t, "remote", c.HashRemote)
+	require.Equal(t, "DEEP_ARCHIVE", c.StorageClass)
+	require.True(t, verifyTime.Equal(c.VerifyTime))
+	// upload info is kept until copy is replaced
+	require.Equal(t, "upload", c.UploadID)
+}
+
+func TestUpsertArchiveCopy(t *testing.T) {
+	db := newTestDB(t)
+	isoA := insertTestISO(t, db, "a.iso")
+	isoB := insertTestISO(t, db, "b.iso")
+
+	_, err := db.InsertArchiveCopy(&types.ArchiveCopy{IsoID: isoA, Region: "us-east-1", Bucket: "backup"})
+	require.Nil(t, err)
+	c, err := db.GetArchiveCopy(isoA, "us-east-1", "backup")
+	require.Nil(t, err)
+	c.UploadKey = "a.iso"
+	c.UploadID = "upload"
+	require.Nil(t, db.UpdateArchiveCopyUploadInfo(c))
+
+	// uploaded copy replaces the one in progress, and clears its upload info
+	require.Nil(t, db.UpsertArchiveCopy(&types.ArchiveCopy{IsoID: isoA, Region: "us-east-1", Bucket: "backup",
+		StorageClass: "STANDARD", Status: types.CopyUploaded, HashRemote: "remote"}))
+	require.Nil(t, db.UpsertArchiveCopy(&types.ArchiveCopy{IsoID: isoB, Region: "us-east-1", Bucket: "backup",
+		Status: types.CopyUploaded}))
+	require.Nil(t, db.UpsertArchiveCopy(&types.ArchiveCopy{IsoID: isoA, Region: "eu-west-1", Bucket: "backup",
+		Status: types.CopyUploaded}))
+
+	copies, err := db.ListArchiveCopies()
+	require.Nil(t, err)
+	require.Len(t, copies, 3)
+	require.Equal(t, c.ID, copies[0].ID)
+	require.Equal(t, types.CopyUploaded, copies[0].Status)
+	require.Equal(t, "remote", copies[0].HashRemote)
+	require.Equal(t, "STANDARD", copies[0].StorageClass)
+	require.Empty(t, copies[0].UploadID)
+	require.Empty(t, copies[0].UploadKey)
+	require.Equal(t, "eu-west-1", copies[1].Region)
+	require.Equal(t, "b.iso", copies[2].IsoName)
+}
+
+func TestCopyParts(t *testing.T) {
+	db := newTestDB(t)
+	isoID := insertTestISO(t, db, "a.iso")
+	copyID, err := db.InsertArchiveCopy(&types.ArchiveCopy{IsoID: isoID, Region: "us-east-1", Bucket: "backup"})
+	require.Nil(t, err)
+	otherID, err := db.InsertArchiveCopy(&types.ArchiveCopy{IsoID: isoID, Region: "eu-west-1", Bucket: "backup"})
+	require.Nil(t, err)
+
+	parts, err := db.GetCopyParts(copyID)
+	require.Nil(t, err)
+	require.Empty(t, parts)
+
+	require.Nil(t, db.UpsertCopyPart(copyID, &types.PartInfo{PartNo: 1, Status: types.PartUploading}))
+	require.Nil(t, db.UpsertCopyPart(copyID, &types.PartInfo{PartNo: 2, Status: types.PartUploading}))
+	require.Nil(t, db.UpsertCopyPart(otherID, &types.PartInfo{PartNo: 1, Etag: "other",
+		Status: types.PartUploaded}))
+	// part status changes in place
+	require.Nil(t, db.UpsertCopyPart(copyID, &types.PartInfo{PartNo: 1, Etag: "etag1", HashRemote: "hash1",
+		Status: types.PartUploaded}))
+	require.Nil(t, db.UpsertCopyPart(copyID, &types.PartInfo{PartNo: 2, Status: types.PartUploadFailed}))
+
+	parts, err = db.GetCopyParts(copyID)
+	require.Nil(t, err)
+	require.Len(t, parts, 2)
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNo < parts[j].PartNo })
+	require.Equal(t, &types.PartInfo{PartNo: 1, Etag: "etag1", HashRemote: "hash1", Status: types.PartUploaded},
+		parts[0])
+	require.Equal(t, &types.PartInfo{PartNo: 2, Status: types.PartUploadFailed}, parts[1])
+
+	// parts of other copies are kept
+	require.Nil(t, db.DeleteCopyParts(copyID))
+	parts, err = db.GetCopyParts(copyID)
+	require.Nil(t, err)
+	require.Empty(t, parts)
+	parts, err = db.GetCopyParts(otherID)
+	require.Nil(t, err)
+	require.Len(t, parts, 1)
+}
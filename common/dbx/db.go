@@ -27,12 +27,33 @@ type DB struct {
 	db *sql.DB
 }
 
-// OpenDB opens db with given filename.
+// OpenDB opens db with given filename, which is created if it doesn't exist, and upgrades it to the latest
+// schema.
 func OpenDB(filename string) (*DB, error) {
 	db := &DB{}
 	var err error
 	db.db, err = sql.Open("sqlite3", filename)
-	return db, err
+	if err != nil {
+		return nil, err
+	}
+	err = db.migrate()
+	if err != nil {
+		db.db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// OpenDBReadOnly opens db with given filename in read only mode. It fails if the file doesn't exist
+// instead of creating it.
+func OpenDBReadOnly(filename string) (*DB, error) {
+	db := &DB{}
+	var err error
+	db.db, err = sql.Open("sqlite3", "file:"+filename+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	return db, db.db.Ping()
 }
 
 // IsNoRow check the error is no row or not
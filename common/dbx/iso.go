@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/lomorage/lomo-backup/common/compress"
 	"github.com/lomorage/lomo-backup/common/types"
 	//_ "github.com/mattn/go-sqlite3"
 )
@@ -18,25 +19,34 @@ var listFilesNotInIsoOrCloudStmt = "select d.scan_root_dir_id, d.path, f.name, f
 const (
 	listFilesNotInIsoAndCloudStmt = "select d.scan_root_dir_id, d.path, f.name, f.id, f.size, f.hash_local, f.mod_time from files as f" +
 		" inner join dirs as d on f.dir_id=d.id where f.iso_id=0 order by f.dir_id, f.id"
-	getTotalFileSizeNotInIsoStmt     = "select sum(size) from files where iso_id=0"
+	listFilesInIsoStmt = "select d.scan_root_dir_id, d.path, f.name, f.id, f.size, f.hash_local, f.mod_time from files as f" +
+		" inner join dirs as d on f.dir_id=d.id where f.iso_id=? order by f.dir_id, f.id"
+	getTotalFileSizeNotInIsoStmt     = "select ifnull(sum(size), 0) from files where iso_id=0"
 	getTotalFilesInIsoStmt           = "select sum(size), count(size) from files where iso_id=?"
+	getTotalFilesStmt                = "select ifnull(sum(size), 0), count(size) from files"
+	listFileExtSizesInIsoStmt        = "select ext, sum(size) from files where iso_id=? group by ext"
 	updateBatchFilesIsoIDStmt        = "update files set iso_id=%d where id in (%s)"
 	updateFileIsoIDAndRemoteHashStmt = "update files set iso_id=?, hash_remote=? where id=?"
 
 	deleteBatchFilesStmt = "delete from files where id in (%s)"
 
 	getIsoByNameStmt = "select id, size, hash_local, hash_remote, region, bucket, upload_id, upload_key," +
-		" create_time from isos where name=?"
-	listIsosStmt  = "select id, name, size, status, region, bucket, hash_local, hash_remote, create_time from isos"
+		" codec, create_time, retention_mode, retain_until, storage_class, class_time from isos where name=?"
+	listIsosStmt = "select id, name, size, status, region, bucket, hash_local, hash_remote, codec," +
+		" create_time, retention_mode, retain_until, upload_id, upload_key, storage_class, class_time from isos"
 	insertIsoStmt = "insert into isos (name, size, status, hash_local, create_time) values (?, ?, ?, ?, ?)"
 
-	resetISOFileInfo = "update isos set status=?, region='', bucket='', hash_remote='' where name=?"
+	resetISOFileInfo = "update isos set status=?, region='', bucket='', hash_remote='', retention_mode=''," +
+		" retain_until=NULL where name=?"
 
 	updateIsoStatusStmt           = "update isos set status=? where id=?"
 	updateIsoStatusRemoteHashStmt = "update isos set status=?, hash_remote=? where id=?"
 	updateIsoRegionBucketStmt     = "update isos set status=?, region=?, bucket=? where id=?"
 	updateIsoRemoteHashStmt       = "update isos set hash_remote=? where id=?"
-	updateIsoUploadInfoStmt       = "update isos set region=?,bucket=?, upload_key=?,upload_id=? where id=?"
+	updateIsoStorageClassStmt     = "update isos set storage_class=?, class_time=? where id=?"
+	updateIsoUploadInfoStmt       = "update isos set region=?,bucket=?, upload_key=?,upload_id=?, retention_mode=?," +
+		" retain_until=? where id=?"
+	updateIsoCodecStmt = "update isos set codec=? where id=?"
 
 	insertPartStmt = "insert into parts (iso_id, part_no, hash_local, hash_remote, size, status, create_time)" +
 		" values (?, ?, ?, ?, ?, ?, ?)"
@@ -75,6 +85,34 @@ func (db *DB) ListFilesNotInISOAndCloud() ([]*types.FileInfo, error) {
 	return files, err
 }
 
+// ListFilesInIso lists all files packed in given iso. DirID of returned files is the scan root dir ID
+func (db *DB) ListFilesInIso(isoID int) ([]*types.FileInfo, error) {
+	files := []*types.FileInfo{}
+
+	err := db.retryIfLocked(fmt.Sprintf("list files in ISO %d", isoID),
+		func(tx *sql.Tx) error {
+			rows, err := tx.Query(listFilesInIsoStmt, isoID)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var path, name string
+				f := &types.FileInfo{IsoID: isoID}
+				err = rows.Scan(&f.DirID, &path, &name, &f.ID, &f.Size, &f.HashLocal, &f.ModTime)
+				if err != nil {
+					return err
+				}
+				f.Name = filepath.Join(path, name)
+
+				files = append(files, f)
+			}
+			return rows.Err()
+		},
+	)
+	return files, err
+}
+
 func (db *DB) ListFilesNotInISOOrCloud() ([]*types.FileInfo, error) {
 	files := []*types.FileInfo{}
 
@@ -111,6 +149,17 @@ func (db *DB) TotalFileSizeNotInISO() (uint64, error) {
 	return totalSize, err
 }
 
+// GetTotalFiles returns total size and count of all scanned files
+func (db *DB) GetTotalFiles() (uint64, uint64, error) {
+	var totalSize, totalCount uint64
+	err := db.retryIfLocked("get total file info",
+		func(tx *sql.Tx) error {
+			return tx.QueryRow(getTotalFilesStmt).Scan(&totalSize, &totalCount)
+		},
+	)
+	return totalSize, totalCount, err
+}
+
 func (db *DB) GetTotalFilesInIso(isoID int) (uint64, uint64, error) {
 	var totalSize, totalCount uint64
 	err := db.retryIfLocked("get total file info in ISO "+strconv.Itoa(isoID),
@@ -121,16 +170,47 @@ func (db *DB) GetTotalFilesInIso(isoID int) (uint64, uint64, error) {
 	return totalSize, totalCount, err
 }
 
+// ListFileExtSizesInIso returns total file size per file extension in given ISO
+func (db *DB) ListFileExtSizesInIso(isoID int) (map[string]int, error) {
+	extSizes := map[string]int{}
+	err := db.retryIfLocked("list file extension sizes in ISO "+strconv.Itoa(isoID),
+		func(tx *sql.Tx) error {
+			rows, err := tx.Query(listFileExtSizesInIsoStmt, isoID)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var (
+					ext  string
+					size int
+				)
+				err = rows.Scan(&ext, &size)
+				if err != nil {
+					return err
+				}
+				extSizes[ext] = size
+			}
+			return rows.Err()
+		},
+	)
+	return extSizes, err
+}
+
 func (db *DB) GetIsoByName(name string) (*types.ISOInfo, error) {
 	iso := &types.ISOInfo{Name: name}
+	var retainUntil, classTime sql.NullTime
 	err := db.retryIfLocked(fmt.Sprintf("get ISO %s", name),
 		func(tx *sql.Tx) error {
 			err := tx.QueryRow(getIsoByNameStmt, name).Scan(&iso.ID, &iso.Size, &iso.HashLocal,
 				&iso.HashRemote, &iso.Region, &iso.Bucket,
-				&iso.UploadID, &iso.UploadKey, &iso.CreateTime)
+				&iso.UploadID, &iso.UploadKey, &iso.Codec, &iso.CreateTime, &iso.RetentionMode, &retainUntil,
+				&iso.StorageClass, &classTime)
 			return err
 		},
 	)
+	iso.RetainUntil = retainUntil.Time
+	iso.ClassTime = classTime.Time
 	if err != nil {
 		if IsErrNoRow(err) {
 			return nil, nil
@@ -150,11 +230,15 @@ func (db *DB) ListISOs() ([]*types.ISOInfo, error) {
 			}
 			for rows.Next() {
 				iso := &types.ISOInfo{}
+				var retainUntil, classTime sql.NullTime
 				err = rows.Scan(&iso.ID, &iso.Name, &iso.Size, &iso.Status, &iso.Region, &iso.Bucket,
-					&iso.HashLocal, &iso.HashRemote, &iso.CreateTime)
+					&iso.HashLocal, &iso.HashRemote, &iso.Codec, &iso.CreateTime, &iso.RetentionMode, &retainUntil,
+					&iso.UploadID, &iso.UploadKey, &iso.StorageClass, &classTime)
 				if err != nil {
 					return err
 				}
+				iso.RetainUntil = retainUntil.Time
+				iso.ClassTime = classTime.Time
 				isos = append(isos, iso)
 			}
 			return rows.Err()
@@ -271,8 +355,28 @@ func (db *DB) UpdateIsoStatusRemoteHash(isoID int, remoteHash string, status typ
 func (db *DB) UpdateIsoUploadInfo(info *types.ISOInfo) error {
 	return db.retryIfLocked(fmt.Sprintf("update ISO %d upload info", info.ID),
 		func(tx *sql.Tx) error {
+			retainUntil := sql.NullTime{Time: info.RetainUntil.UTC(), Valid: !info.RetainUntil.IsZero()}
 			_, err := tx.Exec(updateIsoUploadInfoStmt, info.Region, info.Bucket,
-				info.UploadKey, info.UploadID, info.ID)
+				info.UploadKey, info.UploadID, info.RetentionMode, retainUntil, info.ID)
+			return err
+		},
+	)
+}
+
+// UpdateIsoStorageClass records storage class of uploaded iso, and when it is uploaded or transitioned into it
+func (db *DB) UpdateIsoStorageClass(isoID int, storageClass string, classTime time.Time) error {
+	return db.retryIfLocked(fmt.Sprintf("update iso %d storage class %s", isoID, storageClass),
+		func(tx *sql.Tx) error {
+			_, err := tx.Exec(updateIsoStorageClassStmt, storageClass, nullTime(classTime), isoID)
+			return err
+		},
+	)
+}
+
+func (db *DB) UpdateIsoCodec(isoID int, codec compress.Codec) error {
+	return db.retryIfLocked(fmt.Sprintf("update iso %d codec %s", isoID, codec),
+		func(tx *sql.Tx) error {
+			_, err := tx.Exec(updateIsoCodecStmt, codec, isoID)
 			return err
 		},
 	)
@@ -0,0 +1,126 @@
+package dbx
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//go:embed schema/*.sql
+var schemaFS embed.FS
+
+// legacyProbes are queries which only succeed once given schema version is applied. DBs created before schema
+// version was tracked have user_version 0, and their version is the highest one whose probe succeeds
+var legacyProbes = []struct {
+	version int
+	query   string
+}{
+	{6, "SELECT storage_class FROM isos LIMIT 0"},
+	{5, "SELECT id FROM archive_copies LIMIT 0"},
+	{4, "SELECT id FROM restores LIMIT 0"},
+	{3, "SELECT retention_mode FROM isos LIMIT 0"},
+	{2, "SELECT codec FROM isos LIMIT 0"},
+	{1, "SELECT id FROM isos LIMIT 0"},
+}
+
+type schema struct {
+	version int
+	stmts   string
+}
+
+func loadSchemas() ([]schema, error) {
+	entries, err := schemaFS.ReadDir("schema")
+	if err != nil {
+		return nil, err
+	}
+	schemas := make([]schema, 0, len(entries))
+	for _, e := range entries {
+		version, err := strconv.Atoi(strings.TrimSuffix(e.Name(), ".sql"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid schema filename %s", e.Name())
+		}
+		content, err := schemaFS.ReadFile(path.Join("schema", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		schemas = append(schemas, schema{version: version, stmts: string(content)})
+	}
+	sort.Slice(schemas, func(i, j int) bool { return schemas[i].version < schemas[j].version })
+	return schemas, nil
+}
+
+// schemaVersion returns version of DB, and whether it is detected from its tables instead of recorded
+func (db *DB) schemaVersion() (int, bool, error) {
+	var version int
+	err := db.db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil || version != 0 {
+		return version, false, err
+	}
+	for _, p := range legacyProbes {
+		rows, err := db.db.Query(p.query)
+		if err != nil {
+			continue
+		}
+		rows.Close()
+		return p.version, true, nil
+	}
+	return 0, false, nil
+}
+
+func setVersion(exec func(query string, args ...interface{}) (sql.Result, error), version int) error {
+	// pragma doesn't take parameters
+	_, err := exec(fmt.Sprintf("PRAGMA user_version = %d", version))
+	return err
+}
+
+// migrate applies schemas newer than the version of DB in order, each in one transaction together with the
+// version update, so that an interrupted upgrade is resumed from the schema which failed
+func (db *DB) migrate() error {
+	version, detected, err := db.schemaVersion()
+	if err != nil {
+		return err
+	}
+	if detected {
+		err = setVersion(db.db.Exec, version)
+		if err != nil {
+			return err
+		}
+	}
+	schemas, err := loadSchemas()
+	if err != nil {
+		return err
+	}
+	for _, s := range schemas {
+		if s.version <= version {
+			continue
+		}
+		err = db.applySchema(s)
+		if err != nil {
+			return errors.Wrapf(err, "while upgrade DB to schema %d", s.version)
+		}
+	}
+	return nil
+}
+
+func (db *DB) applySchema(s schema) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(s.stmts)
+	if err != nil {
+		return err
+	}
+	err = setVersion(tx.Exec, s.version)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,110 @@
+package dbx
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lomorage/lomo-backup/common/types"
+	"github.com/stretchr/testify/require"
+)
+
+// createRawDB creates DB with given schema files only, as the scripts did before schema version was tracked
+func createRawDB(t *testing.T, schemas ...string) string {
+	filename := filepath.Join(t.TempDir(), "lomob.db")
+	raw, err := sql.Open("sqlite3", filename)
+	require.Nil(t, err)
+	defer raw.Close()
+	for _, s := range schemas {
+		content, err := os.ReadFile(filepath.Join("schema", s))
+		require.Nil(t, err)
+		_, err = raw.Exec(string(content))
+		require.Nil(t, err, s)
+	}
+	return filename
+}
+
+func userVersion(t *testing.T, db *DB) int {
+	var version int
+	require.Nil(t, db.db.QueryRow("PRAGMA user_version").Scan(&version))
+	return version
+}
+
+func latestVersion(t *testing.T) int {
+	schemas, err := loadSchemas()
+	require.Nil(t, err)
+	return schemas[len(schemas)-1].version
+}
+
+func TestMigrateFromFirstSchema(t *testing.T) {
+	filename := createRawDB(t, "1.sql")
+	raw, err := sql.Open("sqlite3", filename)
+	require.Nil(t, err)
+	_, err = raw.Exec(`INSERT INTO isos (name, size, status, hash_local, create_time)
+		VALUES ("a.iso", 100, 1, "local", "2024-01-01 00:00:00")`)
+	require.Nil(t, err)
+	require.Nil(t, raw.Close())
+
+	db, err := OpenDB(filename)
+	require.Nil(t, err)
+	require.Equal(t, latestVersion(t), userVersion(t, db))
+	iso, err := db.GetIsoByName("a.iso")
+	require.Nil(t, err)
+	require.Equal(t, 100, iso.Size)
+	isos, err := db.ListISOs()
+	require.Nil(t, err)
+	require.Len(t, isos, 1)
+	require.Equal(t, types.IsoCreated, isos[0].Status)
+	_, err = db.InsertArchiveCopy(&types.ArchiveCopy{IsoID: iso.ID, Region: "us-east-1", Bucket: "backup"})
+	require.Nil(t, err)
+	require.Nil(t, db.db.Close())
+
+	// upgraded DB is opened as is
+	db, err = OpenDB(filename)
+	require.Nil(t, err)
+	defer db.db.Close()
+	copies, err := db.ListArchiveCopies()
+	require.Nil(t, err)
+	require.Len(t, copies, 1)
+}
+
+func TestMigrateUntrackedVersion(t *testing.T) {
+	// DB created with all schemas by scripts isn't upgraded again
+	filename := createRawDB(t, "1.sql", "2.sql", "3.sql", "4.sql", "5.sql", "6.sql")
+	db, err := OpenDB(filename)
+	require.Nil(t, err)
+	defer db.db.Close()
+	require.Equal(t, 6, userVersion(t, db))
+
+	// DB created in the middle of schemas is upgraded from the next one
+	filename = createRawDB(t, "1.sql", "2.sql", "3.sql")
+	db, err = OpenDB(filename)
+	require.Nil(t, err)
+	defer db.db.Close()
+	require.Equal(t, latestVersion(t), userVersion(t, db))
+	_, err = db.ListArchiveCopies()
+	require.Nil(t, err)
+}
+
+func TestMigrateFailure(t *testing.T) {
+	// schema failed is rolled back, and the ones before it are kept
+	filename := createRawDB(t, "1.sql")
+	raw, err := sql.Open("sqlite3", filename)
+	require.Nil(t, err)
+	defer raw.Close()
+	_, err = raw.Exec("PRAGMA user_version = 1; ALTER TABLE isos ADD COLUMN retain_until TIMESTAMP")
+	require.Nil(t, err)
+
+	_, err = OpenDB(filename)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "schema 3")
+
+	var version int
+	require.Nil(t, raw.QueryRow("PRAGMA user_version").Scan(&version))
+	require.Equal(t, 2, version)
+	_, err = raw.Exec("SELECT codec FROM isos LIMIT 0")
+	require.Nil(t, err)
+	_, err = raw.Exec("SELECT retention_mode FROM isos LIMIT 0")
+	require.NotNil(t, err)
+}
@@ -0,0 +1,66 @@
+package dbx
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lomorage/lomo-backup/common/types"
+)
+
+const (
+	upsertRestoreStmt = "insert into restores (name, region, bucket, tier, days, output, raw, status, create_time)" +
+		" values (?, ?, ?, ?, ?, ?, ?, ?, ?) on conflict(region, bucket, name) do update set tier=excluded.tier," +
+		" days=excluded.days, output=excluded.output, raw=excluded.raw, status=excluded.status, expiry_time=NULL," +
+		" create_time=excluded.create_time"
+	listRestoresStmt = "select id, name, region, bucket, tier, days, output, raw, status, expiry_time, create_time" +
+		" from restores order by id"
+	updateRestoreStatusStmt = "update restores set status=?, expiry_time=? where id=?"
+)
+
+// UpsertRestore records restore request of given object, which replaces previous one of the same object
+func (db *DB) UpsertRestore(r *types.RestoreInfo) error {
+	return db.retryIfLocked(fmt.Sprintf("upsert restore of %s", r.Name),
+		func(tx *sql.Tx) error {
+			_, err := tx.Exec(upsertRestoreStmt, r.Name, r.Region, r.Bucket, r.Tier, r.Days, r.Output, r.Raw,
+				types.RestoreRequested, time.Now().UTC())
+			return err
+		},
+	)
+}
+
+func (db *DB) ListRestores() ([]*types.RestoreInfo, error) {
+	restores := []*types.RestoreInfo{}
+	err := db.retryIfLocked("list restores",
+		func(tx *sql.Tx) error {
+			rows, err := tx.Query(listRestoresStmt)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				r := &types.RestoreInfo{}
+				var expiryTime sql.NullTime
+				err = rows.Scan(&r.ID, &r.Name, &r.Region, &r.Bucket, &r.Tier, &r.Days, &r.Output, &r.Raw,
+					&r.Status, &expiryTime, &r.CreateTime)
+				if err != nil {
+					return err
+				}
+				r.ExpiryTime = expiryTime.Time
+				restores = append(restores, r)
+			}
+			return rows.Err()
+		},
+	)
+	return restores, err
+}
+
+func (db *DB) UpdateRestoreStatus(id int, status types.RestoreStatus, expiryTime time.Time) error {
+	return db.retryIfLocked(fmt.Sprintf("update restore %d status %s", id, status),
+		func(tx *sql.Tx) error {
+			_, err := tx.Exec(updateRestoreStatusStmt, status,
+				sql.NullTime{Time: expiryTime.UTC(), Valid: !expiryTime.IsZero()}, id)
+			return err
+		},
+	)
+}
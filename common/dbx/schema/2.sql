@@ -0,0 +1 @@
+ALTER TABLE isos ADD COLUMN codec INTEGER DEFAULT 0 NOT NULL;
@@ -0,0 +1,2 @@
+ALTER TABLE isos ADD COLUMN retention_mode VARCHAR DEFAULT "" NOT NULL;
+ALTER TABLE isos ADD COLUMN retain_until TIMESTAMP;
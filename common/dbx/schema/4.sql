@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS restores (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name VARCHAR NOT NULL,
+  region VARCHAR NOT NULL,
+  bucket VARCHAR NOT NULL,
+  tier VARCHAR NOT NULL,
+  days INTEGER NOT NULL,
+  output VARCHAR NOT NULL,
+  raw INTEGER DEFAULT 0 NOT NULL,
+  status INTEGER NOT NULL,
+  expiry_time TIMESTAMP,
+  create_time TIMESTAMP NOT NULL,
+
+  UNIQUE(region, bucket, name)
+);
@@ -0,0 +1,33 @@
+CREATE TABLE IF NOT EXISTS archive_copies (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  iso_id INTEGER NOT NULL,
+  destination VARCHAR DEFAULT "" NOT NULL,
+  region VARCHAR NOT NULL,
+  bucket VARCHAR NOT NULL,
+  storage_class VARCHAR DEFAULT "" NOT NULL,
+  status INTEGER NOT NULL,
+  hash_remote VARCHAR DEFAULT "" NOT NULL,
+  upload_key VARCHAR DEFAULT "" NOT NULL,
+  upload_id VARCHAR DEFAULT "" NOT NULL,
+  retention_mode VARCHAR DEFAULT "" NOT NULL,
+  retain_until TIMESTAMP,
+  verify_time TIMESTAMP,
+  create_time TIMESTAMP NOT NULL,
+
+  UNIQUE(iso_id, region, bucket)
+);
+
+CREATE TABLE IF NOT EXISTS copy_parts (
+  copy_id INTEGER NOT NULL,
+  part_no INTEGER NOT NULL,
+  etag VARCHAR DEFAULT "" NOT NULL,
+  hash_remote VARCHAR DEFAULT "" NOT NULL,
+  status INTEGER NOT NULL,
+
+  CONSTRAINT copy_part UNIQUE (copy_id, part_no)
+);
+
+INSERT OR IGNORE INTO archive_copies (iso_id, region, bucket, status, hash_remote, retention_mode, retain_until,
+  create_time)
+  SELECT id, region, bucket, 1, hash_remote, retention_mode, retain_until, create_time FROM isos
+  WHERE status=3 AND region!="";
@@ -0,0 +1,6 @@
+ALTER TABLE isos ADD COLUMN storage_class VARCHAR DEFAULT "" NOT NULL;
+ALTER TABLE isos ADD COLUMN class_time TIMESTAMP;
+
+UPDATE isos SET storage_class=ifnull((SELECT c.storage_class FROM archive_copies AS c
+  WHERE c.iso_id=isos.id AND c.region=isos.region AND c.bucket=isos.bucket), "")
+  WHERE status=3;
@@ -4,11 +4,16 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"time"
 
+	"github.com/lomorage/lomo-backup/common/bwlimit"
+	"github.com/lomorage/lomo-backup/common/progress"
+	"github.com/lomorage/lomo-backup/common/retry"
 	"github.com/lomorage/lomo-backup/common/types"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/drive/v3"
 	"google.golang.org/api/option"
@@ -20,10 +25,14 @@ type Config struct {
 	CredFilename  string
 	TokenFilename string
 	RefreshToken  bool
+	Retry         retry.Policy
+	// upload bandwidth limiter, nil if not limited
+	Limiter *bwlimit.Limiter
 }
 
 type DriveClient struct {
-	srv *drive.Service
+	srv   *drive.Service
+	retry retry.Policy
 }
 
 func CreateDriveClient(conf *Config) (*DriveClient, error) {
@@ -56,14 +65,25 @@ func CreateDriveClient(conf *Config) (*DriveClient, error) {
 		return nil, err
 	}
 
-	cli := &DriveClient{}
+	cli := &DriveClient{retry: conf.Retry}
 
-	cli.srv, err = drive.NewService(ctx, option.WithHTTPClient(config.Client(ctx, token)))
+	// token is refreshed above already, so only requests to drive are limited
+	clientCtx := context.WithValue(ctx, oauth2.HTTPClient,
+		&http.Client{Transport: bwlimit.NewTransport(progress.NewTransport(nil), conf.Limiter)})
+	cli.srv, err = drive.NewService(ctx, option.WithHTTPClient(config.Client(clientCtx, token)))
 	return cli, err
 }
 
+func (c *DriveClient) do(desc string, fn func() error) error {
+	return retry.Do(context.Background(), c.retry, desc, fn)
+}
+
 func (c *DriveClient) GetFile(fileID string) (io.ReadCloser, error) {
-	f, err := c.srv.Files.Get(fileID).Download()
+	var f *http.Response
+	err := c.do("download "+fileID, func() (err error) {
+		f, err = c.srv.Files.Get(fileID).Download()
+		return
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -76,7 +96,11 @@ func (c *DriveClient) GetFileID(filename, parentFolderID string) (string, string
 	if parentFolderID != "" {
 		query += fmt.Sprintf(" and '%s' in parents", parentFolderID)
 	}
-	files, err := c.srv.Files.List().Q(query).PageSize(1).Fields("files(id, name, parents)").Do()
+	var files *drive.FileList
+	err := c.do("find "+filename, func() (err error) {
+		files, err = c.srv.Files.List().Q(query).PageSize(1).Fields("files(id, name, parents)").Do()
+		return
+	})
 	if err != nil {
 		return "", "", err
 	}
@@ -100,7 +124,7 @@ func (c *DriveClient) GetAndCreateFileIDIfNotExist(filename, parentFolderID stri
 	}
 	if fileID == "" {
 		// not exist, create new one
-		fileID, err = c.CreateFile(filename, parentFolderID, r, modTime)
+		fileID, err = c.CreateFile(context.Background(), filename, parentFolderID, r, modTime)
 		return false, fileID, err
 	}
 	if parentFolderID != "" && pid != parentFolderID {
@@ -109,7 +133,9 @@ func (c *DriveClient) GetAndCreateFileIDIfNotExist(filename, parentFolderID stri
 	return true, fileID, nil
 }
 
-func (c *DriveClient) CreateFile(filename, parentFolderID string, r io.Reader, modTime time.Time) (string, error) {
+// CreateFile creates folder if r is nil. Bytes uploaded are counted into progress tracker of ctx if any
+func (c *DriveClient) CreateFile(ctx context.Context, filename, parentFolderID string, r io.Reader,
+	modTime time.Time) (string, error) {
 	file := &drive.File{
 		Name:        filename,
 		CreatedTime: modTime.Format(time.RFC3339),
@@ -118,24 +144,61 @@ func (c *DriveClient) CreateFile(filename, parentFolderID string, r io.Reader, m
 	if parentFolderID != "" {
 		file.Parents = []string{parentFolderID}
 	}
+	var f *drive.File
 	if r == nil {
 		// it is a folder
 		file.MimeType = mimiTypeFolder
-		f, err := c.srv.Files.Create(file).Do()
+		err := c.do("create folder "+filename, func() (err error) {
+			f, err = c.srv.Files.Create(file).Context(ctx).Do()
+			return
+		})
 		if err != nil {
 			return "", err
 		}
 		return f.Id, nil
 	}
-	f, err := c.srv.Files.Create(file).Media(r).Do()
+
+	// content is able to be uploaded again only if it is seekable
+	policy := c.retry
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		policy.MaxRetries = 0
+	}
+	err := retry.Do(ctx, policy, "create "+filename, func() (err error) {
+		if seeker != nil {
+			_, err = seeker.Seek(0, io.SeekStart)
+			if err != nil {
+				return err
+			}
+		}
+		f, err = c.srv.Files.Create(file).Media(r).Context(ctx).Do()
+		return
+	})
 	if err != nil {
 		return "", err
 	}
 	return f.Id, nil
 }
 
+// GetFileMetadata returns app properties saved with the file, which is nil if there is none
+func (c *DriveClient) GetFileMetadata(fileID string) (map[string]string, error) {
+	var file *drive.File
+	err := c.do("get metadata of "+fileID, func() (err error) {
+		file, err = c.srv.Files.Get(fileID).Fields("appProperties").Do()
+		return
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve file metadata: %v", err)
+	}
+	return file.AppProperties, nil
+}
+
 func (c *DriveClient) UpdateFileMetadata(fileID string, metadata map[string]string) error {
-	file, err := c.srv.Files.Get(fileID).Fields("appProperties").Do()
+	var file *drive.File
+	err := c.do("get metadata of "+fileID, func() (err error) {
+		file, err = c.srv.Files.Get(fileID).Fields("appProperties").Do()
+		return
+	})
 	if err != nil {
 		return fmt.Errorf("failed to retrieve file metadata: %v", err)
 	}
@@ -144,7 +207,10 @@ func (c *DriveClient) UpdateFileMetadata(fileID string, metadata map[string]stri
 	file.AppProperties = metadata
 
 	// Call the update method with modified metadata
-	_, err = c.srv.Files.Update(fileID, file).Fields("id, name, appProperties").Do()
+	err = c.do("update metadata of "+fileID, func() error {
+		_, err := c.srv.Files.Update(fileID, file).Fields("id, name, appProperties").Do()
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("failed to update file metadata: %v", err)
 	}
@@ -154,7 +220,11 @@ func (c *DriveClient) UpdateFileMetadata(fileID string, metadata map[string]stri
 
 func (c *DriveClient) ListFiles(folderID string) ([]*types.DirInfo, []*types.FileInfo, error) {
 	query := fmt.Sprintf("'%s' in parents", folderID)
-	list, err := c.srv.Files.List().Q(query).Fields("files(id, name, size, mimeType, createdTime, appProperties)").Do()
+	var list *drive.FileList
+	err := c.do("list "+folderID, func() (err error) {
+		list, err = c.srv.Files.List().Q(query).Fields("files(id, name, size, mimeType, createdTime, appProperties)").Do()
+		return
+	})
 	if err != nil {
 		return nil, nil, err
 	}
@@ -0,0 +1,113 @@
+package gcloud
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lomorage/lomo-backup/common/retry"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+type reply struct {
+	status int
+	body   string
+}
+
+func rateLimited(reason string) reply {
+	return reply{http.StatusForbidden,
+		`{"error":{"code":403,"message":"injected","errors":[{"reason":"` + reason + `"}]}}`}
+}
+
+// newTestDriveClient returns client connected to one server replying in order, and the bodies of
+// requests received by the server
+func newTestDriveClient(t *testing.T, replies ...reply) (*DriveClient, func() [][]byte) {
+	var (
+		mu     sync.Mutex
+		bodies [][]byte
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, body)
+		rep := replies[0]
+		if len(replies) > 1 {
+			replies = replies[1:]
+		}
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(rep.status)
+		_, _ = io.WriteString(w, rep.body)
+	}))
+	t.Cleanup(s.Close)
+
+	srv, err := drive.NewService(context.Background(), option.WithEndpoint(s.URL+"/"),
+		option.WithHTTPClient(s.Client()))
+	require.Nil(t, err)
+	cli := &DriveClient{srv: srv,
+		retry: retry.Policy{MaxRetries: 4, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}}
+	return cli, func() [][]byte {
+		mu.Lock()
+		defer mu.Unlock()
+		return bodies
+	}
+}
+
+func TestGetFileIDRetry(t *testing.T) {
+	cli, requests := newTestDriveClient(t,
+		reply{http.StatusTooManyRequests, `{"error":{"code":429,"message":"injected"}}`},
+		rateLimited("userRateLimitExceeded"),
+		reply{http.StatusServiceUnavailable, `{"error":{"code":503,"message":"injected"}}`},
+		reply{http.StatusOK, `{"files":[{"id":"file","parents":["parent"]}]}`},
+	)
+	id, parentID, err := cli.GetFileID("name", "parent")
+	require.Nil(t, err)
+	require.Equal(t, "file", id)
+	require.Equal(t, "parent", parentID)
+	require.Len(t, requests(), 4)
+}
+
+func TestGetFileIDNoRetryForAuth(t *testing.T) {
+	cli, requests := newTestDriveClient(t,
+		reply{http.StatusUnauthorized, `{"error":{"code":401,"message":"injected"}}`},
+		reply{http.StatusOK, `{"files":[]}`},
+	)
+	_, _, err := cli.GetFileID("name", "")
+	require.NotNil(t, err)
+	require.Equal(t, retry.Auth, retry.Classify(err))
+	require.Len(t, requests(), 1)
+}
+
+func TestCreateFileRetry(t *testing.T) {
+	content := bytes.Repeat([]byte("lomorage"), 100)
+
+	// seekable content is uploaded again from the beginning
+	cli, requests := newTestDriveClient(t,
+		reply{http.StatusInternalServerError, `{"error":{"code":500,"message":"injected"}}`},
+		reply{http.StatusOK, `{"id":"file"}`},
+	)
+	id, err := cli.CreateFile(context.Background(), "name", "parent", bytes.NewReader(content), time.Now())
+	require.Nil(t, err)
+	require.Equal(t, "file", id)
+	require.Len(t, requests(), 2)
+	for _, body := range requests() {
+		require.True(t, bytes.Contains(body, content))
+	}
+
+	// content not seekable is not retried
+	cli, requests = newTestDriveClient(t,
+		reply{http.StatusInternalServerError, `{"error":{"code":500,"message":"injected"}}`},
+		reply{http.StatusOK, `{"id":"file"}`},
+	)
+	_, err = cli.CreateFile(context.Background(), "name", "parent", io.MultiReader(bytes.NewReader(content)), time.Now())
+	require.NotNil(t, err)
+	require.Len(t, requests(), 1)
+}
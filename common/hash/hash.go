@@ -8,6 +8,7 @@ import (
 	"os"
 
 	lomoio "github.com/lomorage/lomo-backup/common/io"
+	"github.com/lomorage/lomo-backup/common/progress"
 )
 
 func CalculateHashHex(hash []byte) string {
@@ -29,6 +30,11 @@ func CalculateHashBytes(buffer []byte) []byte {
 }
 
 func CalculateHashFile(path string) ([]byte, error) {
+	return CalculateHashFileWithProgress(path, nil)
+}
+
+// CalculateHashFileWithProgress counts bytes hashed into tracker
+func CalculateHashFileWithProgress(path string, t *progress.Tracker) ([]byte, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
@@ -36,7 +42,7 @@ func CalculateHashFile(path string) ([]byte, error) {
 	defer f.Close()
 
 	h := sha256.New()
-	_, err = io.Copy(h, f)
+	_, err = io.Copy(h, progress.NewReader(f, t))
 	if err != nil {
 		return nil, err
 	}
@@ -46,6 +52,11 @@ func CalculateHashFile(path string) ([]byte, error) {
 
 // return hex encoding and base 64 encoding
 func CalculateMultiPartsHash(path string, partSize int) ([][]byte, error) {
+	return CalculateMultiPartsHashWithProgress(path, partSize, nil)
+}
+
+// CalculateMultiPartsHashWithProgress counts bytes hashed into tracker
+func CalculateMultiPartsHashWithProgress(path string, partSize int, t *progress.Tracker) ([][]byte, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
@@ -68,7 +79,7 @@ func CalculateMultiPartsHash(path string, partSize int) ([][]byte, error) {
 		}
 		prs := lomoio.NewFilePartReadSeeker(f, curr, curr+partLength)
 		h := sha256.New()
-		_, err = io.Copy(h, prs)
+		_, err = io.Copy(h, progress.NewReader(prs, t))
 		if err != nil {
 			return nil, err
 		}
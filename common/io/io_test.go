@@ -3,6 +3,7 @@ package io
 import (
 	"io"
 	"os"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -142,6 +143,48 @@ func TestFilePartReadSeekerRead(t *testing.T) {
 	verifyRead(t, expectFile, prs, 500)
 }
 
+func TestFilePartReadSeekerConcurrentRead(t *testing.T) {
+	expect, err := os.ReadFile(testFilename)
+	require.Nil(t, err)
+
+	fpart, err := os.Open(testFilename)
+	require.Nil(t, err)
+	defer fpart.Close()
+
+	// all parts share the same file, and read in small chunks so that reads interleave
+	const partSize = 1000
+	outputs := make([][]byte, (len(expect)+partSize-1)/partSize)
+	wg := sync.WaitGroup{}
+	for i := range outputs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			end := (i + 1) * partSize
+			if end > len(expect) {
+				end = len(expect)
+			}
+			prs := NewFilePartReadSeeker(fpart, int64(i*partSize), int64(end))
+			buf := make([]byte, 7)
+			for {
+				n, err := prs.Read(buf)
+				outputs[i] = append(outputs[i], buf[:n]...)
+				if err == io.EOF {
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i, output := range outputs {
+		end := (i + 1) * partSize
+		if end > len(expect) {
+			end = len(expect)
+		}
+		require.Equal(t, expect[i*partSize:end], output, "part %d", i)
+	}
+}
+
 func verifyReadSeek(t *testing.T, expectReadSeeker, readSeeker io.ReadSeeker,
 	len, expectOffset, offset, whence int) {
 	_, err := expectReadSeeker.Seek(int64(expectOffset), whence)
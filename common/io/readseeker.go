@@ -29,6 +29,8 @@ func (prs *FilePartReadSeeker) SetStartEnd(start, end int64) {
 	prs.current = start
 }
 
+// Read reads with ReadAt instead of changing file offset, so that different parts of the same file
+// are able to be read concurrently
 func (prs *FilePartReadSeeker) Read(p []byte) (n int, err error) {
 	currBegin := prs.current
 	defer func() {
@@ -39,44 +41,22 @@ func (prs *FilePartReadSeeker) Read(p []byte) (n int, err error) {
 		}
 		logrus.Trace(logs)
 	}()
-	// seek to the current if it is not yet
-	curr, err := prs.f.Seek(0, io.SeekCurrent)
-	if err != nil {
-		return
-	}
-	if curr != prs.current {
-		curr, err = prs.f.Seek(prs.current, io.SeekStart)
-		if err != nil {
-			return
-		}
-		if curr != prs.current {
-			return 0, fmt.Errorf("fail to seek to offset %d before read", prs.current)
-		}
-	}
 
 	if prs.current >= prs.end {
 		return 0, io.EOF
 	}
-	currLen := prs.end - prs.current
-	if len(p) <= int(currLen) {
-		n, err = prs.f.Read(p)
-		if err != nil {
-			return
-		}
-		prs.current += int64(n)
-		return
-	}
-	buf := make([]byte, currLen)
-	n, err = prs.f.Read(buf)
-	if err != nil {
-		return
+	if currLen := prs.end - prs.current; int64(len(p)) > currLen {
+		p = p[:currLen]
 	}
-	copy(p, buf)
+	n, err = prs.f.ReadAt(p, prs.current)
 	prs.current += int64(n)
-
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
 	return
 }
 
+// Seek changes position relative to part start, and the position is limited within the part
 func (prs *FilePartReadSeeker) Seek(offset int64, whence int) (n int64, err error) {
 	defer func() {
 		logs := fmt.Sprintf("seek %s request %d, %d, reply %d", prs.f.Name(), offset, whence, n)
@@ -85,59 +65,22 @@ func (prs *FilePartReadSeeker) Seek(offset int64, whence int) (n int64, err erro
 		}
 		logrus.Trace(logs)
 	}()
-	// seek to whenonce point, then seek
 	switch whence {
 	case io.SeekStart:
-		if offset <= 0 {
-			_, err = prs.f.Seek(prs.start, io.SeekStart)
-			n = 0
-			prs.current = prs.start
-			return
-		}
-		if offset >= prs.end-prs.start {
-			_, err = prs.f.Seek(prs.end, io.SeekStart)
-			n = prs.end - prs.start
-			prs.current = prs.end
-			return
-		}
-		n, err = prs.f.Seek(prs.start+offset, io.SeekStart)
+		n = offset
 	case io.SeekCurrent:
-		if offset < 0 {
-			if prs.current+offset < prs.start {
-				_, err = prs.f.Seek(prs.start, io.SeekStart)
-				n = 0
-				prs.current = prs.start
-				return
-			}
-		} else {
-			if prs.current+offset >= prs.end {
-				n, err = prs.f.Seek(prs.end, io.SeekStart)
-				n -= prs.start
-				prs.current = prs.end
-				return
-			}
-		}
-		n, err = prs.f.Seek(prs.current+offset, io.SeekStart)
+		n = prs.current - prs.start + offset
 	case io.SeekEnd:
-		if offset >= 0 {
-			_, err = prs.f.Seek(prs.end, io.SeekStart)
-			n = prs.end - prs.start
-			prs.current = prs.end
-			return
-		}
-		if offset*-1 > prs.end-prs.start {
-			_, err = prs.f.Seek(prs.start, io.SeekStart)
-			n = 0
-			prs.current = prs.start
-			return
-		}
-		n, err = prs.f.Seek(prs.end+offset, io.SeekStart)
+		n = prs.Size() + offset
 	default:
 		return 0, fmt.Errorf("not implemented")
 	}
-	n -= prs.start
+	if n < 0 {
+		n = 0
+	} else if n > prs.Size() {
+		n = prs.Size()
+	}
 	prs.current = prs.start + n
-
 	return
 }
 
@@ -0,0 +1,114 @@
+package parity
+
+import "errors"
+
+// arithmetic in GF(2^8) with primitive polynomial x^8 + x^4 + x^3 + x^2 + 1
+const gfPoly = 0x11d
+
+var (
+	gfExp [512]byte
+	gfLog [256]byte
+
+	errSingular = errors.New("matrix is singular")
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= gfPoly
+		}
+	}
+	// duplicate so that gfMul doesn't need modulo
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	if a == 0 {
+		panic("inverse of zero in GF(2^8)")
+	}
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfMulAdd computes dst[i] ^= c * src[i]
+func gfMulAdd(c byte, src, dst []byte) {
+	if c == 0 {
+		return
+	}
+	if c == 1 {
+		for i, s := range src {
+			dst[i] ^= s
+		}
+		return
+	}
+	logC := int(gfLog[c])
+	for i, s := range src {
+		if s != 0 {
+			dst[i] ^= gfExp[logC+int(gfLog[s])]
+		}
+	}
+}
+
+type matrix [][]byte
+
+func newMatrix(rows, cols int) matrix {
+	m := make(matrix, rows)
+	for i := range m {
+		m[i] = make([]byte, cols)
+	}
+	return m
+}
+
+// invert returns the inverse of one square matrix with Gauss-Jordan elimination
+func (m matrix) invert() (matrix, error) {
+	n := len(m)
+	// augment with identity matrix
+	work := newMatrix(n, 2*n)
+	for i := 0; i < n; i++ {
+		copy(work[i], m[i])
+		work[i][n+i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for r := col; r < n; r++ {
+			if work[r][col] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, errSingular
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+
+		inv := gfInv(work[col][col])
+		for c := range work[col] {
+			work[col][c] = gfMul(work[col][c], inv)
+		}
+		for r := 0; r < n; r++ {
+			if r == col || work[r][col] == 0 {
+				continue
+			}
+			gfMulAdd(work[r][col], work[col], work[r])
+		}
+	}
+
+	inv := newMatrix(n, n)
+	for i := 0; i < n; i++ {
+		copy(inv[i], work[i][n:])
+	}
+	return inv, nil
+}
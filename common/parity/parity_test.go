@@ -0,0 +1,188 @@
+package parity
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testFilename = "../testdata/indepedant_declaration.txt"
+
+func TestReconstruct(t *testing.T) {
+	rs, err := newRSCode(5, 3)
+	require.Nil(t, err)
+
+	r := rand.New(rand.NewSource(1))
+	data := newMatrix(5, 64)
+	for _, d := range data {
+		r.Read(d)
+	}
+	parity := newMatrix(3, 64)
+	require.Nil(t, rs.encode(data, parity))
+
+	// every combination of up to 3 missing shards is recoverable
+	for mask := 0; mask < 1<<8; mask++ {
+		shards := make([][]byte, 8)
+		missing := 0
+		for i := range shards {
+			if mask&(1<<i) != 0 {
+				missing++
+				continue
+			}
+			if i < 5 {
+				shards[i] = append([]byte{}, data[i]...)
+			} else {
+				shards[i] = append([]byte{}, parity[i-5]...)
+			}
+		}
+		err = rs.reconstruct(shards)
+		if missing > 3 {
+			require.Equal(t, ErrTooFewShards, err, mask)
+			continue
+		}
+		require.Nil(t, err, mask)
+		for i := 0; i < 5; i++ {
+			require.Equal(t, data[i], shards[i], mask)
+		}
+	}
+
+	_, err = newRSCode(200, 57)
+	require.NotNil(t, err)
+}
+
+func genSidecar(t *testing.T, data []byte, opts Options) []byte {
+	buf := &bytes.Buffer{}
+	require.Nil(t, Generate(buf, bytes.NewReader(data), int64(len(data)), opts))
+	h, err := ReadHeader(bytes.NewReader(buf.Bytes()))
+	require.Nil(t, err)
+	require.Equal(t, opts, h.Options)
+	require.EqualValues(t, len(data), h.Size)
+	require.EqualValues(t, buf.Len(), h.SidecarSize())
+	return buf.Bytes()
+}
+
+func TestRepairFile(t *testing.T) {
+	original, err := os.ReadFile(testFilename)
+	require.Nil(t, err)
+
+	opts := Options{BlockSize: 512, DataShards: 4, ParityShards: 2}
+	sidecar := genSidecar(t, original, opts)
+	blocks := (int64(len(original)) + 511) / 512
+
+	filename := filepath.Join(t.TempDir(), "object")
+	require.Nil(t, os.WriteFile(filename, original, 0644))
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	require.Nil(t, err)
+	defer f.Close()
+
+	report, err := Verify(f, bytes.NewReader(sidecar))
+	require.Nil(t, err)
+	require.Equal(t, blocks, report.Blocks)
+	require.Empty(t, report.Damaged)
+	require.True(t, report.OK())
+
+	// flip one bit in first block, corrupt two blocks in second group, and corrupt the last
+	// partial block
+	corrupt := func(off int64, b byte) {
+		buf := []byte{0}
+		_, err := f.ReadAt(buf, off)
+		require.Nil(t, err)
+		buf[0] ^= b
+		_, err = f.WriteAt(buf, off)
+		require.Nil(t, err)
+	}
+	corrupt(10, 0x01)
+	corrupt(4*512+100, 0xff)
+	corrupt(6*512+511, 0x80)
+	corrupt(int64(len(original))-1, 0x20)
+
+	report, err = Verify(f, bytes.NewReader(sidecar))
+	require.Nil(t, err)
+	require.Equal(t, []int64{0, 4, 6, blocks - 1}, report.Damaged)
+	require.EqualValues(t, 4, report.Repaired)
+	require.True(t, report.OK())
+
+	report, err = Repair(f, bytes.NewReader(sidecar))
+	require.Nil(t, err)
+	require.EqualValues(t, 4, report.Repaired)
+	require.True(t, report.OK())
+
+	repaired, err := os.ReadFile(filename)
+	require.Nil(t, err)
+	require.Equal(t, original, repaired)
+
+	// more damaged blocks than parity blocks in one group
+	corrupt(0, 1)
+	corrupt(512, 1)
+	corrupt(1024, 1)
+	report, err = Repair(f, bytes.NewReader(sidecar))
+	require.Nil(t, err)
+	require.False(t, report.OK())
+	require.Equal(t, []int64{0, 1, 2}, report.Unrepairable)
+}
+
+func TestRepairTruncatedFile(t *testing.T) {
+	original, err := os.ReadFile(testFilename)
+	require.Nil(t, err)
+
+	opts := Options{BlockSize: 1024, DataShards: 3, ParityShards: 2}
+	sidecar := genSidecar(t, original, opts)
+
+	// lose the tail of the file, and corrupt one parity block as well
+	filename := filepath.Join(t.TempDir(), "object")
+	require.Nil(t, os.WriteFile(filename, original[:len(original)-900], 0644))
+	blocks := (len(original) + 1023) / 1024
+	lastGroupOff := int64(headerLen) + int64((blocks-1)/3)*(&Header{Options: opts}).groupLen()
+	sidecar[lastGroupOff+(&Header{Options: opts}).hashesLen()+3] ^= 0xff
+
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	require.Nil(t, err)
+	defer f.Close()
+
+	report, err := Repair(f, bytes.NewReader(sidecar))
+	require.Nil(t, err)
+	require.True(t, report.OK(), "%+v", report)
+	require.EqualValues(t, 1, report.ParityDamaged)
+
+	repaired, err := os.ReadFile(filename)
+	require.Nil(t, err)
+	require.Equal(t, original, repaired)
+}
+
+func TestInvalidSidecar(t *testing.T) {
+	_, err := ReadHeader(bytes.NewReader([]byte("LOMP")))
+	require.Equal(t, ErrInvalidSidecar, err)
+	_, err = ReadHeader(bytes.NewReader(make([]byte, headerLen)))
+	require.Equal(t, ErrInvalidSidecar, err)
+
+	err = Generate(&bytes.Buffer{}, bytes.NewReader(nil), 0, Options{BlockSize: 0, DataShards: 1, ParityShards: 1})
+	require.NotNil(t, err)
+}
+
+func TestDamagedSidecar(t *testing.T) {
+	original, err := os.ReadFile(testFilename)
+	require.Nil(t, err)
+
+	opts := Options{BlockSize: 512, DataShards: 4, ParityShards: 2}
+	sidecar := genSidecar(t, original, opts)
+	h := &Header{Options: opts, Size: int64(len(original))}
+
+	// damaged hash of one intact block in the second group
+	damaged := append([]byte{}, sidecar...)
+	damaged[int64(headerLen)+h.groupLen()+hashLen+7] ^= 0x01
+	report, err := Verify(bytes.NewReader(original), bytes.NewReader(damaged))
+	require.Nil(t, err)
+	require.Equal(t, []int64{1}, report.HashesDamaged)
+	require.Empty(t, report.Damaged)
+	require.Empty(t, report.Unrepairable)
+
+	// damaged header
+	damaged = append([]byte{}, sidecar...)
+	damaged[len(magic)+2] ^= 0x01
+	_, err = ReadHeader(bytes.NewReader(damaged))
+	require.Equal(t, ErrInvalidSidecar, err)
+}
@@ -0,0 +1,133 @@
+package parity
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MaxShards is the maximum number of data plus parity shards supported in GF(2^8)
+const MaxShards = 256
+
+var (
+	ErrTooFewShards = errors.New("too few shards to reconstruct")
+	errShardSize    = errors.New("shards have different size")
+)
+
+// rsCode is one systematic Reed-Solomon erasure code. The encoding matrix is the identity matrix on top
+// of one Cauchy matrix, and any square submatrix of it is invertible, so that any dataShards of all
+// shards are able to reconstruct the data
+type rsCode struct {
+	dataShards   int
+	parityShards int
+	// parity rows of encoding matrix, parityShards x dataShards
+	parity matrix
+}
+
+func newRSCode(dataShards, parityShards int) (*rsCode, error) {
+	if dataShards <= 0 || parityShards <= 0 {
+		return nil, fmt.Errorf("invalid shards: data %d, parity %d", dataShards, parityShards)
+	}
+	if dataShards+parityShards > MaxShards {
+		return nil, fmt.Errorf("total shards %d exceeds %d", dataShards+parityShards, MaxShards)
+	}
+	// cauchy matrix: 1 / (x_i + y_j), where x_i = dataShards + i and y_j = j are all distinct
+	p := newMatrix(parityShards, dataShards)
+	for i := range p {
+		for j := range p[i] {
+			p[i][j] = gfInv(byte(dataShards+i) ^ byte(j))
+		}
+	}
+	return &rsCode{dataShards: dataShards, parityShards: parityShards, parity: p}, nil
+}
+
+// row returns the encoding matrix row of given shard index
+func (rs *rsCode) row(idx int) []byte {
+	if idx < rs.dataShards {
+		r := make([]byte, rs.dataShards)
+		r[idx] = 1
+		return r
+	}
+	return rs.parity[idx-rs.dataShards]
+}
+
+// encode computes parity shards from data shards. All shards must have the same size
+func (rs *rsCode) encode(data, parity [][]byte) error {
+	if len(data) != rs.dataShards || len(parity) != rs.parityShards {
+		return fmt.Errorf("expect %d data and %d parity shards, got %d and %d",
+			rs.dataShards, rs.parityShards, len(data), len(parity))
+	}
+	size := len(data[0])
+	for _, d := range data {
+		if len(d) != size {
+			return errShardSize
+		}
+	}
+	for i, p := range parity {
+		if len(p) != size {
+			return errShardSize
+		}
+		for k := range p {
+			p[k] = 0
+		}
+		for j, d := range data {
+			gfMulAdd(rs.parity[i][j], d, p)
+		}
+	}
+	return nil
+}
+
+// reconstruct recovers missing data shards in place. shards contains data shards followed by parity
+// shards, and missing ones are nil. Missing data shards are allocated, while missing parity shards are
+// left nil as they are not needed by caller
+func (rs *rsCode) reconstruct(shards [][]byte) error {
+	if len(shards) != rs.dataShards+rs.parityShards {
+		return fmt.Errorf("expect %d shards, got %d", rs.dataShards+rs.parityShards, len(shards))
+	}
+
+	size := -1
+	var present []int
+	missingData := false
+	for i, s := range shards {
+		if s == nil {
+			if i < rs.dataShards {
+				missingData = true
+			}
+			continue
+		}
+		if size < 0 {
+			size = len(s)
+		} else if len(s) != size {
+			return errShardSize
+		}
+		if len(present) < rs.dataShards {
+			present = append(present, i)
+		}
+	}
+	if !missingData {
+		return nil
+	}
+	if len(present) < rs.dataShards {
+		return ErrTooFewShards
+	}
+
+	sub := make(matrix, rs.dataShards)
+	for i, idx := range present {
+		sub[i] = rs.row(idx)
+	}
+	dec, err := sub.invert()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < rs.dataShards; i++ {
+		if shards[i] != nil {
+			continue
+		}
+		out := make([]byte, size)
+		for j, idx := range present {
+			gfMulAdd(dec[i][j], shards[idx], out)
+		}
+		shards[i] = out
+	}
+	return nil
+}
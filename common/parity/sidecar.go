@@ -0,0 +1,360 @@
+package parity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// sidecar file layout:
+//
+//	header: magic(4) | version(1) | block size(4) | data shards(2) | parity shards(2) | object size(8) |
+//	        sha256 of header fields
+//	group 0: sha256 of data and parity blocks | sha256 of header fields, group index(8) and block hashes |
+//	         parity blocks
+//	group 1: ...
+//
+// Object is split into blocks, the last one padded with zeros. Every dataShards blocks form one group
+// and parityShards parity blocks are computed for it. Blocks after end of object in the last group are
+// treated as zero blocks. Hashes locate damaged blocks, which are then reconstructed as erasures.
+const (
+	magic          = "LOMP"
+	version        = 1
+	fieldsLen      = len(magic) + 1 + 4 + 2 + 2 + 8
+	hashLen        = sha256.Size
+	headerLen      = fieldsLen + hashLen
+	maxBlkSize     = 1 << 30
+	groupIndexSize = 8
+)
+
+// DefaultBlockSize is the default size of one block
+const DefaultBlockSize = 1 << 20
+
+var ErrInvalidSidecar = errors.New("invalid parity file")
+
+// Options are parameters to generate parity
+type Options struct {
+	BlockSize    int
+	DataShards   int
+	ParityShards int
+}
+
+func (o Options) validate() error {
+	if o.BlockSize <= 0 || o.BlockSize > maxBlkSize {
+		return fmt.Errorf("invalid parity block size: %d", o.BlockSize)
+	}
+	_, err := newRSCode(o.DataShards, o.ParityShards)
+	return err
+}
+
+// Header is the header of one parity file
+type Header struct {
+	Options
+	Size int64
+}
+
+// Blocks returns total number of data blocks of the object
+func (h *Header) Blocks() int64 {
+	return (h.Size + int64(h.BlockSize) - 1) / int64(h.BlockSize)
+}
+
+// Groups returns total number of groups
+func (h *Header) Groups() int64 {
+	return (h.Blocks() + int64(h.DataShards) - 1) / int64(h.DataShards)
+}
+
+// hashesLen is the length of block hashes of one group, followed by their checksum
+func (h *Header) hashesLen() int64 {
+	return int64(h.DataShards+h.ParityShards+1) * hashLen
+}
+
+func (h *Header) groupLen() int64 {
+	return h.hashesLen() + int64(h.ParityShards)*int64(h.BlockSize)
+}
+
+// SidecarSize returns the size of the parity file
+func (h *Header) SidecarSize() int64 {
+	return int64(headerLen) + h.Groups()*h.groupLen()
+}
+
+func (h *Header) fields() []byte {
+	buf := make([]byte, fieldsLen)
+	copy(buf, magic)
+	buf[len(magic)] = version
+	off := len(magic) + 1
+	binary.BigEndian.PutUint32(buf[off:], uint32(h.BlockSize))
+	binary.BigEndian.PutUint16(buf[off+4:], uint16(h.DataShards))
+	binary.BigEndian.PutUint16(buf[off+6:], uint16(h.ParityShards))
+	binary.BigEndian.PutUint64(buf[off+8:], uint64(h.Size))
+	return buf
+}
+
+func (h *Header) marshal() []byte {
+	buf := h.fields()
+	sum := sha256.Sum256(buf)
+	return append(buf, sum[:]...)
+}
+
+// hashesSum returns checksum of block hashes of one group, which binds them to header and group index
+func (h *Header) hashesSum(group int64, hashes []byte) []byte {
+	d := sha256.New()
+	d.Write(h.fields())
+	var idx [groupIndexSize]byte
+	binary.BigEndian.PutUint64(idx[:], uint64(group))
+	d.Write(idx[:])
+	d.Write(hashes)
+	return d.Sum(nil)
+}
+
+// ReadHeader reads and validates the header of one parity file
+func ReadHeader(sidecar io.ReaderAt) (*Header, error) {
+	buf := make([]byte, headerLen)
+	n, err := sidecar.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n < fieldsLen || string(buf[:len(magic)]) != magic {
+		return nil, ErrInvalidSidecar
+	}
+	if buf[len(magic)] != version {
+		return nil, fmt.Errorf("unsupported parity file version %d", buf[len(magic)])
+	}
+	sum := sha256.Sum256(buf[:fieldsLen])
+	if n < headerLen || !bytes.Equal(sum[:], buf[fieldsLen:]) {
+		return nil, ErrInvalidSidecar
+	}
+	off := len(magic) + 1
+	h := &Header{
+		Options: Options{
+			BlockSize:    int(binary.BigEndian.Uint32(buf[off:])),
+			DataShards:   int(binary.BigEndian.Uint16(buf[off+4:])),
+			ParityShards: int(binary.BigEndian.Uint16(buf[off+6:])),
+		},
+		Size: int64(binary.BigEndian.Uint64(buf[off+8:])),
+	}
+	if err = h.validate(); err != nil || h.Size < 0 {
+		return nil, ErrInvalidSidecar
+	}
+	return h, nil
+}
+
+// Generate reads size bytes of object from r, and writes its parity file into w
+func Generate(w io.Writer, r io.Reader, size int64, opts Options) error {
+	err := opts.validate()
+	if err != nil {
+		return err
+	}
+	rs, err := newRSCode(opts.DataShards, opts.ParityShards)
+	if err != nil {
+		return err
+	}
+	h := &Header{Options: opts, Size: size}
+	_, err = w.Write(h.marshal())
+	if err != nil {
+		return err
+	}
+
+	data := newMatrix(opts.DataShards, opts.BlockSize)
+	parity := newMatrix(opts.ParityShards, opts.BlockSize)
+	hashes := make([]byte, 0, h.hashesLen())
+	remaining := size
+	for g := int64(0); g < h.Groups(); g++ {
+		hashes = hashes[:0]
+		for _, d := range data {
+			n := int64(len(d))
+			if remaining < n {
+				n = remaining
+			}
+			_, err = io.ReadFull(r, d[:n])
+			if err != nil {
+				return err
+			}
+			clear(d[n:])
+			remaining -= n
+
+			sum := sha256.Sum256(d)
+			hashes = append(hashes, sum[:]...)
+		}
+		err = rs.encode(data, parity)
+		if err != nil {
+			return err
+		}
+		for _, p := range parity {
+			sum := sha256.Sum256(p)
+			hashes = append(hashes, sum[:]...)
+		}
+		hashes = append(hashes, h.hashesSum(g, hashes)...)
+
+		_, err = w.Write(hashes)
+		if err != nil {
+			return err
+		}
+		for _, p := range parity {
+			_, err = w.Write(p)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Report is the result of verify or repair
+type Report struct {
+	Blocks int64
+	// index of damaged data blocks
+	Damaged []int64
+	// number of damaged parity blocks
+	ParityDamaged int64
+	// groups whose block hashes are damaged in parity file, so that their blocks are unable to be verified
+	HashesDamaged []int64
+	Repaired      int64
+	// index of damaged data blocks which are unable to be repaired
+	Unrepairable []int64
+}
+
+// OK returns true if all data blocks are intact or repaired
+func (r *Report) OK() bool {
+	return len(r.Unrepairable) == 0 && int64(len(r.Damaged)) == r.Repaired
+}
+
+// Verify checks object in f against its parity file, without modifying f. Report.Repaired is the number
+// of damaged blocks which are able to be repaired
+func Verify(f io.ReaderAt, sidecar io.ReaderAt) (*Report, error) {
+	return check(f, nil, sidecar)
+}
+
+// Repair checks object in f against its parity file, and writes reconstructed blocks back into f.
+// Caller need truncate f to Header.Size if f is longer than the original object
+func Repair(f ReadWriterAt, sidecar io.ReaderAt) (*Report, error) {
+	return check(f, f, sidecar)
+}
+
+// ReadWriterAt is the interface to repair one file in place, e.g. *os.File
+type ReadWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+func check(r io.ReaderAt, w io.WriterAt, sidecar io.ReaderAt) (*Report, error) {
+	h, err := ReadHeader(sidecar)
+	if err != nil {
+		return nil, err
+	}
+	rs, err := newRSCode(h.DataShards, h.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{Blocks: h.Blocks()}
+	totalShards := h.DataShards + h.ParityShards
+	hashes := make([]byte, h.hashesLen())
+	shards := make([][]byte, totalShards)
+	bufs := newMatrix(totalShards, h.BlockSize)
+	for g := int64(0); g < h.Groups(); g++ {
+		groupOff := int64(headerLen) + g*h.groupLen()
+		_, err = sidecar.ReadAt(hashes, groupOff)
+		if err != nil {
+			return nil, errors.Join(ErrInvalidSidecar, err)
+		}
+		// intact blocks would be reported as damaged by damaged hashes
+		if !bytes.Equal(h.hashesSum(g, hashes[:totalShards*hashLen]), hashes[totalShards*hashLen:]) {
+			report.HashesDamaged = append(report.HashesDamaged, g)
+			continue
+		}
+
+		var damaged []int
+		for i := 0; i < h.DataShards; i++ {
+			blk := g*int64(h.DataShards) + int64(i)
+			off := blk * int64(h.BlockSize)
+			n := int64(h.BlockSize)
+			if off+n > h.Size {
+				n = h.Size - off
+			}
+			buf := bufs[i]
+			clear(buf)
+			if n > 0 {
+				// short read is treated as damage, which is detected by hash
+				_, err = r.ReadAt(buf[:n], off)
+				if err != nil && err != io.EOF {
+					return nil, err
+				}
+			}
+			if !hashEqual(buf, hashes[i*hashLen:]) {
+				damaged = append(damaged, i)
+				shards[i] = nil
+				if n > 0 {
+					report.Damaged = append(report.Damaged, blk)
+				}
+				continue
+			}
+			shards[i] = buf
+		}
+		if len(damaged) == 0 {
+			continue
+		}
+
+		for i := 0; i < h.ParityShards; i++ {
+			idx := h.DataShards + i
+			buf := bufs[idx]
+			_, err = sidecar.ReadAt(buf, groupOff+h.hashesLen()+int64(i*h.BlockSize))
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			if err == io.EOF || !hashEqual(buf, hashes[idx*hashLen:]) {
+				report.ParityDamaged++
+				shards[idx] = nil
+				continue
+			}
+			shards[idx] = buf
+		}
+
+		err = rs.reconstruct(shards)
+		if err != nil {
+			if err != ErrTooFewShards {
+				return nil, err
+			}
+			for _, i := range damaged {
+				blk := g*int64(h.DataShards) + int64(i)
+				if blk < report.Blocks {
+					report.Unrepairable = append(report.Unrepairable, blk)
+				}
+			}
+			continue
+		}
+
+		for _, i := range damaged {
+			blk := g*int64(h.DataShards) + int64(i)
+			if blk >= report.Blocks {
+				// zero padding block is damaged, which means parity file is corrupted
+				continue
+			}
+			if !hashEqual(shards[i], hashes[i*hashLen:]) {
+				report.Unrepairable = append(report.Unrepairable, blk)
+				continue
+			}
+			report.Repaired++
+			if w == nil {
+				continue
+			}
+			off := blk * int64(h.BlockSize)
+			n := int64(h.BlockSize)
+			if off+n > h.Size {
+				n = h.Size - off
+			}
+			_, err = w.WriteAt(shards[i][:n], off)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return report, nil
+}
+
+func hashEqual(data, expect []byte) bool {
+	sum := sha256.Sum256(data)
+	return bytes.Equal(sum[:], expect[:hashLen])
+}
@@ -0,0 +1,233 @@
+package progress
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Event is one snapshot of a long running task, like scan, iso creation or upload
+type Event struct {
+	Task string
+	// bytes processed, including skipped ones
+	Done int64
+	// total bytes, 0 if unknown
+	Total int64
+	// bytes per second since the task started, skipped bytes excluded
+	Rate float64
+	// estimated time left, -1 if unknown
+	ETA     time.Duration
+	Elapsed time.Duration
+	// true for the last event of the task, which is reported even if the task fails
+	Finished bool
+}
+
+// Percent returns done percentage, -1 if total is unknown
+func (e Event) Percent() float64 {
+	if e.Total <= 0 {
+		return -1
+	}
+	return float64(e.Done) * 100 / float64(e.Total)
+}
+
+// Reporter receives events of all tasks. Events of one task are delivered in order, and Report shouldn't
+// block for long as it is called in the goroutine processing data
+type Reporter interface {
+	Report(e Event)
+}
+
+// ReporterFunc adapts one function to Reporter
+type ReporterFunc func(e Event)
+
+func (f ReporterFunc) Report(e Event) {
+	f(e)
+}
+
+// DefaultInterval is the min interval between two events of one task, except the final one
+const DefaultInterval = 500 * time.Millisecond
+
+// Tracker counts processed bytes of one task and reports to Reporter. All methods are safe for
+// concurrent use, and are no-op on nil tracker so that callers don't need check whether progress is on
+type Tracker struct {
+	reporter Reporter
+	task     string
+	interval time.Duration
+	now      func() time.Time
+
+	mu       sync.Mutex
+	total    int64
+	done     int64
+	skipped  int64
+	start    time.Time
+	last     time.Time
+	finished bool
+}
+
+// NewTracker returns nil if reporter is nil. total is 0 if unknown
+func NewTracker(reporter Reporter, task string, total int64) *Tracker {
+	if reporter == nil {
+		return nil
+	}
+	t := &Tracker{reporter: reporter, task: task, total: total, interval: DefaultInterval, now: time.Now}
+	t.start = t.now()
+	return t
+}
+
+func (t *Tracker) event(now time.Time) Event {
+	e := Event{
+		Task:     t.task,
+		Done:     t.done,
+		Total:    t.total,
+		ETA:      -1,
+		Elapsed:  now.Sub(t.start),
+		Finished: t.finished,
+	}
+	if sec := e.Elapsed.Seconds(); sec > 0 {
+		e.Rate = float64(t.done-t.skipped) / sec
+	}
+	if t.finished {
+		e.ETA = 0
+	} else if e.Rate > 0 && t.total > 0 {
+		e.ETA = time.Duration(float64(max(t.total-t.done, 0)) / e.Rate * float64(time.Second))
+	}
+	return e
+}
+
+func (t *Tracker) update(fn func()) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.finished {
+		return
+	}
+	fn()
+	now := t.now()
+	if !t.finished && now.Sub(t.last) < t.interval {
+		return
+	}
+	t.last = now
+	t.reporter.Report(t.event(now))
+}
+
+// Add counts n bytes processed. n is negative if processed data is discarded, e.g. failed upload
+func (t *Tracker) Add(n int64) {
+	t.update(func() { t.done += n })
+}
+
+// Skip counts n bytes done without processing, e.g. parts uploaded in previous run, which doesn't
+// count in rate
+func (t *Tracker) Skip(n int64) {
+	t.update(func() {
+		t.done += n
+		t.skipped += n
+	})
+}
+
+// AddTotal changes total by n, for task whose total is known gradually
+func (t *Tracker) AddTotal(n int64) {
+	t.update(func() { t.total += n })
+}
+
+// Finish reports the final event. Following calls are ignored
+func (t *Tracker) Finish() {
+	t.update(func() { t.finished = true })
+}
+
+type reader struct {
+	r io.Reader
+	t *Tracker
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.t.Add(int64(n))
+	return n, err
+}
+
+// NewReader counts bytes read from r, and returns r if tracker is nil. It is for local processing like
+// hashing or copying. Network uploads are counted by Transport instead, because cloud SDK reads body
+// several times to calculate checksums before sending
+func NewReader(r io.Reader, t *Tracker) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &reader{r: r, t: t}
+}
+
+type trackerKey struct{}
+
+// WithTracker returns context whose requests' bodies are counted by Transport into t
+func WithTracker(ctx context.Context, t *Tracker) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, trackerKey{}, t)
+}
+
+// FromContext returns tracker set by WithTracker, nil if none. It is for uploads not over http, e.g.
+// to local directory
+func FromContext(ctx context.Context) *Tracker {
+	t, _ := ctx.Value(trackerKey{}).(*Tracker)
+	return t
+}
+
+// body counts bytes sent until the request fails
+type body struct {
+	io.ReadCloser
+	t *Tracker
+
+	mu        sync.Mutex
+	n         int64
+	discarded bool
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	if !b.discarded {
+		b.n += int64(n)
+		b.t.Add(int64(n))
+	}
+	b.mu.Unlock()
+	return n, err
+}
+
+func (b *body) discard() {
+	b.mu.Lock()
+	b.discarded = true
+	b.t.Add(-b.n)
+	b.mu.Unlock()
+}
+
+// Transport counts request bodies sent into tracker of request context. Bytes of request failed or
+// replied with error status are taken back, as they will be sent again if it is retried
+type Transport struct {
+	Base http.RoundTripper
+}
+
+func NewTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &Transport{Base: base}
+}
+
+func (tr *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t := FromContext(req.Context())
+	if t == nil || req.Body == nil || req.Body == http.NoBody {
+		return tr.Base.RoundTrip(req)
+	}
+	b := &body{ReadCloser: req.Body, t: t}
+	r := req.Clone(req.Context())
+	r.Body = b
+	resp, err := tr.Base.RoundTrip(r)
+	// 308 is not failure, as google drive replies it to each chunk of resumable upload
+	if err != nil || resp.StatusCode >= http.StatusBadRequest {
+		b.discard()
+	}
+	return resp, err
+}
@@ -0,0 +1,167 @@
+package progress
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type recorder struct {
+	events []Event
+}
+
+func (r *recorder) Report(e Event) {
+	r.events = append(r.events, e)
+}
+
+func (r *recorder) last() Event {
+	return r.events[len(r.events)-1]
+}
+
+func newTestTracker(total int64) (*Tracker, *recorder, *time.Time) {
+	r := &recorder{}
+	t := NewTracker(r, "test", total)
+	now := t.start
+	t.now = func() time.Time { return now }
+	return t, r, &now
+}
+
+func TestTracker(t *testing.T) {
+	require.Nil(t, NewTracker(nil, "test", 100))
+	// nil tracker is no-op
+	var nilTracker *Tracker
+	nilTracker.Add(1)
+	nilTracker.Finish()
+
+	tracker, r, now := newTestTracker(1000)
+	tracker.Skip(400)
+	require.Len(t, r.events, 1)
+	require.EqualValues(t, 400, r.last().Done)
+
+	// throttled within interval
+	tracker.Add(100)
+	require.Len(t, r.events, 1)
+
+	// skipped bytes are not in rate
+	*now = now.Add(2 * time.Second)
+	tracker.Add(100)
+	require.Len(t, r.events, 2)
+	e := r.last()
+	require.EqualValues(t, 600, e.Done)
+	require.EqualValues(t, 1000, e.Total)
+	require.Equal(t, 100.0, e.Rate)
+	require.Equal(t, 4*time.Second, e.ETA)
+	require.Equal(t, 60.0, e.Percent())
+
+	// bytes of failed upload are taken back
+	*now = now.Add(time.Second)
+	tracker.Add(-100)
+	require.EqualValues(t, 500, r.last().Done)
+
+	tracker.AddTotal(-500)
+	tracker.Finish()
+	e = r.last()
+	require.True(t, e.Finished)
+	require.EqualValues(t, 500, e.Total)
+	require.Equal(t, time.Duration(0), e.ETA)
+	require.Equal(t, 3*time.Second, e.Elapsed)
+
+	// no event after finish
+	n := len(r.events)
+	tracker.Add(1)
+	tracker.Finish()
+	require.Len(t, r.events, n)
+}
+
+func TestUnknownTotal(t *testing.T) {
+	tracker, r, now := newTestTracker(0)
+	*now = now.Add(time.Second)
+	tracker.Add(10)
+	e := r.last()
+	require.Equal(t, -1.0, e.Percent())
+	require.Equal(t, time.Duration(-1), e.ETA)
+	require.Equal(t, "test  10 B  10 B/s", Format(e))
+}
+
+func TestReader(t *testing.T) {
+	tracker, r, _ := newTestTracker(0)
+	data := bytes.Repeat([]byte("lomorage"), 1000)
+	n, err := io.Copy(io.Discard, NewReader(bytes.NewReader(data), tracker))
+	require.Nil(t, err)
+	tracker.Finish()
+	require.EqualValues(t, len(data), n)
+	require.EqualValues(t, len(data), r.last().Done)
+}
+
+func TestTransport(t *testing.T) {
+	status := http.StatusInternalServerError
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(status)
+	}))
+	defer s.Close()
+
+	client := &http.Client{Transport: NewTransport(nil)}
+	tracker, r, _ := newTestTracker(0)
+	ctx := WithTracker(context.Background(), tracker)
+	data := strings.Repeat("lomorage", 1000)
+	post := func() {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.URL, strings.NewReader(data))
+		require.Nil(t, err)
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+	}
+
+	// failed request is not counted
+	post()
+	status = http.StatusPermanentRedirect
+	post()
+	status = http.StatusOK
+	post()
+
+	tracker.Finish()
+	require.EqualValues(t, 2*len(data), r.last().Done)
+}
+
+func TestLogger(t *testing.T) {
+	l := NewLogger(10 * time.Second)
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	var buf bytes.Buffer
+	count := 0
+	l.log = func(e Event) {
+		count++
+		buf.WriteString(e.Task + "\n")
+	}
+
+	l.Report(Event{Task: "a", Done: 1})
+	l.Report(Event{Task: "a", Done: 2})
+	l.Report(Event{Task: "b", Done: 1})
+	require.Equal(t, 2, count)
+
+	now = now.Add(10 * time.Second)
+	l.Report(Event{Task: "a", Done: 3})
+	// final event is always logged
+	l.Report(Event{Task: "a", Done: 4, Finished: true})
+	require.Equal(t, 4, count)
+	require.Equal(t, "a\nb\na\na\n", buf.String())
+}
+
+func TestTerminal(t *testing.T) {
+	var buf bytes.Buffer
+	term := NewTerminal(&buf)
+	term.Report(Event{Task: "upload", Done: 500, Total: 1000, Rate: 100, ETA: 5 * time.Second})
+	term.Report(Event{Task: "upload", Done: 1000, Total: 1000, Rate: 100, Elapsed: 10 * time.Second,
+		Finished: true})
+	require.Equal(t, "\rupload   50.0%  500 B/1.0 KB  100 B/s  ETA 5s\033[K"+
+		"\rupload  100.0%  1.0 KB/1.0 KB  100 B/s  in 10s\033[K\n", buf.String())
+}
@@ -0,0 +1,101 @@
+package progress
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lomorage/lomo-backup/common/datasize"
+	"github.com/sirupsen/logrus"
+)
+
+// Format returns one line summary of event, like "upload a.iso  45.2%  1.2 GB/2.6 GB  12.3 MB/s  ETA 2m3s"
+func Format(e Event) string {
+	items := []string{e.Task}
+	if p := e.Percent(); p >= 0 {
+		items = append(items, fmt.Sprintf("%5.1f%%", p),
+			datasize.ByteSize(max(e.Done, 0)).HR()+"/"+datasize.ByteSize(e.Total).HR())
+	} else {
+		items = append(items, datasize.ByteSize(max(e.Done, 0)).HR())
+	}
+	items = append(items, datasize.ByteSize(int64(e.Rate)).HR()+"/s")
+	switch {
+	case e.Finished:
+		items = append(items, "in "+e.Elapsed.Round(time.Second).String())
+	case e.ETA >= 0:
+		items = append(items, "ETA "+e.ETA.Round(time.Second).String())
+	}
+	return strings.Join(items, "  ")
+}
+
+// Terminal redraws progress of the running task in one line, and keeps the final line of each task
+type Terminal struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewTerminal(w io.Writer) *Terminal {
+	return &Terminal{w: w}
+}
+
+func (r *Terminal) Report(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// clear the rest of previous line which may be longer
+	fmt.Fprintf(r.w, "\r%s\033[K", Format(e))
+	if e.Finished {
+		fmt.Fprintln(r.w)
+	}
+}
+
+// Logger logs progress of each task as structured log line every interval, for output which is not terminal
+type Logger struct {
+	interval time.Duration
+	now      func() time.Time
+	log      func(e Event)
+
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+func NewLogger(interval time.Duration) *Logger {
+	return &Logger{interval: interval, now: time.Now, log: logEvent, last: map[string]time.Time{}}
+}
+
+func (l *Logger) Report(e Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	last, ok := l.last[e.Task]
+	if e.Finished {
+		delete(l.last, e.Task)
+	} else if ok && now.Sub(last) < l.interval {
+		return
+	} else {
+		l.last[e.Task] = now
+	}
+	l.log(e)
+}
+
+func logEvent(e Event) {
+	fields := logrus.Fields{
+		"task":    e.Task,
+		"done":    e.Done,
+		"rate":    int64(e.Rate),
+		"elapsed": e.Elapsed.Round(time.Second).String(),
+	}
+	if e.Total > 0 {
+		fields["total"] = e.Total
+		fields["percent"] = fmt.Sprintf("%.1f", e.Percent())
+	}
+	if e.ETA >= 0 && !e.Finished {
+		fields["eta"] = e.ETA.Round(time.Second).String()
+	}
+	msg := "Progress"
+	if e.Finished {
+		msg = "Finished"
+	}
+	logrus.WithFields(fields).Info(msg)
+}
@@ -0,0 +1,224 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// Class is the category of one failed cloud call
+type Class int
+
+const (
+	// Permanent errors are not retried, e.g. not found or invalid request
+	Permanent Class = iota
+	Throttling
+	ServerError
+	Network
+	// Auth errors are not retried as waiting won't fix credentials or clock skew
+	Auth
+)
+
+func (c Class) String() string {
+	switch c {
+	case Throttling:
+		return "throttling"
+	case ServerError:
+		return "server"
+	case Network:
+		return "network"
+	case Auth:
+		return "auth"
+	}
+	return "permanent"
+}
+
+func (c Class) Retryable() bool {
+	return c == Throttling || c == ServerError || c == Network
+}
+
+// Policy limits retries of one call. Delay before the nth retry is BaseDelay*2^(n-1) with jitter,
+// and never exceeds MaxDelay
+type Policy struct {
+	// number of retries after the first attempt, 0 disables retry
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+}
+
+var DefaultPolicy = Policy{MaxRetries: 5, BaseDelay: time.Second, MaxDelay: 30 * time.Second}
+
+// Backoff returns delay before the nth retry, which starts from 1. Half of the delay is random so that
+// parallel workers failed at the same time won't retry at the same time again
+func (p Policy) Backoff(n int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < n && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	d = min(d, p.MaxDelay)
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+var (
+	throttlingCodes = map[string]struct{}{
+		"Throttling":                             {},
+		"ThrottlingException":                    {},
+		"ThrottledException":                     {},
+		"RequestThrottled":                       {},
+		"RequestThrottledException":              {},
+		"TooManyRequestsException":               {},
+		"ProvisionedThroughputExceededException": {},
+		"RequestLimitExceeded":                   {},
+		"SlowDown":                               {},
+	}
+	authCodes = map[string]struct{}{
+		"AccessDenied":          {},
+		"ExpiredToken":          {},
+		"ExpiredTokenException": {},
+		"InvalidAccessKeyId":    {},
+		"InvalidClientTokenId":  {},
+		"InvalidToken":          {},
+		"RequestTimeTooSkewed":  {},
+		"SignatureDoesNotMatch": {},
+	}
+	googleThrottlingReasons = map[string]struct{}{
+		"rateLimitExceeded":     {},
+		"userRateLimitExceeded": {},
+	}
+)
+
+func classifyStatus(code int) Class {
+	switch {
+	case code == http.StatusTooManyRequests:
+		return Throttling
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return Auth
+	case code == http.StatusRequestTimeout:
+		return Network
+	case code >= http.StatusInternalServerError:
+		return ServerError
+	}
+	return Permanent
+}
+
+func classifyAWS(aerr awserr.Error) Class {
+	code := aerr.Code()
+	if _, ok := throttlingCodes[code]; ok {
+		return Throttling
+	}
+	if _, ok := authCodes[code]; ok {
+		return Auth
+	}
+	switch code {
+	case request.ErrCodeRequestError, request.ErrCodeRead:
+		// connection failures are wrapped by SDK, while invalid endpoint is permanent
+		if aerr.OrigErr() == nil {
+			return Network
+		}
+		return Classify(aerr.OrigErr())
+	case request.ErrCodeResponseTimeout, "RequestTimeout":
+		return Network
+	case "InternalError", "ServiceUnavailable":
+		return ServerError
+	}
+	if rf, ok := aerr.(awserr.RequestFailure); ok {
+		return classifyStatus(rf.StatusCode())
+	}
+	return Permanent
+}
+
+// Classify returns class of error returned by AWS or Google API, or by the underlying connection
+func Classify(err error) Class {
+	if err == nil {
+		return Permanent
+	}
+
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		return classifyAWS(aerr)
+	}
+
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		if gerr.Code == http.StatusForbidden {
+			for _, e := range gerr.Errors {
+				if _, ok := googleThrottlingReasons[e.Reason]; ok {
+					return Throttling
+				}
+			}
+		}
+		return classifyStatus(gerr.Code)
+	}
+
+	var rerr *oauth2.RetrieveError
+	if errors.As(err, &rerr) {
+		if rerr.Response != nil && rerr.Response.StatusCode >= http.StatusInternalServerError {
+			return ServerError
+		}
+		return Auth
+	}
+
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) {
+		return Network
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return Network
+	}
+	// connection is closed by peer before response
+	var uerr *url.Error
+	if errors.As(err, &uerr) && errors.Is(uerr.Err, io.EOF) {
+		return Network
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return Network
+	}
+	return Permanent
+}
+
+// Do calls fn until it succeeds, returns one error not retryable, or retries are used up. Error from
+// the last call is returned as it is, so that caller is able to check its type
+func Do(ctx context.Context, p Policy, desc string, fn func() error) error {
+	for n := 1; ; n++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		c := Classify(err)
+		if !c.Retryable() || n > p.MaxRetries {
+			if n > 1 {
+				logrus.Warnf("%s failed after %d retries: %s", desc, n-1, err)
+			}
+			return err
+		}
+
+		d := p.Backoff(n)
+		logrus.Warnf("%s failed with %s error, #%d retry in %s: %s", desc, c, n, d, err)
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+func TestClassify(t *testing.T) {
+	awsFailure := func(code string, status int) error {
+		return awserr.NewRequestFailure(awserr.New(code, "message", nil), status, "id")
+	}
+	connReset := &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+
+	for _, c := range []struct {
+		err   error
+		class Class
+	}{
+		{nil, Permanent},
+		{errors.New("unknown"), Permanent},
+		{awsFailure("SlowDown", http.StatusServiceUnavailable), Throttling},
+		{awsFailure("ThrottlingException", http.StatusBadRequest), Throttling},
+		{awsFailure("Unknown", http.StatusTooManyRequests), Throttling},
+		{awsFailure("InternalError", http.StatusInternalServerError), ServerError},
+		{awsFailure("Unknown", http.StatusBadGateway), ServerError},
+		{awsFailure("InvalidAccessKeyId", http.StatusForbidden), Auth},
+		{awsFailure("RequestTimeTooSkewed", http.StatusForbidden), Auth},
+		{awsFailure("Unknown", http.StatusUnauthorized), Auth},
+		{awsFailure("NotFound", http.StatusNotFound), Permanent},
+		{awsFailure("InvalidPart", http.StatusBadRequest), Permanent},
+		{awserr.New(request.ErrCodeRequestError, "send request failed",
+			&url.Error{Op: "Put", URL: "http://s3", Err: connReset}), Network},
+		{awserr.New(request.ErrCodeRequestError, "send request failed",
+			&url.Error{Op: "Put", URL: "http://s3", Err: io.EOF}), Network},
+		{awserr.New(request.ErrCodeRequestError, "send request failed",
+			&url.Error{Op: "Put", URL: "s4://s3", Err: errors.New("unsupported protocol scheme")}), Permanent},
+		{awserr.New(request.ErrCodeResponseTimeout, "timeout", nil), Network},
+		{&googleapi.Error{Code: http.StatusTooManyRequests}, Throttling},
+		{&googleapi.Error{Code: http.StatusForbidden,
+			Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}}}, Throttling},
+		{&googleapi.Error{Code: http.StatusForbidden,
+			Errors: []googleapi.ErrorItem{{Reason: "insufficientPermissions"}}}, Auth},
+		{&googleapi.Error{Code: http.StatusServiceUnavailable}, ServerError},
+		{&googleapi.Error{Code: http.StatusNotFound}, Permanent},
+		{fmt.Errorf("refresh token: %w", &oauth2.RetrieveError{Response: &http.Response{StatusCode: 400}}), Auth},
+		{connReset, Network},
+		{fmt.Errorf("wrapped: %w", syscall.ECONNRESET), Network},
+		{io.ErrUnexpectedEOF, Network},
+	} {
+		require.Equal(t, c.class, Classify(c.err), "%v", c.err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := Policy{MaxRetries: 100, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for n := 1; n <= 100; n++ {
+		expect := p.MaxDelay
+		if n <= 4 {
+			expect = p.BaseDelay << (n - 1)
+		}
+		for i := 0; i < 10; i++ {
+			d := p.Backoff(n)
+			require.GreaterOrEqual(t, d, expect/2, "retry %d", n)
+			require.LessOrEqual(t, d, expect, "retry %d", n)
+		}
+	}
+	require.Equal(t, time.Duration(0), Policy{}.Backoff(1))
+}
+
+func TestDo(t *testing.T) {
+	p := Policy{MaxRetries: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+	serverErr := &googleapi.Error{Code: http.StatusInternalServerError}
+
+	// succeed after retries
+	calls := 0
+	err := Do(context.Background(), p, "test", func() error {
+		calls++
+		if calls < 3 {
+			return serverErr
+		}
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, 3, calls)
+
+	// retries are used up, and the last error is returned as it is
+	calls = 0
+	err = Do(context.Background(), p, "test", func() error {
+		calls++
+		return serverErr
+	})
+	require.Equal(t, serverErr, err)
+	require.Equal(t, p.MaxRetries+1, calls)
+
+	// not retryable
+	for _, e := range []error{errors.New("permanent"), &googleapi.Error{Code: http.StatusUnauthorized}} {
+		calls = 0
+		err = Do(context.Background(), p, "test", func() error {
+			calls++
+			return e
+		})
+		require.Equal(t, e, err)
+		require.Equal(t, 1, calls)
+	}
+
+	// canceled while waiting for retry
+	ctx, cancel := context.WithCancel(context.Background())
+	calls = 0
+	err = Do(ctx, Policy{MaxRetries: 3, BaseDelay: time.Hour, MaxDelay: time.Hour}, "test", func() error {
+		calls++
+		cancel()
+		return serverErr
+	})
+	require.Equal(t, serverErr, err)
+	require.Equal(t, 1, calls)
+}
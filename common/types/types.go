@@ -3,17 +3,34 @@ package types
 import (
 	"time"
 
+	"github.com/lomorage/lomo-backup/common/compress"
 	"github.com/lomorage/lomo-backup/common/hash"
 )
 
 // IsoIDCloud is to flag the file is uploaded into cloud and not packed in ISO yet
 const IsoIDCloud = -1
 
+// metadata saved with uploaded files and objects. Hashes are hex encoded sha256
 const (
 	MetadataKeyHashOrig    = "hash_orig"
 	MetadataKeyHashEncrypt = "hash_enc"
+	// part size of multipart object, which is needed to verify its checksum
+	MetadataKeyPartSize      = "part_size"
+	MetadataKeyFormatVersion = "format_version"
+	MetadataKeyLomobVersion  = "lomob_version"
+	// type of object, which is always saved as object tag too so that lifecycle rules can filter on it
+	MetadataKeyObjectType = "object_type"
+	// codec of compression before encryption, which is absent if object isn't compressed
+	MetadataKeyCodec = "codec"
 )
 
+// ObjectTypeISO is the object type of isos, while their metadata and parity files have no object type
+const ObjectTypeISO = "iso"
+
+// FormatVersion is the version of how objects are compressed and encrypted, and is increased once it is
+// changed incompatibly
+const FormatVersion = "1"
+
 type IsoStatus int
 
 const (
@@ -55,6 +72,45 @@ func (p PartStatus) String() string {
 	return "Unknown"
 }
 
+type RestoreStatus int
+
+const (
+	// restore of archived object is requested, and it is downloaded once restored
+	RestoreRequested RestoreStatus = iota
+	RestoreDownloaded
+)
+
+func (s RestoreStatus) String() string {
+	switch s {
+	case RestoreRequested:
+		return "Requested"
+	case RestoreDownloaded:
+		return "Downloaded"
+	}
+	return "Unknown"
+}
+
+type CopyStatus int
+
+const (
+	CopyUploading CopyStatus = iota
+	CopyUploaded
+	// copy is not found, or different from the one uploaded when verified
+	CopyBroken
+)
+
+func (s CopyStatus) String() string {
+	switch s {
+	case CopyUploading:
+		return "Uploading"
+	case CopyUploaded:
+		return "Uploaded"
+	case CopyBroken:
+		return "Broken"
+	}
+	return "Unknown"
+}
+
 // DirInfo is structure for directory
 type DirInfo struct {
 	ID            int
@@ -100,7 +156,16 @@ type ISOInfo struct {
 	HashRemote string
 	Size       int
 	Status     IsoStatus
+	Codec      compress.Codec
 	CreateTime time.Time
+	// object lock mode of uploaded iso, empty if not locked
+	RetentionMode string
+	RetainUntil   time.Time
+	// storage class of uploaded iso and when it is uploaded or transitioned into it, empty if unknown
+	StorageClass string
+	ClassTime    time.Time
+	// user metadata of remote object returned by HeadObject, with lower case keys
+	Metadata map[string]string
 }
 
 func (ii *ISOInfo) SetHashLocal(data []byte) {
@@ -130,3 +195,45 @@ func (pi *PartInfo) SetHashLocal(data []byte) {
 func (pi *PartInfo) SetHashRemote(data []byte) {
 	pi.HashRemote = hash.CalculateHashBase64(data)
 }
+
+// ArchiveCopy is one copy of iso in one bucket. Each copy is uploaded and verified on its own
+type ArchiveCopy struct {
+	ID      int
+	IsoID   int
+	IsoName string
+	// name of destination in destinations config, empty for copies uploaded by upload iso
+	Destination  string
+	Region       string
+	Bucket       string
+	StorageClass string
+	Status       CopyStatus
+	HashRemote   string
+	UploadKey    string
+	UploadID     string
+	// object lock mode of the copy, empty if not locked
+	RetentionMode string
+	RetainUntil   time.Time
+	// last time the copy is verified by upload or replicate, zero if never
+	VerifyTime time.Time
+	CreateTime time.Time
+}
+
+// RestoreInfo is one pending or finished restore of archived object
+type RestoreInfo struct {
+	ID     int
+	Name   string
+	Region string
+	Bucket string
+	// retrieval tier: Bulk, Standard or Expedited
+	Tier string
+	// days to keep restored copy
+	Days int
+	// file the object is downloaded into
+	Output string
+	// download object as it is without decryption
+	Raw    bool
+	Status RestoreStatus
+	// when restored copy expires, zero if it isn't restored yet
+	ExpiryTime time.Time
+	CreateTime time.Time
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"runtime/debug"
 	"slices"
 	"strings"
 	"time"
@@ -93,5 +94,47 @@ func KeepTime(src, dst string, l bool) error {
 			src,
 		)
 	}
-	return os.Chtimes(dst, ts.AccessTime(), ts.ModTime())
+	return SetTime(dst, ts.AccessTime(), ts.ModTime(), false)
+}
+
+// SetTime changes access time and mod time of dst, which is used when original file is not available,
+// e.g. when file is extracted from ISO
+func SetTime(dst string, atime, mtime time.Time, l bool) error {
+	if l {
+		logrus.Debugf("Set %s access time %s, mod time %s", dst,
+			FormatTimeDateOnly(atime),
+			FormatTimeDateOnly(mtime),
+		)
+	}
+	return os.Chtimes(dst, atime, mtime)
+}
+
+// Version returns module version of lomob, or vcs revision if it is built from source tree
+func Version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	revision, modified := "", false
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			modified = s.Value == "true"
+		}
+	}
+	if revision == "" {
+		return "devel"
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if modified {
+		revision += "-dirty"
+	}
+	return revision
 }
@@ -2,7 +2,7 @@
 
 set -ex
 
-rm -f lomob.db; sqlite3 ./lomob.db < ../../common/dbx/schema/1.sql
+rm -f lomob.db; cat $(ls ../../common/dbx/schema/*.sql | sort -V) | sqlite3 ./lomob.db
 
 # test scan
 ./test-scan.sh
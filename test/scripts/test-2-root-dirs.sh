@@ -6,7 +6,7 @@ expectTotalDirs=22
 expectTotalFiles=118
 
 rm ./lomob.db *.iso
-sqlite3 ./lomob.db < ../../common/dbx/schema/1.sql
+cat $(ls ../../common/dbx/schema/*.sql | sort -V) | sqlite3 ./lomob.db
 
 echo "scan data/content"
 lomob scan -t 1 ../data/content
@@ -14,7 +14,7 @@ cd ../scripts
 for i in 10 5 1; do
   echo "scan directory with $i threads"
   rm ./lomob.db
-  sqlite3 ./lomob.db < ../../common/dbx/schema/1.sql
+  cat $(ls ../../common/dbx/schema/*.sql | sort -V) | sqlite3 ./lomob.db
 
   lomob scan -t $i ../data
 
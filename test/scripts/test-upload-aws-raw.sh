@@ -6,15 +6,18 @@ echo "Test upload ISO files into aws with raw file"
 
 sqlite3 lomob.db "update files set iso_id=0; update isos set upload_key='', upload_id='', hash_remote='', status=1; delete from parts"
 
-export LOCALSTACK_ENDPOINT="http://localhost:4566"
+export LOMOB_S3_ENDPOINT="http://localhost:4566"
+export LOMOB_S3_PATH_STYLE=true
 export LOMOB_MASTER_KEY=1234
 export AWS_ACCESS_KEY_ID=dummy
 export AWS_SECRET_ACCESS_KEY=dummy
 export AWS_DEFAULT_REGION=us-east-1
 
-#LOCALSTACK_ENDPOINT="http://localhost:4566" LOMOB_MASTER_KEY=1234 AWS_ACCESS_KEY_ID=dummy AWS_SECRET_ACCESS_KEY=dummy AWS_DEFAULT_REGION=us-east-1 lomob iso upload 2021-04-26--2021-07-31.iso
+#LOMOB_S3_ENDPOINT="http://localhost:4566" LOMOB_S3_PATH_STYLE=true LOMOB_MASTER_KEY=1234 AWS_ACCESS_KEY_ID=dummy AWS_SECRET_ACCESS_KEY=dummy AWS_DEFAULT_REGION=us-east-1 lomob iso upload 2021-04-26--2021-07-31.iso
 #lomob iso upload --no-encrypt 2019-04-03--2024-04-17.iso 2021-04-26--2021-04-26.iso 2021-04-26--2021-07-31.iso
 
+lomob bucket init
+
 for isoFile in 2019-04-03--2024-04-17.iso 2021-04-26--2021-04-26.iso 2021-04-26--2021-07-31.iso; do
   # clean the left contents
   curl -X DELETE http://localhost:4566/lomorage/$isoFile